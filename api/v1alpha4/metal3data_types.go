@@ -25,6 +25,11 @@ const (
 	// DataFinalizer allows Metal3DataReconciler to clean up resources
 	// associated with Metal3Data before removing it from the apiserver.
 	DataFinalizer = "metal3data.infrastructure.cluster.x-k8s.io"
+
+	// WaitForBMOFinalizer is set on the Metal3Data created from a
+	// Metal3DataTemplate with WaitForBMOOnDelete, and removed by the
+	// Metal3DataReconciler once the BareMetalHost is available again.
+	WaitForBMOFinalizer = "finalizer.metal3.io/wait-for-bmo"
 )
 
 // Metal3DataSpec defines the desired state of Metal3Data.
@@ -17,14 +17,88 @@ limitations under the License.
 package v1alpha4
 
 import (
+	"encoding/json"
+
 	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
 )
 
 const (
 	// DataTemplateFinalizer allows Metal3DataTemplateReconciler to clean up resources
 	// associated with Metal3DataTemplate before removing it from the apiserver.
 	DataTemplateFinalizer = "metal3datatemplate.infrastructure.cluster.x-k8s.io"
+
+	// DataTemplateDefaultedAnnotation is set to "true" on a Metal3DataTemplate
+	// when the defaulting webhook set fields of its spec
+	DataTemplateDefaultedAnnotation = "metal3.io/defaulted"
+)
+
+const (
+	// IndexSpaceExhaustedCondition is True when all the indexes between
+	// MinIndex and MaxIndex are allocated.
+	IndexSpaceExhaustedCondition capi.ConditionType = "IndexSpaceExhausted"
+
+	// EmergencyRangeInUseCondition is True while indexes of the
+	// EmergencyRange are allocated.
+	EmergencyRangeInUseCondition capi.ConditionType = "EmergencyRangeInUse"
+
+	// IncompatibleControllerVersionCondition is True when the controller is
+	// older than the MinControllerVersion of the Metal3DataTemplate.
+	IncompatibleControllerVersionCondition capi.ConditionType = "IncompatibleControllerVersion"
+
+	// StatusRecreationRequiredCondition is True, with a Warning severity,
+	// while the status of a Metal3DataTemplate with DisableAutoRecreateStatus
+	// was never built and waits for an explicit purge.
+	StatusRecreationRequiredCondition capi.ConditionType = "StatusRecreationRequired"
+
+	// OwnershipModeExclusive gives each Metal3Data to a single
+	// Metal3DataClaim.
+	OwnershipModeExclusive = "Exclusive"
+
+	// OwnershipModeShared lets several Metal3DataClaims share the Metal3Data
+	// of an index.
+	OwnershipModeShared = "Shared"
+
+	// AllocationOrderSmallestFirst allocates the lowest free index.
+	AllocationOrderSmallestFirst = "SmallestFirst"
+
+	// AllocationOrderFIFO reuses first the index released the longest ago.
+	AllocationOrderFIFO = "FIFO"
+
+	// AllocationOrderLIFO reuses first the index released last.
+	AllocationOrderLIFO = "LIFO"
+
+	// IndexFreedReason is used when an index was released after the index
+	// space was exhausted.
+	IndexFreedReason = "IndexFreed"
+
+	// IndexAllocatedReason is used when an index was allocated after the
+	// index space was exhausted, for example after MaxIndex was raised.
+	IndexAllocatedReason = "IndexAllocated"
+
+	// ControllerVersionTooOldReason is used when the controller is older than
+	// the MinControllerVersion.
+	ControllerVersionTooOldReason = "ControllerVersionTooOld"
+
+	// AutoRecreateStatusDisabledReason is used when the status is not
+	// recreated automatically because of DisableAutoRecreateStatus.
+	AutoRecreateStatusDisabledReason = "AutoRecreateStatusDisabled"
+)
+
+// StatusStoreBackend is the backend storing the Indexes of the status of a
+// Metal3DataTemplate
+type StatusStoreBackend string
+
+const (
+	// StatusStoreBackendEtcd stores the Indexes in the Metal3DataTemplate, or
+	// in a Secret if UseExternalStatusStore is set.
+	StatusStoreBackendEtcd StatusStoreBackend = "Etcd"
+
+	// StatusStoreBackendConfigMap stores the Indexes in a ConfigMap named
+	// <template name>-status.
+	StatusStoreBackendConfigMap StatusStoreBackend = "ConfigMap"
 )
 
 // MetaDataIndex contains the information to render the index
@@ -424,6 +498,171 @@ type NetworkData struct {
 	Services NetworkDataService `json:"services,omitempty"`
 }
 
+// NetworkConfigSpec describes a single network configured inline on the
+// Metal3DataTemplate
+type NetworkConfigSpec struct {
+	// Interface is the name of the BareMetalHost interface, in the Status
+	// Hardware Details, holding the network
+	Interface string `json:"interface"`
+
+	// CIDR is the subnet of the network, for example 192.168.0.0/24. The
+	// address of a host is the address of the subnet incremented by the
+	// Metal3Data index plus one.
+	CIDR ipamv1.IPSubnetStr `json:"cidr"`
+
+	// Gateway is the default gateway of the network
+	// +optional
+	Gateway *ipamv1.IPAddressStr `json:"gateway,omitempty"`
+
+	// DNS is the list of DNS servers
+	// +optional
+	DNS []ipamv1.IPAddressStr `json:"dns,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=4094
+	// VLAN is the VLAN ID of the network. If unset or 0, the network is not
+	// tagged.
+	// +optional
+	VLAN int `json:"vlan,omitempty"`
+}
+
+// EmergencyRangeSpec is a range of indexes allocated only when all the indexes
+// between MinIndex and MaxIndex are allocated
+type EmergencyRangeSpec struct {
+	// +kubebuilder:validation:Minimum=0
+	// Min is the lowest index of the emergency range.
+	Min int `json:"min"`
+
+	// +kubebuilder:validation:Minimum=0
+	// Max is the highest index of the emergency range.
+	Max int `json:"max"`
+
+	// MaxDuration is how long an index of the emergency range is expected to
+	// stay allocated. The allocations older than that are reported as errors
+	// by the validations.
+	// +optional
+	MaxDuration *metav1.Duration `json:"maxDuration,omitempty"`
+}
+
+// BackoffPolicySpec contains the parameters used to compute the delay before
+// retrying the creation of a Metal3Data object after a conflict
+type BackoffPolicySpec struct {
+	// InitialInterval is the delay before the first retry
+	// +optional
+	InitialInterval *metav1.Duration `json:"initialInterval,omitempty"`
+
+	// MaxInterval is the maximum delay between two retries
+	// +optional
+	MaxInterval *metav1.Duration `json:"maxInterval,omitempty"`
+
+	// +kubebuilder:default=2
+	// +kubebuilder:validation:Minimum=1
+	// Multiplier is the factor applied to the delay after each retry
+	Multiplier int `json:"multiplier,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// MaxRetries is the maximum number of retries, 0 meaning unlimited
+	MaxRetries int `json:"maxRetries,omitempty"`
+}
+
+// LeaderElectionSpec describes the Lease a controller replica holds to
+// reconcile a Metal3DataTemplate. The Lease is named <template name>-lock, in
+// the namespace of the Metal3DataTemplate
+type LeaderElectionSpec struct {
+	// Duration is how long the Lease is held without being renewed before
+	// another replica can take it over, 30 seconds by default
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+}
+
+// AllocationWebhookSpec describes an external URL notified when an index is
+// allocated
+type AllocationWebhookSpec struct {
+	// URL is the http or https URL the notifications are sent to
+	URL string `json:"url"`
+
+	// +kubebuilder:default=POST
+	// +kubebuilder:validation:Enum=POST;PUT
+	// Method is the HTTP method of the notification requests
+	Method string `json:"method,omitempty"`
+
+	// SecretRef is a reference to a Secret in the namespace of the
+	// Metal3DataTemplate. Its token key is sent as bearer token in the
+	// Authorization header.
+	// +optional
+	SecretRef *corev1.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// RetryOnFailure makes the notification synchronous. A failed notification
+	// then fails the reconciliation and is sent again.
+	// +optional
+	RetryOnFailure bool `json:"retryOnFailure,omitempty"`
+}
+
+// PreAllocationHookSpec describes an external URL approving each allocation
+// before its Metal3Data is created
+type PreAllocationHookSpec struct {
+	// URL is the http or https URL the allocation requests are sent to
+	URL string `json:"url"`
+
+	// +kubebuilder:default=10
+	// +kubebuilder:validation:Minimum=1
+	// TimeoutSeconds is the timeout of the allocation requests
+	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty"`
+}
+
+// ExternalIPAMSyncSpec describes the REST API of an external IPAM, such as
+// Infoblox or NetBox, in which the address of each allocated index is
+// claimed and released
+type ExternalIPAMSyncSpec struct {
+	// URL is the http or https base URL of the IPAM API
+	URL string `json:"url"`
+
+	// AuthSecretRef is a reference to a Secret in the namespace of the
+	// Metal3DataTemplate. Its token key is sent as bearer token in the
+	// Authorization header.
+	// +optional
+	AuthSecretRef *corev1.LocalObjectReference `json:"authSecretRef,omitempty"`
+
+	// PathTemplate is a Go template of the path appended to the URL, rendered
+	// with the .IP, .Index and .MachineName of the allocation, for example
+	// /api/v1/ips/{{.IP}}. If unset, the requests are sent to the URL.
+	// +optional
+	PathTemplate string `json:"pathTemplate,omitempty"`
+}
+
+// AlertmanagerWebhookSpec describes an Alertmanager the alerts of the
+// Metal3DataTemplate are pushed to
+type AlertmanagerWebhookSpec struct {
+	// URL is the http or https URL of the alerts API of the Alertmanager,
+	// for example http://alertmanager:9093/api/v1/alerts
+	URL string `json:"url"`
+
+	// Labels are added to the labels of the alerts
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// FireAfterDuration is how long the reconciliation must keep failing
+	// before the alert fires. If unset, it fires on the first failure.
+	// +optional
+	FireAfterDuration *metav1.Duration `json:"fireAfterDuration,omitempty"`
+}
+
+// AnnotationFilter overrides fields of the Metal3Data created for the
+// Metal3Machines that have a given annotation
+type AnnotationFilter struct {
+	// AnnotationKey is the key of the annotation of the Metal3Machine
+	AnnotationKey string `json:"annotationKey"`
+
+	// AnnotationValue is the value the annotation must have. If unset, the
+	// filter matches all the Metal3Machines with the annotation.
+	// +optional
+	AnnotationValue string `json:"annotationValue,omitempty"`
+
+	// DataSpecPatch is merged into the spec of the Metal3Data. Only its
+	// metaData and networkData secret references are used.
+	DataSpecPatch Metal3DataSpec `json:"dataSpecPatch"`
+}
+
 // Metal3DataTemplateSpec defines the desired state of Metal3DataTemplate.
 type Metal3DataTemplateSpec struct {
 
@@ -431,12 +670,352 @@ type Metal3DataTemplateSpec struct {
 	// +kubebuilder:validation:MinLength=1
 	ClusterName string `json:"clusterName"`
 
+	// BaseTemplateRef is a reference to a Metal3DataTemplate in the same
+	// namespace whose MetaData, NetworkData, HelmTemplateConfigMapRef and
+	// DataAnnotations are used when they are not set in this template. The
+	// base template can itself have a base template.
+	// +optional
+	BaseTemplateRef *corev1.LocalObjectReference `json:"baseTemplateRef,omitempty"`
+
+	// MinIndex is the lowest index allocated to a Metal3Data.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinIndex int `json:"minIndex,omitempty"`
+
+	// MaxIndex is the highest index allocated to a Metal3Data. If unset or 0,
+	// the indexes are not bounded.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxIndex int `json:"maxIndex,omitempty"`
+
+	// +kubebuilder:default=1
+	// +kubebuilder:validation:Minimum=1
+	// IndexStep is the increment between two consecutive indexes allocated
+	// from MinIndex, defaults to 1. MaxIndex - MinIndex must be a multiple of
+	// IndexStep.
+	// +optional
+	IndexStep int `json:"indexStep,omitempty"`
+
+	// MaxOwnerReferences is the maximum number of owner references of the
+	// Metal3DataTemplate. If unset or 0, the number is not limited.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxOwnerReferences int `json:"maxOwnerReferences,omitempty"`
+
 	//MetaData contains the information needed to generate the metadata secret
 	MetaData *MetaData `json:"metaData,omitempty"`
 
 	//NetworkData contains the information needed to generate the networkdata
 	// secret
 	NetworkData *NetworkData `json:"networkData,omitempty"`
+
+	// InlineNetworkConfig is a simpler alternative to NetworkData for single
+	// network deployments. It is rendered into the networkdata secret of the
+	// Metal3Data objects. It cannot be set together with NetworkData.
+	// +optional
+	InlineNetworkConfig *NetworkConfigSpec `json:"inlineNetworkConfig,omitempty"`
+
+	// BackoffPolicy configures the delay before retrying the creation of a
+	// Metal3Data object after a conflict. If unset, the requeue happens
+	// immediately.
+	// +optional
+	BackoffPolicy *BackoffPolicySpec `json:"backoffPolicy,omitempty"`
+
+	// TenantIsolation, if true, makes the controller create, for each
+	// Metal3Data, a Role allowing to get only this Metal3Data, bound to the
+	// ServiceAccount set in the metal3.io/tenant-service-account annotation
+	// of its Metal3Machine. The Role and RoleBinding are owned by the
+	// Metal3Machine.
+	// +optional
+	TenantIsolation bool `json:"tenantIsolation,omitempty"`
+
+	// WaitForBMOOnDelete, if true, sets the finalizer.metal3.io/wait-for-bmo
+	// finalizer on the Metal3Data objects created, so that a deleted
+	// Metal3Data is kept until its BareMetalHost is deprovisioned and
+	// available, the baremetal-operator possibly reading it until then.
+	// +optional
+	WaitForBMOOnDelete bool `json:"waitForBMOOnDelete,omitempty"`
+
+	// ServiceAccountRef is a reference to a ServiceAccount in the namespace of
+	// the Metal3DataTemplate. If set, the Metal3Data objects are created with
+	// the identity of this ServiceAccount instead of the controller's one.
+	// +optional
+	ServiceAccountRef *corev1.LocalObjectReference `json:"serviceAccountRef,omitempty"`
+
+	// OwnerReferenceFilter restricts the Metal3Machines that can get a
+	// Metal3Data from this template to the ones matching the selector. If
+	// unset, all Metal3Machines are accepted.
+	// +optional
+	OwnerReferenceFilter *metav1.LabelSelector `json:"ownerReferenceFilter,omitempty"`
+
+	// HostSelector restricts the BareMetalHosts that can get a Metal3Data
+	// from this template to the ones matching the selector. The
+	// BareMetalHost is the one associated with the Metal3Machine owning the
+	// Metal3DataClaim. If unset, all BareMetalHosts are accepted.
+	// +optional
+	HostSelector *metav1.LabelSelector `json:"hostSelector,omitempty"`
+
+	// AllocationCondition is a CEL expression that must evaluate to true for
+	// a Metal3Machine to get a Metal3Data from this template. The
+	// Metal3Machine is available as the machine variable, for example
+	// "machine.metadata.labels['role'] == 'worker'". If unset, all
+	// Metal3Machines are accepted.
+	// +optional
+	AllocationCondition string `json:"allocationCondition,omitempty"`
+
+	// DataOwnershipTransfer allows the Metal3Data of a Metal3Machine to
+	// follow it when it moves to another Metal3DataTemplate. When the
+	// Metal3DataClaim is deleted while the Metal3Machine references another
+	// template, the Metal3Data is annotated for the transfer instead of being
+	// deleted, and that template allocates its index again, replacing it with
+	// a new Metal3Data, if it also sets DataOwnershipTransfer.
+	// +optional
+	DataOwnershipTransfer bool `json:"dataOwnershipTransfer,omitempty"`
+
+	// RequiredLabels are labels that are always set on the
+	// Metal3DataTemplate object itself. They are merged into its labels on
+	// every creation and update, overriding the existing values.
+	// +optional
+	RequiredLabels map[string]string `json:"requiredLabels,omitempty"`
+
+	// DataAnnotations are set on every Metal3Data created from this
+	// template. The cluster name always takes precedence for the
+	// cluster.x-k8s.io/cluster-name key.
+	// +optional
+	DataAnnotations map[string]string `json:"dataAnnotations,omitempty"`
+
+	// AllocationWebhook is notified each time a Metal3Data is created from
+	// this template
+	// +optional
+	AllocationWebhook *AllocationWebhookSpec `json:"allocationWebhook,omitempty"`
+
+	// PreAllocationHook must approve each allocation. It receives the
+	// allocation before the Metal3Data is created, which only happens if it
+	// answers with the HTTP 200 status.
+	// +optional
+	PreAllocationHook *PreAllocationHookSpec `json:"preAllocationHook,omitempty"`
+
+	// ExternalIPAMSync claims the address of each allocated index, computed
+	// from the CIDR of the InlineNetworkConfig, in an external IPAM with a
+	// POST request, and releases it with a DELETE request when the index is
+	// freed. The allocation or release fails, and is retried, if the IPAM
+	// fails. It requires InlineNetworkConfig.
+	// +optional
+	ExternalIPAMSync *ExternalIPAMSyncSpec `json:"externalIPAMSync,omitempty"`
+
+	// AlertmanagerWebhook is an Alertmanager receiving an alert when the
+	// reconciliation of the Metal3DataTemplate keeps failing. The alert is
+	// resolved by the next successful reconciliation.
+	// +optional
+	AlertmanagerWebhook *AlertmanagerWebhookSpec `json:"alertmanagerWebhook,omitempty"`
+
+	// IPPoolRef is a reference to an IPPool in the namespace of the
+	// Metal3DataTemplate, used by the Metal3Data objects, whose addresses are
+	// indexed in the IPIndex field of the status.
+	// +optional
+	IPPoolRef *corev1.LocalObjectReference `json:"ipPoolRef,omitempty"`
+
+	// +kubebuilder:default=Exclusive
+	// +kubebuilder:validation:Enum=Exclusive;Shared
+	// OwnershipMode is Exclusive when each Metal3Data belongs to a single
+	// Metal3DataClaim, or Shared when the Metal3DataClaims requesting the same
+	// index share its Metal3Data.
+	OwnershipMode string `json:"ownershipMode,omitempty"`
+
+	// +kubebuilder:default=SmallestFirst
+	// +kubebuilder:validation:Enum=SmallestFirst;FIFO;LIFO
+	// AllocationOrder selects the index given to a new Metal3Data.
+	// SmallestFirst gives the lowest free index. FIFO reuses first the index
+	// released the longest ago and LIFO the index released last, falling back
+	// to the lowest free index.
+	AllocationOrder string `json:"allocationOrder,omitempty"`
+
+	// EmergencyRange is a range of indexes outside of MinIndex and MaxIndex,
+	// allocated only when all the indexes between them are allocated.
+	// +optional
+	EmergencyRange *EmergencyRangeSpec `json:"emergencyRange,omitempty"`
+
+	// StaticAssignments maps the names of Metal3Machines to the index always
+	// given to their Metal3Data. These indexes are reserved and never given to
+	// other Metal3Machines.
+	// +optional
+	StaticAssignments map[string]int `json:"staticAssignments,omitempty"`
+
+	// GracePeriodAfterDelete delays the reuse of the index of a deleted
+	// Metal3Data, for example while DHCP servers still cache the binding of
+	// the previous machine. The index is listed in the ReservedIndexes of the
+	// status until the period elapsed.
+	// +optional
+	GracePeriodAfterDelete *metav1.Duration `json:"gracePeriodAfterDelete,omitempty"`
+
+	// HelmTemplateConfigMapRef is a reference to a ConfigMap in the namespace
+	// of the Metal3DataTemplate. Its template key contains a Helm style
+	// template of a Metal3Data spec, rendered with the .Values.index and
+	// .Values.machineName values when a Metal3Data is created. The metaData
+	// and networkData secret references of the result are used for the
+	// Metal3Data.
+	// +optional
+	HelmTemplateConfigMapRef *corev1.LocalObjectReference `json:"helmTemplateConfigMapRef,omitempty"`
+
+	// AnnotationFilters override fields of the Metal3Data depending on the
+	// annotations of the Metal3Machine, for example to use a different
+	// networkData secret for the machines of a rack. The matching filters
+	// are applied in order, the last one taking precedence.
+	// +optional
+	AnnotationFilters []AnnotationFilter `json:"annotationFilters,omitempty"`
+
+	// RetryFailedDeletes makes the controller retry the deletion of a
+	// Metal3Data a few times on transient API errors before failing the
+	// reconciliation.
+	// +optional
+	RetryFailedDeletes bool `json:"retryFailedDeletes,omitempty"`
+
+	// UseExternalStatusStore stores the Indexes of the status in a Secret
+	// named <template name>-status instead of the Metal3DataTemplate, for
+	// templates with too many allocations to fit in a single object. The
+	// data of the Secret is also limited to 1 MiB.
+	// +optional
+	UseExternalStatusStore bool `json:"useExternalStatusStore,omitempty"`
+
+	// +kubebuilder:default=Etcd
+	// +kubebuilder:validation:Enum=Etcd;ConfigMap
+	// StatusStoreBackend selects where the Indexes of the status are stored,
+	// Etcd in the Metal3DataTemplate or ConfigMap in a ConfigMap named
+	// <template name>-status, limited to 1 MiB, to avoid rewriting large
+	// objects in etcd on every allocation. UseExternalStatusStore can only be
+	// set with Etcd.
+	// +optional
+	StatusStoreBackend StatusStoreBackend `json:"statusStoreBackend,omitempty"`
+
+	// UseLeaseLock makes the controller hold a Lease named
+	// <template name>-lock, in the namespace of the Metal3DataTemplate, while
+	// it allocates the indexes and until the status is patched, instead of
+	// relying on the conflicts of the status updates only. The holder renews
+	// the Lease while it reconciles, and it expires after 30 seconds if its
+	// holder stops without releasing it. The Lease is owned by the
+	// Metal3DataTemplate.
+	// +optional
+	UseLeaseLock bool `json:"useLeaseLock,omitempty"`
+
+	// LeaderElectionLease, if set, makes a controller replica take the Lease
+	// before reconciling this Metal3DataTemplate and keep it, renewing it at
+	// each reconciliation, so that the templates are reconciled in parallel
+	// by different replicas. The other replicas requeue the reconciliation
+	// while the Lease did not expire. It cannot be set with UseLeaseLock.
+	// +optional
+	LeaderElectionLease *LeaderElectionSpec `json:"leaderElectionLease,omitempty"`
+
+	// DisableAutoRecreateStatus, if true, prevents the controller from
+	// building the status of a Metal3DataTemplate whose status was never
+	// updated, and from allocating its indexes, until the status is purged
+	// explicitly with the metal3.io/confirm-purge annotation.
+	// +optional
+	DisableAutoRecreateStatus bool `json:"disableAutoRecreateStatus,omitempty"`
+
+	// MinControllerVersion is the minimum semantic version of the controller
+	// able to reconcile this Metal3DataTemplate, for templates using features
+	// of recent releases. An older controller sets the
+	// IncompatibleControllerVersion condition and does not reconcile it.
+	// +optional
+	MinControllerVersion string `json:"minControllerVersion,omitempty"`
+
+	// MonitoringInterval, if set, is the interval at which the consistency
+	// of the status with the Metal3Data and Metal3DataClaim objects is
+	// checked in the background, between the reconciliations. It must be at
+	// least one second.
+	// +optional
+	MonitoringInterval *metav1.Duration `json:"monitoringInterval,omitempty"`
+}
+
+// IndexEntry describes the allocation of an index to a Metal3DataClaim.
+type IndexEntry struct {
+	// Index is the allocated index.
+	Index int `json:"index"`
+
+	// MachineName is the name of the Metal3Machine the index is allocated to.
+	// +optional
+	MachineName string `json:"machineName,omitempty"`
+
+	// MachineUID is the UID of the Metal3Machine the index is allocated to.
+	// +optional
+	MachineUID string `json:"machineUID,omitempty"`
+
+	// AllocatedAt is the creation time of the Metal3Data holding the index.
+	// +optional
+	AllocatedAt *metav1.Time `json:"allocatedAt,omitempty"`
+
+	// LeaseExpiry is the time after which the allocation can be released.
+	// +optional
+	LeaseExpiry *metav1.Time `json:"leaseExpiry,omitempty"`
+
+	// DataName is the name of the Metal3Data holding the index, when it was
+	// transferred from another template. If unset, the Metal3Data is named
+	// after the template and the index.
+	// +optional
+	DataName string `json:"dataName,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It also accepts a bare index, as
+// stored by the previous format of Status.Indexes.
+func (e *IndexEntry) UnmarshalJSON(data []byte) error {
+	var index int
+	if err := json.Unmarshal(data, &index); err == nil {
+		*e = IndexEntry{Index: index}
+		return nil
+	}
+	// Use an alias type to not recurse into this function
+	type indexEntry IndexEntry
+	entry := indexEntry{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	*e = IndexEntry(entry)
+	return nil
+}
+
+// MigrateIndexes converts the previous format of Status.Indexes, a map of
+// claim names to indexes, to the current one.
+func MigrateIndexes(indexes map[string]int) map[string]IndexEntry {
+	if indexes == nil {
+		return nil
+	}
+	entries := make(map[string]IndexEntry, len(indexes))
+	for claimName, index := range indexes {
+		entries[claimName] = IndexEntry{Index: index}
+	}
+	return entries
+}
+
+// IndexReservation is a released index that cannot be allocated again until
+// ReservedUntil
+type IndexReservation struct {
+	// Index is the reserved index.
+	Index int `json:"index"`
+
+	// ReservedUntil is the time after which the index can be allocated again.
+	ReservedUntil metav1.Time `json:"reservedUntil"`
+}
+
+// RevisionEntry records a change of the spec of a Metal3DataTemplate
+type RevisionEntry struct {
+	// Revision is the number of the revision, starting at 1.
+	Revision int `json:"revision"`
+
+	// ChangedAt is the time at which the change was observed.
+	ChangedAt metav1.Time `json:"changedAt"`
+
+	// SpecChecksum is the checksum of the spec of this revision.
+	SpecChecksum string `json:"specChecksum"`
+
+	// ChangedFields are the fields of the spec changed since the previous
+	// revision, unset for the first revision.
+	// +optional
+	ChangedFields []string `json:"changedFields,omitempty"`
+
+	// FieldChecksums contains the checksum of each field set in the spec of
+	// this revision, used to find the ChangedFields of the next revision.
+	// +optional
+	FieldChecksums map[string]string `json:"fieldChecksums,omitempty"`
 }
 
 // Metal3DataTemplateSptatus defines the observed state of Metal3DataTemplate.
@@ -445,8 +1024,149 @@ type Metal3DataTemplateStatus struct {
 	// +optional
 	LastUpdated *metav1.Time `json:"lastUpdated,omitempty"`
 
-	//Indexes contains the map of Metal3Machine and index used
-	Indexes map[string]int `json:"indexes,omitempty"`
+	// LastMigratedAt is when the format of the status was last migrated.
+	// +optional
+	LastMigratedAt *metav1.Time `json:"lastMigratedAt,omitempty"`
+
+	// MigratedFromVersion is the version of the format of the status found
+	// by the last migration, 1 for the indexes stored as a map of claim
+	// names to integers, 2 for the current format.
+	// +optional
+	MigratedFromVersion int `json:"migratedFromVersion,omitempty"`
+
+	//Indexes contains the map of Metal3DataClaim and allocated index
+	Indexes map[string]IndexEntry `json:"indexes,omitempty"`
+
+	// ExternalStatusSecretRef is a reference to the Secret storing the
+	// Indexes when UseExternalStatusStore is set.
+	// +optional
+	ExternalStatusSecretRef *corev1.LocalObjectReference `json:"externalStatusSecretRef,omitempty"`
+
+	// StatusStoreBackend is the backend storing the Indexes when it is not
+	// the Metal3DataTemplate or the external status Secret.
+	// +optional
+	StatusStoreBackend StatusStoreBackend `json:"statusStoreBackend,omitempty"`
+
+	// FreedIndexes lists the released indexes that are not allocated again,
+	// the oldest first. It is only maintained for the FIFO and LIFO
+	// allocation orders.
+	// +optional
+	FreedIndexes []int `json:"freedIndexes,omitempty"`
+
+	// ReservedIndexes lists, sorted by index, the released indexes that
+	// cannot be allocated before the GracePeriodAfterDelete elapsed.
+	// +optional
+	ReservedIndexes []IndexReservation `json:"reservedIndexes,omitempty"`
+
+	// EmergencyAllocations maps the Metal3DataClaim names to the indexes of
+	// the EmergencyRange allocated to them.
+	// +optional
+	EmergencyAllocations map[string]int `json:"emergencyAllocations,omitempty"`
+
+	// UnprovisionedMachines lists, sorted, the names of the Metal3Machines
+	// whose Metal3DataClaim has no allocated index yet.
+	// +optional
+	UnprovisionedMachines []string `json:"unprovisionedMachines,omitempty"`
+
+	// SkipAllocationCount is the number of Metal3Machines of the
+	// Metal3DataClaims that opted out of the allocation with the
+	// metal3.io/skip-allocation annotation.
+	// +optional
+	SkipAllocationCount int `json:"skipAllocationCount,omitempty"`
+
+	// ProvisionedMachineCount is the number of Metal3Machines given an index
+	// by this Metal3DataTemplate since its creation. It is never decremented.
+	// +optional
+	ProvisionedMachineCount int `json:"provisionedMachineCount,omitempty"`
+
+	// DeprovisionedMachineCount is the number of Metal3Machines whose index
+	// was released by this Metal3DataTemplate since its creation. It is never
+	// decremented.
+	// +optional
+	DeprovisionedMachineCount int `json:"deprovisionedMachineCount,omitempty"`
+
+	// PendingDeletions are the names of the Metal3Data objects whose deletion
+	// was requested but did not succeed yet, for example on a transient API
+	// error. They are deleted again before the indexes are rebuilt.
+	// +optional
+	PendingDeletions []string `json:"pendingDeletions,omitempty"`
+
+	// DataSizeBytes is the total size, serialized in JSON, of the Metal3Data
+	// objects generated from this template.
+	// +optional
+	DataSizeBytes int64 `json:"dataSizeBytes,omitempty"`
+
+	// LastCreatedDataName is the name of the last Metal3Data created from
+	// this template.
+	// +optional
+	LastCreatedDataName string `json:"lastCreatedDataName,omitempty"`
+
+	// LastCreatedMachineName is the name of the Metal3Machine of the last
+	// Metal3Data created from this template.
+	// +optional
+	LastCreatedMachineName string `json:"lastCreatedMachineName,omitempty"`
+
+	// IPIndex contains the map of IP addresses from the IPPoolRef pool and the
+	// Metal3Machine using them.
+	// +optional
+	IPIndex map[string]string `json:"ipIndex,omitempty"`
+
+	// FailingSince is the time of the first of the consecutive failed
+	// reconciliations, unset after a successful one.
+	// +optional
+	FailingSince *metav1.Time `json:"failingSince,omitempty"`
+
+	// AlertFiring is true when an alert was sent to the AlertmanagerWebhook
+	// and was not resolved yet.
+	// +optional
+	AlertFiring bool `json:"alertFiring,omitempty"`
+
+	// ConcurrentReconcileCount is the number of reconciliations of this
+	// Metal3DataTemplate that were in progress in the controller when the
+	// status was last updated.
+	// +optional
+	ConcurrentReconcileCount int `json:"concurrentReconcileCount,omitempty"`
+
+	// ControllerVersion is the version of the controller that last
+	// reconciled this object.
+	// +optional
+	ControllerVersion string `json:"controllerVersion,omitempty"`
+
+	// OwnerReferencesHash is a hash of the owner references of the
+	// Metal3DataTemplate when the status was last updated, used to detect
+	// their changes.
+	// +optional
+	OwnerReferencesHash string `json:"ownerReferencesHash,omitempty"`
+
+	// IndexChecksum is the SHA256 of the index and Metal3Machine of each
+	// entry of the Indexes, to compare the allocations of two clusters, for
+	// example after a pivot.
+	// +optional
+	IndexChecksum string `json:"indexChecksum,omitempty"`
+
+	// LargestGap is the number of indexes of the longest range of
+	// consecutive free indexes, with the IndexStep, between MinIndex and
+	// MaxIndex. Without MaxIndex, the unbounded range after the last
+	// allocated index is not counted.
+	// +optional
+	LargestGap int `json:"largestGap,omitempty"`
+
+	// FragmentationRatio is the number of free indexes between MinIndex and
+	// MaxIndex divided by the LargestGap, with two decimals. It is 1.00 when
+	// all the free indexes are consecutive, and grows with the fragmentation
+	// of the index space. It is a string as floats are not portable in APIs.
+	// +optional
+	FragmentationRatio string `json:"fragmentationRatio,omitempty"`
+
+	// RevisionHistory contains the last changes of the spec, the most recent
+	// last.
+	// +kubebuilder:validation:MaxItems=10
+	// +optional
+	RevisionHistory []RevisionEntry `json:"revisionHistory,omitempty"`
+
+	// Conditions defines current service state of the Metal3DataTemplate.
+	// +optional
+	Conditions capi.Conditions `json:"conditions,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -455,6 +1175,9 @@ type Metal3DataTemplateStatus struct {
 // +kubebuilder:subresource:status
 // +kubebuilder:object:root=true
 // +kubebuilder:printcolumn:name="Cluster",type="string",JSONPath=".metadata.labels.cluster\\.x-k8s\\.io/cluster-name",description="Cluster to which this template belongs"
+// +kubebuilder:printcolumn:name="Exhausted",type="string",JSONPath=".status.conditions[?(@.type=='IndexSpaceExhausted')].status",description="Whether all indexes are allocated"
+// +kubebuilder:printcolumn:name="Last Data",type="string",JSONPath=".status.lastCreatedDataName",description="Last Metal3Data created from this template"
+// +kubebuilder:printcolumn:name="Last Machine",type="string",JSONPath=".status.lastCreatedMachineName",description="Metal3Machine of the last Metal3Data created from this template"
 
 // Metal3DataTemplate is the Schema for the metal3datatemplates API
 type Metal3DataTemplate struct {
@@ -465,6 +1188,63 @@ type Metal3DataTemplate struct {
 	Status Metal3DataTemplateStatus `json:"status,omitempty"`
 }
 
+// GetConditions returns the list of conditions for a Metal3DataTemplate API object.
+func (c *Metal3DataTemplate) GetConditions() capi.Conditions {
+	return c.Status.Conditions
+}
+
+// SetConditions will set the given conditions on a Metal3DataTemplate object
+func (c *Metal3DataTemplate) SetConditions(conditions capi.Conditions) {
+	c.Status.Conditions = conditions
+}
+
+// LookupByIP returns the name of the Metal3Machine using the given address of
+// the IPPoolRef pool, and the index allocated to it.
+func (c *Metal3DataTemplate) LookupByIP(ip string) (string, int, bool) {
+	machineName, ok := c.Status.IPIndex[ip]
+	if !ok {
+		return "", 0, false
+	}
+	if entry, ok := c.Status.Indexes[machineName]; ok {
+		return machineName, entry.Index, true
+	}
+	for _, entry := range c.Status.Indexes {
+		if entry.MachineName == machineName {
+			return machineName, entry.Index, true
+		}
+	}
+	return "", 0, false
+}
+
+// ToHelmValues renders the spec of the Metal3DataTemplate as nested maps,
+// suitable for a Helm values file.
+func (c *Metal3DataTemplate) ToHelmValues() (map[string]interface{}, error) {
+	specJSON, err := json.Marshal(c.Spec)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(specJSON, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// FromHelmValues replaces the spec of the Metal3DataTemplate with the content
+// of the given Helm values, as rendered by ToHelmValues.
+func (c *Metal3DataTemplate) FromHelmValues(values map[string]interface{}) error {
+	valuesJSON, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	spec := Metal3DataTemplateSpec{}
+	if err := json.Unmarshal(valuesJSON, &spec); err != nil {
+		return err
+	}
+	c.Spec = spec
+	return nil
+}
+
 // +kubebuilder:object:root=true
 
 // Metal3DataTemplateList contains a list of Metal3DataTemplate
@@ -0,0 +1,182 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha4
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+func TestMetal3DataTemplateHelmValues(t *testing.T) {
+	tests := []struct {
+		name string
+		spec Metal3DataTemplateSpec
+	}{
+		{
+			name: "empty spec",
+			spec: Metal3DataTemplateSpec{},
+		},
+		{
+			name: "full spec",
+			spec: Metal3DataTemplateSpec{
+				ClusterName: "abc",
+				MetaData: &MetaData{
+					Strings: []MetaDataString{
+						{
+							Key:   "String-1",
+							Value: "String-1",
+						},
+					},
+					ObjectNames: []MetaDataObjectName{
+						{
+							Key:    "ObjectName-1",
+							Object: "machine",
+						},
+					},
+				},
+				NetworkData: &NetworkData{
+					Links: NetworkDataLink{
+						Ethernets: []NetworkDataLinkEthernet{
+							{
+								Type: "phy",
+								Id:   "eth0",
+								MTU:  1500,
+								MACAddress: &NetworkLinkEthernetMac{
+									String: pointer.StringPtr("XX:XX:XX:XX:XX:XX"),
+								},
+							},
+						},
+					},
+				},
+				BackoffPolicy: &BackoffPolicySpec{
+					InitialInterval: &metav1.Duration{Duration: time.Second},
+					MaxInterval:     &metav1.Duration{Duration: time.Minute},
+					Multiplier:      2,
+					MaxRetries:      5,
+				},
+				ServiceAccountRef: &corev1.LocalObjectReference{
+					Name: "tenant",
+				},
+				OwnerReferenceFilter: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"pool": "workers"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			c := &Metal3DataTemplate{Spec: tt.spec}
+			values, err := c.ToHelmValues()
+			g.Expect(err).NotTo(HaveOccurred())
+
+			restored := &Metal3DataTemplate{}
+			g.Expect(restored.FromHelmValues(values)).To(Succeed())
+			g.Expect(restored.Spec).To(Equal(tt.spec))
+		})
+	}
+}
+
+func TestMetal3DataTemplateHelmValuesContent(t *testing.T) {
+	g := NewWithT(t)
+
+	c := &Metal3DataTemplate{
+		Spec: Metal3DataTemplateSpec{
+			ClusterName: "abc",
+			BackoffPolicy: &BackoffPolicySpec{
+				Multiplier: 2,
+			},
+		},
+	}
+	values, err := c.ToHelmValues()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(values).To(Equal(map[string]interface{}{
+		"clusterName": "abc",
+		"backoffPolicy": map[string]interface{}{
+			"multiplier": float64(2),
+		},
+	}))
+
+	g.Expect(c.FromHelmValues(map[string]interface{}{
+		"clusterName": []string{"abc"},
+	})).NotTo(Succeed())
+}
+
+func TestMetal3DataTemplateStatusIndexesMigration(t *testing.T) {
+	g := NewWithT(t)
+
+	status := Metal3DataTemplateStatus{}
+	err := json.Unmarshal(
+		[]byte(`{"indexes":{"abc":0,"bcd":{"index":1,"machineName":"machine-bcd"}}}`),
+		&status,
+	)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status.Indexes).To(Equal(map[string]IndexEntry{
+		"abc": {Index: 0},
+		"bcd": {Index: 1, MachineName: "machine-bcd"},
+	}))
+
+	err = json.Unmarshal([]byte(`{"indexes":{"abc":"zero"}}`), &status)
+	g.Expect(err).To(HaveOccurred())
+
+	g.Expect(MigrateIndexes(nil)).To(BeNil())
+	g.Expect(MigrateIndexes(map[string]int{"abc": 2})).To(Equal(
+		map[string]IndexEntry{"abc": {Index: 2}},
+	))
+}
+
+func TestMetal3DataTemplateLookupByIP(t *testing.T) {
+	g := NewWithT(t)
+
+	template := &Metal3DataTemplate{
+		Status: Metal3DataTemplateStatus{
+			Indexes: map[string]IndexEntry{
+				"machine-abc": {Index: 0},
+				"claim-bcd":   {Index: 1, MachineName: "machine-bcd"},
+			},
+			IPIndex: map[string]string{
+				"192.168.0.10": "machine-abc",
+				"192.168.0.11": "machine-bcd",
+				"192.168.0.12": "machine-cde",
+			},
+		},
+	}
+
+	machineName, index, ok := template.LookupByIP("192.168.0.10")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(machineName).To(Equal("machine-abc"))
+	g.Expect(index).To(Equal(0))
+
+	machineName, index, ok = template.LookupByIP("192.168.0.11")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(machineName).To(Equal("machine-bcd"))
+	g.Expect(index).To(Equal(1))
+
+	_, _, ok = template.LookupByIP("192.168.0.12")
+	g.Expect(ok).To(BeFalse())
+
+	_, _, ok = template.LookupByIP("192.168.0.13")
+	g.Expect(ok).To(BeFalse())
+}
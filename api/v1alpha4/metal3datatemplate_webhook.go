@@ -14,12 +14,22 @@ limitations under the License.
 package v1alpha4
 
 import (
+	"net"
+	"net/http"
+	"net/url"
 	"reflect"
+	"sort"
+	"text/template"
+	"time"
 
 	"github.com/pkg/errors"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/validation/field"
+	utilversion "k8s.io/apimachinery/pkg/util/version"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
@@ -37,6 +47,23 @@ var _ webhook.Defaulter = &Metal3DataTemplate{}
 var _ webhook.Validator = &Metal3DataTemplate{}
 
 func (c *Metal3DataTemplate) Default() {
+	if c.Spec.AllocationOrder == "" {
+		c.Spec.AllocationOrder = AllocationOrderSmallestFirst
+		if c.Annotations == nil {
+			c.Annotations = make(map[string]string)
+		}
+		c.Annotations[DataTemplateDefaultedAnnotation] = "true"
+	}
+
+	if len(c.Spec.RequiredLabels) == 0 {
+		return
+	}
+	if c.Labels == nil {
+		c.Labels = make(map[string]string)
+	}
+	for key, value := range c.Spec.RequiredLabels {
+		c.Labels[key] = value
+	}
 }
 
 // ValidateCreate implements webhook.Validator so a webhook will be registered for the type
@@ -46,7 +73,7 @@ func (c *Metal3DataTemplate) ValidateCreate() error {
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (c *Metal3DataTemplate) ValidateUpdate(old runtime.Object) error {
-	allErrs := field.ErrorList{}
+	allErrs := c.validateSpec()
 	oldM3dt, ok := old.(*Metal3DataTemplate)
 	if !ok || oldM3dt == nil {
 		return apierrors.NewInternalError(errors.New("unable to convert existing object"))
@@ -72,6 +99,20 @@ func (c *Metal3DataTemplate) ValidateUpdate(old runtime.Object) error {
 		)
 	}
 
+	allErrs = append(allErrs,
+		c.validateOwnerReferences(len(oldM3dt.OwnerReferences))...,
+	)
+
+	if c.Spec.OwnershipMode != oldM3dt.Spec.OwnershipMode {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "ownershipMode"),
+				c.Spec.OwnershipMode,
+				"cannot be modified",
+			),
+		)
+	}
+
 	if len(allErrs) == 0 {
 		return nil
 	}
@@ -83,12 +124,666 @@ func (c *Metal3DataTemplate) ValidateDelete() error {
 	return nil
 }
 
-//No further validation for now
 func (c *Metal3DataTemplate) validate() error {
-	var allErrs field.ErrorList
+	allErrs := c.validateSpec()
+	allErrs = append(allErrs, c.validateOwnerReferences(0)...)
 
 	if len(allErrs) == 0 {
 		return nil
 	}
 	return apierrors.NewInvalid(GroupVersion.WithKind("Metal3DataTemplate").GroupKind(), c.Name, allErrs)
 }
+
+// validateOwnerReferences rejects more owner references than
+// MaxOwnerReferences, unless there are not more than the previous ones, so
+// that the owner references of a template over the limit can be removed
+func (c *Metal3DataTemplate) validateOwnerReferences(previous int) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if c.Spec.MaxOwnerReferences > 0 &&
+		len(c.OwnerReferences) > c.Spec.MaxOwnerReferences &&
+		len(c.OwnerReferences) > previous {
+		allErrs = append(allErrs,
+			field.TooMany(
+				field.NewPath("metadata", "ownerReferences"),
+				len(c.OwnerReferences),
+				c.Spec.MaxOwnerReferences,
+			),
+		)
+	}
+	return allErrs
+}
+
+// validateSpec validates the fields of the spec that can be checked
+// independently of any previous version of the object
+func (c *Metal3DataTemplate) validateSpec() field.ErrorList {
+	var allErrs field.ErrorList
+
+	if c.Spec.MinIndex < 0 {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "minIndex"),
+				c.Spec.MinIndex,
+				"must be positive",
+			),
+		)
+	}
+
+	if c.Spec.MaxIndex < 0 {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "maxIndex"),
+				c.Spec.MaxIndex,
+				"must be positive",
+			),
+		)
+	} else if c.Spec.MaxIndex != 0 && c.Spec.MaxIndex < c.Spec.MinIndex {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "maxIndex"),
+				c.Spec.MaxIndex,
+				"must be greater or equal to minIndex",
+			),
+		)
+	}
+
+	if c.Spec.IndexStep < 0 {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "indexStep"),
+				c.Spec.IndexStep,
+				"must be greater or equal to 1",
+			),
+		)
+	} else if c.Spec.IndexStep > 1 && c.Spec.MaxIndex > c.Spec.MinIndex &&
+		(c.Spec.MaxIndex-c.Spec.MinIndex)%c.Spec.IndexStep != 0 {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "maxIndex"),
+				c.Spec.MaxIndex,
+				"maxIndex - minIndex must be a multiple of indexStep",
+			),
+		)
+	}
+
+	if c.Spec.MaxOwnerReferences < 0 {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "maxOwnerReferences"),
+				c.Spec.MaxOwnerReferences,
+				"must be positive",
+			),
+		)
+	}
+
+	if c.Spec.BackoffPolicy != nil {
+		allErrs = append(allErrs, c.validateBackoffPolicy()...)
+	}
+
+	if c.Spec.LeaderElectionLease != nil {
+		allErrs = append(allErrs, c.validateLeaderElectionLease()...)
+	}
+
+	if c.Spec.ServiceAccountRef != nil && c.Spec.ServiceAccountRef.Name == "" {
+		allErrs = append(allErrs,
+			field.Required(
+				field.NewPath("spec", "serviceAccountRef", "name"),
+				"must be set when serviceAccountRef is given",
+			),
+		)
+	}
+
+	allErrs = append(allErrs, metav1validation.ValidateLabels(
+		c.Spec.RequiredLabels, field.NewPath("spec", "requiredLabels"),
+	)...)
+
+	allErrs = append(allErrs, apivalidation.ValidateAnnotations(
+		c.Spec.DataAnnotations, field.NewPath("spec", "dataAnnotations"),
+	)...)
+
+	if c.Spec.OwnershipMode != "" && c.Spec.OwnershipMode != OwnershipModeExclusive &&
+		c.Spec.OwnershipMode != OwnershipModeShared {
+		allErrs = append(allErrs,
+			field.NotSupported(
+				field.NewPath("spec", "ownershipMode"),
+				c.Spec.OwnershipMode,
+				[]string{OwnershipModeExclusive, OwnershipModeShared},
+			),
+		)
+	}
+
+	if c.Spec.AllocationOrder != "" &&
+		c.Spec.AllocationOrder != AllocationOrderSmallestFirst &&
+		c.Spec.AllocationOrder != AllocationOrderFIFO &&
+		c.Spec.AllocationOrder != AllocationOrderLIFO {
+		allErrs = append(allErrs,
+			field.NotSupported(
+				field.NewPath("spec", "allocationOrder"),
+				c.Spec.AllocationOrder,
+				[]string{AllocationOrderSmallestFirst, AllocationOrderFIFO,
+					AllocationOrderLIFO,
+				},
+			),
+		)
+	}
+
+	if c.Spec.EmergencyRange != nil {
+		allErrs = append(allErrs, c.validateEmergencyRange()...)
+	}
+
+	if len(c.Spec.StaticAssignments) != 0 {
+		allErrs = append(allErrs, c.validateStaticAssignments()...)
+	}
+
+	if c.Spec.GracePeriodAfterDelete != nil && c.Spec.GracePeriodAfterDelete.Duration < 0 {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "gracePeriodAfterDelete"),
+				c.Spec.GracePeriodAfterDelete,
+				"must be positive",
+			),
+		)
+	}
+
+	if c.Spec.MonitoringInterval != nil && c.Spec.MonitoringInterval.Duration < time.Second {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "monitoringInterval"),
+				c.Spec.MonitoringInterval,
+				"must be at least one second",
+			),
+		)
+	}
+
+	if c.Spec.BaseTemplateRef != nil {
+		if c.Spec.BaseTemplateRef.Name == "" {
+			allErrs = append(allErrs,
+				field.Required(
+					field.NewPath("spec", "baseTemplateRef", "name"),
+					"must be set when baseTemplateRef is given",
+				),
+			)
+		} else if c.Spec.BaseTemplateRef.Name == c.Name {
+			allErrs = append(allErrs,
+				field.Invalid(
+					field.NewPath("spec", "baseTemplateRef", "name"),
+					c.Spec.BaseTemplateRef.Name,
+					"cannot reference the template itself",
+				),
+			)
+		}
+	}
+
+	if c.Spec.HelmTemplateConfigMapRef != nil && c.Spec.HelmTemplateConfigMapRef.Name == "" {
+		allErrs = append(allErrs,
+			field.Required(
+				field.NewPath("spec", "helmTemplateConfigMapRef", "name"),
+				"must be set when helmTemplateConfigMapRef is given",
+			),
+		)
+	}
+
+	if c.Spec.AllocationWebhook != nil {
+		allErrs = append(allErrs, c.validateAllocationWebhook()...)
+	}
+
+	if c.Spec.PreAllocationHook != nil {
+		allErrs = append(allErrs, c.validatePreAllocationHook()...)
+	}
+
+	if c.Spec.ExternalIPAMSync != nil {
+		allErrs = append(allErrs, c.validateExternalIPAMSync()...)
+	}
+
+	if c.Spec.AlertmanagerWebhook != nil {
+		allErrs = append(allErrs, c.validateAlertmanagerWebhook()...)
+	}
+
+	if len(c.Spec.AnnotationFilters) != 0 {
+		allErrs = append(allErrs, c.validateAnnotationFilters()...)
+	}
+
+	if c.Spec.InlineNetworkConfig != nil {
+		allErrs = append(allErrs, c.validateInlineNetworkConfig()...)
+	}
+
+	if c.Spec.OwnerReferenceFilter != nil {
+		if _, err := metav1.LabelSelectorAsSelector(c.Spec.OwnerReferenceFilter); err != nil {
+			allErrs = append(allErrs,
+				field.Invalid(
+					field.NewPath("spec", "ownerReferenceFilter"),
+					c.Spec.OwnerReferenceFilter,
+					err.Error(),
+				),
+			)
+		}
+	}
+
+	if c.Spec.HostSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(c.Spec.HostSelector); err != nil {
+			allErrs = append(allErrs,
+				field.Invalid(
+					field.NewPath("spec", "hostSelector"),
+					c.Spec.HostSelector,
+					err.Error(),
+				),
+			)
+		}
+	}
+
+	if c.Spec.MinControllerVersion != "" {
+		if _, err := utilversion.ParseSemantic(c.Spec.MinControllerVersion); err != nil {
+			allErrs = append(allErrs,
+				field.Invalid(
+					field.NewPath("spec", "minControllerVersion"),
+					c.Spec.MinControllerVersion,
+					err.Error(),
+				),
+			)
+		}
+	}
+
+	if c.Spec.StatusStoreBackend != "" &&
+		c.Spec.StatusStoreBackend != StatusStoreBackendEtcd &&
+		c.Spec.UseExternalStatusStore {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "useExternalStatusStore"),
+				c.Spec.UseExternalStatusStore,
+				"can only be set with the Etcd statusStoreBackend",
+			),
+		)
+	}
+	return allErrs
+}
+
+func (c *Metal3DataTemplate) validateEmergencyRange() field.ErrorList {
+	var allErrs field.ErrorList
+	emergencyRange := c.Spec.EmergencyRange
+	path := field.NewPath("spec", "emergencyRange")
+
+	if c.Spec.MaxIndex == 0 {
+		allErrs = append(allErrs,
+			field.Required(
+				field.NewPath("spec", "maxIndex"),
+				"must be set when emergencyRange is given",
+			),
+		)
+	}
+
+	if emergencyRange.Min < 0 {
+		allErrs = append(allErrs,
+			field.Invalid(path.Child("min"), emergencyRange.Min, "must be positive"),
+		)
+	}
+	if emergencyRange.Max < emergencyRange.Min {
+		allErrs = append(allErrs,
+			field.Invalid(path.Child("max"), emergencyRange.Max,
+				"must be greater or equal to min",
+			),
+		)
+	} else if c.Spec.MaxIndex != 0 && emergencyRange.Min <= c.Spec.MaxIndex &&
+		emergencyRange.Max >= c.Spec.MinIndex {
+		allErrs = append(allErrs,
+			field.Invalid(path, emergencyRange,
+				"must not overlap the range between minIndex and maxIndex",
+			),
+		)
+	}
+	return allErrs
+}
+
+func (c *Metal3DataTemplate) validateStaticAssignments() field.ErrorList {
+	var allErrs field.ErrorList
+	path := field.NewPath("spec", "staticAssignments")
+
+	machineNames := make([]string, 0, len(c.Spec.StaticAssignments))
+	for machineName := range c.Spec.StaticAssignments {
+		machineNames = append(machineNames, machineName)
+	}
+	sort.Strings(machineNames)
+
+	assignedIndexes := make(map[int]bool)
+	for _, machineName := range machineNames {
+		index := c.Spec.StaticAssignments[machineName]
+		if index < c.Spec.MinIndex || (c.Spec.MaxIndex != 0 && index > c.Spec.MaxIndex) {
+			allErrs = append(allErrs,
+				field.Invalid(
+					path.Key(machineName),
+					index,
+					"must be between minIndex and maxIndex",
+				),
+			)
+		}
+		if assignedIndexes[index] {
+			allErrs = append(allErrs,
+				field.Duplicate(path.Key(machineName), index),
+			)
+		}
+		assignedIndexes[index] = true
+	}
+	return allErrs
+}
+
+func (c *Metal3DataTemplate) validateInlineNetworkConfig() field.ErrorList {
+	var allErrs field.ErrorList
+	networkConfig := c.Spec.InlineNetworkConfig
+	networkConfigPath := field.NewPath("spec", "inlineNetworkConfig")
+
+	if c.Spec.NetworkData != nil {
+		allErrs = append(allErrs,
+			field.Forbidden(
+				networkConfigPath,
+				"cannot be set together with networkData",
+			),
+		)
+	}
+
+	if networkConfig.Interface == "" {
+		allErrs = append(allErrs,
+			field.Required(
+				networkConfigPath.Child("interface"),
+				"must be set when inlineNetworkConfig is given",
+			),
+		)
+	}
+
+	if _, _, err := net.ParseCIDR(string(networkConfig.CIDR)); err != nil {
+		allErrs = append(allErrs,
+			field.Invalid(
+				networkConfigPath.Child("cidr"),
+				networkConfig.CIDR,
+				"must be a valid CIDR",
+			),
+		)
+	}
+
+	if networkConfig.Gateway != nil && net.ParseIP(string(*networkConfig.Gateway)) == nil {
+		allErrs = append(allErrs,
+			field.Invalid(
+				networkConfigPath.Child("gateway"),
+				*networkConfig.Gateway,
+				"must be a valid IP address",
+			),
+		)
+	}
+
+	for i, dns := range networkConfig.DNS {
+		if net.ParseIP(string(dns)) == nil {
+			allErrs = append(allErrs,
+				field.Invalid(
+					networkConfigPath.Child("dns").Index(i),
+					dns,
+					"must be a valid IP address",
+				),
+			)
+		}
+	}
+
+	if networkConfig.VLAN < 0 || networkConfig.VLAN > 4094 {
+		allErrs = append(allErrs,
+			field.Invalid(
+				networkConfigPath.Child("vlan"),
+				networkConfig.VLAN,
+				"must be between 0 and 4094",
+			),
+		)
+	}
+	return allErrs
+}
+
+func (c *Metal3DataTemplate) validateAllocationWebhook() field.ErrorList {
+	var allErrs field.ErrorList
+	allocationWebhook := c.Spec.AllocationWebhook
+
+	webhookURL, err := url.Parse(allocationWebhook.URL)
+	if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") ||
+		webhookURL.Host == "" {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "allocationWebhook", "url"),
+				allocationWebhook.URL,
+				"must be an http or https URL",
+			),
+		)
+	} else if isLocalHost(webhookURL.Hostname()) {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "allocationWebhook", "url"),
+				allocationWebhook.URL,
+				"must not point to a loopback or link-local address",
+			),
+		)
+	}
+
+	if allocationWebhook.Method != "" && allocationWebhook.Method != http.MethodPost &&
+		allocationWebhook.Method != http.MethodPut {
+		allErrs = append(allErrs,
+			field.NotSupported(
+				field.NewPath("spec", "allocationWebhook", "method"),
+				allocationWebhook.Method,
+				[]string{http.MethodPost, http.MethodPut},
+			),
+		)
+	}
+
+	if allocationWebhook.SecretRef != nil && allocationWebhook.SecretRef.Name == "" {
+		allErrs = append(allErrs,
+			field.Required(
+				field.NewPath("spec", "allocationWebhook", "secretRef", "name"),
+				"must be set when secretRef is given",
+			),
+		)
+	}
+	return allErrs
+}
+
+func (c *Metal3DataTemplate) validatePreAllocationHook() field.ErrorList {
+	var allErrs field.ErrorList
+	preAllocationHook := c.Spec.PreAllocationHook
+
+	hookURL, err := url.Parse(preAllocationHook.URL)
+	if err != nil || (hookURL.Scheme != "http" && hookURL.Scheme != "https") ||
+		hookURL.Host == "" {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "preAllocationHook", "url"),
+				preAllocationHook.URL,
+				"must be an http or https URL",
+			),
+		)
+	} else if isLocalHost(hookURL.Hostname()) {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "preAllocationHook", "url"),
+				preAllocationHook.URL,
+				"must not point to a loopback or link-local address",
+			),
+		)
+	}
+
+	if preAllocationHook.TimeoutSeconds < 0 {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "preAllocationHook", "timeoutSeconds"),
+				preAllocationHook.TimeoutSeconds,
+				"must be positive",
+			),
+		)
+	}
+	return allErrs
+}
+
+func (c *Metal3DataTemplate) validateExternalIPAMSync() field.ErrorList {
+	var allErrs field.ErrorList
+	externalIPAMSync := c.Spec.ExternalIPAMSync
+
+	ipamURL, err := url.Parse(externalIPAMSync.URL)
+	if err != nil || (ipamURL.Scheme != "http" && ipamURL.Scheme != "https") ||
+		ipamURL.Host == "" {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "externalIPAMSync", "url"),
+				externalIPAMSync.URL,
+				"must be an http or https URL",
+			),
+		)
+	} else if isLocalHost(ipamURL.Hostname()) {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "externalIPAMSync", "url"),
+				externalIPAMSync.URL,
+				"must not point to a loopback or link-local address",
+			),
+		)
+	}
+
+	if _, err := template.New("path").Parse(externalIPAMSync.PathTemplate); err != nil {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "externalIPAMSync", "pathTemplate"),
+				externalIPAMSync.PathTemplate,
+				err.Error(),
+			),
+		)
+	}
+
+	if c.Spec.InlineNetworkConfig == nil {
+		allErrs = append(allErrs,
+			field.Required(
+				field.NewPath("spec", "inlineNetworkConfig"),
+				"must be set when externalIPAMSync is given",
+			),
+		)
+	}
+	return allErrs
+}
+
+func (c *Metal3DataTemplate) validateAlertmanagerWebhook() field.ErrorList {
+	var allErrs field.ErrorList
+	alertmanagerWebhook := c.Spec.AlertmanagerWebhook
+
+	webhookURL, err := url.Parse(alertmanagerWebhook.URL)
+	if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") ||
+		webhookURL.Host == "" {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "alertmanagerWebhook", "url"),
+				alertmanagerWebhook.URL,
+				"must be an http or https URL",
+			),
+		)
+	} else if isLocalHost(webhookURL.Hostname()) {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "alertmanagerWebhook", "url"),
+				alertmanagerWebhook.URL,
+				"must not point to a loopback or link-local address",
+			),
+		)
+	}
+
+	if alertmanagerWebhook.FireAfterDuration != nil &&
+		alertmanagerWebhook.FireAfterDuration.Duration < 0 {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "alertmanagerWebhook", "fireAfterDuration"),
+				alertmanagerWebhook.FireAfterDuration,
+				"must be positive",
+			),
+		)
+	}
+	return allErrs
+}
+
+func (c *Metal3DataTemplate) validateAnnotationFilters() field.ErrorList {
+	var allErrs field.ErrorList
+
+	for i, filter := range c.Spec.AnnotationFilters {
+		path := field.NewPath("spec", "annotationFilters").Index(i)
+		if filter.AnnotationKey == "" {
+			allErrs = append(allErrs,
+				field.Required(path.Child("annotationKey"), "must be set"),
+			)
+		}
+		patch := filter.DataSpecPatch
+		if patch.Index != 0 || patch.Claim.Name != "" || patch.Template.Name != "" {
+			allErrs = append(allErrs,
+				field.Invalid(
+					path.Child("dataSpecPatch"),
+					patch,
+					"only metaData and networkData can be set",
+				),
+			)
+		}
+	}
+	return allErrs
+}
+
+func (c *Metal3DataTemplate) validateLeaderElectionLease() field.ErrorList {
+	var allErrs field.ErrorList
+	lease := c.Spec.LeaderElectionLease
+
+	if c.Spec.UseLeaseLock {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "useLeaseLock"),
+				c.Spec.UseLeaseLock,
+				"cannot be set with leaderElectionLease",
+			),
+		)
+	}
+
+	if lease.Duration != nil && lease.Duration.Duration < time.Second {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "leaderElectionLease", "duration"),
+				lease.Duration,
+				"must be at least one second",
+			),
+		)
+	}
+	return allErrs
+}
+
+func (c *Metal3DataTemplate) validateBackoffPolicy() field.ErrorList {
+	var allErrs field.ErrorList
+	policy := c.Spec.BackoffPolicy
+
+	if policy.InitialInterval != nil && policy.MaxInterval != nil &&
+		policy.InitialInterval.Duration > policy.MaxInterval.Duration {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "backoffPolicy", "initialInterval"),
+				policy.InitialInterval,
+				"must be lower or equal to maxInterval",
+			),
+		)
+	}
+
+	if policy.MaxRetries < 0 {
+		allErrs = append(allErrs,
+			field.Invalid(
+				field.NewPath("spec", "backoffPolicy", "maxRetries"),
+				policy.MaxRetries,
+				"must be positive",
+			),
+		)
+	}
+	return allErrs
+}
+
+// isLocalHost returns true if the host of a webhook URL is localhost, or a
+// loopback, link-local or unspecified IP address, that the controller refuses
+// to connect to
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast()
+}
@@ -14,11 +14,15 @@ limitations under the License.
 package v1alpha4
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
 )
 
 func TestMetal3DataTemplateDefault(t *testing.T) {
@@ -32,8 +36,66 @@ func TestMetal3DataTemplateDefault(t *testing.T) {
 	}
 	c.Default()
 
-	g.Expect(c.Spec).To(Equal(Metal3DataTemplateSpec{}))
+	g.Expect(c.Spec).To(Equal(Metal3DataTemplateSpec{
+		AllocationOrder: AllocationOrderSmallestFirst,
+	}))
 	g.Expect(c.Status).To(Equal(Metal3DataTemplateStatus{}))
+	g.Expect(c.Annotations).To(Equal(map[string]string{
+		DataTemplateDefaultedAnnotation: "true",
+	}))
+
+	c = &Metal3DataTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+		},
+		Spec: Metal3DataTemplateSpec{
+			AllocationOrder: AllocationOrderFIFO,
+		},
+	}
+	c.Default()
+
+	g.Expect(c.Spec.AllocationOrder).To(Equal(AllocationOrderFIFO))
+	g.Expect(c.Annotations).To(BeNil())
+}
+
+func TestMetal3DataTemplateDefaultRequiredLabels(t *testing.T) {
+	g := NewWithT(t)
+
+	c := &Metal3DataTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+			Labels: map[string]string{
+				"environment": "staging",
+				"team":        "metal3",
+			},
+		},
+		Spec: Metal3DataTemplateSpec{
+			RequiredLabels: map[string]string{
+				"environment": "production",
+				"managed-by":  "capm3",
+			},
+		},
+	}
+	c.Default()
+
+	g.Expect(c.Labels).To(Equal(map[string]string{
+		"environment": "production",
+		"managed-by":  "capm3",
+		"team":        "metal3",
+	}))
+
+	c = &Metal3DataTemplate{
+		Spec: Metal3DataTemplateSpec{
+			RequiredLabels: map[string]string{
+				"environment": "production",
+			},
+		},
+	}
+	c.Default()
+
+	g.Expect(c.Labels).To(Equal(map[string]string{
+		"environment": "production",
+	}))
 }
 
 func TestMetal3DataTemplateValidation(t *testing.T) {
@@ -44,13 +106,1003 @@ func TestMetal3DataTemplateValidation(t *testing.T) {
 		c         *Metal3DataTemplate
 	}{
 		{
-			name:      "should succeed when values and templates correct",
+			name:      "should succeed when values and templates correct",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{},
+			},
+		},
+		{
+			name:      "should succeed when backoffPolicy is correct",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					BackoffPolicy: &BackoffPolicySpec{
+						InitialInterval: &metav1.Duration{Duration: time.Second},
+						MaxInterval:     &metav1.Duration{Duration: time.Minute},
+						Multiplier:      2,
+						MaxRetries:      5,
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when initialInterval is bigger than maxInterval",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					BackoffPolicy: &BackoffPolicySpec{
+						InitialInterval: &metav1.Duration{Duration: time.Minute},
+						MaxInterval:     &metav1.Duration{Duration: time.Second},
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when maxRetries is negative",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					BackoffPolicy: &BackoffPolicySpec{
+						MaxRetries: -1,
+					},
+				},
+			},
+		},
+		{
+			name:      "should succeed with valid index bounds",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex: 2,
+					MaxIndex: 10,
+				},
+			},
+		},
+		{
+			name:      "should succeed with only minIndex",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex: 2,
+				},
+			},
+		},
+		{
+			name:      "should fail when minIndex is negative",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex: -1,
+				},
+			},
+		},
+		{
+			name:      "should fail when maxIndex is negative",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MaxIndex: -1,
+				},
+			},
+		},
+		{
+			name:      "should fail when maxIndex is lower than minIndex",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex: 10,
+					MaxIndex: 2,
+				},
+			},
+		},
+		{
+			name:      "should succeed when the index range is a multiple of indexStep",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex:  10,
+					MaxIndex:  100,
+					IndexStep: 10,
+				},
+			},
+		},
+		{
+			name:      "should succeed with annotation filters setting secrets",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AnnotationFilters: []AnnotationFilter{
+						{
+							AnnotationKey: "metal3.io/rack",
+							DataSpecPatch: Metal3DataSpec{
+								NetworkData: &corev1.SecretReference{Name: "abc"},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with an annotation filter without key",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AnnotationFilters: []AnnotationFilter{
+						{
+							DataSpecPatch: Metal3DataSpec{
+								NetworkData: &corev1.SecretReference{Name: "abc"},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with an annotation filter setting the index",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AnnotationFilters: []AnnotationFilter{
+						{
+							AnnotationKey: "metal3.io/rack",
+							DataSpecPatch: Metal3DataSpec{Index: 3},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when indexStep is negative",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					IndexStep: -1,
+				},
+			},
+		},
+		{
+			name:      "should fail when the index range is not a multiple of indexStep",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex:  10,
+					MaxIndex:  95,
+					IndexStep: 10,
+				},
+			},
+		},
+		{
+			name:      "should succeed with owner references under the limit",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+					OwnerReferences: []metav1.OwnerReference{
+						{Name: "m3m1"}, {Name: "m3m2"},
+					},
+				},
+				Spec: Metal3DataTemplateSpec{
+					MaxOwnerReferences: 2,
+				},
+			},
+		},
+		{
+			name:      "should fail with too many owner references",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+					OwnerReferences: []metav1.OwnerReference{
+						{Name: "m3m1"}, {Name: "m3m2"}, {Name: "m3m3"},
+					},
+				},
+				Spec: Metal3DataTemplateSpec{
+					MaxOwnerReferences: 2,
+				},
+			},
+		},
+		{
+			name:      "should fail when maxOwnerReferences is negative",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MaxOwnerReferences: -1,
+				},
+			},
+		},
+		{
+			name:      "should succeed with a valid allocation webhook",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AllocationWebhook: &AllocationWebhookSpec{
+						URL:    "https://cmdb.example.com/allocations",
+						Method: "PUT",
+						SecretRef: &corev1.LocalObjectReference{
+							Name: "cmdb-auth",
+						},
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when the allocation webhook URL is not http",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AllocationWebhook: &AllocationWebhookSpec{
+						URL: "ftp://cmdb.example.com/allocations",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when the allocation webhook URL is link-local",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AllocationWebhook: &AllocationWebhookSpec{
+						URL: "http://169.254.169.254/latest/meta-data",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when the allocation webhook URL is localhost",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AllocationWebhook: &AllocationWebhookSpec{
+						URL: "http://localhost:8080/allocations",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when the allocation webhook method is not supported",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AllocationWebhook: &AllocationWebhookSpec{
+						URL:    "https://cmdb.example.com/allocations",
+						Method: "GET",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when the allocation webhook secretRef has no name",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AllocationWebhook: &AllocationWebhookSpec{
+						URL:       "https://cmdb.example.com/allocations",
+						SecretRef: &corev1.LocalObjectReference{},
+					},
+				},
+			},
+		},
+		{
+			name:      "should succeed with a valid pre-allocation hook",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					PreAllocationHook: &PreAllocationHookSpec{
+						URL:            "https://policy.example.com/allocations",
+						TimeoutSeconds: 5,
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when the pre-allocation hook URL is invalid",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					PreAllocationHook: &PreAllocationHookSpec{
+						URL: "policy.example.com",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when the pre-allocation hook URL is localhost",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					PreAllocationHook: &PreAllocationHookSpec{
+						URL: "http://127.0.0.1:8080/allocations",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when the pre-allocation hook timeout is negative",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					PreAllocationHook: &PreAllocationHookSpec{
+						URL:            "https://policy.example.com/allocations",
+						TimeoutSeconds: -1,
+					},
+				},
+			},
+		},
+		{
+			name:      "should succeed with a valid inline network config",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					InlineNetworkConfig: &NetworkConfigSpec{
+						Interface: "eth0",
+						CIDR:      "192.168.0.0/24",
+						Gateway:   (*ipamv1.IPAddressStr)(pointer.StringPtr("192.168.0.1")),
+						DNS:       []ipamv1.IPAddressStr{"8.8.8.8"},
+						VLAN:      100,
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with an inline network config and networkData",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					NetworkData: &NetworkData{},
+					InlineNetworkConfig: &NetworkConfigSpec{
+						Interface: "eth0",
+						CIDR:      "192.168.0.0/24",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with an invalid inline network config",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					InlineNetworkConfig: &NetworkConfigSpec{
+						CIDR:    "192.168.0.0",
+						Gateway: (*ipamv1.IPAddressStr)(pointer.StringPtr("192.168.0")),
+						DNS:     []ipamv1.IPAddressStr{"dns.example.com"},
+						VLAN:    4095,
+					},
+				},
+			},
+		},
+		{
+			name:      "should succeed with the LIFO allocation order",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AllocationOrder: AllocationOrderLIFO,
+				},
+			},
+		},
+		{
+			name:      "should fail with an unknown allocation order",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AllocationOrder: "Random",
+				},
+			},
+		},
+		{
+			name:      "should succeed with a base template",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "worker",
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					BaseTemplateRef: &corev1.LocalObjectReference{Name: "base"},
+				},
+			},
+		},
+		{
+			name:      "should fail with a base template without name",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "worker",
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					BaseTemplateRef: &corev1.LocalObjectReference{},
+				},
+			},
+		},
+		{
+			name:      "should fail with the template as base template",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "worker",
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					BaseTemplateRef: &corev1.LocalObjectReference{Name: "worker"},
+				},
+			},
+		},
+		{
+			name:      "should succeed with an emergency range",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex:       1,
+					MaxIndex:       10,
+					EmergencyRange: &EmergencyRangeSpec{Min: 11, Max: 12},
+				},
+			},
+		},
+		{
+			name:      "should fail with an emergency range and no maxIndex",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					EmergencyRange: &EmergencyRangeSpec{Min: 11, Max: 12},
+				},
+			},
+		},
+		{
+			name:      "should fail with an emergency range overlapping the indexes",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex:       1,
+					MaxIndex:       10,
+					EmergencyRange: &EmergencyRangeSpec{Min: 10, Max: 12},
+				},
+			},
+		},
+		{
+			name:      "should fail with an emergency range max lower than min",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex:       1,
+					MaxIndex:       10,
+					EmergencyRange: &EmergencyRangeSpec{Min: 12, Max: 11},
+				},
+			},
+		},
+		{
+			name:      "should fail with an invalid data annotation",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					DataAnnotations: map[string]string{
+						"invalid key!": "true",
+					},
+				},
+			},
+		},
+		{
+			name:      "should succeed with static assignments",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex: 1,
+					MaxIndex: 3,
+					StaticAssignments: map[string]int{
+						"control-plane-0": 1,
+						"control-plane-1": 2,
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with a shared static index",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					StaticAssignments: map[string]int{
+						"control-plane-0": 1,
+						"control-plane-1": 1,
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with a static index out of bounds",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinIndex: 1,
+					StaticAssignments: map[string]int{
+						"control-plane-0": 0,
+					},
+				},
+			},
+		},
+		{
+			name:      "should succeed with the Shared ownership mode",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					OwnershipMode: OwnershipModeShared,
+				},
+			},
+		},
+		{
+			name:      "should fail with an unknown ownership mode",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					OwnershipMode: "Public",
+				},
+			},
+		},
+		{
+			name:      "should fail when helmTemplateConfigMapRef has no name",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					HelmTemplateConfigMapRef: &corev1.LocalObjectReference{},
+				},
+			},
+		},
+		{
+			name:      "should succeed when serviceAccountRef has a name",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					ServiceAccountRef: &corev1.LocalObjectReference{
+						Name: "tenant",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when serviceAccountRef has no name",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					ServiceAccountRef: &corev1.LocalObjectReference{},
+				},
+			},
+		},
+		{
+			name:      "should fail when requiredLabels are invalid",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					RequiredLabels: map[string]string{
+						"environment": "not a valid value",
+					},
+				},
+			},
+		},
+		{
+			name:      "should succeed when ownerReferenceFilter is valid",
 			expectErr: false,
 			c: &Metal3DataTemplate{
 				ObjectMeta: metav1.ObjectMeta{
 					Namespace: "foo",
 				},
-				Spec: Metal3DataTemplateSpec{},
+				Spec: Metal3DataTemplateSpec{
+					OwnerReferenceFilter: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"pool": "workers"},
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when ownerReferenceFilter is invalid",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					OwnerReferenceFilter: &metav1.LabelSelector{
+						MatchExpressions: []metav1.LabelSelectorRequirement{
+							{
+								Key:      "pool",
+								Operator: "Unknown",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:      "should succeed when hostSelector is valid",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					HostSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"hardware": "gen10"},
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when hostSelector is invalid",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					HostSelector: &metav1.LabelSelector{
+						MatchExpressions: []metav1.LabelSelectorRequirement{
+							{
+								Key:      "hardware",
+								Operator: "Unknown",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:      "should succeed when alertmanagerWebhook is valid",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AlertmanagerWebhook: &AlertmanagerWebhookSpec{
+						URL:               "http://alertmanager:9093/api/v1/alerts",
+						FireAfterDuration: &metav1.Duration{Duration: time.Hour},
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when alertmanagerWebhook url is invalid",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AlertmanagerWebhook: &AlertmanagerWebhookSpec{
+						URL: "alertmanager",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when alertmanagerWebhook url is a link-local address",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					AlertmanagerWebhook: &AlertmanagerWebhookSpec{
+						URL: "http://169.254.169.254/api/v1/alerts",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail when gracePeriodAfterDelete is negative",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					GracePeriodAfterDelete: &metav1.Duration{Duration: -time.Hour},
+				},
+			},
+		},
+		{
+			name:      "should succeed with an externalIPAMSync",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					InlineNetworkConfig: &NetworkConfigSpec{
+						Interface: "eth0",
+						CIDR:      "192.168.0.0/24",
+					},
+					ExternalIPAMSync: &ExternalIPAMSyncSpec{
+						URL:          "https://ipam.example.com",
+						PathTemplate: "/api/v1/ips/{{.IP}}",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with an externalIPAMSync without inlineNetworkConfig",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					ExternalIPAMSync: &ExternalIPAMSyncSpec{
+						URL: "https://ipam.example.com",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with an invalid externalIPAMSync pathTemplate",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					InlineNetworkConfig: &NetworkConfigSpec{
+						Interface: "eth0",
+						CIDR:      "192.168.0.0/24",
+					},
+					ExternalIPAMSync: &ExternalIPAMSyncSpec{
+						URL:          "ipam.example.com",
+						PathTemplate: "/api/v1/ips/{{.IP",
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with a loopback externalIPAMSync url",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					InlineNetworkConfig: &NetworkConfigSpec{
+						Interface: "eth0",
+						CIDR:      "192.168.0.0/24",
+					},
+					ExternalIPAMSync: &ExternalIPAMSyncSpec{
+						URL: "http://127.0.0.1:8080",
+					},
+				},
+			},
+		},
+		{
+			name:      "should succeed with a monitoringInterval",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MonitoringInterval: &metav1.Duration{Duration: time.Minute},
+				},
+			},
+		},
+		{
+			name:      "should fail when monitoringInterval is below one second",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MonitoringInterval: &metav1.Duration{Duration: time.Millisecond},
+				},
+			},
+		},
+		{
+			name:      "should succeed when minControllerVersion is a semantic version",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinControllerVersion: "v1.4.0",
+				},
+			},
+		},
+		{
+			name:      "should fail when minControllerVersion is not a semantic version",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					MinControllerVersion: "1.4",
+				},
+			},
+		},
+		{
+			name:      "should succeed with a leaderElectionLease",
+			expectErr: false,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					LeaderElectionLease: &LeaderElectionSpec{
+						Duration: &metav1.Duration{Duration: time.Minute},
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with a leaderElectionLease and useLeaseLock",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					UseLeaseLock:        true,
+					LeaderElectionLease: &LeaderElectionSpec{},
+				},
+			},
+		},
+		{
+			name:      "should fail with an invalid leaderElectionLease",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					LeaderElectionLease: &LeaderElectionSpec{
+						Duration: &metav1.Duration{Duration: time.Millisecond},
+					},
+				},
+			},
+		},
+		{
+			name:      "should fail with useExternalStatusStore and the ConfigMap statusStoreBackend",
+			expectErr: true,
+			c: &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "foo",
+				},
+				Spec: Metal3DataTemplateSpec{
+					StatusStoreBackend:     StatusStoreBackendConfigMap,
+					UseExternalStatusStore: true,
+				},
 			},
 		},
 	}
@@ -90,6 +1142,16 @@ func TestMetal3DataTemplateUpdateValidation(t *testing.T) {
 			new:       &Metal3DataTemplateSpec{},
 			old:       nil,
 		},
+		{
+			name:      "should fail when ownershipMode changes",
+			expectErr: true,
+			new: &Metal3DataTemplateSpec{
+				OwnershipMode: OwnershipModeShared,
+			},
+			old: &Metal3DataTemplateSpec{
+				OwnershipMode: OwnershipModeExclusive,
+			},
+		},
 		{
 			name:      "should fail when Metadata value changes",
 			expectErr: true,
@@ -209,3 +1271,69 @@ func TestMetal3DataTemplateUpdateValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestMetal3DataTemplateUpdateOwnerReferences(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		expectErr bool
+		newRefs   int
+		oldRefs   int
+	}{
+		{
+			name:      "should succeed when under the limit",
+			expectErr: false,
+			newRefs:   2,
+			oldRefs:   1,
+		},
+		{
+			name:      "should fail when growing over the limit",
+			expectErr: true,
+			newRefs:   3,
+			oldRefs:   2,
+		},
+		{
+			name:      "should succeed when removing owners over the limit",
+			expectErr: false,
+			newRefs:   3,
+			oldRefs:   4,
+		},
+		{
+			name:      "should succeed when unchanged over the limit",
+			expectErr: false,
+			newRefs:   3,
+			oldRefs:   3,
+		},
+	}
+
+	ownerRefs := func(nb int) []metav1.OwnerReference {
+		refs := []metav1.OwnerReference{}
+		for i := 0; i < nb; i++ {
+			refs = append(refs, metav1.OwnerReference{Name: fmt.Sprintf("m3m%d", i)})
+		}
+		return refs
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			new := &Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:       "foo",
+					OwnerReferences: ownerRefs(tt.newRefs),
+				},
+				Spec: Metal3DataTemplateSpec{
+					MaxOwnerReferences: 2,
+				},
+			}
+			old := new.DeepCopy()
+			old.OwnerReferences = ownerRefs(tt.oldRefs)
+
+			if tt.expectErr {
+				g.Expect(new.ValidateUpdate(old)).NotTo(Succeed())
+			} else {
+				g.Expect(new.ValidateUpdate(old)).To(Succeed())
+			}
+		})
+	}
+}
@@ -23,6 +23,7 @@ package v1alpha4
 import (
 	"github.com/metal3-io/ip-address-manager/api/v1alpha1"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/cluster-api/api/v1alpha3"
 	"sigs.k8s.io/cluster-api/errors"
@@ -43,6 +44,134 @@ func (in *APIEndpoint) DeepCopy() *APIEndpoint {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AlertmanagerWebhookSpec) DeepCopyInto(out *AlertmanagerWebhookSpec) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.FireAfterDuration != nil {
+		in, out := &in.FireAfterDuration, &out.FireAfterDuration
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AlertmanagerWebhookSpec.
+func (in *AlertmanagerWebhookSpec) DeepCopy() *AlertmanagerWebhookSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AlertmanagerWebhookSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AllocationWebhookSpec) DeepCopyInto(out *AllocationWebhookSpec) {
+	*out = *in
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AllocationWebhookSpec.
+func (in *AllocationWebhookSpec) DeepCopy() *AllocationWebhookSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AllocationWebhookSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AnnotationFilter) DeepCopyInto(out *AnnotationFilter) {
+	*out = *in
+	in.DataSpecPatch.DeepCopyInto(&out.DataSpecPatch)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AnnotationFilter.
+func (in *AnnotationFilter) DeepCopy() *AnnotationFilter {
+	if in == nil {
+		return nil
+	}
+	out := new(AnnotationFilter)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackoffPolicySpec) DeepCopyInto(out *BackoffPolicySpec) {
+	*out = *in
+	if in.InitialInterval != nil {
+		in, out := &in.InitialInterval, &out.InitialInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.MaxInterval != nil {
+		in, out := &in.MaxInterval, &out.MaxInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackoffPolicySpec.
+func (in *BackoffPolicySpec) DeepCopy() *BackoffPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(BackoffPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EmergencyRangeSpec) DeepCopyInto(out *EmergencyRangeSpec) {
+	*out = *in
+	if in.MaxDuration != nil {
+		in, out := &in.MaxDuration, &out.MaxDuration
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EmergencyRangeSpec.
+func (in *EmergencyRangeSpec) DeepCopy() *EmergencyRangeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(EmergencyRangeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalIPAMSyncSpec) DeepCopyInto(out *ExternalIPAMSyncSpec) {
+	*out = *in
+	if in.AuthSecretRef != nil {
+		in, out := &in.AuthSecretRef, &out.AuthSecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalIPAMSyncSpec.
+func (in *ExternalIPAMSyncSpec) DeepCopy() *ExternalIPAMSyncSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalIPAMSyncSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FromPool) DeepCopyInto(out *FromPool) {
 	*out = *in
@@ -132,6 +261,65 @@ func (in *Image) DeepCopy() *Image {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IndexEntry) DeepCopyInto(out *IndexEntry) {
+	*out = *in
+	if in.AllocatedAt != nil {
+		in, out := &in.AllocatedAt, &out.AllocatedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.LeaseExpiry != nil {
+		in, out := &in.LeaseExpiry, &out.LeaseExpiry
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IndexEntry.
+func (in *IndexEntry) DeepCopy() *IndexEntry {
+	if in == nil {
+		return nil
+	}
+	out := new(IndexEntry)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IndexReservation) DeepCopyInto(out *IndexReservation) {
+	*out = *in
+	in.ReservedUntil.DeepCopyInto(&out.ReservedUntil)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IndexReservation.
+func (in *IndexReservation) DeepCopy() *IndexReservation {
+	if in == nil {
+		return nil
+	}
+	out := new(IndexReservation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LeaderElectionSpec) DeepCopyInto(out *LeaderElectionSpec) {
+	*out = *in
+	if in.Duration != nil {
+		in, out := &in.Duration, &out.Duration
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LeaderElectionSpec.
+func (in *LeaderElectionSpec) DeepCopy() *LeaderElectionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(LeaderElectionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *MetaData) DeepCopyInto(out *MetaData) {
 	*out = *in
@@ -709,6 +897,11 @@ func (in *Metal3DataTemplateList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Metal3DataTemplateSpec) DeepCopyInto(out *Metal3DataTemplateSpec) {
 	*out = *in
+	if in.BaseTemplateRef != nil {
+		in, out := &in.BaseTemplateRef, &out.BaseTemplateRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
 	if in.MetaData != nil {
 		in, out := &in.MetaData, &out.MetaData
 		*out = new(MetaData)
@@ -719,6 +912,109 @@ func (in *Metal3DataTemplateSpec) DeepCopyInto(out *Metal3DataTemplateSpec) {
 		*out = new(NetworkData)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.InlineNetworkConfig != nil {
+		in, out := &in.InlineNetworkConfig, &out.InlineNetworkConfig
+		*out = new(NetworkConfigSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BackoffPolicy != nil {
+		in, out := &in.BackoffPolicy, &out.BackoffPolicy
+		*out = new(BackoffPolicySpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ServiceAccountRef != nil {
+		in, out := &in.ServiceAccountRef, &out.ServiceAccountRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.OwnerReferenceFilter != nil {
+		in, out := &in.OwnerReferenceFilter, &out.OwnerReferenceFilter
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HostSelector != nil {
+		in, out := &in.HostSelector, &out.HostSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RequiredLabels != nil {
+		in, out := &in.RequiredLabels, &out.RequiredLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.DataAnnotations != nil {
+		in, out := &in.DataAnnotations, &out.DataAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.AllocationWebhook != nil {
+		in, out := &in.AllocationWebhook, &out.AllocationWebhook
+		*out = new(AllocationWebhookSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PreAllocationHook != nil {
+		in, out := &in.PreAllocationHook, &out.PreAllocationHook
+		*out = new(PreAllocationHookSpec)
+		**out = **in
+	}
+	if in.ExternalIPAMSync != nil {
+		in, out := &in.ExternalIPAMSync, &out.ExternalIPAMSync
+		*out = new(ExternalIPAMSyncSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AlertmanagerWebhook != nil {
+		in, out := &in.AlertmanagerWebhook, &out.AlertmanagerWebhook
+		*out = new(AlertmanagerWebhookSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.IPPoolRef != nil {
+		in, out := &in.IPPoolRef, &out.IPPoolRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.EmergencyRange != nil {
+		in, out := &in.EmergencyRange, &out.EmergencyRange
+		*out = new(EmergencyRangeSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.StaticAssignments != nil {
+		in, out := &in.StaticAssignments, &out.StaticAssignments
+		*out = make(map[string]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.GracePeriodAfterDelete != nil {
+		in, out := &in.GracePeriodAfterDelete, &out.GracePeriodAfterDelete
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.HelmTemplateConfigMapRef != nil {
+		in, out := &in.HelmTemplateConfigMapRef, &out.HelmTemplateConfigMapRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.AnnotationFilters != nil {
+		in, out := &in.AnnotationFilters, &out.AnnotationFilters
+		*out = make([]AnnotationFilter, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LeaderElectionLease != nil {
+		in, out := &in.LeaderElectionLease, &out.LeaderElectionLease
+		*out = new(LeaderElectionSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.MonitoringInterval != nil {
+		in, out := &in.MonitoringInterval, &out.MonitoringInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Metal3DataTemplateSpec.
@@ -738,13 +1034,76 @@ func (in *Metal3DataTemplateStatus) DeepCopyInto(out *Metal3DataTemplateStatus)
 		in, out := &in.LastUpdated, &out.LastUpdated
 		*out = (*in).DeepCopy()
 	}
+	if in.LastMigratedAt != nil {
+		in, out := &in.LastMigratedAt, &out.LastMigratedAt
+		*out = (*in).DeepCopy()
+	}
 	if in.Indexes != nil {
 		in, out := &in.Indexes, &out.Indexes
+		*out = make(map[string]IndexEntry, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.ExternalStatusSecretRef != nil {
+		in, out := &in.ExternalStatusSecretRef, &out.ExternalStatusSecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.FreedIndexes != nil {
+		in, out := &in.FreedIndexes, &out.FreedIndexes
+		*out = make([]int, len(*in))
+		copy(*out, *in)
+	}
+	if in.ReservedIndexes != nil {
+		in, out := &in.ReservedIndexes, &out.ReservedIndexes
+		*out = make([]IndexReservation, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.EmergencyAllocations != nil {
+		in, out := &in.EmergencyAllocations, &out.EmergencyAllocations
 		*out = make(map[string]int, len(*in))
 		for key, val := range *in {
 			(*out)[key] = val
 		}
 	}
+	if in.UnprovisionedMachines != nil {
+		in, out := &in.UnprovisionedMachines, &out.UnprovisionedMachines
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PendingDeletions != nil {
+		in, out := &in.PendingDeletions, &out.PendingDeletions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IPIndex != nil {
+		in, out := &in.IPIndex, &out.IPIndex
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.FailingSince != nil {
+		in, out := &in.FailingSince, &out.FailingSince
+		*out = (*in).DeepCopy()
+	}
+	if in.RevisionHistory != nil {
+		in, out := &in.RevisionHistory, &out.RevisionHistory
+		*out = make([]RevisionEntry, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make(v1alpha3.Conditions, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Metal3DataTemplateStatus.
@@ -1002,6 +1361,31 @@ func (in *Metal3MachineTemplateSpec) DeepCopy() *Metal3MachineTemplateSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NetworkConfigSpec) DeepCopyInto(out *NetworkConfigSpec) {
+	*out = *in
+	if in.Gateway != nil {
+		in, out := &in.Gateway, &out.Gateway
+		*out = new(v1alpha1.IPAddressStr)
+		**out = **in
+	}
+	if in.DNS != nil {
+		in, out := &in.DNS, &out.DNS
+		*out = make([]v1alpha1.IPAddressStr, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NetworkConfigSpec.
+func (in *NetworkConfigSpec) DeepCopy() *NetworkConfigSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NetworkConfigSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NetworkData) DeepCopyInto(out *NetworkData) {
 	*out = *in
@@ -1442,3 +1826,46 @@ func (in *NetworkLinkEthernetMac) DeepCopy() *NetworkLinkEthernetMac {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PreAllocationHookSpec) DeepCopyInto(out *PreAllocationHookSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PreAllocationHookSpec.
+func (in *PreAllocationHookSpec) DeepCopy() *PreAllocationHookSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PreAllocationHookSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RevisionEntry) DeepCopyInto(out *RevisionEntry) {
+	*out = *in
+	in.ChangedAt.DeepCopyInto(&out.ChangedAt)
+	if in.ChangedFields != nil {
+		in, out := &in.ChangedFields, &out.ChangedFields
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.FieldChecksums != nil {
+		in, out := &in.FieldChecksums, &out.FieldChecksums
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RevisionEntry.
+func (in *RevisionEntry) DeepCopy() *RevisionEntry {
+	if in == nil {
+		return nil
+	}
+	out := new(RevisionEntry)
+	in.DeepCopyInto(out)
+	return out
+}
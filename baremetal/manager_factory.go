@@ -19,7 +19,9 @@ package baremetal
 import (
 	"github.com/go-logr/logr"
 	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"k8s.io/client-go/tools/record"
 	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -39,9 +41,14 @@ type ManagerFactoryInterface interface {
 	)
 }
 
-// ManagerFactory only contains a client
+// ManagerFactory contains a client, the OwnerKindFilter of the data
+// managers, and the recorder of the Events and the informers of the data
+// template managers
 type ManagerFactory struct {
-	client client.Client
+	client          client.Client
+	ownerKindFilter []string
+	recorder        record.EventRecorder
+	informers       cache.Informers
 }
 
 // NewManagerFactory returns a new factory.
@@ -49,6 +56,28 @@ func NewManagerFactory(client client.Client) ManagerFactory {
 	return ManagerFactory{client: client}
 }
 
+// NewManagerFactoryWithOwnerKindFilter returns a new factory creating data
+// managers recognizing the owner references of the given kinds as machines.
+func NewManagerFactoryWithOwnerKindFilter(client client.Client,
+	ownerKindFilter []string,
+) ManagerFactory {
+	return ManagerFactory{client: client, ownerKindFilter: ownerKindFilter}
+}
+
+// WithEventRecorder returns a copy of the factory creating data template
+// managers recording their Events with the given recorder
+func (f ManagerFactory) WithEventRecorder(recorder record.EventRecorder) ManagerFactory {
+	f.recorder = recorder
+	return f
+}
+
+// WithInformers returns a copy of the factory creating data template
+// managers watching the objects with the given informers
+func (f ManagerFactory) WithInformers(informers cache.Informers) ManagerFactory {
+	f.informers = informers
+	return f
+}
+
 // NewClusterManager creates a new ClusterManager
 func (f ManagerFactory) NewClusterManager(cluster *capi.Cluster, capm3Cluster *capm3.Metal3Cluster, clusterLog logr.Logger) (ClusterManagerInterface, error) {
 	return NewClusterManager(f.client, cluster, capm3Cluster, clusterLog)
@@ -65,10 +94,20 @@ func (f ManagerFactory) NewMachineManager(capiCluster *capi.Cluster,
 
 // NewDataTemplateManager creates a new DataTemplateManager
 func (f ManagerFactory) NewDataTemplateManager(metadata *capm3.Metal3DataTemplate, metadataLog logr.Logger) (DataTemplateManagerInterface, error) {
-	return NewDataTemplateManager(f.client, metadata, metadataLog)
+	return NewDataTemplateManagerWithOptions(f.client, metadata, metadataLog,
+		WithOwnerKindFilter(f.ownerKindFilter), WithEventRecorder(f.recorder),
+		WithInformers(f.informers),
+	)
 }
 
 // NewDataManager creates a new DataManager
 func (f ManagerFactory) NewDataManager(metadata *capm3.Metal3Data, metadataLog logr.Logger) (DataManagerInterface, error) {
-	return NewDataManager(f.client, metadata, metadataLog)
+	dataMgr, err := NewDataManager(f.client, metadata, metadataLog)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.ownerKindFilter) > 0 {
+		dataMgr.OwnerKindFilter = append([]string{}, f.ownerKindFilter...)
+	}
+	return dataMgr, nil
 }
@@ -41,6 +41,33 @@ var _ = Describe("Manager factory testing", func() {
 		Expect(managerFactory.client).To(Equal(managerClient))
 	})
 
+	It("returns data managers with the owner kind filter", func() {
+		ownerKinds := []string{"Metal3Machine", "VirtualMetal3Machine"}
+		managerFactory = NewManagerFactoryWithOwnerKindFilter(managerClient,
+			ownerKinds,
+		)
+		templateMgr, err := managerFactory.NewDataTemplateManager(
+			&capm3.Metal3DataTemplate{}, clusterLog,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(templateMgr.(*DataTemplateManager).OwnerKindFilter).To(Equal(ownerKinds))
+		dataMgr, err := managerFactory.NewDataManager(&capm3.Metal3Data{},
+			clusterLog,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataMgr.(*DataManager).OwnerKindFilter).To(Equal(ownerKinds))
+
+		// The default filter is used without kinds
+		managerFactory = NewManagerFactory(managerClient)
+		templateMgr, err = managerFactory.NewDataTemplateManager(
+			&capm3.Metal3DataTemplate{}, clusterLog,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(templateMgr.(*DataTemplateManager).OwnerKindFilter).To(Equal(
+			DefaultOwnerKindFilter,
+		))
+	})
+
 	It("returns a cluster manager", func() {
 		_, err := managerFactory.NewClusterManager(&capi.Cluster{},
 			&capm3.Metal3Cluster{}, clusterLog,
@@ -22,6 +22,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
 
@@ -34,6 +35,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/utils/pointer"
 	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
 	"sigs.k8s.io/cluster-api/util"
@@ -41,12 +43,23 @@ import (
 	"sigs.k8s.io/yaml"
 )
 
+const (
+	// SkipWaitForHostAnnotation, set on a deleted Metal3Data, removes the
+	// WaitForBMOFinalizer without waiting for the BareMetalHost
+	SkipWaitForHostAnnotation = "metal3.io/skip-wait-for-bmo"
+)
+
+// waitForHostTimeout is how long a deleted Metal3Data waits at most for its
+// BareMetalHost
+var waitForHostTimeout = time.Hour
+
 // DataManagerInterface is an interface for a DataManager
 type DataManagerInterface interface {
 	SetFinalizer()
 	UnsetFinalizer()
 	Reconcile(ctx context.Context) error
 	ReleaseLeases(ctx context.Context) error
+	WaitForHost(ctx context.Context) error
 }
 
 // DataManager is responsible for performing machine reconciliation
@@ -54,6 +67,10 @@ type DataManager struct {
 	client client.Client
 	Data   *capm3.Metal3Data
 	Log    logr.Logger
+	// OwnerKindFilter are the kinds of the owner references, in the group of
+	// the Metal3Machines, recognized as the machine of the Metal3DataClaim.
+	// It defaults to DefaultOwnerKindFilter.
+	OwnerKindFilter []string
 }
 
 // NewDataManager returns a new helper for managing a Metal3Data object
@@ -61,9 +78,10 @@ func NewDataManager(client client.Client,
 	data *capm3.Metal3Data, dataLog logr.Logger) (*DataManager, error) {
 
 	return &DataManager{
-		client: client,
-		Data:   data,
-		Log:    dataLog,
+		client:          client,
+		Data:            data,
+		Log:             dataLog,
+		OwnerKindFilter: append([]string{}, DefaultOwnerKindFilter...),
 	}, nil
 }
 
@@ -164,8 +182,9 @@ func (m *DataManager) createSecrets(ctx context.Context) error {
 		}
 	}
 
-	// If the NetworkData is given as part of Metal3DataTemplate
-	if m3dt.Spec.NetworkData != nil {
+	// If the NetworkData or an inline network config is given as part of
+	// Metal3DataTemplate
+	if m3dt.Spec.NetworkData != nil || m3dt.Spec.InlineNetworkConfig != nil {
 		// If the secret name is unset, set it
 		if m.Data.Spec.NetworkData == nil || m.Data.Spec.NetworkData.Name == "" {
 			m.Data.Spec.NetworkData = &corev1.SecretReference{
@@ -224,6 +243,15 @@ func (m *DataManager) createSecrets(ctx context.Context) error {
 	}
 	m.Log.Info("Fetched BMH")
 
+	// Record the host to wait for on deletion, the Metal3Machine may be gone
+	// by then
+	if Contains(m.Data.Finalizers, capm3.WaitForBMOFinalizer) {
+		if m.Data.Annotations == nil {
+			m.Data.Annotations = make(map[string]string)
+		}
+		m.Data.Annotations[HostAnnotation] = bmh.Namespace + "/" + bmh.Name
+	}
+
 	// Create the owner Ref for the secret
 	ownerRefs := []metav1.OwnerReference{
 		{
@@ -293,6 +321,77 @@ func (m *DataManager) ReleaseLeases(ctx context.Context) error {
 	return m.releaseAddressesFromPool(ctx, *m3dt)
 }
 
+// WaitForHost removes the WaitForBMOFinalizer once the BareMetalHost of the
+// HostAnnotation, recorded when the secrets were rendered, no longer needs
+// the Metal3Data, or is gone. It returns a RequeueAfterError while the host is
+// still used or deprovisioned, unless the Metal3Data has the
+// SkipWaitForHostAnnotation or was deleted more than waitForHostTimeout ago.
+func (m *DataManager) WaitForHost(ctx context.Context) error {
+	if !Contains(m.Data.Finalizers, capm3.WaitForBMOFinalizer) {
+		return nil
+	}
+	if _, ok := m.Data.Annotations[SkipWaitForHostAnnotation]; ok {
+		m.Log.Info("Not waiting for the BareMetalHost, skip annotation set")
+		m.Data.Finalizers = Filter(m.Data.Finalizers, capm3.WaitForBMOFinalizer)
+		return nil
+	}
+	if m.Data.DeletionTimestamp != nil &&
+		time.Since(m.Data.DeletionTimestamp.Time) > waitForHostTimeout {
+		m.Log.Info("Timed out waiting for the BareMetalHost to be deprovisioned")
+		m.Data.Finalizers = Filter(m.Data.Finalizers, capm3.WaitForBMOFinalizer)
+		return nil
+	}
+	hostKey, ok := m.Data.Annotations[HostAnnotation]
+	if ok {
+		hostNamespace, hostName, err := cache.SplitMetaNamespaceKey(hostKey)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid %s annotation", HostAnnotation)
+		}
+		host := &bmo.BareMetalHost{}
+		key := client.ObjectKey{
+			Name:      hostName,
+			Namespace: hostNamespace,
+		}
+		err = m.client.Get(ctx, key, host)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err == nil && m.hostUsesData(host) {
+			m.Log.Info("Waiting for the BareMetalHost to be deprovisioned",
+				"host", hostKey, "state", host.Status.Provisioning.State,
+			)
+			return &RequeueAfterError{RequeueAfter: requeueAfter}
+		}
+	}
+	m.Data.Finalizers = Filter(m.Data.Finalizers, capm3.WaitForBMOFinalizer)
+	return nil
+}
+
+// hostUsesData returns whether the baremetal-operator may still read the
+// Metal3Data to deprovision the BareMetalHost. It does not once the host is
+// available or ready, in error, externally provisioned, or no longer
+// consumed by the machine of the Metal3Data.
+func (m *DataManager) hostUsesData(host *bmo.BareMetalHost) bool {
+	switch host.Status.Provisioning.State {
+	case bmo.StateAvailable, bmo.StateReady, bmo.StateExternallyProvisioned:
+		return false
+	}
+	if host.Spec.ExternallyProvisioned ||
+		host.Status.OperationalStatus == bmo.OperationalStatusError {
+		return false
+	}
+	if host.Spec.ConsumerRef == nil {
+		return false
+	}
+	for _, ownerRef := range m.Data.OwnerReferences {
+		if Contains(m.OwnerKindFilter, ownerRef.Kind) {
+			return host.Spec.ConsumerRef.Kind == ownerRef.Kind &&
+				host.Spec.ConsumerRef.Name == ownerRef.Name
+		}
+	}
+	return true
+}
+
 // addressFromPool contains the elements coming from an IPPool
 type addressFromPool struct {
 	address    ipamv1.IPAddressStr
@@ -759,6 +858,9 @@ func renderNetworkData(m3d *capm3.Metal3Data, m3dt *capm3.Metal3DataTemplate,
 	bmh *bmo.BareMetalHost, poolAddresses map[string]addressFromPool,
 ) ([]byte, error) {
 	if m3dt.Spec.NetworkData == nil {
+		if m3dt.Spec.InlineNetworkConfig != nil {
+			return renderInlineNetworkConfig(*m3dt.Spec.InlineNetworkConfig, m3d, bmh)
+		}
 		return nil, nil
 	}
 	var err error
@@ -785,6 +887,144 @@ func renderNetworkData(m3d *capm3.Metal3Data, m3dt *capm3.Metal3DataTemplate,
 	return yaml.Marshal(networkData)
 }
 
+// renderInlineNetworkConfig renders the inline network config of a
+// Metal3DataTemplate into a networkData object
+func renderInlineNetworkConfig(networkConfig capm3.NetworkConfigSpec,
+	m3d *capm3.Metal3Data, bmh *bmo.BareMetalHost,
+) ([]byte, error) {
+	macAddress, err := getBMHMacByName(networkConfig.Interface, bmh)
+	if err != nil {
+		return nil, err
+	}
+	hostIP, subnet, err := inlineNetworkHostIP(networkConfig, m3d.Spec.Index)
+	if err != nil {
+		return nil, err
+	}
+	prefix, _ := subnet.Mask.Size()
+	ipv4 := subnet.IP.To4() != nil
+
+	linkID := networkConfig.Interface
+	links := []interface{}{
+		map[string]interface{}{
+			"type":                 "phy",
+			"id":                   linkID,
+			"ethernet_mac_address": macAddress,
+		},
+	}
+	if networkConfig.VLAN != 0 {
+		linkID = fmt.Sprintf("%s.%d", networkConfig.Interface, networkConfig.VLAN)
+		links = append(links, map[string]interface{}{
+			"type":             "vlan",
+			"id":               linkID,
+			"vlan_mac_address": macAddress,
+			"vlan_id":          networkConfig.VLAN,
+			"vlan_link":        networkConfig.Interface,
+		})
+	}
+
+	network := map[string]interface{}{
+		"id":      linkID,
+		"link":    linkID,
+		"netmask": translateMask(prefix, ipv4),
+		"routes":  []interface{}{},
+	}
+	if ipv4 {
+		network["type"] = "ipv4"
+		network["ip_address"] = ipamv1.IPAddressv4Str(hostIP.String())
+	} else {
+		network["type"] = "ipv6"
+		network["ip_address"] = ipamv1.IPAddressv6Str(hostIP.String())
+	}
+	if networkConfig.Gateway != nil {
+		defaultNetwork := "0.0.0.0"
+		if !ipv4 {
+			defaultNetwork = "::"
+		}
+		network["routes"] = []interface{}{
+			map[string]interface{}{
+				"network": defaultNetwork,
+				"netmask": translateMask(0, ipv4),
+				"gateway": *networkConfig.Gateway,
+			},
+		}
+	}
+
+	services := []interface{}{}
+	for _, dns := range networkConfig.DNS {
+		services = append(services, map[string]interface{}{
+			"type":    "dns",
+			"address": dns,
+		})
+	}
+
+	return yaml.Marshal(map[string][]interface{}{
+		"links":    links,
+		"networks": []interface{}{network},
+		"services": services,
+	})
+}
+
+// inlineNetworkHostIP returns the address of the index in the inline network
+// config, the address of the subnet incremented by the index plus one, and
+// the subnet. It returns an error if the address is out of the subnet, or is
+// its IPv4 broadcast address or the gateway.
+func inlineNetworkHostIP(networkConfig capm3.NetworkConfigSpec, index int,
+) (net.IP, *net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(string(networkConfig.CIDR))
+	if err != nil {
+		return nil, nil, err
+	}
+	hostIP, err := addOffsetToIP(subnet.IP, index+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !subnet.Contains(hostIP) {
+		return nil, nil, errors.Errorf("Index %d is out of the bounds of %s",
+			index, networkConfig.CIDR,
+		)
+	}
+	// The /31 and /32 IPv4 subnets have no broadcast address
+	ones, bits := subnet.Mask.Size()
+	if bits == 32 && ones < 31 {
+		broadcast := make(net.IP, len(subnet.IP))
+		for i := range subnet.IP {
+			broadcast[i] = subnet.IP[i] | ^subnet.Mask[i]
+		}
+		if hostIP.Equal(broadcast) {
+			return nil, nil, errors.Errorf(
+				"Index %d is the broadcast address of %s", index,
+				networkConfig.CIDR,
+			)
+		}
+	}
+	if networkConfig.Gateway != nil &&
+		hostIP.Equal(net.ParseIP(string(*networkConfig.Gateway))) {
+		return nil, nil, errors.Errorf("Index %d is the gateway %s of %s",
+			index, *networkConfig.Gateway, networkConfig.CIDR,
+		)
+	}
+	return hostIP, subnet, nil
+}
+
+// addOffsetToIP returns the IP address incremented by offset
+func addOffsetToIP(ip net.IP, offset int) (net.IP, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	hostIP := make(net.IP, len(ip))
+	copy(hostIP, ip)
+	carry := offset
+	for i := len(hostIP) - 1; i >= 0 && carry > 0; i-- {
+		sum := int(hostIP[i]) + carry
+		hostIP[i] = byte(sum % 256)
+		carry = sum / 256
+	}
+	if carry > 0 {
+		return nil, errors.New("IP address overflow")
+	}
+	return hostIP, nil
+}
+
 // renderNetworkServices renders the services
 func renderNetworkServices(services capm3.NetworkDataService, poolAddresses map[string]addressFromPool) ([]interface{}, error) {
 	data := []interface{}{}
@@ -1237,7 +1477,7 @@ func (m *DataManager) getM3Machine(ctx context.Context, m3dt *capm3.Metal3DataTe
 		}
 		// not matching on UID since when pivoting it might change
 		// Not matching on API version as this might change
-		if ownerRef.Kind == "Metal3Machine" &&
+		if Contains(m.OwnerKindFilter, ownerRef.Kind) &&
 			oGV.Group == capm3.GroupVersion.Group {
 			metal3MachineName = ownerRef.Name
 			break
@@ -18,6 +18,7 @@ package baremetal
 
 import (
 	"context"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
@@ -652,6 +653,191 @@ var _ = Describe("Metal3Data manager", func() {
 		}),
 	)
 
+	type testCaseWaitForHost struct {
+		finalizers      []string
+		hostAnnotation  string
+		skipAnnotation  bool
+		deletedAt       time.Time
+		hostState       bmo.ProvisioningState
+		hostSpec        bmo.BareMetalHostSpec
+		hostError       bool
+		expectRequeue   bool
+		expectFinalizer bool
+	}
+
+	consumedHost := bmo.BareMetalHostSpec{
+		ConsumerRef: &corev1.ObjectReference{
+			Kind: "Metal3Machine",
+			Name: "machine0",
+		},
+	}
+
+	DescribeTable("Test WaitForHost",
+		func(tc testCaseWaitForHost) {
+			m3d := &infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "abc",
+					Namespace:   "myns",
+					Finalizers:  tc.finalizers,
+					Annotations: map[string]string{},
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: infrav1.GroupVersion.String(),
+							Kind:       "Metal3Machine",
+							Name:       "machine0",
+						},
+					},
+				},
+			}
+			if tc.hostAnnotation != "" {
+				m3d.Annotations[HostAnnotation] = tc.hostAnnotation
+			}
+			if tc.skipAnnotation {
+				m3d.Annotations[SkipWaitForHostAnnotation] = ""
+			}
+			if !tc.deletedAt.IsZero() {
+				m3d.DeletionTimestamp = &metav1.Time{Time: tc.deletedAt}
+			}
+			objects := []runtime.Object{}
+			if tc.hostState != "" {
+				host := &bmo.BareMetalHost{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "host0",
+						Namespace: "myns",
+					},
+					Spec: tc.hostSpec,
+					Status: bmo.BareMetalHostStatus{
+						Provisioning: bmo.ProvisionStatus{
+							State: tc.hostState,
+						},
+					},
+				}
+				if tc.hostError {
+					host.Status.OperationalStatus = bmo.OperationalStatusError
+				}
+				objects = append(objects, host)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupScheme(), objects...)
+			dataMgr, err := NewDataManager(c, m3d, klogr.New())
+			Expect(err).NotTo(HaveOccurred())
+
+			err = dataMgr.WaitForHost(context.TODO())
+			if tc.expectRequeue {
+				Expect(err).To(BeAssignableToTypeOf(&RequeueAfterError{}))
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(Contains(m3d.Finalizers, infrav1.WaitForBMOFinalizer)).To(
+				Equal(tc.expectFinalizer),
+			)
+			Expect(Contains(m3d.Finalizers, infrav1.DataFinalizer)).To(BeTrue())
+		},
+		Entry("No finalizer", testCaseWaitForHost{
+			finalizers: []string{infrav1.DataFinalizer},
+		}),
+		Entry("Host deprovisioning", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation:  "myns/host0",
+			hostState:       bmo.StateDeprovisioning,
+			hostSpec:        consumedHost,
+			expectRequeue:   true,
+			expectFinalizer: true,
+		}),
+		Entry("Host deprovisioning, skip annotation", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation: "myns/host0",
+			skipAnnotation: true,
+			hostState:      bmo.StateDeprovisioning,
+			hostSpec:       consumedHost,
+		}),
+		Entry("Host deprovisioning, timed out", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation: "myns/host0",
+			deletedAt:      time.Now().Add(-2 * time.Hour),
+			hostState:      bmo.StateDeprovisioning,
+			hostSpec:       consumedHost,
+		}),
+		Entry("Host deprovisioning, recently deleted", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation:  "myns/host0",
+			deletedAt:       time.Now(),
+			hostState:       bmo.StateDeprovisioning,
+			hostSpec:        consumedHost,
+			expectRequeue:   true,
+			expectFinalizer: true,
+		}),
+		Entry("Host consumed by another machine", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation: "myns/host0",
+			hostState:      bmo.StateProvisioning,
+			hostSpec: bmo.BareMetalHostSpec{
+				ConsumerRef: &corev1.ObjectReference{
+					Kind: "Metal3Machine",
+					Name: "machine1",
+				},
+			},
+		}),
+		Entry("Host not consumed", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation: "myns/host0",
+			hostState:      bmo.StateDeprovisioning,
+		}),
+		Entry("Host in error", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation: "myns/host0",
+			hostState:      bmo.StateDeprovisioning,
+			hostSpec:       consumedHost,
+			hostError:      true,
+		}),
+		Entry("Host externally provisioned", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation: "myns/host0",
+			hostState:      bmo.StateExternallyProvisioned,
+			hostSpec:       consumedHost,
+		}),
+		Entry("Host available", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation: "myns/host0",
+			hostState:      bmo.StateAvailable,
+		}),
+		Entry("Host ready", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation: "myns/host0",
+			hostState:      bmo.StateReady,
+		}),
+		Entry("Host gone", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+			hostAnnotation: "myns/host0",
+		}),
+		Entry("No host recorded", testCaseWaitForHost{
+			finalizers: []string{
+				infrav1.DataFinalizer, infrav1.WaitForBMOFinalizer,
+			},
+		}),
+	)
+
 	type testCaseGetAddressesFromPool struct {
 		m3dtSpec      infrav1.Metal3DataTemplateSpec
 		ipClaims      []string
@@ -1480,6 +1666,19 @@ var _ = Describe("Metal3Data manager", func() {
 		expectedOutput map[string][]interface{}
 	}
 
+	inlineNetworkConfigBMH := &bmo.BareMetalHost{
+		Status: bmo.BareMetalHostStatus{
+			HardwareDetails: &bmo.HardwareDetails{
+				NIC: []bmo.NIC{
+					{
+						Name: "eth0",
+						MAC:  "XX:XX:XX:XX:XX:XX",
+					},
+				},
+			},
+		},
+	}
+
 	DescribeTable("Test renderNetworkData",
 		func(tc testCaseRenderNetworkData) {
 			result, err := renderNetworkData(tc.m3d, tc.m3dt, tc.bmh, tc.poolAddresses)
@@ -1648,6 +1847,164 @@ var _ = Describe("Metal3Data manager", func() {
 			},
 			expectedOutput: map[string][]interface{}{},
 		}),
+		Entry("Inline network config", testCaseRenderNetworkData{
+			m3d: &infrav1.Metal3Data{
+				Spec: infrav1.Metal3DataSpec{
+					Index: 2,
+				},
+			},
+			m3dt: &infrav1.Metal3DataTemplate{
+				Spec: infrav1.Metal3DataTemplateSpec{
+					InlineNetworkConfig: &infrav1.NetworkConfigSpec{
+						Interface: "eth0",
+						CIDR:      "192.168.0.0/24",
+						Gateway:   (*ipamv1.IPAddressStr)(pointer.StringPtr("192.168.0.254")),
+						DNS:       []ipamv1.IPAddressStr{"8.8.8.8"},
+						VLAN:      100,
+					},
+				},
+			},
+			bmh: inlineNetworkConfigBMH,
+			expectedOutput: map[string][]interface{}{
+				"services": {
+					map[interface{}]interface{}{
+						"type":    "dns",
+						"address": "8.8.8.8",
+					},
+				},
+				"links": {
+					map[interface{}]interface{}{
+						"type":                 "phy",
+						"id":                   "eth0",
+						"ethernet_mac_address": "XX:XX:XX:XX:XX:XX",
+					},
+					map[interface{}]interface{}{
+						"type":             "vlan",
+						"id":               "eth0.100",
+						"vlan_mac_address": "XX:XX:XX:XX:XX:XX",
+						"vlan_id":          100,
+						"vlan_link":        "eth0",
+					},
+				},
+				"networks": {
+					map[interface{}]interface{}{
+						"ip_address": "192.168.0.3",
+						"routes": []interface{}{
+							map[interface{}]interface{}{
+								"network": "0.0.0.0",
+								"netmask": "0.0.0.0",
+								"gateway": "192.168.0.254",
+							},
+						},
+						"type":    "ipv4",
+						"id":      "eth0.100",
+						"link":    "eth0.100",
+						"netmask": "255.255.255.0",
+					},
+				},
+			},
+		}),
+		Entry("Inline network config, IPv6 without VLAN", testCaseRenderNetworkData{
+			m3d: &infrav1.Metal3Data{
+				Spec: infrav1.Metal3DataSpec{
+					Index: 0,
+				},
+			},
+			m3dt: &infrav1.Metal3DataTemplate{
+				Spec: infrav1.Metal3DataTemplateSpec{
+					InlineNetworkConfig: &infrav1.NetworkConfigSpec{
+						Interface: "eth0",
+						CIDR:      "2001::/64",
+					},
+				},
+			},
+			bmh: inlineNetworkConfigBMH,
+			expectedOutput: map[string][]interface{}{
+				"services": {},
+				"links": {
+					map[interface{}]interface{}{
+						"type":                 "phy",
+						"id":                   "eth0",
+						"ethernet_mac_address": "XX:XX:XX:XX:XX:XX",
+					},
+				},
+				"networks": {
+					map[interface{}]interface{}{
+						"ip_address": "2001::1",
+						"routes":     []interface{}{},
+						"type":       "ipv6",
+						"id":         "eth0",
+						"link":       "eth0",
+						"netmask":    "ffff:ffff:ffff:ffff::",
+					},
+				},
+			},
+		}),
+		Entry("Inline network config, index out of the subnet", testCaseRenderNetworkData{
+			m3d: &infrav1.Metal3Data{
+				Spec: infrav1.Metal3DataSpec{
+					Index: 4,
+				},
+			},
+			m3dt: &infrav1.Metal3DataTemplate{
+				Spec: infrav1.Metal3DataTemplateSpec{
+					InlineNetworkConfig: &infrav1.NetworkConfigSpec{
+						Interface: "eth0",
+						CIDR:      "192.168.0.0/30",
+					},
+				},
+			},
+			bmh:         inlineNetworkConfigBMH,
+			expectError: true,
+		}),
+		Entry("Inline network config, index on the broadcast address", testCaseRenderNetworkData{
+			m3d: &infrav1.Metal3Data{
+				Spec: infrav1.Metal3DataSpec{
+					Index: 2,
+				},
+			},
+			m3dt: &infrav1.Metal3DataTemplate{
+				Spec: infrav1.Metal3DataTemplateSpec{
+					InlineNetworkConfig: &infrav1.NetworkConfigSpec{
+						Interface: "eth0",
+						CIDR:      "192.168.0.0/30",
+					},
+				},
+			},
+			bmh:         inlineNetworkConfigBMH,
+			expectError: true,
+		}),
+		Entry("Inline network config, index on the gateway", testCaseRenderNetworkData{
+			m3d: &infrav1.Metal3Data{
+				Spec: infrav1.Metal3DataSpec{
+					Index: 253,
+				},
+			},
+			m3dt: &infrav1.Metal3DataTemplate{
+				Spec: infrav1.Metal3DataTemplateSpec{
+					InlineNetworkConfig: &infrav1.NetworkConfigSpec{
+						Interface: "eth0",
+						CIDR:      "192.168.0.0/24",
+						Gateway:   (*ipamv1.IPAddressStr)(pointer.StringPtr("192.168.0.254")),
+					},
+				},
+			},
+			bmh:         inlineNetworkConfigBMH,
+			expectError: true,
+		}),
+		Entry("Inline network config, unknown interface", testCaseRenderNetworkData{
+			m3d: &infrav1.Metal3Data{},
+			m3dt: &infrav1.Metal3DataTemplate{
+				Spec: infrav1.Metal3DataTemplateSpec{
+					InlineNetworkConfig: &infrav1.NetworkConfigSpec{
+						Interface: "eth1",
+						CIDR:      "192.168.0.0/24",
+					},
+				},
+			},
+			bmh:         inlineNetworkConfigBMH,
+			expectError: true,
+		}),
 	)
 
 	It("Test renderNetworkServices", func() {
@@ -0,0 +1,139 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// alertmanagerAlertName is the alertname label of the alerts sent to the
+// AlertmanagerWebhook
+const alertmanagerAlertName = "Metal3DataTemplateReconcileFailing"
+
+// AlertmanagerAlert is an alert of the Alertmanager API, a list of them is
+// sent to the AlertmanagerWebhook of a Metal3DataTemplate
+type AlertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    *metav1.Time      `json:"startsAt,omitempty"`
+	EndsAt      *metav1.Time      `json:"endsAt,omitempty"`
+}
+
+// alertmanagerClient is the HTTP client used to send the alerts to the
+// AlertmanagerWebhooks. The alerts are sent during the reconciliation, so
+// its timeout is short to not hold the worker.
+var alertmanagerClient = newWebhookClient(2 * time.Second)
+
+// updateAlert tracks the consecutive failures of UpdateDatas in the status.
+// When they last longer than the FireAfterDuration of the
+// AlertmanagerWebhook, an alert is sent, and it is resolved after the next
+// success. A requeue is not a failure. A failure to send an alert is only
+// logged, and it is sent again on the next reconciliation.
+func (m *DataTemplateManager) updateAlert(ctx context.Context, err error) {
+	if _, ok := errors.Cause(err).(HasRequeueAfterError); ok {
+		return
+	}
+	status := &m.DataTemplate.Status
+	alertmanagerWebhook := m.DataTemplate.Spec.AlertmanagerWebhook
+	now := metav1.Now()
+
+	if err == nil {
+		status.FailingSince = nil
+		if !status.AlertFiring {
+			return
+		}
+		if alertmanagerWebhook != nil {
+			alert := m.newAlertmanagerAlert(ctx, "")
+			alert.EndsAt = &now
+			if err := m.sendAlert(alertmanagerWebhook.URL, alert); err != nil {
+				m.Log.Info("Failed to resolve the alert", "cluster",
+					clusterNameFromContext(ctx), "error", err.Error(),
+				)
+				return
+			}
+		}
+		status.AlertFiring = false
+		return
+	}
+
+	if status.FailingSince == nil {
+		status.FailingSince = &now
+	}
+	if alertmanagerWebhook == nil {
+		return
+	}
+	if alertmanagerWebhook.FireAfterDuration != nil &&
+		now.Sub(status.FailingSince.Time) < alertmanagerWebhook.FireAfterDuration.Duration {
+		return
+	}
+	alert := m.newAlertmanagerAlert(ctx, err.Error())
+	alert.StartsAt = status.FailingSince
+	if err := m.sendAlert(alertmanagerWebhook.URL, alert); err != nil {
+		m.Log.Info("Failed to send the alert", "cluster",
+			clusterNameFromContext(ctx), "error", err.Error(),
+		)
+		return
+	}
+	status.AlertFiring = true
+}
+
+// newAlertmanagerAlert returns the alert of the Metal3DataTemplate, with the
+// labels of the AlertmanagerWebhook
+func (m *DataTemplateManager) newAlertmanagerAlert(ctx context.Context,
+	description string,
+) AlertmanagerAlert {
+	alert := AlertmanagerAlert{
+		Labels: map[string]string{
+			"alertname":          alertmanagerAlertName,
+			"namespace":          m.DataTemplate.Namespace,
+			"metal3datatemplate": m.DataTemplate.Name,
+		},
+	}
+	if clusterName := clusterNameFromContext(ctx); clusterName != "" {
+		alert.Labels["cluster"] = clusterName
+	}
+	for key, value := range m.DataTemplate.Spec.AlertmanagerWebhook.Labels {
+		alert.Labels[key] = value
+	}
+	if description != "" {
+		alert.Annotations = map[string]string{"description": description}
+	}
+	return alert
+}
+
+// sendAlert posts the alert to the alerts API of an Alertmanager
+func (m *DataTemplateManager) sendAlert(url string, alert AlertmanagerAlert) error {
+	body, err := json.Marshal([]AlertmanagerAlert{alert})
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the alert")
+	}
+	resp, err := alertmanagerClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Failed to send the alert")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("Alertmanager returned %s", resp.Status)
+	}
+	return nil
+}
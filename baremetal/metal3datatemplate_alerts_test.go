@@ -0,0 +1,115 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/klogr"
+)
+
+var _ = Describe("Metal3DataTemplate alerts", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	It("Sends alerts to the Alertmanager", func() {
+		alerts := make(chan AlertmanagerAlert, 10)
+		serverStatus := http.StatusOK
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				received := []AlertmanagerAlert{}
+				Expect(json.NewDecoder(r.Body).Decode(&received)).To(Succeed())
+				Expect(received).To(HaveLen(1))
+				alerts <- received[0]
+				w.WriteHeader(serverStatus)
+			},
+		))
+		defer server.Close()
+
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				AlertmanagerWebhook: &infrav1.AlertmanagerWebhookSpec{
+					URL:               server.URL,
+					Labels:            map[string]string{"severity": "page"},
+					FireAfterDuration: &metav1.Duration{Duration: time.Minute},
+				},
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(nil, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		ctx := WithClusterName(context.TODO(), "cluster1")
+
+		// A requeue is not a failure
+		templateMgr.updateAlert(ctx, &RequeueAfterError{})
+		Expect(template.Status.FailingSince).To(BeNil())
+
+		// The failure did not last long enough
+		templateMgr.updateAlert(ctx, errors.New("Failed to create Metal3Data"))
+		Expect(template.Status.FailingSince).NotTo(BeNil())
+		Expect(template.Status.AlertFiring).To(BeFalse())
+		Expect(alerts).NotTo(Receive())
+
+		failingSince := metav1.NewTime(time.Now().Add(-2 * time.Minute).Truncate(time.Second))
+		template.Status.FailingSince = &failingSince
+		serverStatus = http.StatusInternalServerError
+		templateMgr.updateAlert(ctx, errors.New("Failed to create Metal3Data"))
+		Expect(template.Status.AlertFiring).To(BeFalse())
+		Expect(alerts).To(Receive())
+
+		serverStatus = http.StatusOK
+		templateMgr.updateAlert(ctx, errors.New("Failed to create Metal3Data"))
+		Expect(template.Status.AlertFiring).To(BeTrue())
+		alert := AlertmanagerAlert{}
+		Expect(alerts).To(Receive(&alert))
+		Expect(alert.Labels).To(Equal(map[string]string{
+			"alertname":          "Metal3DataTemplateReconcileFailing",
+			"namespace":          "myns",
+			"metal3datatemplate": "abc",
+			"cluster":            "cluster1",
+			"severity":           "page",
+		}))
+		Expect(alert.Annotations).To(Equal(map[string]string{
+			"description": "Failed to create Metal3Data",
+		}))
+		Expect(alert.StartsAt.Equal(&failingSince)).To(BeTrue())
+		Expect(alert.EndsAt).To(BeNil())
+
+		templateMgr.updateAlert(ctx, nil)
+		Expect(template.Status.FailingSince).To(BeNil())
+		Expect(template.Status.AlertFiring).To(BeFalse())
+		Expect(alerts).To(Receive(&alert))
+		Expect(alert.EndsAt).NotTo(BeNil())
+		Expect(alert.Annotations).To(BeEmpty())
+
+		// Nothing to resolve
+		templateMgr.updateAlert(ctx, nil)
+		Expect(alerts).NotTo(Receive())
+	})
+})
@@ -0,0 +1,111 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// CompileAllocationCondition compiles the AllocationCondition of a
+// Metal3DataTemplate. The program expects the Metal3Machine, as an
+// unstructured object, in the machine variable.
+func CompileAllocationCondition(condition string) (cel.Program, error) {
+	env, err := cel.NewEnv(cel.Declarations(
+		decls.NewVar("machine", decls.NewMapType(decls.String, decls.Dyn)),
+	))
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(condition)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	return env.Program(ast)
+}
+
+// allocationConditionProgram is the AllocationCondition of a generation of a
+// Metal3DataTemplate, compiled
+type allocationConditionProgram struct {
+	generation int64
+	condition  string
+	program    cel.Program
+}
+
+// allocationConditionPrograms holds the allocationConditionProgram of each
+// Metal3DataTemplate, by namespaced name, so that the condition is only
+// compiled again when the spec changes
+var allocationConditionPrograms sync.Map
+
+// allocationConditionProgram returns the compiled AllocationCondition of the
+// Metal3DataTemplate, from the cache if its generation was already compiled
+func (m *DataTemplateManager) allocationConditionProgram() (cel.Program, error) {
+	key := types.NamespacedName{
+		Name:      m.DataTemplate.Name,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if value, ok := allocationConditionPrograms.Load(key); ok {
+		cached := value.(*allocationConditionProgram)
+		if cached.generation == m.DataTemplate.Generation &&
+			cached.condition == m.DataTemplate.Spec.AllocationCondition {
+			return cached.program, nil
+		}
+	}
+	program, err := CompileAllocationCondition(m.DataTemplate.Spec.AllocationCondition)
+	if err != nil {
+		return nil, err
+	}
+	allocationConditionPrograms.Store(key, &allocationConditionProgram{
+		generation: m.DataTemplate.Generation,
+		condition:  m.DataTemplate.Spec.AllocationCondition,
+		program:    program,
+	})
+	return program, nil
+}
+
+// machineMatchesCondition evaluates the AllocationCondition against the
+// Metal3Machine
+func (m *DataTemplateManager) machineMatchesCondition(m3m *capm3.Metal3Machine,
+) (bool, error) {
+	program, err := m.allocationConditionProgram()
+	if err != nil {
+		return false, errors.Wrap(err, "invalid allocationCondition")
+	}
+
+	machine, err := runtime.DefaultUnstructuredConverter.ToUnstructured(m3m)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to convert the Metal3Machine")
+	}
+
+	result, _, err := program.Eval(map[string]interface{}{"machine": machine})
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to evaluate the allocationCondition")
+	}
+	matches, ok := result.Value().(bool)
+	if !ok {
+		return false, errors.Errorf("allocationCondition returned %v instead of a boolean",
+			result.Value(),
+		)
+	}
+	return matches, nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/klogr"
+)
+
+var _ = Describe("Metal3DataTemplate allocation condition", func() {
+	It("Test allocationConditionProgram", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       "condition",
+				Namespace:  "myns",
+				Generation: 1,
+			},
+			Spec: infrav1.Metal3DataTemplateSpec{
+				AllocationCondition: "true",
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(nil, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		program, err := templateMgr.allocationConditionProgram()
+		Expect(err).NotTo(HaveOccurred())
+		cachedProgram, err := templateMgr.allocationConditionProgram()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cachedProgram).To(BeIdenticalTo(program))
+
+		// A new generation is compiled again
+		template.Generation = 2
+		template.Spec.AllocationCondition = "machine.metadata.name =="
+		_, err = templateMgr.allocationConditionProgram()
+		Expect(err).To(HaveOccurred())
+		template.Spec.AllocationCondition = "false"
+		cachedProgram, err = templateMgr.allocationConditionProgram()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cachedProgram).NotTo(BeIdenticalTo(program))
+
+		templateMgr.UnsetFinalizer()
+		_, ok := allocationConditionPrograms.Load(types.NamespacedName{
+			Name: "condition", Namespace: "myns",
+		})
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,160 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AllocationNotification is the payload sent to the allocation webhook of a
+// Metal3DataTemplate
+type AllocationNotification struct {
+	Template    string `json:"template"`
+	MachineName string `json:"machineName"`
+	Index       int    `json:"index"`
+	DataName    string `json:"dataName"`
+}
+
+// allocationWebhookClient is the HTTP client used to notify the allocation
+// webhooks
+var allocationWebhookClient = newWebhookClient(10 * time.Second)
+
+// notifyAllocation sends the notification to the allocation webhook, if any.
+// Unless RetryOnFailure is set, the request is sent asynchronously and the
+// failures are only logged. Otherwise, a failure is returned and the claim is
+// annotated so that the notification is sent again on the next reconcile.
+func (m *DataTemplateManager) notifyAllocation(ctx context.Context,
+	dataClaim *capm3.Metal3DataClaim, notification AllocationNotification,
+) error {
+	allocationWebhook := m.DataTemplate.Spec.AllocationWebhook
+	if allocationWebhook == nil {
+		delete(dataClaim.Annotations, AllocationNotificationPendingAnnotation)
+		return nil
+	}
+
+	req, err := m.newAllocationRequest(ctx, notification)
+	if err == nil && !allocationWebhook.RetryOnFailure {
+		claimName := dataClaim.Name
+		go func() {
+			if err := sendAllocationRequest(req); err != nil {
+				m.Log.Info("Failed to notify the allocation webhook",
+					"cluster", clusterNameFromContext(ctx),
+					"Claim", claimName, "error", err.Error(),
+				)
+			}
+		}()
+		return nil
+	}
+	if err == nil {
+		err = sendAllocationRequest(req.WithContext(ctx))
+	}
+
+	if err != nil {
+		m.Log.Info("Failed to notify the allocation webhook",
+			"cluster", clusterNameFromContext(ctx),
+			"Claim", dataClaim.Name, "error", err.Error(),
+		)
+		if !allocationWebhook.RetryOnFailure {
+			return nil
+		}
+		if dataClaim.Annotations == nil {
+			dataClaim.Annotations = make(map[string]string)
+		}
+		dataClaim.Annotations[AllocationNotificationPendingAnnotation] = "true"
+		dataClaim.Status.ErrorMessage = pointer.StringPtr(
+			"Failed to notify the allocation webhook",
+		)
+		return &notificationError{err: err}
+	}
+	delete(dataClaim.Annotations, AllocationNotificationPendingAnnotation)
+	return nil
+}
+
+// newAllocationRequest builds the request to the allocation webhook, with the
+// token of the referenced Secret as bearer token
+func (m *DataTemplateManager) newAllocationRequest(ctx context.Context,
+	notification AllocationNotification,
+) (*http.Request, error) {
+	allocationWebhook := m.DataTemplate.Spec.AllocationWebhook
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal the allocation notification")
+	}
+
+	method := allocationWebhook.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, allocationWebhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create the allocation request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if allocationWebhook.SecretRef != nil {
+		secret := &corev1.Secret{}
+		key := client.ObjectKey{
+			Name:      allocationWebhook.SecretRef.Name,
+			Namespace: m.DataTemplate.Namespace,
+		}
+		if err := m.client.Get(ctx, key, secret); err != nil {
+			return nil, errors.Wrap(err, "Failed to get the allocation webhook secret")
+		}
+		token, ok := secret.Data[AllocationWebhookTokenKey]
+		if !ok {
+			return nil, errors.Errorf("Allocation webhook secret %s has no %s key",
+				key.Name, AllocationWebhookTokenKey,
+			)
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+	}
+	return req, nil
+}
+
+// notificationError is returned when the allocation webhook could not be
+// notified and RetryOnFailure is set
+type notificationError struct {
+	err error
+}
+
+func (e *notificationError) Error() string {
+	return e.err.Error()
+}
+
+// sendAllocationRequest sends the request and checks the response status
+func sendAllocationRequest(req *http.Request) error {
+	resp, err := allocationWebhookClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Failed to send the allocation notification")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("Allocation webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Metal3DataTemplate allocation webhook", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	type testCaseNotifyAllocation struct {
+		noWebhook        bool
+		retryOnFailure   bool
+		serverStatus     int
+		expectError      bool
+		expectRequest    bool
+		expectAnnotation bool
+		claimAnnotations map[string]string
+	}
+
+	DescribeTable("Test notifyAllocation",
+		func(tc testCaseNotifyAllocation) {
+			requests := make(chan *http.Request, 1)
+			bodies := make(chan AllocationNotification, 1)
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					notification := AllocationNotification{}
+					Expect(json.NewDecoder(r.Body).Decode(&notification)).To(Succeed())
+					requests <- r
+					bodies <- notification
+					w.WriteHeader(tc.serverStatus)
+				},
+			))
+			defer server.Close()
+
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "abc",
+					Namespace: "myns",
+				},
+			}
+			if !tc.noWebhook {
+				template.Spec.AllocationWebhook = &infrav1.AllocationWebhookSpec{
+					URL: server.URL,
+					SecretRef: &corev1.LocalObjectReference{
+						Name: "webhook-auth",
+					},
+					RetryOnFailure: tc.retryOnFailure,
+				}
+			}
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "webhook-auth",
+					Namespace: "myns",
+				},
+				Data: map[string][]byte{
+					"token":   []byte("secret-token"),
+					"X-Other": []byte("ignored"),
+				},
+			}
+			dataClaim := &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "machine1",
+					Namespace:   "myns",
+					Annotations: tc.claimAnnotations,
+				},
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), secret)
+			templateMgr, err := NewDataTemplateManager(c, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = templateMgr.notifyAllocation(context.TODO(), dataClaim,
+				AllocationNotification{
+					Template:    "abc",
+					MachineName: "machine1",
+					Index:       3,
+					DataName:    "abc-3",
+				},
+			)
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+			if tc.expectAnnotation {
+				Expect(dataClaim.Annotations).To(HaveKey(AllocationNotificationPendingAnnotation))
+			} else {
+				Expect(dataClaim.Annotations).NotTo(HaveKey(AllocationNotificationPendingAnnotation))
+			}
+
+			if !tc.expectRequest {
+				Consistently(requests, 100*time.Millisecond).ShouldNot(Receive())
+				return
+			}
+			var req *http.Request
+			Eventually(requests).Should(Receive(&req))
+			Expect(req.Method).To(Equal(http.MethodPost))
+			Expect(req.Header.Get("Authorization")).To(Equal("Bearer secret-token"))
+			Expect(req.Header.Get("X-Other")).To(BeEmpty())
+			Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+			Expect(bodies).To(Receive(Equal(AllocationNotification{
+				Template:    "abc",
+				MachineName: "machine1",
+				Index:       3,
+				DataName:    "abc-3",
+			})))
+		},
+		Entry("No webhook", testCaseNotifyAllocation{
+			noWebhook: true,
+			claimAnnotations: map[string]string{
+				AllocationNotificationPendingAnnotation: "true",
+			},
+		}),
+		Entry("Asynchronous", testCaseNotifyAllocation{
+			serverStatus:  http.StatusOK,
+			expectRequest: true,
+		}),
+		Entry("Asynchronous, failure ignored", testCaseNotifyAllocation{
+			serverStatus:  http.StatusInternalServerError,
+			expectRequest: true,
+		}),
+		Entry("Retry on failure, success", testCaseNotifyAllocation{
+			retryOnFailure: true,
+			serverStatus:   http.StatusNoContent,
+			expectRequest:  true,
+			claimAnnotations: map[string]string{
+				AllocationNotificationPendingAnnotation: "true",
+			},
+		}),
+		Entry("Retry on failure, failure", testCaseNotifyAllocation{
+			retryOnFailure:   true,
+			serverStatus:     http.StatusInternalServerError,
+			expectRequest:    true,
+			expectError:      true,
+			expectAnnotation: true,
+		}),
+	)
+
+	It("Allocates the other claims when a notification fails", func() {
+		serverStatus := http.StatusInternalServerError
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(serverStatus)
+			},
+		))
+		defer server.Close()
+
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				AllocationWebhook: &infrav1.AllocationWebhookSpec{
+					URL:            server.URL,
+					RetryOnFailure: true,
+				},
+			},
+		}
+		objects := []runtime.Object{template.DeepCopy()}
+		for _, name := range []string{"machine-0", "machine-1"} {
+			objects = append(objects, &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: "myns",
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: infrav1.GroupVersion.String(),
+							Kind:       "Metal3Machine",
+							Name:       name,
+						},
+					},
+				},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: "abc"},
+				},
+			})
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).To(MatchError(ContainSubstring("500 Internal Server Error")))
+		Expect(template.Status.Indexes).To(HaveLen(2))
+		for _, name := range []string{"machine-0", "machine-1"} {
+			dataClaim := &infrav1.Metal3DataClaim{}
+			key := client.ObjectKey{Name: name, Namespace: "myns"}
+			Expect(c.Get(context.TODO(), key, dataClaim)).To(Succeed())
+			Expect(dataClaim.Annotations).To(HaveKey(AllocationNotificationPendingAnnotation))
+			Expect(dataClaim.Status.RenderedData).NotTo(BeNil())
+		}
+
+		// The pending notifications are sent on the next reconciliation
+		serverStatus = http.StatusOK
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		for _, name := range []string{"machine-0", "machine-1"} {
+			dataClaim := &infrav1.Metal3DataClaim{}
+			key := client.ObjectKey{Name: name, Namespace: "myns"}
+			Expect(c.Get(context.TODO(), key, dataClaim)).To(Succeed())
+			Expect(dataClaim.Annotations).NotTo(HaveKey(AllocationNotificationPendingAnnotation))
+		}
+	})
+})
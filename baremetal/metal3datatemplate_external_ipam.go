@@ -0,0 +1,153 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExternalIPAMRequest is the payload sent to the ExternalIPAMSync API of a
+// Metal3DataTemplate to claim or release the address of an index. It is
+// also the data of the PathTemplate.
+type ExternalIPAMRequest struct {
+	IP          string `json:"ip"`
+	Index       int    `json:"index"`
+	MachineName string `json:"machineName"`
+	Template    string `json:"template"`
+	ClusterName string `json:"clusterName"`
+}
+
+// externalIPAMClient is the HTTP client used to claim and release the
+// addresses in the ExternalIPAMSync APIs
+var externalIPAMClient = newWebhookClient(10 * time.Second)
+
+// syncExternalIPAM claims, with the POST method, or releases, with the
+// DELETE method, the address of the index in the ExternalIPAMSync API, if
+// any. The request is sent to the URL followed by the rendered PathTemplate,
+// with the token of the AuthSecretRef Secret as bearer token. An address
+// unknown to the IPAM is considered released.
+func (m *DataTemplateManager) syncExternalIPAM(ctx context.Context,
+	method string, index int, machineName string,
+) error {
+	externalIPAMSync := m.DataTemplate.Spec.ExternalIPAMSync
+	if externalIPAMSync == nil {
+		return nil
+	}
+	ip, err := m.externalIPAMAddress(index)
+	if err != nil {
+		return err
+	}
+	ipamRequest := ExternalIPAMRequest{
+		IP:          ip,
+		Index:       index,
+		MachineName: machineName,
+		Template:    m.DataTemplate.Name,
+		ClusterName: m.DataTemplate.Spec.ClusterName,
+	}
+
+	pathTemplate, err := template.New("path").Parse(externalIPAMSync.PathTemplate)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse the external IPAM path template")
+	}
+	var path bytes.Buffer
+	if err := pathTemplate.Execute(&path, ipamRequest); err != nil {
+		return errors.Wrap(err, "Failed to render the external IPAM path template")
+	}
+	body, err := json.Marshal(ipamRequest)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the external IPAM request")
+	}
+	req, err := http.NewRequest(method,
+		strings.TrimSuffix(externalIPAMSync.URL, "/")+path.String(),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create the external IPAM request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if externalIPAMSync.AuthSecretRef != nil {
+		secret, err := checkSecretExists(m.client, ctx,
+			externalIPAMSync.AuthSecretRef.Name, m.DataTemplate.Namespace,
+		)
+		if err != nil {
+			return errors.Wrap(err, "Failed to get the external IPAM secret")
+		}
+		token, ok := secret.Data[ExternalIPAMTokenKey]
+		if !ok {
+			return errors.Errorf("External IPAM secret %s has no %s key",
+				secret.Name, ExternalIPAMTokenKey,
+			)
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+	}
+
+	resp, err := externalIPAMClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "Failed to send the external IPAM request")
+	}
+	defer resp.Body.Close()
+	if method == http.MethodDelete && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("External IPAM returned %s for %s %s", resp.Status,
+			method, ip,
+		)
+	}
+	m.Log.Info("Synchronized the external IPAM",
+		"cluster", clusterNameFromContext(ctx),
+		"method", method, "ip", ip, "index", index,
+	)
+	return nil
+}
+
+// rollbackExternalIPAMClaim releases the address claimed for an index whose
+// Metal3Data could not be created. A failure is only logged, the claim being
+// sent again on the next reconciliation.
+func (m *DataTemplateManager) rollbackExternalIPAMClaim(ctx context.Context,
+	index int, machineName string,
+) {
+	if err := m.syncExternalIPAM(ctx, http.MethodDelete, index, machineName); err != nil {
+		m.Log.Info("Failed to release the address in the external IPAM",
+			"cluster", clusterNameFromContext(ctx),
+			"index", index, "error", err.Error(),
+		)
+	}
+}
+
+// externalIPAMAddress returns the address of the index in the
+// InlineNetworkConfig, as rendered in the network data
+func (m *DataTemplateManager) externalIPAMAddress(index int) (string, error) {
+	networkConfig := m.DataTemplate.Spec.InlineNetworkConfig
+	if networkConfig == nil {
+		return "", errors.New("No inlineNetworkConfig set for the external IPAM")
+	}
+	hostIP, _, err := inlineNetworkHostIP(*networkConfig, index)
+	if err != nil {
+		return "", errors.Wrap(err, "Invalid inlineNetworkConfig address")
+	}
+	return hostIP.String(), nil
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/klogr"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Metal3DataTemplate external IPAM", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	It("Synchronizes the external IPAM", func() {
+		requests := make(chan string, 10)
+		serverStatus := http.StatusInternalServerError
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				request := ExternalIPAMRequest{}
+				Expect(json.NewDecoder(r.Body).Decode(&request)).To(Succeed())
+				Expect(request.MachineName).To(Equal("machine-0"))
+				Expect(r.Header.Get("Authorization")).To(Equal("Bearer secret"))
+				requests <- r.Method + " " + r.URL.Path
+				w.WriteHeader(serverStatus)
+			},
+		))
+		defer server.Close()
+
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				InlineNetworkConfig: &infrav1.NetworkConfigSpec{
+					Interface: "eth0",
+					CIDR:      "192.168.0.0/24",
+				},
+				ExternalIPAMSync: &infrav1.ExternalIPAMSyncSpec{
+					URL:           server.URL + "/",
+					AuthSecretRef: &corev1.LocalObjectReference{Name: "ipam"},
+					PathTemplate:  "/api/v1/ips/{{.IP}}",
+				},
+			},
+		}
+		dataClaim := &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: infrav1.GroupVersion.String(),
+						Kind:       "Metal3Machine",
+						Name:       "machine-0",
+					},
+				},
+			},
+			Spec: infrav1.Metal3DataClaimSpec{
+				Template: corev1.ObjectReference{Name: "abc"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			dataClaim,
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "ipam",
+					Namespace: "myns",
+				},
+				Data: map[string][]byte{"token": []byte("secret")},
+			},
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		dataKey := client.ObjectKey{Name: "abc-0", Namespace: "myns"}
+
+		// A failed claim does not allocate the index
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).To(MatchError(ContainSubstring("500 Internal Server Error")))
+		Expect(requests).To(Receive(Equal("POST /api/v1/ips/192.168.0.1")))
+		Expect(template.Status.Indexes).To(BeEmpty())
+		Expect(c.Get(context.TODO(), dataKey, &infrav1.Metal3Data{})).NotTo(Succeed())
+
+		serverStatus = http.StatusCreated
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(Receive(Equal("POST /api/v1/ips/192.168.0.1")))
+		Expect(indexesOf(template.Status.Indexes)).To(Equal(map[string]int{"machine-0": 0}))
+		Expect(c.Get(context.TODO(), dataKey, &infrav1.Metal3Data{})).To(Succeed())
+
+		// A failed release keeps the index and its Metal3Data
+		savedClaim := &infrav1.Metal3DataClaim{}
+		claimKey := client.ObjectKey{Name: "machine-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), claimKey, savedClaim)).To(Succeed())
+		now := metav1.Now()
+		savedClaim.DeletionTimestamp = &now
+		Expect(c.Update(context.TODO(), savedClaim)).To(Succeed())
+		serverStatus = http.StatusBadGateway
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).To(MatchError(ContainSubstring("502 Bad Gateway")))
+		Expect(requests).To(Receive(Equal("DELETE /api/v1/ips/192.168.0.1")))
+		Expect(indexesOf(template.Status.Indexes)).To(Equal(map[string]int{"machine-0": 0}))
+		Expect(c.Get(context.TODO(), dataKey, &infrav1.Metal3Data{})).To(Succeed())
+
+		serverStatus = http.StatusNoContent
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(Receive(Equal("DELETE /api/v1/ips/192.168.0.1")))
+		Expect(template.Status.Indexes).To(BeEmpty())
+		Expect(c.Get(context.TODO(), dataKey, &infrav1.Metal3Data{})).NotTo(Succeed())
+	})
+
+	It("Test externalIPAMAddress", func() {
+		templateMgr, err := NewDataTemplateManager(nil, &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				InlineNetworkConfig: &infrav1.NetworkConfigSpec{
+					Interface: "eth0",
+					CIDR:      "192.168.0.0/29",
+					Gateway:   (*ipamv1.IPAddressStr)(pointer.StringPtr("192.168.0.1")),
+				},
+			},
+		}, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(templateMgr.externalIPAMAddress(1)).To(Equal("192.168.0.2"))
+		Expect(templateMgr.externalIPAMAddress(5)).To(Equal("192.168.0.6"))
+		// The gateway, the broadcast address and the addresses out of the
+		// subnet are not claimed
+		for _, index := range []int{0, 6, 7} {
+			_, err := templateMgr.externalIPAMAddress(index)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("Releases the external IPAM address only when it is not used", func() {
+		requests := make(chan string, 10)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				requests <- r.Method + " " + r.URL.Path
+				if r.Method == http.MethodDelete {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			},
+		))
+		defer server.Close()
+
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				InlineNetworkConfig: &infrav1.NetworkConfigSpec{
+					Interface: "eth0",
+					CIDR:      "192.168.0.0/24",
+				},
+				ExternalIPAMSync: &infrav1.ExternalIPAMSyncSpec{
+					URL:          server.URL,
+					PathTemplate: "/api/v1/ips/{{.IP}}",
+				},
+			},
+		}
+		dataClaim := &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: infrav1.GroupVersion.String(),
+						Kind:       "Metal3Machine",
+						Name:       "machine-0",
+					},
+				},
+			},
+			Spec: infrav1.Metal3DataClaimSpec{
+				Template: corev1.ObjectReference{Name: "abc"},
+			},
+		}
+		// A Metal3Data of no template holds the name of the first index
+		conflictingData := &infrav1.Metal3Data{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "abc-0",
+				Namespace: "myns",
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			dataClaim, conflictingData,
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		// The address is kept on a conflict, the claim being sent again
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).To(BeAssignableToTypeOf(&RequeueAfterError{}))
+		Expect(requests).To(Receive(Equal("POST /api/v1/ips/192.168.0.1")))
+		Expect(requests).NotTo(Receive())
+
+		Expect(c.Delete(context.TODO(), conflictingData)).To(Succeed())
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(Receive(Equal("POST /api/v1/ips/192.168.0.1")))
+		Expect(indexesOf(template.Status.Indexes)).To(Equal(map[string]int{"machine-0": 0}))
+
+		// Cancelling the allocation releases the address, unknown to the
+		// IPAM here
+		Expect(templateMgr.CancelProvisioning(context.TODO(), "machine-0")).To(Succeed())
+		Expect(requests).To(Receive(Equal("DELETE /api/v1/ips/192.168.0.1")))
+		Expect(template.Status.Indexes).To(BeEmpty())
+	})
+})
@@ -0,0 +1,77 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"bytes"
+	"context"
+	"text/template"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// renderHelmTemplate fetches the template of the HelmTemplateConfigMapRef
+// ConfigMap and renders it into a Metal3Data spec
+func (m *DataTemplateManager) renderHelmTemplate(ctx context.Context,
+	index int, machineName string,
+) (*capm3.Metal3DataSpec, error) {
+	configMap := &corev1.ConfigMap{}
+	key := client.ObjectKey{
+		Name:      m.DataTemplate.Spec.HelmTemplateConfigMapRef.Name,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := m.client.Get(ctx, key, configMap); err != nil {
+		return nil, errors.Wrap(err, "Failed to get the Helm template ConfigMap")
+	}
+	helmTemplate, ok := configMap.Data[HelmTemplateConfigMapKey]
+	if !ok {
+		return nil, errors.Errorf("No %s key in ConfigMap %s",
+			HelmTemplateConfigMapKey, configMap.Name,
+		)
+	}
+	return renderDataSpec(helmTemplate, index, machineName)
+}
+
+// renderDataSpec renders a Helm style template of a Metal3Data spec. The
+// values are available as .Values.index and .Values.machineName.
+func renderDataSpec(helmTemplate string, index int, machineName string,
+) (*capm3.Metal3DataSpec, error) {
+	tmpl, err := template.New("metal3data").Option("missingkey=error").
+		Parse(helmTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the Helm template")
+	}
+	values := map[string]interface{}{
+		"Values": map[string]interface{}{
+			"index":       index,
+			"machineName": machineName,
+		},
+	}
+	rendered := &bytes.Buffer{}
+	if err := tmpl.Execute(rendered, values); err != nil {
+		return nil, errors.Wrap(err, "Failed to render the Helm template")
+	}
+	spec := &capm3.Metal3DataSpec{}
+	if err := yaml.UnmarshalStrict(rendered.Bytes(), spec); err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshal the rendered Helm template")
+	}
+	return spec, nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/klogr"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Metal3DataTemplate Helm rendering", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	type testCaseRenderHelmTemplate struct {
+		configMap    *corev1.ConfigMap
+		expectedSpec *infrav1.Metal3DataSpec
+		expectError  bool
+	}
+
+	DescribeTable("Test renderHelmTemplate",
+		func(tc testCaseRenderHelmTemplate) {
+			objects := []runtime.Object{}
+			if tc.configMap != nil {
+				objects = append(objects, tc.configMap)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					HelmTemplateConfigMapRef: &corev1.LocalObjectReference{
+						Name: "helm-template",
+					},
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(c, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			spec, err := templateMgr.renderHelmTemplate(context.TODO(), 3, "machine1")
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(spec).To(Equal(tc.expectedSpec))
+		},
+		Entry("ConfigMap not found", testCaseRenderHelmTemplate{
+			expectError: true,
+		}),
+		Entry("Missing key", testCaseRenderHelmTemplate{
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "helm-template",
+					Namespace: "myns",
+				},
+			},
+			expectError: true,
+		}),
+		Entry("Invalid template", testCaseRenderHelmTemplate{
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "helm-template",
+					Namespace: "myns",
+				},
+				Data: map[string]string{
+					HelmTemplateConfigMapKey: "metaData:\n  name: {{ .Values.index",
+				},
+			},
+			expectError: true,
+		}),
+		Entry("Unknown value", testCaseRenderHelmTemplate{
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "helm-template",
+					Namespace: "myns",
+				},
+				Data: map[string]string{
+					HelmTemplateConfigMapKey: "metaData:\n  name: {{ .Values.hostName }}",
+				},
+			},
+			expectError: true,
+		}),
+		Entry("Unknown field", testCaseRenderHelmTemplate{
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "helm-template",
+					Namespace: "myns",
+				},
+				Data: map[string]string{
+					HelmTemplateConfigMapKey: "userData:\n  name: abc",
+				},
+			},
+			expectError: true,
+		}),
+		Entry("Valid", testCaseRenderHelmTemplate{
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "helm-template",
+					Namespace: "myns",
+				},
+				Data: map[string]string{
+					HelmTemplateConfigMapKey: "metaData:\n" +
+						"  name: {{ .Values.machineName }}-meta-{{ .Values.index }}\n" +
+						"networkData:\n" +
+						"  name: node-{{ .Values.index }}-network\n",
+				},
+			},
+			expectedSpec: &infrav1.Metal3DataSpec{
+				MetaData: &corev1.SecretReference{
+					Name: "machine1-meta-3",
+				},
+				NetworkData: &corev1.SecretReference{
+					Name: "node-3-network",
+				},
+			},
+		}),
+	)
+})
@@ -0,0 +1,224 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"os"
+	"time"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// leaseLockDuration is how long the Lease lock of a Metal3DataTemplate is
+// held before it can be taken over, so that a crashed holder does not block
+// the allocations. leaseHolderIdentity identifies this controller process.
+var (
+	leaseLockDuration   = 30 * time.Second
+	leaseHolderIdentity = leaseIdentity()
+)
+
+// leaseIdentity returns a unique holder identity for the Lease locks
+func leaseIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "capm3"
+	}
+	return hostname + "_" + string(uuid.NewUUID())
+}
+
+// leaseLockKey returns the key of the Lease lock of the Metal3DataTemplate,
+// <template name>-lock in its namespace
+func (m *DataTemplateManager) leaseLockKey() client.ObjectKey {
+	return client.ObjectKey{
+		Name:      m.DataTemplate.Name + "-lock",
+		Namespace: m.DataTemplate.Namespace,
+	}
+}
+
+// leaseDuration returns how long the Lease lock is held by this controller
+// without renewal, the Duration of the LeaderElectionLease if set,
+// leaseLockDuration otherwise
+func (m *DataTemplateManager) leaseDuration() time.Duration {
+	lease := m.DataTemplate.Spec.LeaderElectionLease
+	if lease != nil && lease.Duration != nil && lease.Duration.Duration > 0 {
+		return lease.Duration.Duration
+	}
+	return leaseLockDuration
+}
+
+// AcquireLeaseLock takes the Lease named <template name>-lock in the
+// namespace of the Metal3DataTemplate, creating it if needed, and renews it
+// if this controller already holds it. The Lease is owned by the
+// Metal3DataTemplate, so that it is deleted with it. It returns a
+// RequeueAfterError if the Lease is held by another controller and did not
+// expire yet, according to the LeaseDurationSeconds set by the holder, or if
+// another controller took it concurrently. The Lease is then renewed in the
+// background, so that it does not expire during a long reconciliation, until
+// ReleaseLeaseLock or, for a LeaderElectionLease that is kept across
+// reconciliations, until the context is cancelled.
+func (m *DataTemplateManager) AcquireLeaseLock(ctx context.Context) error {
+	key := m.leaseLockKey()
+	owner := metav1.OwnerReference{
+		APIVersion: capm3.GroupVersion.String(),
+		Kind:       "Metal3DataTemplate",
+		Name:       m.DataTemplate.Name,
+		UID:        m.DataTemplate.UID,
+	}
+	leaseDuration := m.leaseDuration()
+	if err := m.acquireLease(ctx, key, owner, leaseDuration); err != nil {
+		return err
+	}
+	if m.stopLeaseRenewal == nil {
+		m.startLeaseRenewal(ctx, key, owner, leaseDuration)
+	}
+	return nil
+}
+
+// startLeaseRenewal renews the Lease lock every third of its duration in a
+// goroutine, until the context is cancelled or stopLeaseRenewal is called.
+// The goroutine only uses the given values, not the Metal3DataTemplate that
+// the reconciliation modifies.
+func (m *DataTemplateManager) startLeaseRenewal(ctx context.Context,
+	key client.ObjectKey, owner metav1.OwnerReference, leaseDuration time.Duration,
+) {
+	renewalCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(leaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewalCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := m.acquireLease(renewalCtx, key, owner, leaseDuration)
+			if err != nil && renewalCtx.Err() == nil {
+				m.Log.Info("Failed to renew the Lease lock",
+					"cluster", clusterNameFromContext(ctx), "error", err.Error(),
+				)
+			}
+		}
+	}()
+	m.stopLeaseRenewal = func() {
+		cancel()
+		<-done
+	}
+}
+
+// acquireLease takes or renews the Lease lock with the given key, owner and
+// duration, as described in AcquireLeaseLock
+func (m *DataTemplateManager) acquireLease(ctx context.Context,
+	key client.ObjectKey, owner metav1.OwnerReference, leaseDuration time.Duration,
+) error {
+	now := metav1.NewMicroTime(time.Now())
+	leaseDurationSeconds := int32(leaseDuration / time.Second)
+	lease := &coordinationv1.Lease{}
+	err := m.client.Get(ctx, key, lease)
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            key.Name,
+				Namespace:       key.Namespace,
+				OwnerReferences: []metav1.OwnerReference{owner},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       pointer.StringPtr(leaseHolderIdentity),
+				LeaseDurationSeconds: &leaseDurationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if err := m.client.Create(ctx, lease); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				return &RequeueAfterError{RequeueAfter: requeueAfter}
+			}
+			return errors.Wrap(err, "Failed to create the Lease lock")
+		}
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Failed to get the Lease lock")
+	}
+
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	// The holder may run with another configuration, its own duration is
+	// the one that decides whether the Lease expired
+	holderDuration := leaseLockDuration
+	if lease.Spec.LeaseDurationSeconds != nil && *lease.Spec.LeaseDurationSeconds > 0 {
+		holderDuration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	if holder != "" && holder != leaseHolderIdentity && lease.Spec.RenewTime != nil &&
+		lease.Spec.RenewTime.Add(holderDuration).After(now.Time) {
+		m.Log.Info("Lease lock held by another controller",
+			"cluster", clusterNameFromContext(ctx), "holder", holder,
+		)
+		return &RequeueAfterError{RequeueAfter: requeueAfter}
+	}
+	if holder != leaseHolderIdentity || lease.Spec.AcquireTime == nil {
+		lease.Spec.AcquireTime = &now
+	}
+	lease.OwnerReferences = addOwnerRef(lease.OwnerReferences, owner)
+	lease.Spec.HolderIdentity = pointer.StringPtr(leaseHolderIdentity)
+	lease.Spec.LeaseDurationSeconds = &leaseDurationSeconds
+	lease.Spec.RenewTime = &now
+	if err := m.client.Update(ctx, lease); err != nil {
+		if apierrors.IsConflict(err) {
+			return &RequeueAfterError{RequeueAfter: requeueAfter}
+		}
+		return errors.Wrap(err, "Failed to update the Lease lock")
+	}
+	return nil
+}
+
+// ReleaseLeaseLock stops the renewal of the Lease lock of the
+// Metal3DataTemplate and clears its holder if it is held by this controller
+func (m *DataTemplateManager) ReleaseLeaseLock(ctx context.Context) error {
+	if m.stopLeaseRenewal != nil {
+		m.stopLeaseRenewal()
+		m.stopLeaseRenewal = nil
+	}
+	lease := &coordinationv1.Lease{}
+	key := m.leaseLockKey()
+	if err := m.client.Get(ctx, key, lease); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrap(err, "Failed to get the Lease lock")
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != leaseHolderIdentity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = nil
+	lease.Spec.AcquireTime = nil
+	lease.Spec.RenewTime = nil
+	if err := m.client.Update(ctx, lease); err != nil {
+		return errors.Wrap(err, "Failed to release the Lease lock")
+	}
+	return nil
+}
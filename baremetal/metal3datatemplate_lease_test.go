@@ -0,0 +1,212 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/klogr"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Metal3DataTemplate Lease lock", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	It("Test AcquireLeaseLock and ReleaseLeaseLock", func() {
+		scheme := setupSchemeMm()
+		Expect(coordinationv1.AddToScheme(scheme)).To(Succeed())
+		c := fakeclient.NewFakeClientWithScheme(scheme)
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				UseLeaseLock: true,
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		key := client.ObjectKey{Name: "abc-lock", Namespace: "myns"}
+
+		// The Lease is created on the first acquisition, owned by the template
+		Expect(templateMgr.AcquireLeaseLock(context.TODO())).To(Succeed())
+		lease := &coordinationv1.Lease{}
+		Expect(c.Get(context.TODO(), key, lease)).To(Succeed())
+		Expect(*lease.Spec.HolderIdentity).To(Equal(leaseHolderIdentity))
+		Expect(*lease.Spec.LeaseDurationSeconds).To(BeEquivalentTo(30))
+		Expect(lease.OwnerReferences).To(HaveLen(1))
+		Expect(lease.OwnerReferences[0].Kind).To(Equal("Metal3DataTemplate"))
+		Expect(lease.OwnerReferences[0].Name).To(Equal("abc"))
+
+		// The holder can acquire it again
+		Expect(templateMgr.AcquireLeaseLock(context.TODO())).To(Succeed())
+
+		// Releasing it stops the renewal and clears the holder
+		Expect(templateMgr.ReleaseLeaseLock(context.TODO())).To(Succeed())
+		Expect(templateMgr.stopLeaseRenewal).To(BeNil())
+		lease = &coordinationv1.Lease{}
+		Expect(c.Get(context.TODO(), key, lease)).To(Succeed())
+		Expect(lease.Spec.HolderIdentity).To(BeNil())
+
+		// A Lease held by another controller is not acquired nor released
+		renewTime := metav1.NewMicroTime(time.Now())
+		lease.Spec.HolderIdentity = pointer.StringPtr("other")
+		lease.Spec.RenewTime = &renewTime
+		Expect(c.Update(context.TODO(), lease)).To(Succeed())
+		err = templateMgr.AcquireLeaseLock(context.TODO())
+		Expect(err).To(BeAssignableToTypeOf(&RequeueAfterError{}))
+		Expect(templateMgr.ReleaseLeaseLock(context.TODO())).To(Succeed())
+		Expect(c.Get(context.TODO(), key, lease)).To(Succeed())
+		Expect(*lease.Spec.HolderIdentity).To(Equal("other"))
+
+		// An expired Lease is taken over
+		renewTime = metav1.NewMicroTime(time.Now().Add(-time.Minute))
+		lease.Spec.RenewTime = &renewTime
+		Expect(c.Update(context.TODO(), lease)).To(Succeed())
+		Expect(templateMgr.AcquireLeaseLock(context.TODO())).To(Succeed())
+		Expect(c.Get(context.TODO(), key, lease)).To(Succeed())
+		Expect(*lease.Spec.HolderIdentity).To(Equal(leaseHolderIdentity))
+		Expect(templateMgr.ReleaseLeaseLock(context.TODO())).To(Succeed())
+	})
+
+	It("Renews the Lease lock until it is released", func() {
+		scheme := setupSchemeMm()
+		Expect(coordinationv1.AddToScheme(scheme)).To(Succeed())
+		c := fakeclient.NewFakeClientWithScheme(scheme)
+		template := &infrav1.Metal3DataTemplate{ObjectMeta: templateMeta}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		key := client.ObjectKey{Name: "abc-lock", Namespace: "myns"}
+		renewTime := func() time.Time {
+			lease := &coordinationv1.Lease{}
+			if err := c.Get(context.TODO(), key, lease); err != nil ||
+				lease.Spec.RenewTime == nil {
+				return time.Time{}
+			}
+			return lease.Spec.RenewTime.Time
+		}
+
+		templateMgr.startLeaseRenewal(context.TODO(), key,
+			metav1.OwnerReference{Kind: "Metal3DataTemplate", Name: "abc"},
+			30*time.Millisecond,
+		)
+		Eventually(renewTime).ShouldNot(BeZero())
+		firstRenewal := renewTime()
+		Eventually(renewTime).Should(BeTemporally(">", firstRenewal))
+
+		Expect(templateMgr.ReleaseLeaseLock(context.TODO())).To(Succeed())
+		Expect(renewTime()).To(BeZero())
+		Consistently(renewTime, 100*time.Millisecond).Should(BeZero())
+	})
+
+	It("Renews the LeaderElectionLease until the context is cancelled", func() {
+		scheme := setupSchemeMm()
+		Expect(coordinationv1.AddToScheme(scheme)).To(Succeed())
+		c := fakeclient.NewFakeClientWithScheme(scheme)
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				LeaderElectionLease: &infrav1.LeaderElectionSpec{
+					Duration: &metav1.Duration{Duration: 30 * time.Millisecond},
+				},
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		key := client.ObjectKey{Name: "abc-lock", Namespace: "myns"}
+		renewTime := func() time.Time {
+			lease := &coordinationv1.Lease{}
+			Expect(c.Get(context.TODO(), key, lease)).To(Succeed())
+			return lease.Spec.RenewTime.Time
+		}
+
+		ctx, cancel := context.WithCancel(context.TODO())
+		Expect(templateMgr.AcquireLeaseLock(ctx)).To(Succeed())
+		firstRenewal := renewTime()
+		Eventually(renewTime).Should(BeTemporally(">", firstRenewal))
+
+		// The Lease is kept, but no longer renewed, after the reconciliation
+		cancel()
+		templateMgr.stopLeaseRenewal()
+		lastRenewal := renewTime()
+		Consistently(renewTime, 100*time.Millisecond).Should(Equal(lastRenewal))
+		lease := &coordinationv1.Lease{}
+		Expect(c.Get(context.TODO(), key, lease)).To(Succeed())
+		Expect(*lease.Spec.HolderIdentity).To(Equal(leaseHolderIdentity))
+	})
+
+	It("Test AcquireLeaseLock with a LeaderElectionLease", func() {
+		scheme := setupSchemeMm()
+		Expect(coordinationv1.AddToScheme(scheme)).To(Succeed())
+		c := fakeclient.NewFakeClientWithScheme(scheme)
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				LeaderElectionLease: &infrav1.LeaderElectionSpec{
+					Duration: &metav1.Duration{Duration: 2 * time.Minute},
+				},
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		key := client.ObjectKey{Name: "abc-lock", Namespace: "myns"}
+		ctx, cancel := context.WithCancel(context.TODO())
+		defer cancel()
+
+		Expect(templateMgr.AcquireLeaseLock(ctx)).To(Succeed())
+		Expect(templateMgr.stopLeaseRenewal).NotTo(BeNil())
+		lease := &coordinationv1.Lease{}
+		Expect(c.Get(context.TODO(), key, lease)).To(Succeed())
+		Expect(*lease.Spec.LeaseDurationSeconds).To(BeEquivalentTo(120))
+		acquireTime := lease.Spec.AcquireTime
+
+		// Acquiring it again renews it, keeping the acquisition time
+		Expect(templateMgr.AcquireLeaseLock(ctx)).To(Succeed())
+		lease = &coordinationv1.Lease{}
+		Expect(c.Get(context.TODO(), key, lease)).To(Succeed())
+		Expect(lease.Spec.AcquireTime.Equal(acquireTime)).To(BeTrue())
+
+		// A Lease renewed by another replica within its duration is not taken
+		renewTime := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+		lease.Spec.HolderIdentity = pointer.StringPtr("other")
+		lease.Spec.RenewTime = &renewTime
+		Expect(c.Update(context.TODO(), lease)).To(Succeed())
+		err = templateMgr.AcquireLeaseLock(ctx)
+		Expect(err).To(BeAssignableToTypeOf(&RequeueAfterError{}))
+
+		// The duration of the holder decides whether the Lease expired
+		lease = &coordinationv1.Lease{}
+		Expect(c.Get(context.TODO(), key, lease)).To(Succeed())
+		lease.Spec.LeaseDurationSeconds = pointer.Int32Ptr(30)
+		Expect(c.Update(context.TODO(), lease)).To(Succeed())
+		Expect(templateMgr.AcquireLeaseLock(ctx)).To(Succeed())
+		lease = &coordinationv1.Lease{}
+		Expect(c.Get(context.TODO(), key, lease)).To(Succeed())
+		Expect(*lease.Spec.HolderIdentity).To(Equal(leaseHolderIdentity))
+		Expect(*lease.Spec.LeaseDurationSeconds).To(BeEquivalentTo(120))
+	})
+})
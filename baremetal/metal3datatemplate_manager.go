@@ -17,48 +17,617 @@ limitations under the License.
 package baremetal
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/go-logr/logr"
 	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/metal3-io/cluster-api-provider-metal3/version"
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	utilversion "k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/utils/pointer"
 	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/util/conditions"
 	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
+const (
+	// DataClaimRetriesAnnotation is set on a Metal3DataClaim to count the
+	// consecutive failed attempts to create its Metal3Data, when a
+	// BackoffPolicy is set on the Metal3DataTemplate
+	DataClaimRetriesAnnotation = "metal3.io/data-claim-retries"
+
+	// AllocationNotificationPendingAnnotation is set on a Metal3DataClaim when
+	// the allocation webhook of the Metal3DataTemplate could not be notified,
+	// and RetryOnFailure is set
+	AllocationNotificationPendingAnnotation = "metal3.io/allocation-notification-pending"
+
+	// AllocationWebhookTokenKey is the key of the Secret referenced by the
+	// AllocationWebhook containing the bearer token of the notifications
+	AllocationWebhookTokenKey = "token"
+
+	// ExternalIPAMTokenKey is the key of the Secret referenced by the
+	// ExternalIPAMSync containing the bearer token of the requests
+	ExternalIPAMTokenKey = "token"
+
+	// SharedIndexLabel is set on a Metal3DataClaim to request a given index of
+	// a Metal3DataTemplate in Shared ownership mode. The Metal3DataClaims
+	// requesting the same index share its Metal3Data. The label is copied
+	// from the Metal3Machine when the Metal3DataClaim is created.
+	SharedIndexLabel = "metal3.io/shared-index"
+
+	// HelmTemplateConfigMapKey is the key of the ConfigMap referenced by
+	// HelmTemplateConfigMapRef containing the template
+	HelmTemplateConfigMapKey = "template"
+
+	// ExternalStatusSecretSuffix is appended to the name of a
+	// Metal3DataTemplate to name the Secret storing its Indexes when
+	// UseExternalStatusStore is set
+	ExternalStatusSecretSuffix = "-status"
+
+	// ExternalStatusSecretKey is the key of the external status Secret
+	// containing the JSON encoded Indexes
+	ExternalStatusSecretKey = "indexes"
+
+	// TenantServiceAccountAnnotation is set on a Metal3Machine to the name of
+	// the ServiceAccount, in its namespace, allowed to read its Metal3Data
+	// when the Metal3DataTemplate has TenantIsolation
+	TenantServiceAccountAnnotation = "metal3.io/tenant-service-account"
+
+	// ConfirmPurgeAnnotation must be set to "true" on a Metal3DataTemplate
+	// for PurgeStatus to reset its status
+	ConfirmPurgeAnnotation = "metal3.io/confirm-purge"
+
+	// IndexChangesAnnotation is set on a Metal3DataTemplate to the JSON
+	// encoded IndexChanges of the last reconciliation that allocated or freed
+	// indexes, so that the audit log of the patch records them
+	IndexChangesAnnotation = "metal3.io/index-changes"
+
+	// TransferToAnnotation is set on a Metal3Data to the name of the
+	// Metal3DataTemplate that should adopt it, when DataOwnershipTransfer is
+	// set and its Metal3Machine moved to that template
+	TransferToAnnotation = "metal3.io/transfer-to"
+
+	// SkipAllocationAnnotation set to "true" on a Metal3Machine opts it out of
+	// the allocation of a Metal3Data, for example for the bootstrap nodes
+	SkipAllocationAnnotation = "metal3.io/skip-allocation"
+
+	// AllocationSkippedEventReason is the reason of the Events recorded on a
+	// Metal3DataTemplate when a Metal3Machine opts out of the allocation
+	AllocationSkippedEventReason = "AllocationSkipped"
+
+	// AllocationSkippedAnnotation is set on a Metal3DataClaim once the
+	// AllocationSkipped Event was recorded for it, so that it is recorded
+	// only once while its Metal3Machine opts out of the allocation
+	AllocationSkippedAnnotation = "metal3.io/allocation-skipped"
+
+	// StatusInconsistentEventReason is the reason of the Warning Events
+	// recorded on a Metal3DataTemplate when the monitoring finds
+	// inconsistencies between its status and the Metal3Data objects
+	StatusInconsistentEventReason = "StatusInconsistent"
+
+	// LiveIndexCountMismatchEventReason is the reason of the Warning Events
+	// recorded on a Metal3DataTemplate when the monitoring counts more or
+	// fewer Metal3Data objects than allocated indexes
+	LiveIndexCountMismatchEventReason = "LiveIndexCountMismatch"
+
+	// OwnerReferencesLimitEventReason is the reason of the Warning Events
+	// recorded on a Metal3DataTemplate when its owner references reach 80% of
+	// its MaxOwnerReferences
+	OwnerReferencesLimitEventReason = "OwnerReferencesLimit"
+
+	// ReconcilePanicEventReason is the reason of the Warning Events recorded
+	// on a Metal3DataTemplate when its reconciliation panicked
+	ReconcilePanicEventReason = "ReconcilePanic"
+
+	// OwnerReferenceFilterRejectedEventReason is the reason of the Warning
+	// Events recorded on a Metal3DataTemplate when a Metal3Machine does not
+	// match its OwnerReferenceFilter
+	OwnerReferenceFilterRejectedEventReason = "OwnerReferenceFilterRejected"
+
+	// EmergencyIndexAllocatedEventReason is the reason of the Warning Events
+	// recorded on a Metal3DataTemplate when an index of its EmergencyRange
+	// is allocated
+	EmergencyIndexAllocatedEventReason = "EmergencyIndexAllocated"
+
+	// QuotaExceededEventReason is the reason of the Warning Events recorded
+	// on a Metal3DataTemplate when a ResourceQuota of the namespace does not
+	// allow the creation of another Metal3Data
+	QuotaExceededEventReason = "QuotaExceeded"
+
+	// IndexChecksumAnnotation is set on a Metal3DataTemplate to the
+	// IndexChecksum of its status
+	IndexChecksumAnnotation = "metal3.io/index-checksum"
+
+	// DataSizeChecksumAnnotation is set on a Metal3DataTemplate to the
+	// checksum of the indexes of the Metal3Data objects its DataSizeBytes was
+	// computed from
+	DataSizeChecksumAnnotation = "metal3.io/data-size-checksum"
+)
+
+// IndexChanges lists, by claim name, the indexes allocated and freed by a
+// reconciliation
+type IndexChanges struct {
+	Allocated map[string]int `json:"allocated,omitempty"`
+	Freed     map[string]int `json:"freed,omitempty"`
+}
+
+// DataAllocation describes an index allocated to a Metal3Machine
+type DataAllocation struct {
+	MachineName string
+	DataName    string
+	Index       int
+}
+
+// DeltaStatus describes the allocations created and deleted by a call to
+// UpdateDatas, sorted by index
+type DeltaStatus struct {
+	Created []DataAllocation
+	Deleted []DataAllocation
+	// RequeueNeeded is true when Metal3DataClaims are still waiting for an
+	// index
+	RequeueNeeded bool
+	// RequeueAfter is the delay until the earliest reservation of the
+	// ReservedIndexes expires, 0 if there is none
+	RequeueAfter time.Duration
+}
+
+// clusterNameContextKey is the key of the cluster name in the context of a
+// Metal3DataTemplate reconciliation
+type clusterNameContextKey struct{}
+
+// WithClusterName returns a copy of ctx carrying the name of the cluster the
+// Metal3DataTemplate belongs to, added to the logs of the DataTemplateManager
+func WithClusterName(ctx context.Context, clusterName string) context.Context {
+	return context.WithValue(ctx, clusterNameContextKey{}, clusterName)
+}
+
+// clusterNameFromContext returns the cluster name set by WithClusterName, or
+// an empty string
+func clusterNameFromContext(ctx context.Context) string {
+	clusterName, _ := ctx.Value(clusterNameContextKey{}).(string)
+	return clusterName
+}
+
 // DataTemplateManagerInterface is an interface for a DataTemplateManager
 type DataTemplateManagerInterface interface {
 	SetFinalizer()
 	UnsetFinalizer()
+	DeleteMetrics()
 	SetClusterOwnerRef(*capi.Cluster) error
-	UpdateDatas(context.Context) (int, error)
+	AcquireLeaseLock(context.Context) error
+	ReleaseLeaseLock(context.Context) error
+	RecoverFromPanic(context.Context, func() error) (bool, error)
+	Startup(context.Context) error
+	UpdateDatas(context.Context, ServiceAccountClientGetter) (int, DeltaStatus, error)
+	GetDataForMachine(context.Context, string) (*capm3.Metal3Data, error)
+	ExplainIndex(context.Context, int) (string, error)
+	PurgeStatus(context.Context) error
+	CompactStatus(context.Context) error
+	MigrateStatus(context.Context) error
+	WatchDataCreation(context.Context, func(capm3.Metal3Data)) error
+	WatchOwnerReferences(context.Context, chan<- OwnerReferenceEvent) error
+	WatchIndexChanges(context.Context, chan<- IndexChangeEvent) error
+	InspectGaps(context.Context) ([]IndexGap, error)
+	CancelProvisioning(context.Context, string) error
+	ResetIndex(context.Context, string) error
+	SimulateDelete(context.Context, string) ([]string, error)
+	Rebalance(context.Context, *capm3.Metal3DataTemplate, []string) ([]string, error)
+	PatchMachine(context.Context, string, func(*capm3.Metal3Machine)) error
+	FetchRemoteStatus(context.Context, client.Client) (*capm3.Metal3DataTemplateStatus, error)
+	ValidateStatusConsistency(context.Context) ([]StatusInconsistency, error)
+	SelfHeal(context.Context) error
+	RunValidations(context.Context) (*ValidationReport, error)
+	LiveIndexCount(context.Context) (int, error)
+	StartMonitoring(context.Context) error
+	ForEachIndex(func(int, string, string) error) error
+}
+
+var _ DataTemplateManagerInterface = &DataTemplateManager{}
+
+// ServiceAccountClientGetter prototype
+type ServiceAccountClientGetter func(ctx context.Context, namespace, name string) (client.Client, error)
+
+// deleteRetries is the number of retries of a failed Metal3Data deletion when
+// RetryFailedDeletes is set, deleteRetryInterval the delay between them
+var (
+	deleteRetries       = 3
+	deleteRetryInterval = time.Second
+)
+
+// patchMachineRetries is the number of attempts of PatchMachine on conflicts
+const patchMachineRetries = 3
+
+// metal3DataQuotaResource is the object count resource of the Metal3Data in
+// a ResourceQuota
+var metal3DataQuotaResource = corev1.ResourceName("count/metal3datas." +
+	capm3.GroupVersion.Group,
+)
+
+// The versions of the format of the status of a Metal3DataTemplate.
+// StatusVersionIndexMap stored the indexes as a map of claim names to
+// integers, StatusVersionIndexEntries stores IndexEntries.
+const (
+	StatusVersionIndexMap     = 1
+	StatusVersionIndexEntries = 2
+)
+
+// etcdObjectSizeLimit is the default maximum size of an object stored in
+// etcd. A Metal3Data above dataSizeWarningPercent of it is logged.
+const (
+	etcdObjectSizeLimit    = 1572864
+	dataSizeWarningPercent = 80
+)
+
+var (
+	// dataSizeBytesGauge exports the DataSizeBytes of the Metal3DataTemplates
+	dataSizeBytesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metal3_datatemplate_data_size_bytes",
+			Help: "Total size of the Metal3Data objects generated from a Metal3DataTemplate",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// allocatedCountGauge exports the number of indexes allocated in the
+	// status of the Metal3DataTemplates
+	allocatedCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metal3_datatemplate_allocated_count",
+			Help: "Number of indexes allocated in the status of a Metal3DataTemplate",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// liveIndexCountGauge exports the number of Metal3Data objects of the
+	// Metal3DataTemplates counted by LiveIndexCount
+	liveIndexCountGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metal3_datatemplate_live_index_count",
+			Help: "Number of Metal3Data objects of a Metal3DataTemplate in the cluster",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// statusInconsistenciesGauge exports the number of inconsistencies found
+	// by the monitoring of the Metal3DataTemplates
+	statusInconsistenciesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metal3_datatemplate_status_inconsistencies",
+			Help: "Number of inconsistencies between the status of a Metal3DataTemplate and its Metal3Data objects",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// liveIndexCountDriftGauge exports the difference between the live index
+	// count and the allocated indexes found by the monitoring of the
+	// Metal3DataTemplates
+	liveIndexCountDriftGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metal3_datatemplate_live_index_count_drift",
+			Help: "Number of Metal3Data objects of a Metal3DataTemplate minus its allocated indexes",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// migrationTimestampGauge exports the LastMigratedAt of the
+	// Metal3DataTemplates
+	migrationTimestampGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metal3_datatemplate_migration_timestamp_seconds",
+			Help: "Unix time of the last migration of the status format of a Metal3DataTemplate",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// provisionedMachinesCounter counts the Metal3Machines given an index by
+	// the Metal3DataTemplates
+	provisionedMachinesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metal3_datatemplate_provisioned_machines_total",
+			Help: "Number of Metal3Machines given an index by a Metal3DataTemplate",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	// activeReconcilesGauge exports the number of reconciliations of
+	// Metal3DataTemplates in progress in the controller
+	activeReconcilesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "metal3_datatemplate_active_reconciles",
+			Help: "Number of reconciliations of Metal3DataTemplates in progress",
+		},
+	)
+
+	// deprovisionedMachinesCounter counts the Metal3Machines whose index was
+	// released by the Metal3DataTemplates
+	deprovisionedMachinesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metal3_datatemplate_deprovisioned_machines_total",
+			Help: "Number of Metal3Machines whose index was released by a Metal3DataTemplate",
+		},
+		[]string{"namespace", "name"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(dataSizeBytesGauge, allocatedCountGauge,
+		liveIndexCountGauge, statusInconsistenciesGauge,
+		liveIndexCountDriftGauge, migrationTimestampGauge,
+		provisionedMachinesCounter, deprovisionedMachinesCounter,
+		activeReconcilesGauge,
+	)
+}
+
+// DataNotFoundError represents that no Metal3Data is allocated for a machine
+type DataNotFoundError struct {
+	Machine string
 }
 
+// Error implements the error interface
+func (e *DataNotFoundError) Error() string {
+	return "No Metal3Data allocated for " + e.Machine
+}
+
+// IndexExhaustedError represents that no index is free in a Metal3DataTemplate
+type IndexExhaustedError struct {
+	DataTemplate string
+}
+
+// Error implements the error interface
+func (e *IndexExhaustedError) Error() string {
+	return "No free index left in Metal3DataTemplate " + e.DataTemplate
+}
+
+const (
+	// GhostEntryReason is used when an index entry has neither a Metal3Data
+	// nor a live Metal3DataClaim
+	GhostEntryReason = "GhostEntry"
+
+	// MissingDataReason is used when the Metal3Data of an index entry is
+	// missing while its Metal3DataClaim still exists
+	MissingDataReason = "MissingData"
+
+	// MissingEntryReason is used when a Metal3Data of the template has no
+	// index entry
+	MissingEntryReason = "MissingEntry"
+)
+
+// QuotaExceededError represents that a ResourceQuota of the namespace does
+// not allow the creation of another Metal3Data
+type QuotaExceededError struct {
+	Quota   string
+	Current int
+	Max     int
+}
+
+// Error implements the error interface
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("ResourceQuota %s exceeded for Metal3Data: %d used, %d allowed",
+		e.Quota, e.Current, e.Max,
+	)
+}
+
+const (
+	// DataCreatedEventReason is the reason of the Events recorded on a
+	// Metal3DataTemplate when an index is allocated
+	DataCreatedEventReason = "Metal3DataCreated"
+
+	// DataDeletedEventReason is the reason of the Events recorded on a
+	// Metal3DataTemplate when an index is released
+	DataDeletedEventReason = "Metal3DataDeleted"
+
+	// dataCreatedEventMessage and dataDeletedEventMessage are the formats of
+	// the messages of the allocation Events
+	dataCreatedEventMessage = "Allocated index %d to Metal3Machine %s in Metal3Data %s"
+	dataDeletedEventMessage = "Released index %d of Metal3Machine %s from Metal3Data %s"
+)
+
 // DataTemplateManager is responsible for performing machine reconciliation
 type DataTemplateManager struct {
 	client       client.Client
 	DataTemplate *capm3.Metal3DataTemplate
 	Log          logr.Logger
+	// Informers is only used by the Watch methods, usually set to the cache
+	// of the controller manager. The handlers they add are removed when their
+	// context is cancelled.
+	Informers cache.Informers
+	// OwnerKindFilter are the kinds of the owner references, in the group of
+	// the Metal3Machines, recognized as the machine of a Metal3DataClaim or
+	// Metal3Data, for example a custom VirtualMetal3Machine. It defaults to
+	// DefaultOwnerKindFilter.
+	OwnerKindFilter []string
+	// restoredIndexes are the indexes SelfHeal gives back to the
+	// Metal3DataClaims whose Metal3Data is missing, by claim name
+	restoredIndexes map[string]int
+	// skippedClaims are the Metal3DataClaims whose Metal3Machine has the
+	// SkipAllocationAnnotation, by claim name
+	skippedClaims map[string]bool
+	// listedDatas are the Metal3Data objects of the namespace listed by
+	// getIndexes
+	listedDatas []capm3.Metal3Data
+	// pageSize is the maximum number of objects fetched per List call, 0
+	// disables the pagination
+	pageSize int64
+	// rateLimiter throttles the creation of the Metal3Data objects
+	rateLimiter flowcontrol.RateLimiter
+	// metricsRecorder is notified of the allocated and released indexes
+	metricsRecorder DataTemplateMetricsRecorder
+	// fieldManager is the field owner set on the created Metal3Data objects
+	fieldManager string
+	// recorder records the Events of the Metal3DataTemplate, none are
+	// recorded if unset
+	recorder record.EventRecorder
+	// stopLeaseRenewal stops the renewal of the Lease lock started by
+	// AcquireLeaseLock, if any
+	stopLeaseRenewal func()
+}
+
+// DataTemplateMetricsRecorder records the index allocations and releases of
+// a Metal3DataTemplate
+type DataTemplateMetricsRecorder interface {
+	RecordAllocation(template string, index int)
+	RecordRelease(template string, index int)
+}
+
+// DefaultOwnerKindFilter is the default OwnerKindFilter of a
+// DataTemplateManager
+var DefaultOwnerKindFilter = []string{"Metal3Machine"}
+
+// DataTemplateManagerOption configures a DataTemplateManager
+type DataTemplateManagerOption func(*DataTemplateManager)
+
+// WithPageSize sets the maximum number of objects fetched per List call
+func WithPageSize(pageSize int64) DataTemplateManagerOption {
+	return func(m *DataTemplateManager) {
+		m.pageSize = pageSize
+	}
+}
+
+// WithRateLimiter sets the rate limiter used to throttle the creation of the
+// Metal3Data objects
+func WithRateLimiter(rateLimiter flowcontrol.RateLimiter) DataTemplateManagerOption {
+	return func(m *DataTemplateManager) {
+		m.rateLimiter = rateLimiter
+	}
+}
+
+// WithMetricsRecorder sets the recorder notified of the index allocations
+// and releases
+func WithMetricsRecorder(recorder DataTemplateMetricsRecorder) DataTemplateManagerOption {
+	return func(m *DataTemplateManager) {
+		m.metricsRecorder = recorder
+	}
+}
+
+// WithOwnerKindFilter sets the kinds of the owner references recognized as
+// the machine of a Metal3DataClaim or Metal3Data
+func WithOwnerKindFilter(ownerKindFilter []string) DataTemplateManagerOption {
+	return func(m *DataTemplateManager) {
+		m.OwnerKindFilter = append([]string{}, ownerKindFilter...)
+	}
+}
+
+// WithFieldManager sets the field manager used when creating the Metal3Data
+// objects
+func WithFieldManager(fieldManager string) DataTemplateManagerOption {
+	return func(m *DataTemplateManager) {
+		m.fieldManager = fieldManager
+	}
+}
+
+// WithInformers sets the Informers used by the Watch methods
+func WithInformers(informers cache.Informers) DataTemplateManagerOption {
+	return func(m *DataTemplateManager) {
+		m.Informers = informers
+	}
+}
+
+// WithEventRecorder sets the recorder of the Events of the
+// Metal3DataTemplate
+func WithEventRecorder(recorder record.EventRecorder) DataTemplateManagerOption {
+	return func(m *DataTemplateManager) {
+		m.recorder = recorder
+	}
 }
 
 // NewDataTemplateManager returns a new helper for managing a dataTemplate object
 func NewDataTemplateManager(client client.Client,
 	dataTemplate *capm3.Metal3DataTemplate, dataTemplateLog logr.Logger) (*DataTemplateManager, error) {
 
-	return &DataTemplateManager{
+	return NewDataTemplateManagerWithOptions(client, dataTemplate,
+		dataTemplateLog,
+	)
+}
+
+// NewDataTemplateManagerWithOptions returns a new helper for managing a
+// dataTemplate object, configured with the given options
+func NewDataTemplateManagerWithOptions(client client.Client,
+	dataTemplate *capm3.Metal3DataTemplate, dataTemplateLog logr.Logger,
+	options ...DataTemplateManagerOption,
+) (*DataTemplateManager, error) {
+
+	m := &DataTemplateManager{
 		client:       client,
 		DataTemplate: dataTemplate,
 		Log:          dataTemplateLog,
-	}, nil
+	}
+	for _, option := range options {
+		option(m)
+	}
+	if len(m.OwnerKindFilter) == 0 {
+		m.OwnerKindFilter = append([]string{}, DefaultOwnerKindFilter...)
+	}
+	if m.pageSize < 0 {
+		return nil, errors.New("page size must not be negative")
+	}
+	return m, nil
+}
+
+// list lists the objects of the namespace of the Metal3DataTemplate matching
+// the options into list, fetching them by pages of pageSize objects if set
+func (m *DataTemplateManager) list(ctx context.Context, list runtime.Object,
+	listOpts ...client.ListOption,
+) error {
+	opts := &client.ListOptions{}
+	opts.ApplyOptions(listOpts)
+	// without this ListOption, all namespaces would be including in the listing
+	opts.Namespace = m.DataTemplate.Namespace
+	opts.Limit = m.pageSize
+	if m.pageSize == 0 {
+		return m.client.List(ctx, list, opts)
+	}
+
+	items := []runtime.Object{}
+	for {
+		page := list.DeepCopyObject()
+		if err := m.client.List(ctx, page, opts); err != nil {
+			return err
+		}
+		pageItems, err := apimeta.ExtractList(page)
+		if err != nil {
+			return err
+		}
+		items = append(items, pageItems...)
+		listAccessor, err := apimeta.ListAccessor(page)
+		if err != nil {
+			return err
+		}
+		opts.Continue = listAccessor.GetContinue()
+		if opts.Continue == "" {
+			break
+		}
+	}
+	return apimeta.SetList(list, items)
 }
 
 // SetFinalizer sets finalizer
@@ -77,6 +646,25 @@ func (m *DataTemplateManager) UnsetFinalizer() {
 	m.DataTemplate.Finalizers = Filter(m.DataTemplate.Finalizers,
 		capm3.DataTemplateFinalizer,
 	)
+	// The template is deleted, its compiled condition is not needed anymore
+	allocationConditionPrograms.Delete(types.NamespacedName{
+		Name:      m.DataTemplate.Name,
+		Namespace: m.DataTemplate.Namespace,
+	})
+}
+
+// DeleteMetrics deletes the series of the Metal3DataTemplate from the metrics
+// labelled with its namespace and name, once it is deleted
+func (m *DataTemplateManager) DeleteMetrics() {
+	namespace, name := m.DataTemplate.Namespace, m.DataTemplate.Name
+	dataSizeBytesGauge.DeleteLabelValues(namespace, name)
+	allocatedCountGauge.DeleteLabelValues(namespace, name)
+	liveIndexCountGauge.DeleteLabelValues(namespace, name)
+	statusInconsistenciesGauge.DeleteLabelValues(namespace, name)
+	liveIndexCountDriftGauge.DeleteLabelValues(namespace, name)
+	migrationTimestampGauge.DeleteLabelValues(namespace, name)
+	provisionedMachinesCounter.DeleteLabelValues(namespace, name)
+	deprovisionedMachinesCounter.DeleteLabelValues(namespace, name)
 }
 
 func (m *DataTemplateManager) SetClusterOwnerRef(cluster *capi.Cluster) error {
@@ -99,27 +687,45 @@ func (m *DataTemplateManager) SetClusterOwnerRef(cluster *capi.Cluster) error {
 			return err
 		}
 	}
+	m.checkOwnerReferences()
 	return nil
 }
 
+// checkOwnerReferences records a Warning Event when the number of owner
+// references reaches 80% of MaxOwnerReferences. Above the limit, the webhook
+// rejects the updates of the Metal3DataTemplate adding owner references.
+func (m *DataTemplateManager) checkOwnerReferences() {
+	maxOwnerRefs := m.DataTemplate.Spec.MaxOwnerReferences
+	if maxOwnerRefs <= 0 {
+		return
+	}
+	// Unchanged since the last reconciliation, already checked
+	if ownerReferencesHash(m.DataTemplate.OwnerReferences) ==
+		m.DataTemplate.Status.OwnerReferencesHash {
+		return
+	}
+	if len(m.DataTemplate.OwnerReferences)*5 >= maxOwnerRefs*4 {
+		m.recordEvent(corev1.EventTypeWarning, OwnerReferencesLimitEventReason,
+			fmt.Sprintf("%d owner references out of the maximum of %d",
+				len(m.DataTemplate.OwnerReferences), maxOwnerRefs,
+			),
+		)
+	}
+}
+
 // RecreateStatus recreates the status if empty
 func (m *DataTemplateManager) getIndexes(ctx context.Context) (map[int]string, error) {
 
-	m.Log.Info("Fetching Metal3Data objects")
+	m.Log.Info("Fetching Metal3Data objects", "cluster", clusterNameFromContext(ctx))
 
 	//start from empty maps
-	m.DataTemplate.Status.Indexes = make(map[string]int)
+	m.DataTemplate.Status.Indexes = make(map[string]capm3.IndexEntry)
 
 	indexes := make(map[int]string)
 
 	// get list of Metal3Data objects
 	dataObjects := capm3.Metal3DataList{}
-	// without this ListOption, all namespaces would be including in the listing
-	opts := &client.ListOptions{
-		Namespace: m.DataTemplate.Namespace,
-	}
-
-	err := m.client.List(ctx, &dataObjects, opts)
+	err := m.list(ctx, &dataObjects)
 	if err != nil {
 		return indexes, err
 	}
@@ -127,6 +733,13 @@ func (m *DataTemplateManager) getIndexes(ctx context.Context) (map[int]string, e
 	// Iterate over the Metal3Data objects to find all indexes and objects
 	for _, dataObject := range dataObjects.Items {
 
+		// A transferred Metal3Data keeps its name, so its index stays
+		// reserved to avoid name conflicts
+		if m.isTransferredData(&dataObject) {
+			indexes[dataObject.Spec.Index] = ""
+			continue
+		}
+
 		// If DataTemplate does not point to this object, discard
 		if dataObject.Spec.Template.Name == "" {
 			continue
@@ -141,210 +754,2611 @@ func (m *DataTemplateManager) getIndexes(ctx context.Context) (map[int]string, e
 		if dataObject.Spec.Claim.Name != "" {
 			claimName = dataObject.Spec.Claim.Name
 		}
-		m.DataTemplate.Status.Indexes[claimName] = dataObject.Spec.Index
+		m.DataTemplate.Status.Indexes[claimName] = m.newIndexEntry(&dataObject, claimName)
 		indexes[dataObject.Spec.Index] = claimName
+
+		// In Shared mode, the other claims are only in the owner references
+		for _, ownerRef := range dataObject.OwnerReferences {
+			if ownerRef.Kind == "Metal3DataClaim" && ownerRef.Name != claimName {
+				m.DataTemplate.Status.Indexes[ownerRef.Name] = m.newIndexEntry(
+					&dataObject, ownerRef.Name,
+				)
+			}
+		}
 	}
+	m.listedDatas = dataObjects.Items
 	m.updateStatusTimestamp()
 	return indexes, nil
 }
 
-func (m *DataTemplateManager) updateStatusTimestamp() {
-	now := metav1.Now()
-	m.DataTemplate.Status.LastUpdated = &now
+// autoRecreateStatus returns false, and sets the StatusRecreationRequired
+// condition, if the status was never updated and DisableAutoRecreateStatus
+// is set, in which case only PurgeStatus builds it. It clears the condition
+// otherwise.
+func (m *DataTemplateManager) autoRecreateStatus() bool {
+	if m.DataTemplate.Spec.DisableAutoRecreateStatus &&
+		m.DataTemplate.Status.LastUpdated.IsZero() {
+		conditions.Set(m.DataTemplate, &capi.Condition{
+			Type:     capm3.StatusRecreationRequiredCondition,
+			Status:   corev1.ConditionTrue,
+			Severity: capi.ConditionSeverityWarning,
+			Reason:   capm3.AutoRecreateStatusDisabledReason,
+			Message: "The status is not recreated automatically, set the " +
+				ConfirmPurgeAnnotation + " annotation to \"true\" to recreate it",
+		})
+		return false
+	}
+	conditions.Delete(m.DataTemplate, capm3.StatusRecreationRequiredCondition)
+	return true
 }
 
-// UpdateDatas manages the claims and creates or deletes Metal3Data accordingly.
-// It returns the number of current allocations
-func (m *DataTemplateManager) UpdateDatas(ctx context.Context) (int, error) {
-
-	indexes, err := m.getIndexes(ctx)
-	if err != nil {
-		return 0, err
+// newIndexEntry builds the status entry of the index held by a Metal3Data for
+// a claim. The Metal3Machine named after the claim is preferred, as several
+// Metal3Machines own a shared Metal3Data.
+func (m *DataTemplateManager) newIndexEntry(dataObject *capm3.Metal3Data,
+	claimName string,
+) capm3.IndexEntry {
+	entry := capm3.IndexEntry{
+		Index: dataObject.Spec.Index,
 	}
-
-	// get list of Metal3DataClaim objects
-	dataClaimObjects := capm3.Metal3DataClaimList{}
-	// without this ListOption, all namespaces would be including in the listing
-	opts := &client.ListOptions{
-		Namespace: m.DataTemplate.Namespace,
+	if dataObject.Name != dataObject.Spec.Template.Name+"-"+strconv.Itoa(dataObject.Spec.Index) {
+		entry.DataName = dataObject.Name
 	}
-
-	err = m.client.List(ctx, &dataClaimObjects, opts)
-	if err != nil {
-		return 0, err
+	if !dataObject.CreationTimestamp.IsZero() {
+		allocatedAt := dataObject.CreationTimestamp
+		entry.AllocatedAt = &allocatedAt
 	}
-
-	// Iterate over the Metal3Data objects to find all indexes and objects
-	for _, dataClaim := range dataClaimObjects.Items {
-		// If DataTemplate does not point to this object, discard
-		if dataClaim.Spec.Template.Name != m.DataTemplate.Name {
+	for _, ownerRef := range dataObject.OwnerReferences {
+		if !Contains(m.OwnerKindFilter, ownerRef.Kind) {
 			continue
 		}
-
-		if dataClaim.Status.RenderedData != nil && dataClaim.DeletionTimestamp.IsZero() {
-			continue
+		if entry.MachineName == "" || ownerRef.Name == claimName {
+			entry.MachineName = ownerRef.Name
+			entry.MachineUID = string(ownerRef.UID)
 		}
-
-		indexes, err = m.updateData(ctx, &dataClaim, indexes)
-		if err != nil {
-			return 0, err
+		if ownerRef.Name == claimName {
+			break
 		}
 	}
-	m.updateStatusTimestamp()
-	return len(indexes), nil
+	return entry
 }
 
-func (m *DataTemplateManager) updateData(ctx context.Context,
-	dataClaim *capm3.Metal3DataClaim, indexes map[int]string,
-) (map[int]string, error) {
+// dataName returns the name of the Metal3Data holding the index of the entry
+func (m *DataTemplateManager) dataName(entry capm3.IndexEntry) string {
+	return entryDataName(m.DataTemplate, entry)
+}
 
-	helper, err := patch.NewHelper(dataClaim, m.client)
-	if err != nil {
-		return indexes, errors.Wrap(err, "failed to init patch helper")
+// entryDataName returns the name of the Metal3Data holding the index of the
+// entry of the Metal3DataTemplate
+func entryDataName(dataTemplate *capm3.Metal3DataTemplate,
+	entry capm3.IndexEntry,
+) string {
+	if entry.DataName != "" {
+		return entry.DataName
 	}
-	// Always patch dataClaim exiting this function so we can persist any changes.
-	defer func() {
-		err := helper.Patch(ctx, dataClaim)
-		if err != nil {
-			m.Log.Info("failed to Patch capm3DataClaim")
-		}
-	}()
+	return dataTemplate.Name + "-" + strconv.Itoa(entry.Index)
+}
 
-	dataClaim.Status.ErrorMessage = nil
+// isTransferredData returns true if the Metal3Data was generated from this
+// template and is waiting for its transfer to another one
+func (m *DataTemplateManager) isTransferredData(m3Data *capm3.Metal3Data) bool {
+	if m3Data.Spec.Template.Name != m.DataTemplate.Name {
+		return false
+	}
+	_, ok := m3Data.Annotations[TransferToAnnotation]
+	return ok
+}
 
-	if dataClaim.DeletionTimestamp.IsZero() {
-		indexes, err = m.createData(ctx, dataClaim, indexes)
-		if err != nil {
-			return indexes, err
-		}
-	} else {
-		indexes, err = m.deleteData(ctx, dataClaim, indexes)
-		if err != nil {
-			return indexes, err
-		}
+// activeDataTemplateReconciles holds the number of reconciliations in
+// progress of each Metal3DataTemplate, by namespaced name, as an *int32 only
+// accessed atomically
+var activeDataTemplateReconciles sync.Map
+
+// StartDataTemplateReconcile records the start of a reconciliation of the
+// Metal3DataTemplate, also in the metal3_datatemplate_active_reconciles
+// gauge. EndDataTemplateReconcile must be called at its end.
+func StartDataTemplateReconcile(key types.NamespacedName) {
+	activeReconcilesGauge.Inc()
+	count, _ := activeDataTemplateReconciles.LoadOrStore(key, new(int32))
+	atomic.AddInt32(count.(*int32), 1)
+}
+
+// EndDataTemplateReconcile records the end of a reconciliation started with
+// StartDataTemplateReconcile. The counter of the Metal3DataTemplate is
+// removed once no reconciliation of it is in progress, the workqueue never
+// starting another one in the meantime.
+func EndDataTemplateReconcile(key types.NamespacedName) {
+	activeReconcilesGauge.Dec()
+	count, ok := activeDataTemplateReconciles.Load(key)
+	if !ok {
+		return
+	}
+	if atomic.AddInt32(count.(*int32), -1) <= 0 {
+		activeDataTemplateReconciles.Delete(key)
 	}
-	return indexes, nil
 }
 
-func (m *DataTemplateManager) createData(ctx context.Context,
-	dataClaim *capm3.Metal3DataClaim, indexes map[int]string,
-) (map[int]string, error) {
-	if !Contains(dataClaim.Finalizers, capm3.DataClaimFinalizer) {
-		dataClaim.Finalizers = append(dataClaim.Finalizers,
-			capm3.DataClaimFinalizer,
-		)
+// dataTemplateReconciles returns the number of reconciliations in progress
+// of the Metal3DataTemplate
+func dataTemplateReconciles(key types.NamespacedName) int {
+	count, ok := activeDataTemplateReconciles.Load(key)
+	if !ok {
+		return 0
 	}
+	return int(atomic.LoadInt32(count.(*int32)))
+}
 
-	if dataClaimIndex, ok := m.DataTemplate.Status.Indexes[dataClaim.Name]; ok {
-		dataClaim.Status.RenderedData = &corev1.ObjectReference{
-			Name:      m.DataTemplate.Name + "-" + strconv.Itoa(dataClaimIndex),
-			Namespace: m.DataTemplate.Namespace,
+// CheckControllerVersion returns false, and sets the
+// IncompatibleControllerVersion condition of the Metal3DataTemplate, if the
+// controller is older than its MinControllerVersion. It clears the condition
+// otherwise.
+func CheckControllerVersion(dataTemplate *capm3.Metal3DataTemplate) bool {
+	return checkControllerVersion(dataTemplate, version.Version)
+}
+
+// checkControllerVersion implements CheckControllerVersion for the given
+// controller version. A controller version that is not a semantic version,
+// like the one of a development build, is compatible with any template.
+func checkControllerVersion(dataTemplate *capm3.Metal3DataTemplate,
+	controllerVersion string,
+) bool {
+	minVersion := dataTemplate.Spec.MinControllerVersion
+	if minVersion != "" {
+		current, currentErr := utilversion.ParseSemantic(controllerVersion)
+		required, requiredErr := utilversion.ParseSemantic(minVersion)
+		if currentErr == nil && requiredErr == nil && !current.AtLeast(required) {
+			conditions.Set(dataTemplate, &capi.Condition{
+				Type:   capm3.IncompatibleControllerVersionCondition,
+				Status: corev1.ConditionTrue,
+				Reason: capm3.ControllerVersionTooOldReason,
+				Message: fmt.Sprintf(
+					"Controller version %s is older than the minimum version %s",
+					controllerVersion, minVersion,
+				),
+			})
+			return false
 		}
-		return indexes, nil
 	}
+	conditions.Delete(dataTemplate, capm3.IncompatibleControllerVersionCondition)
+	return true
+}
 
-	m3mUID := types.UID("")
-	m3mName := ""
-	for _, ownerRef := range dataClaim.OwnerReferences {
-		aGV, err := schema.ParseGroupVersion(ownerRef.APIVersion)
-		if err != nil {
-			return indexes, err
-		}
-		if ownerRef.Kind == "Metal3Machine" &&
-			aGV.Group == capm3.GroupVersion.Group {
-			m3mUID = ownerRef.UID
-			m3mName = ownerRef.Name
-			break
+// revisionHistoryLimit is the maximum number of entries of the
+// RevisionHistory of a Metal3DataTemplate
+const revisionHistoryLimit = 10
+
+// RecordSpecRevision appends an entry to the RevisionHistory of the
+// Metal3DataTemplate if its spec changed since the last entry, and returns
+// true in that case. Only the last revisionHistoryLimit entries are kept.
+func RecordSpecRevision(dataTemplate *capm3.Metal3DataTemplate) bool {
+	specChecksum, fieldChecksums := specChecksums(dataTemplate.Spec)
+	history := dataTemplate.Status.RevisionHistory
+	entry := capm3.RevisionEntry{
+		Revision:       1,
+		ChangedAt:      metav1.Now(),
+		SpecChecksum:   specChecksum,
+		FieldChecksums: fieldChecksums,
+	}
+	if len(history) > 0 {
+		last := history[len(history)-1]
+		if last.SpecChecksum == specChecksum {
+			return false
 		}
+		entry.Revision = last.Revision + 1
+		entry.ChangedFields = changedFields(last.FieldChecksums, fieldChecksums)
 	}
-	if m3mName == "" {
+	history = append(history, entry)
+	if len(history) > revisionHistoryLimit {
+		history = history[len(history)-revisionHistoryLimit:]
+	}
+	dataTemplate.Status.RevisionHistory = history
+	return true
+}
+
+// specChecksums returns the FNV hash of the JSON of the spec, and of each of
+// its fields set, by JSON name
+func specChecksums(spec capm3.Metal3DataTemplateSpec) (string, map[string]string) {
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		return "", nil
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(specJSON, &fields); err != nil {
+		return "", nil
+	}
+	fieldChecksums := make(map[string]string, len(fields))
+	for name, value := range fields {
+		fieldChecksums[name] = fnvHash(value)
+	}
+	return fnvHash(specJSON), fieldChecksums
+}
+
+// changedFields returns the sorted names of the fields whose checksum
+// differs, including the fields set in only one of them
+func changedFields(previous, current map[string]string) []string {
+	changed := []string{}
+	for name, checksum := range current {
+		if previous[name] != checksum {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func fnvHash(data []byte) string {
+	hash := fnv.New64a()
+	_, _ = hash.Write(data)
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+func (m *DataTemplateManager) updateStatusTimestamp() {
+	now := metav1.Now()
+	m.DataTemplate.Status.LastUpdated = &now
+	m.DataTemplate.Status.ConcurrentReconcileCount = dataTemplateReconciles(
+		types.NamespacedName{
+			Namespace: m.DataTemplate.Namespace,
+			Name:      m.DataTemplate.Name,
+		},
+	)
+	m.DataTemplate.Status.ControllerVersion = version.Version
+	m.DataTemplate.Status.OwnerReferencesHash = ownerReferencesHash(
+		m.DataTemplate.OwnerReferences,
+	)
+	m.DataTemplate.Status.IndexChecksum = indexChecksum(m.DataTemplate.Status.Indexes)
+	gaps := m.indexGaps(m.DataTemplate.Status.Indexes)
+	m.DataTemplate.Status.LargestGap = largestGap(gaps)
+	m.DataTemplate.Status.FragmentationRatio = fragmentationRatio(gaps)
+	if m.DataTemplate.Annotations == nil {
+		m.DataTemplate.Annotations = make(map[string]string)
+	}
+	m.DataTemplate.Annotations[IndexChecksumAnnotation] = m.DataTemplate.Status.IndexChecksum
+}
+
+// IndexGap describes a range of consecutive free indexes, with the
+// IndexStep, from Start to End included. Size is its number of indexes.
+type IndexGap struct {
+	Start int
+	End   int
+	Size  int
+}
+
+// InspectGaps returns the ranges of consecutive free indexes between MinIndex
+// and MaxIndex, sorted by index, from the indexes stored in the status or its
+// status store. The indexes statically assigned or reserved are not free.
+// Without MaxIndex, the unbounded range after the last allocated index is not
+// returned.
+func (m *DataTemplateManager) InspectGaps(ctx context.Context) ([]IndexGap, error) {
+	indexes, err := statusIndexes(ctx, m.client, m.DataTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return m.indexGaps(indexes), nil
+}
+
+// indexGaps implements InspectGaps for the given indexes
+func (m *DataTemplateManager) indexGaps(indexes map[string]capm3.IndexEntry) []IndexGap {
+	minIndex := m.DataTemplate.Spec.MinIndex
+	maxIndex := m.DataTemplate.Spec.MaxIndex
+	step := m.indexStep()
+
+	blockedIndexes := []int{}
+	for _, entry := range indexes {
+		blockedIndexes = append(blockedIndexes, entry.Index)
+	}
+	for _, index := range m.DataTemplate.Spec.StaticAssignments {
+		blockedIndexes = append(blockedIndexes, index)
+	}
+	for _, reservation := range m.DataTemplate.Status.ReservedIndexes {
+		if m.isReservedIndex(reservation.Index) {
+			blockedIndexes = append(blockedIndexes, reservation.Index)
+		}
+	}
+
+	// Positions of the blocked indexes in the index space, which has
+	// slots positions if MaxIndex is set
+	positions := []int{}
+	for _, index := range blockedIndexes {
+		if index < minIndex || (maxIndex != 0 && index > maxIndex) ||
+			(index-minIndex)%step != 0 {
+			continue
+		}
+		positions = append(positions, (index-minIndex)/step)
+	}
+	sort.Ints(positions)
+	slots := 0
+	if maxIndex != 0 {
+		slots = (maxIndex-minIndex)/step + 1
+	} else if len(positions) > 0 {
+		slots = positions[len(positions)-1] + 1
+	}
+
+	gaps := []IndexGap{}
+	addGap := func(start, end int) {
+		if end > start {
+			gaps = append(gaps, IndexGap{
+				Start: minIndex + start*step,
+				End:   minIndex + (end-1)*step,
+				Size:  end - start,
+			})
+		}
+	}
+	next := 0
+	for _, position := range positions {
+		addGap(next, position)
+		if position+1 > next {
+			next = position + 1
+		}
+	}
+	addGap(next, slots)
+	return gaps
+}
+
+// largestGap returns the Size of the largest of the gaps, 0 if none
+func largestGap(gaps []IndexGap) int {
+	largest := 0
+	for _, gap := range gaps {
+		if gap.Size > largest {
+			largest = gap.Size
+		}
+	}
+	return largest
+}
+
+// fragmentationRatio returns the number of free indexes of the gaps divided
+// by the Size of the largest one, formatted with two decimals, or an empty
+// string if there is no gap. It is 1 if all the free indexes are consecutive.
+func fragmentationRatio(gaps []IndexGap) string {
+	largest := largestGap(gaps)
+	if largest == 0 {
+		return ""
+	}
+	free := 0
+	for _, gap := range gaps {
+		free += gap.Size
+	}
+	return strconv.FormatFloat(float64(free)/float64(largest), 'f', 2, 64)
+}
+
+// indexChecksum returns the hex encoded SHA256 of the JSON of the index and
+// machine name of each entry, by claim name. The JSON encoding sorts the map
+// keys. The allocation times and UIDs are left out, as they differ in
+// another cluster, for example after a pivot.
+func indexChecksum(entries map[string]capm3.IndexEntry) string {
+	type indexPair struct {
+		Index       int    `json:"index"`
+		MachineName string `json:"machineName,omitempty"`
+	}
+	pairs := make(map[string]indexPair, len(entries))
+	for claimName, entry := range entries {
+		pairs[claimName] = indexPair{Index: entry.Index, MachineName: entry.MachineName}
+	}
+	pairsJSON, err := json.Marshal(pairs)
+	if err != nil {
+		return ""
+	}
+	checksum := sha256.Sum256(pairsJSON)
+	return hex.EncodeToString(checksum[:])
+}
+
+// ownerReferencesHash returns the FNV hash of the JSON of the sorted owner
+// references
+func ownerReferencesHash(ownerRefs []metav1.OwnerReference) string {
+	sortedRefs := make([]metav1.OwnerReference, len(ownerRefs))
+	copy(sortedRefs, ownerRefs)
+	sort.Slice(sortedRefs, func(i, j int) bool {
+		if sortedRefs[i].Kind != sortedRefs[j].Kind {
+			return sortedRefs[i].Kind < sortedRefs[j].Kind
+		}
+		if sortedRefs[i].Name != sortedRefs[j].Name {
+			return sortedRefs[i].Name < sortedRefs[j].Name
+		}
+		return sortedRefs[i].UID < sortedRefs[j].UID
+	})
+	refsJSON, err := json.Marshal(sortedRefs)
+	if err != nil {
+		return ""
+	}
+	return fnvHash(refsJSON)
+}
+
+// PurgeStatus resets the status of the Metal3DataTemplate and rebuilds it from
+// the existing Metal3Data objects. It requires the ConfirmPurgeAnnotation to
+// be set to "true", and removes it once done.
+func (m *DataTemplateManager) PurgeStatus(ctx context.Context) error {
+	if m.DataTemplate.Annotations[ConfirmPurgeAnnotation] != "true" {
+		return errors.New("Purge not confirmed, " + ConfirmPurgeAnnotation +
+			" annotation must be set to \"true\"")
+	}
+
+	helper, err := patch.NewHelper(m.DataTemplate, m.client)
+	if err != nil {
+		return errors.Wrap(err, "failed to init patch helper")
+	}
+	m.Log.Info("Purging the status", "cluster", clusterNameFromContext(ctx))
+	delete(m.DataTemplate.Annotations, ConfirmPurgeAnnotation)
+	// The cumulative counters and the pending deletions survive the purge
+	m.DataTemplate.Status = capm3.Metal3DataTemplateStatus{
+		ProvisionedMachineCount:   m.DataTemplate.Status.ProvisionedMachineCount,
+		DeprovisionedMachineCount: m.DataTemplate.Status.DeprovisionedMachineCount,
+		PendingDeletions:          m.DataTemplate.Status.PendingDeletions,
+	}
+	if err := helper.Patch(ctx, m.DataTemplate); err != nil {
+		return errors.Wrap(err, "failed to patch the purged status")
+	}
+
+	helper, err = patch.NewHelper(m.DataTemplate, m.client)
+	if err != nil {
+		return errors.Wrap(err, "failed to init patch helper")
+	}
+	if err := m.processPendingDeletions(ctx); err != nil {
+		return err
+	}
+	if _, err := m.getIndexes(ctx); err != nil {
+		return err
+	}
+	if err := m.storeExternalStatus(ctx); err != nil {
+		return err
+	}
+	return helper.Patch(ctx, m.DataTemplate)
+}
+
+// CompactStatus removes the empty entries of the status maps and patches the
+// status. These are the index of the Metal3Data objects without a
+// Metal3DataClaim, recorded under an empty claim name, and the IP addresses
+// of the IPIndex without a Metal3Machine. The Metal3Data objects are not
+// deleted, so their indexes are recorded again by the next reconciliation if
+// they still have no Metal3DataClaim.
+func (m *DataTemplateManager) CompactStatus(ctx context.Context) error {
+	indexes, err := statusIndexes(ctx, m.client, m.DataTemplate)
+	if err != nil {
+		return err
+	}
+
+	helper, err := patch.NewHelper(m.DataTemplate, m.client)
+	if err != nil {
+		return errors.Wrap(err, "failed to init patch helper")
+	}
+	m.DataTemplate.Status.Indexes = indexes
+	if entry, ok := m.DataTemplate.Status.Indexes[""]; ok {
+		m.Log.Info("Removing the unclaimed index from the status",
+			"cluster", clusterNameFromContext(ctx), "index", entry.Index,
+		)
+		delete(m.DataTemplate.Status.Indexes, "")
+	}
+	for ipAddress, machineName := range m.DataTemplate.Status.IPIndex {
+		if machineName == "" {
+			delete(m.DataTemplate.Status.IPIndex, ipAddress)
+		}
+	}
+	m.updateEmergencyAllocations()
+	m.updateStatusTimestamp()
+	if err := m.storeExternalStatus(ctx); err != nil {
+		return err
+	}
+	return helper.Patch(ctx, m.DataTemplate)
+}
+
+// MigrateStatus converts the indexes of the status stored in the
+// StatusVersionIndexMap format, which only have an index, to the current
+// format. The indexes are rebuilt from the Metal3Data objects, as in every
+// reconciliation, which hold the Metal3Machine and the allocation time of
+// the entries. It then records the version found and the time in the
+// LastMigratedAt and MigratedFromVersion of the status, exports the time as
+// a gauge, and patches the status.
+func (m *DataTemplateManager) MigrateStatus(ctx context.Context) error {
+	indexes, err := statusIndexes(ctx, m.client, m.DataTemplate)
+	if err != nil {
+		return err
+	}
+	version := StatusVersionIndexEntries
+	for claimName, entry := range indexes {
+		if claimName != "" && entry.MachineName == "" && entry.AllocatedAt == nil {
+			version = StatusVersionIndexMap
+			break
+		}
+	}
+
+	helper, err := patch.NewHelper(m.DataTemplate, m.client)
+	if err != nil {
+		return errors.Wrap(err, "failed to init patch helper")
+	}
+	if _, err := m.getIndexes(ctx); err != nil {
+		return err
+	}
+	m.Log.Info("Migrated the status", "cluster", clusterNameFromContext(ctx),
+		"version", version,
+	)
+
+	now := metav1.Now()
+	m.DataTemplate.Status.LastMigratedAt = &now
+	m.DataTemplate.Status.MigratedFromVersion = version
+	m.updateStatusTimestamp()
+	if err := m.storeExternalStatus(ctx); err != nil {
+		return err
+	}
+	if err := helper.Patch(ctx, m.DataTemplate); err != nil {
+		return errors.Wrap(err, "failed to patch the migrated status")
+	}
+	migrationTimestampGauge.WithLabelValues(m.DataTemplate.Namespace,
+		m.DataTemplate.Name,
+	).Set(float64(now.Unix()))
+	return nil
+}
+
+// ResetIndex forces the allocation of a new Metal3Data to the given
+// Metal3Machine, for example when its Metal3Data is corrupted. It releases the
+// index with CancelProvisioning, so that the next UpdateDatas allocates an
+// index to the Metal3DataClaim again. It returns a DataNotFoundError if there
+// is no allocation for this machine.
+func (m *DataTemplateManager) ResetIndex(ctx context.Context,
+	machineName string,
+) error {
+	return m.CancelProvisioning(ctx, machineName)
+}
+
+// clearRenderedData clears the rendered data and the error message of the
+// Metal3DataClaim, if it still exists, so that an index is allocated to it
+// again
+func (m *DataTemplateManager) clearRenderedData(ctx context.Context,
+	claimName string,
+) error {
+	dataClaim := &capm3.Metal3DataClaim{}
+	key := client.ObjectKey{
+		Name:      claimName,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := m.client.Get(ctx, key, dataClaim); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrap(err, "Failed to get Metal3DataClaim")
+	}
+	helper, err := patch.NewHelper(dataClaim, m.client)
+	if err != nil {
+		return errors.Wrap(err, "failed to init patch helper")
+	}
+	dataClaim.Status.RenderedData = nil
+	dataClaim.Status.ErrorMessage = nil
+	return helper.Patch(ctx, dataClaim)
+}
+
+// claimNameForMachine returns the name of the Metal3DataClaim of the given
+// Metal3Machine in the indexes, or an empty string if it has no allocation
+func claimNameForMachine(indexes map[string]capm3.IndexEntry,
+	machineName string,
+) string {
+	if _, ok := indexes[machineName]; ok {
+		return machineName
+	}
+	for claimName, entry := range indexes {
+		if entry.MachineName == machineName {
+			return claimName
+		}
+	}
+	return ""
+}
+
+// SimulateDelete returns the actions that the deletion of the Metal3DataClaim
+// of the given Metal3Machine would take, as human-readable strings, for
+// example to review them before deprovisioning the machine. It only reads the
+// status and does not create, update or delete any object. It returns a
+// DataNotFoundError if there is no allocation for this machine.
+func (m *DataTemplateManager) SimulateDelete(ctx context.Context,
+	machineName string,
+) ([]string, error) {
+	indexes, err := statusIndexes(ctx, m.client, m.DataTemplate)
+	if err != nil {
+		return nil, err
+	}
+	claimName := claimNameForMachine(indexes, machineName)
+	if claimName == "" {
+		return nil, &DataNotFoundError{Machine: machineName}
+	}
+	entry := indexes[claimName]
+	dataName := m.dataName(entry)
+
+	sharedWith := ""
+	for otherName, otherEntry := range indexes {
+		if otherName != claimName && otherEntry.Index == entry.Index {
+			sharedWith = otherName
+			break
+		}
+	}
+
+	actions := []string{}
+	if sharedWith != "" {
+		actions = append(actions, fmt.Sprintf(
+			"Remove Metal3DataClaim %s and Metal3Machine %s from the owners of Metal3Data %s, shared with Metal3DataClaim %s",
+			claimName, machineName, dataName, sharedWith,
+		))
+	} else {
+		actions = append(actions, fmt.Sprintf("Delete Metal3Data %s", dataName))
+		if m.DataTemplate.Spec.IPPoolRef != nil {
+			actions = append(actions, fmt.Sprintf(
+				"Release IPClaim %s-%s from IPPool %s", dataName,
+				m.DataTemplate.Spec.IPPoolRef.Name,
+				m.DataTemplate.Spec.IPPoolRef.Name,
+			))
+		}
+	}
+	actions = append(actions, fmt.Sprintf(
+		"Remove Metal3DataClaim %s from the indexes", claimName,
+	))
+	if sharedWith != "" {
+		return actions, nil
+	}
+
+	actions = append(actions, fmt.Sprintf("Free index %d", entry.Index))
+	if m.DataTemplate.Spec.AllocationOrder == capm3.AllocationOrderFIFO ||
+		m.DataTemplate.Spec.AllocationOrder == capm3.AllocationOrderLIFO {
+		actions = append(actions, fmt.Sprintf(
+			"Append index %d to the freed indexes", entry.Index,
+		))
+	}
+	if _, ok := m.DataTemplate.Status.EmergencyAllocations[claimName]; ok {
+		actions = append(actions, fmt.Sprintf(
+			"Remove Metal3DataClaim %s from the emergency allocations", claimName,
+		))
+	}
+	ipAddresses := []string{}
+	for ipAddress, ipMachineName := range m.DataTemplate.Status.IPIndex {
+		if ipMachineName == machineName {
+			ipAddresses = append(ipAddresses, ipAddress)
+		}
+	}
+	sort.Strings(ipAddresses)
+	for _, ipAddress := range ipAddresses {
+		actions = append(actions, fmt.Sprintf(
+			"Remove IP address %s from the IP index", ipAddress,
+		))
+	}
+	if conditions.IsTrue(m.DataTemplate, capm3.IndexSpaceExhaustedCondition) {
+		actions = append(actions, fmt.Sprintf(
+			"Set the %s condition to false", capm3.IndexSpaceExhaustedCondition,
+		))
+	}
+	return actions, nil
+}
+
+// previewRejection returns why createData would not allocate an index to the
+// Metal3Machine, or an empty string
+func (m *DataTemplateManager) previewRejection(ctx context.Context,
+	machineName string,
+) (string, error) {
+	m3m, err := m.getMetal3Machine(ctx, machineName)
+	if err != nil {
+		return "", err
+	}
+	if m.machineSkipsAllocation(m3m) {
+		return "Opted out of the allocation with the " + SkipAllocationAnnotation + " annotation", nil
+	}
+	if m3m == nil && m.requiresMetal3Machine() {
+		return "", metal3MachineNotFound(machineName)
+	}
+	if m.DataTemplate.Spec.OwnerReferenceFilter != nil {
+		matches, err := m.machineMatchesFilter(m3m)
+		if err != nil || !matches {
+			return "Does not match the ownerReferenceFilter", err
+		}
+	}
+	if m.DataTemplate.Spec.AllocationCondition != "" {
+		matches, err := m.machineMatchesCondition(m3m)
+		if err != nil || !matches {
+			return "Does not match the allocationCondition", err
+		}
+	}
+	if m.DataTemplate.Spec.HostSelector != nil {
+		_, matches, err := m.hostMatchesSelector(ctx, m3m)
+		if err != nil || !matches {
+			return "BareMetalHost does not match the hostSelector", err
+		}
+	}
+	return "", nil
+}
+
+// GetDataForMachine returns the Metal3Data allocated from this template for
+// the given Metal3Machine. The Metal3DataClaim of a Metal3Machine has the same
+// name, so it is used to look up the index. It returns a DataNotFoundError if
+// there is no allocation for this machine.
+func (m *DataTemplateManager) GetDataForMachine(ctx context.Context,
+	machineName string,
+) (*capm3.Metal3Data, error) {
+	indexes, err := statusIndexes(ctx, m.client, m.DataTemplate)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := indexes[machineName]
+	if !ok {
+		return nil, &DataNotFoundError{Machine: machineName}
+	}
+
+	m3Data := &capm3.Metal3Data{}
+	key := client.ObjectKey{
+		Name:      m.dataName(entry),
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := m.client.Get(ctx, key, m3Data); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, &DataNotFoundError{Machine: machineName}
+		}
+		return nil, errors.Wrap(err, "Failed to get Metal3Data")
+	}
+	return m3Data, nil
+}
+
+// CancelProvisioning releases the index allocated to the given Metal3Machine.
+// It deletes the Metal3Data, clears the rendered data of the Metal3DataClaim
+// and removes the allocation from the status, that is then patched. It
+// returns a DataNotFoundError if there is no allocation for this machine. If
+// the Metal3DataClaim still exists when it is reconciled again, a new index
+// is allocated to it.
+func (m *DataTemplateManager) CancelProvisioning(ctx context.Context,
+	machineName string,
+) error {
+	indexes, err := statusIndexes(ctx, m.client, m.DataTemplate)
+	if err != nil {
+		return err
+	}
+	claimName := claimNameForMachine(indexes, machineName)
+	if claimName == "" {
+		return &DataNotFoundError{Machine: machineName}
+	}
+	entry := indexes[claimName]
+
+	helper, err := patch.NewHelper(m.DataTemplate, m.client)
+	if err != nil {
+		return errors.Wrap(err, "failed to init patch helper")
+	}
+	m3Data := &capm3.Metal3Data{}
+	key := client.ObjectKey{
+		Name:      m.dataName(entry),
+		Namespace: m.DataTemplate.Namespace,
+	}
+	m.Log.Info("Cancelling the allocation",
+		"cluster", clusterNameFromContext(ctx),
+		"Metal3Machine", machineName,
+		"Metal3Data", key.Name,
+	)
+	if err := m.client.Get(ctx, key, m3Data); apierrors.IsNotFound(err) {
+		// The Metal3Data is gone but its address may still be claimed
+		if err := m.syncExternalIPAM(ctx, http.MethodDelete, entry.Index,
+			machineName,
+		); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return errors.Wrap(err, "Failed to get Metal3Data")
+	} else if err := m.deleteDataObject(ctx, m3Data); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "Failed to delete Metal3Data")
+	}
+	if err := m.clearRenderedData(ctx, claimName); err != nil {
+		return err
+	}
+
+	m.DataTemplate.Status.Indexes = indexes
+	delete(m.DataTemplate.Status.Indexes, claimName)
+	m.recordFreedIndex(entry.Index)
+	m.updateEmergencyAllocations()
+	if conditions.IsTrue(m.DataTemplate, capm3.IndexSpaceExhaustedCondition) {
+		conditions.MarkFalse(m.DataTemplate, capm3.IndexSpaceExhaustedCondition,
+			capm3.IndexFreedReason, capi.ConditionSeverityNone, "",
+		)
+	}
+	m.updateStatusTimestamp()
+	if err := m.storeExternalStatus(ctx); err != nil {
+		return err
+	}
+	return helper.Patch(ctx, m.DataTemplate)
+}
+
+// PatchMachine fetches the Metal3Machine in the namespace of the
+// Metal3DataTemplate, calls patchFn on it and applies the changes with a
+// merge patch. The patch carries the resource version, and is retried from a
+// fresh copy of the Metal3Machine up to patchMachineRetries times on
+// conflicts. Only the metadata and spec are patched, not the status.
+func (m *DataTemplateManager) PatchMachine(ctx context.Context,
+	machineName string, patchFn func(*capm3.Metal3Machine),
+) error {
+	key := client.ObjectKey{
+		Name:      machineName,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	var err error
+	for attempt := 0; attempt < patchMachineRetries; attempt++ {
+		m3m := &capm3.Metal3Machine{}
+		if err := m.client.Get(ctx, key, m3m); err != nil {
+			return errors.Wrap(err, "Failed to get Metal3Machine")
+		}
+		base := m3m.DeepCopy()
+		patchFn(m3m)
+		err = m.client.Patch(ctx, m3m, client.MergeFromWithOptions(base,
+			client.MergeFromWithOptimisticLock{},
+		))
+		if err == nil || !apierrors.IsConflict(err) {
+			break
+		}
+		m.Log.Info("Conflict patching Metal3Machine, retrying",
+			"cluster", clusterNameFromContext(ctx), "Metal3Machine", machineName,
+		)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to patch Metal3Machine")
+	}
+	return nil
+}
+
+// FetchRemoteStatus returns the status of the Metal3DataTemplate with the same
+// name and namespace in the cluster of remoteClient, for example to compare it
+// with DiffStatuses during a pivot
+func (m *DataTemplateManager) FetchRemoteStatus(ctx context.Context,
+	remoteClient client.Client,
+) (*capm3.Metal3DataTemplateStatus, error) {
+	dataTemplate := &capm3.Metal3DataTemplate{}
+	key := client.ObjectKey{
+		Name:      m.DataTemplate.Name,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := remoteClient.Get(ctx, key, dataTemplate); err != nil {
+		return nil, errors.Wrap(err, "Failed to get remote Metal3DataTemplate")
+	}
+	indexes, err := statusIndexes(ctx, remoteClient, dataTemplate)
+	if err != nil {
+		return nil, err
+	}
+	dataTemplate.Status.Indexes = indexes
+	return &dataTemplate.Status, nil
+}
+
+// DiffStatuses returns the human readable differences between the allocations
+// of two Metal3DataTemplate statuses, sorted
+func DiffStatuses(a, b *capm3.Metal3DataTemplateStatus) []string {
+	if a == nil {
+		a = &capm3.Metal3DataTemplateStatus{}
+	}
+	if b == nil {
+		b = &capm3.Metal3DataTemplateStatus{}
+	}
+	diffs := []string{}
+
+	for claimName, entryA := range a.Indexes {
+		entryB, ok := b.Indexes[claimName]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("claim %s: index %d only in the first status",
+				claimName, entryA.Index,
+			))
+			continue
+		}
+		if entryA.Index != entryB.Index {
+			diffs = append(diffs, fmt.Sprintf("claim %s: index %d != %d",
+				claimName, entryA.Index, entryB.Index,
+			))
+		}
+		if entryA.MachineName != entryB.MachineName {
+			diffs = append(diffs, fmt.Sprintf("claim %s: machine %q != %q",
+				claimName, entryA.MachineName, entryB.MachineName,
+			))
+		}
+	}
+	for claimName, entryB := range b.Indexes {
+		if _, ok := a.Indexes[claimName]; !ok {
+			diffs = append(diffs, fmt.Sprintf("claim %s: index %d only in the second status",
+				claimName, entryB.Index,
+			))
+		}
+	}
+
+	for ip, machineA := range a.IPIndex {
+		machineB, ok := b.IPIndex[ip]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("ip %s: machine %s only in the first status",
+				ip, machineA,
+			))
+		} else if machineA != machineB {
+			diffs = append(diffs, fmt.Sprintf("ip %s: machine %s != %s",
+				ip, machineA, machineB,
+			))
+		}
+	}
+	for ip, machineB := range b.IPIndex {
+		if _, ok := a.IPIndex[ip]; !ok {
+			diffs = append(diffs, fmt.Sprintf("ip %s: machine %s only in the second status",
+				ip, machineB,
+			))
+		}
+	}
+
+	if a.ControllerVersion != b.ControllerVersion {
+		diffs = append(diffs, fmt.Sprintf("controller version %q != %q",
+			a.ControllerVersion, b.ControllerVersion,
+		))
+	}
+
+	sort.Strings(diffs)
+	return diffs
+}
+
+// ExplainIndex returns a human readable description of the allocation of the
+// given index, based on the live Metal3DataTemplate and Metal3Data objects
+func (m *DataTemplateManager) ExplainIndex(ctx context.Context, index int) (string, error) {
+	dataTemplate := &capm3.Metal3DataTemplate{}
+	key := client.ObjectKey{
+		Name:      m.DataTemplate.Name,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := m.client.Get(ctx, key, dataTemplate); err != nil {
+		return "", errors.Wrap(err, "Failed to get Metal3DataTemplate")
+	}
+	indexes, err := statusIndexes(ctx, m.client, dataTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	claimName := ""
+	for name, entry := range indexes {
+		if entry.Index == index {
+			claimName = name
+			break
+		}
+	}
+	if claimName == "" {
+		return "", errors.Errorf("Index %d is not allocated", index)
+	}
+
+	m3Data := &capm3.Metal3Data{}
+	key = client.ObjectKey{
+		Name:      m.dataName(indexes[claimName]),
+		Namespace: dataTemplate.Namespace,
+	}
+	if err := m.client.Get(ctx, key, m3Data); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Sprintf("Index %d allocated to claim %s, Metal3Data %s not found",
+				index, claimName, key.Name,
+			), nil
+		}
+		return "", errors.Wrap(err, "Failed to get Metal3Data")
+	}
+
+	machineName := claimName
+	for _, ownerRef := range m3Data.OwnerReferences {
+		if Contains(m.OwnerKindFilter, ownerRef.Kind) {
+			machineName = ownerRef.Name
+			break
+		}
+	}
+
+	return fmt.Sprintf("Index %d allocated to machine %s (Metal3Data %s), created at %s",
+		index, machineName, m3Data.Name,
+		m3Data.CreationTimestamp.UTC().Format(time.RFC3339),
+	), nil
+}
+
+// ForEachIndex calls fn for each allocated index of the status, sorted by
+// index, with the names of the machine and of the Metal3Data it is allocated
+// to. It stops and returns the first error returned by fn.
+func (m *DataTemplateManager) ForEachIndex(fn func(index int, machineName string,
+	dataName string) error,
+) error {
+	return forEachIndex(m.DataTemplate, m.DataTemplate.Status.Indexes, fn)
+}
+
+// forEachIndex is ForEachIndex on the given indexes of the
+// Metal3DataTemplate, for the callers reading them with statusIndexes. The
+// claims sharing an index are sorted by name.
+func forEachIndex(dataTemplate *capm3.Metal3DataTemplate,
+	indexes map[string]capm3.IndexEntry,
+	fn func(index int, machineName string, dataName string) error,
+) error {
+	claimNames := make([]string, 0, len(indexes))
+	for claimName := range indexes {
+		claimNames = append(claimNames, claimName)
+	}
+	sort.Slice(claimNames, func(i, j int) bool {
+		if indexes[claimNames[i]].Index != indexes[claimNames[j]].Index {
+			return indexes[claimNames[i]].Index < indexes[claimNames[j]].Index
+		}
+		return claimNames[i] < claimNames[j]
+	})
+
+	for _, claimName := range claimNames {
+		entry := indexes[claimName]
+		machineName := entry.MachineName
+		if machineName == "" {
+			machineName = claimName
+		}
+		if err := fn(entry.Index, machineName, entryDataName(dataTemplate, entry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDataFromTemplate returns true if the Metal3Data was generated from this
+// template and belongs to the cluster of the template
+func (m *DataTemplateManager) isDataFromTemplate(m3Data *capm3.Metal3Data) bool {
+	if m3Data.Namespace != m.DataTemplate.Namespace {
+		return false
+	}
+	if m3Data.Spec.Template.Name != m.DataTemplate.Name {
+		return false
+	}
+	return m3Data.Labels[capi.ClusterLabelName] == m.DataTemplate.Spec.ClusterName
+}
+
+// Startup performs the one-time initialization of the Metal3DataTemplate,
+// before its first UpdateDatas. It validates the spec, and warms the cache of
+// the client by listing the Metal3Data and Metal3DataClaim objects of the
+// namespace, so that concurrent reconciliations do not start the informers.
+// The template already exists, accepted by an older webhook, so an invalid
+// spec is only logged instead of blocking the template.
+func (m *DataTemplateManager) Startup(ctx context.Context) error {
+	if err := m.DataTemplate.ValidateCreate(); err != nil {
+		m.Log.Info("Invalid Metal3DataTemplate spec",
+			"cluster", clusterNameFromContext(ctx), "error", err.Error(),
+		)
+	}
+	if err := m.list(ctx, &capm3.Metal3DataList{}); err != nil {
+		return errors.Wrap(err, "Failed to list the Metal3Data objects")
+	}
+	if err := m.list(ctx, &capm3.Metal3DataClaimList{}); err != nil {
+		return errors.Wrap(err, "Failed to list the Metal3DataClaim objects")
+	}
+	m.Log.Info("Started", "cluster", clusterNameFromContext(ctx))
+	return nil
+}
+
+// PanicError is returned by RecoverFromPanic when the function panicked
+type PanicError struct {
+	// Value is the value passed to panic
+	Value interface{}
+	// Stack is the stack trace of the goroutine when it panicked
+	Stack []byte
+}
+
+// Error implements the error interface
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("recovered from panic: %v", e.Value)
+}
+
+// RecoverFromPanic runs fn and returns its error. If fn panics, the panic is
+// recovered, logged with its stack trace and recorded as a Warning Event on
+// the Metal3DataTemplate, and a PanicError is returned with recovered set to
+// true, so that the reconciliation can be requeued instead of crashing the
+// controller.
+func (m *DataTemplateManager) RecoverFromPanic(ctx context.Context,
+	fn func() error,
+) (recovered bool, err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			panicErr := &PanicError{Value: value, Stack: debug.Stack()}
+			m.Log.Error(panicErr, "Recovered from a panic",
+				"cluster", clusterNameFromContext(ctx),
+				"stack", string(panicErr.Stack),
+			)
+			m.recordEvent(corev1.EventTypeWarning,
+				ReconcilePanicEventReason, panicErr.Error(),
+			)
+			recovered, err = true, panicErr
+		}
+	}()
+	return false, fn()
+}
+
+// UpdateDatas manages the claims and creates or deletes Metal3Data accordingly.
+// It returns the number of current allocations and the changes of the
+// allocations. The failures are reported to the AlertmanagerWebhook.
+func (m *DataTemplateManager) UpdateDatas(ctx context.Context,
+	clientFactory ServiceAccountClientGetter,
+) (int, DeltaStatus, error) {
+	allocationsNb, delta, err := m.updateDatas(ctx, clientFactory)
+	m.updateAlert(ctx, err)
+	return allocationsNb, delta, err
+}
+
+func (m *DataTemplateManager) updateDatas(ctx context.Context,
+	clientFactory ServiceAccountClientGetter,
+) (int, DeltaStatus, error) {
+
+	// The allocations are unknown, so the reconciliation is requeued rather
+	// than reporting none, which would let a deleted template go
+	if !m.autoRecreateStatus() {
+		m.Log.Info("Not recreating the status, automatic recreation disabled",
+			"cluster", clusterNameFromContext(ctx),
+		)
+		return 0, DeltaStatus{}, &RequeueAfterError{RequeueAfter: requeueAfter}
+	}
+
+	// The Metal3Data left by a previous failed deletion are deleted first, so
+	// that they are not counted in the rebuilt indexes
+	if err := m.processPendingDeletions(ctx); err != nil {
+		return 0, DeltaStatus{}, err
+	}
+
+	m.skippedClaims = make(map[string]bool)
+	indexes, err := m.getIndexes(ctx)
+	if err != nil {
+		return 0, DeltaStatus{}, err
+	}
+	if err := m.updateDataSize(ctx); err != nil {
+		return 0, DeltaStatus{}, err
+	}
+	previousIndexes := make(map[string]capm3.IndexEntry,
+		len(m.DataTemplate.Status.Indexes),
+	)
+	for claimName, entry := range m.DataTemplate.Status.Indexes {
+		previousIndexes[claimName] = entry
+	}
+	m.pruneReservedIndexes()
+
+	// get list of Metal3DataClaim objects
+	dataClaimObjects := capm3.Metal3DataClaimList{}
+	err = m.list(ctx, &dataClaimObjects)
+	if err != nil {
+		return 0, DeltaStatus{}, err
+	}
+
+	// Iterate over the Metal3Data objects to find all indexes and objects.
+	// The client of the ServiceAccountRef is only needed to create the
+	// Metal3Data objects, the deletions do not depend on it.
+	var dataClient client.Client
+	var claimErr error
+	for _, dataClaim := range dataClaimObjects.Items {
+		// If DataTemplate does not point to this object, discard
+		if dataClaim.Spec.Template.Name != m.DataTemplate.Name {
+			continue
+		}
+
+		// The claims whose allocation notification failed are processed
+		// again to send it
+		_, notificationPending := dataClaim.Annotations[AllocationNotificationPendingAnnotation]
+		if dataClaim.Status.RenderedData != nil && dataClaim.DeletionTimestamp.IsZero() &&
+			!notificationPending {
+			continue
+		}
+
+		if dataClaim.DeletionTimestamp.IsZero() && dataClient == nil {
+			dataClient, err = m.getDataClient(ctx, clientFactory)
+			if err != nil {
+				return 0, DeltaStatus{}, err
+			}
+		}
+
+		indexes, err = m.updateData(ctx, &dataClaim, indexes, dataClient)
+		if err != nil {
+			// A claim that could not get its index, or whose notification
+			// failed, does not prevent the other claims from getting theirs.
+			// The first error is returned once they are processed.
+			_, notificationFailed := errors.Cause(err).(*notificationError)
+			if notificationFailed || dataClaim.DeletionTimestamp.IsZero() {
+				if claimErr == nil {
+					claimErr = err
+				}
+				continue
+			}
+			return 0, DeltaStatus{}, err
+		}
+	}
+	if err := m.updateIPIndex(ctx); err != nil {
+		return 0, DeltaStatus{}, err
+	}
+	m.updateEmergencyAllocations()
+	m.updateUnprovisionedMachines(dataClaimObjects.Items)
+	m.DataTemplate.Status.SkipAllocationCount = len(m.skippedClaims)
+	if err := m.recordIndexChanges(ctx, previousIndexes); err != nil {
+		return 0, DeltaStatus{}, err
+	}
+	m.updateStatusTimestamp()
+	if err := m.storeExternalStatus(ctx); err != nil {
+		return 0, DeltaStatus{}, err
+	}
+	allocatedCountGauge.WithLabelValues(m.DataTemplate.Namespace,
+		m.DataTemplate.Name,
+	).Set(float64(len(indexes)))
+	delta := m.deltaStatus(previousIndexes)
+	m.recordAllocationEvents(delta)
+	return len(indexes), delta, claimErr
+}
+
+// recordAllocationEvents records an Event on the Metal3DataTemplate for each
+// allocation and release of the delta
+func (m *DataTemplateManager) recordAllocationEvents(delta DeltaStatus) {
+	for _, allocation := range delta.Created {
+		m.recordAllocationEvent(DataCreatedEventReason,
+			fmt.Sprintf(dataCreatedEventMessage, allocation.Index,
+				allocation.MachineName, allocation.DataName,
+			),
+		)
+	}
+	for _, allocation := range delta.Deleted {
+		m.recordAllocationEvent(DataDeletedEventReason,
+			fmt.Sprintf(dataDeletedEventMessage, allocation.Index,
+				allocation.MachineName, allocation.DataName,
+			),
+		)
+	}
+}
+
+func (m *DataTemplateManager) recordAllocationEvent(reason, message string) {
+	m.recordEvent(corev1.EventTypeNormal, reason, message)
+}
+
+// recordEvent records an Event of the given type on the Metal3DataTemplate
+// with the recorder, which aggregates the repeated Events
+func (m *DataTemplateManager) recordEvent(eventType, reason, message string) {
+	if m.recorder == nil {
+		return
+	}
+	m.recorder.Event(m.DataTemplate, eventType, reason, message)
+}
+
+// LiveIndexCount returns the number of Metal3Data objects of this template
+// and its cluster, listed from the API by pages, since the status may lag
+// behind them. The count is also exported as a gauge, to compare with the
+// allocated count of the status.
+func (m *DataTemplateManager) LiveIndexCount(ctx context.Context) (int, error) {
+	listOpts := []client.ListOption{}
+	if m.DataTemplate.Spec.ClusterName != "" {
+		listOpts = append(listOpts, client.MatchingLabels{
+			capi.ClusterLabelName: m.DataTemplate.Spec.ClusterName,
+		})
+	}
+	dataObjects := capm3.Metal3DataList{}
+	if err := m.list(ctx, &dataObjects, listOpts...); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m3Data := range dataObjects.Items {
+		if m.isDataFromTemplate(&m3Data) {
+			count++
+		}
+	}
+	liveIndexCountGauge.WithLabelValues(m.DataTemplate.Namespace,
+		m.DataTemplate.Name,
+	).Set(float64(count))
+	return count, nil
+}
+
+// updateUnprovisionedMachines sets the UnprovisionedMachines of the status to
+// the Metal3Machines of the Metal3DataClaims of this template that are not
+// being deleted and have no index entry
+func (m *DataTemplateManager) updateUnprovisionedMachines(
+	dataClaims []capm3.Metal3DataClaim,
+) {
+	unprovisionedMachines := []string{}
+	for _, dataClaim := range dataClaims {
+		if dataClaim.Spec.Template.Name != m.DataTemplate.Name ||
+			!dataClaim.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if _, ok := m.DataTemplate.Status.Indexes[dataClaim.Name]; ok {
+			continue
+		}
+		if m.skippedClaims[dataClaim.Name] {
+			continue
+		}
+		machineName := dataClaim.Name
+		for _, ownerRef := range dataClaim.OwnerReferences {
+			if Contains(m.OwnerKindFilter, ownerRef.Kind) {
+				machineName = ownerRef.Name
+				break
+			}
+		}
+		unprovisionedMachines = append(unprovisionedMachines, machineName)
+	}
+	if len(unprovisionedMachines) == 0 {
+		m.DataTemplate.Status.UnprovisionedMachines = nil
+		return
+	}
+	sort.Strings(unprovisionedMachines)
+	m.DataTemplate.Status.UnprovisionedMachines = unprovisionedMachines
+}
+
+// updateDataSize sets the DataSizeBytes of the status, and the exported
+// gauge, to the total JSON size of the Metal3Data objects of this template
+// listed by getIndexes. It is only recomputed when their indexes changed
+// since the last computation. The Metal3Data objects close to the etcd object
+// size limit are logged.
+func (m *DataTemplateManager) updateDataSize(ctx context.Context) error {
+	checksum := indexChecksum(m.DataTemplate.Status.Indexes)
+	if m.DataTemplate.Annotations[DataSizeChecksumAnnotation] != checksum {
+		var dataSize int64
+		for _, m3Data := range m.listedDatas {
+			if !m.isDataFromTemplate(&m3Data) {
+				continue
+			}
+			m3DataJSON, err := json.Marshal(m3Data)
+			if err != nil {
+				return errors.Wrap(err, "Failed to serialize Metal3Data")
+			}
+			if len(m3DataJSON)*100 > etcdObjectSizeLimit*dataSizeWarningPercent {
+				m.Log.Info("Warning: Metal3Data close to the etcd object size limit",
+					"cluster", clusterNameFromContext(ctx),
+					"Metal3Data", m3Data.Name, "size", len(m3DataJSON),
+					"limit", etcdObjectSizeLimit,
+				)
+			}
+			dataSize += int64(len(m3DataJSON))
+		}
+		m.DataTemplate.Status.DataSizeBytes = dataSize
+		if m.DataTemplate.Annotations == nil {
+			m.DataTemplate.Annotations = make(map[string]string)
+		}
+		m.DataTemplate.Annotations[DataSizeChecksumAnnotation] = checksum
+	}
+	dataSizeBytesGauge.WithLabelValues(m.DataTemplate.Namespace,
+		m.DataTemplate.Name,
+	).Set(float64(m.DataTemplate.Status.DataSizeBytes))
+	return nil
+}
+
+// deltaStatus returns the allocations of the status that differ from the
+// previous indexes
+func (m *DataTemplateManager) deltaStatus(previousIndexes map[string]capm3.IndexEntry,
+) DeltaStatus {
+	delta := DeltaStatus{
+		RequeueNeeded: len(m.DataTemplate.Status.UnprovisionedMachines) != 0,
+		RequeueAfter:  m.reservationsRequeueAfter(),
+	}
+	created := make(map[string]capm3.IndexEntry)
+	for claimName, entry := range m.DataTemplate.Status.Indexes {
+		if previous, ok := previousIndexes[claimName]; !ok || previous.Index != entry.Index {
+			created[claimName] = entry
+		}
+	}
+	deleted := make(map[string]capm3.IndexEntry)
+	for claimName, previous := range previousIndexes {
+		if entry, ok := m.DataTemplate.Status.Indexes[claimName]; !ok || previous.Index != entry.Index {
+			deleted[claimName] = previous
+		}
+	}
+	_ = forEachIndex(m.DataTemplate, created, func(index int, machineName, dataName string) error {
+		delta.Created = append(delta.Created, DataAllocation{
+			MachineName: machineName, DataName: dataName, Index: index,
+		})
+		return nil
+	})
+	_ = forEachIndex(m.DataTemplate, deleted, func(index int, machineName, dataName string) error {
+		delta.Deleted = append(delta.Deleted, DataAllocation{
+			MachineName: machineName, DataName: dataName, Index: index,
+		})
+		return nil
+	})
+	return delta
+}
+
+// recordIndexChanges sets the IndexChangesAnnotation to the differences
+// between the previous indexes and the indexes of the status. The annotation
+// is left unchanged if no index was allocated or freed.
+func (m *DataTemplateManager) recordIndexChanges(ctx context.Context,
+	previousIndexes map[string]capm3.IndexEntry,
+) error {
+	changes := IndexChanges{}
+	for claimName, entry := range m.DataTemplate.Status.Indexes {
+		if previous, ok := previousIndexes[claimName]; !ok || previous.Index != entry.Index {
+			if changes.Allocated == nil {
+				changes.Allocated = make(map[string]int)
+			}
+			changes.Allocated[claimName] = entry.Index
+		}
+	}
+	for claimName, previous := range previousIndexes {
+		if entry, ok := m.DataTemplate.Status.Indexes[claimName]; !ok || previous.Index != entry.Index {
+			if changes.Freed == nil {
+				changes.Freed = make(map[string]int)
+			}
+			changes.Freed[claimName] = previous.Index
+		}
+	}
+	if changes.Allocated == nil && changes.Freed == nil {
+		return nil
+	}
+
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the index changes")
+	}
+	m.Log.Info("Index changes",
+		"cluster", clusterNameFromContext(ctx),
+		"changes", string(changesJSON),
+	)
+	if m.DataTemplate.Annotations == nil {
+		m.DataTemplate.Annotations = make(map[string]string)
+	}
+	m.DataTemplate.Annotations[IndexChangesAnnotation] = string(changesJSON)
+	return nil
+}
+
+// storeExternalStatus moves the Indexes of the status to the StatusStore of
+// the StatusStoreBackend, or to the external status Secret when
+// UseExternalStatusStore is set, leaving only a reference to the Secret in the
+// status. The previously used store or Secret is deleted.
+func (m *DataTemplateManager) storeExternalStatus(ctx context.Context) error {
+	backend := m.DataTemplate.Spec.StatusStoreBackend
+	if backend == capm3.StatusStoreBackendEtcd {
+		backend = ""
+	}
+	if previous := m.DataTemplate.Status.StatusStoreBackend; previous != "" &&
+		previous != backend {
+		store, err := NewStatusStore(ctx, m.client, m.DataTemplate, previous)
+		if err != nil {
+			return err
+		}
+		if err := store.Delete(ctx); err != nil {
+			return err
+		}
+		m.DataTemplate.Status.StatusStoreBackend = ""
+	}
+	if backend != "" {
+		store, err := NewStatusStore(ctx, m.client, m.DataTemplate, backend)
+		if err != nil {
+			return err
+		}
+		if err := store.Set(ctx, m.DataTemplate.Status.Indexes); err != nil {
+			return err
+		}
+		m.DataTemplate.Status.StatusStoreBackend = backend
+		m.DataTemplate.Status.Indexes = nil
+	}
+
+	if !m.DataTemplate.Spec.UseExternalStatusStore {
+		if m.DataTemplate.Status.ExternalStatusSecretRef == nil {
+			return nil
+		}
+		if err := deleteSecret(m.client, ctx,
+			m.DataTemplate.Status.ExternalStatusSecretRef.Name,
+			m.DataTemplate.Namespace,
+		); err != nil {
+			return errors.Wrap(err, "Failed to delete the external status Secret")
+		}
+		m.DataTemplate.Status.ExternalStatusSecretRef = nil
+		return nil
+	}
+
+	indexes, err := json.Marshal(m.DataTemplate.Status.Indexes)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the indexes")
+	}
+	if len(indexes) > maxStatusObjectSize {
+		return errors.Errorf("The indexes, %d bytes, do not fit in the external status Secret",
+			len(indexes),
+		)
+	}
+	secretName := m.DataTemplate.Name + ExternalStatusSecretSuffix
+	ownerRefs := []metav1.OwnerReference{
+		{
+			Controller: pointer.BoolPtr(true),
+			APIVersion: m.DataTemplate.APIVersion,
+			Kind:       m.DataTemplate.Kind,
+			Name:       m.DataTemplate.Name,
+			UID:        m.DataTemplate.UID,
+		},
+	}
+	// The Secret is only written when its content changes
+	secret, err := checkSecretExists(m.client, ctx, secretName,
+		m.DataTemplate.Namespace,
+	)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "Failed to get the external status Secret")
+	}
+	if err != nil || !bytes.Equal(secret.Data[ExternalStatusSecretKey], indexes) ||
+		!reflect.DeepEqual(secret.OwnerReferences, ownerRefs) ||
+		secret.Labels[capi.ClusterLabelName] != m.DataTemplate.Spec.ClusterName {
+		if err := createSecret(m.client, ctx, secretName, m.DataTemplate.Namespace,
+			m.DataTemplate.Spec.ClusterName, ownerRefs,
+			map[string][]byte{ExternalStatusSecretKey: indexes},
+		); err != nil {
+			return errors.Wrap(err, "Failed to store the external status Secret")
+		}
+	}
+	m.DataTemplate.Status.ExternalStatusSecretRef = &corev1.LocalObjectReference{
+		Name: secretName,
+	}
+	m.DataTemplate.Status.Indexes = nil
+	return nil
+}
+
+// statusIndexes returns the Indexes of the status of the Metal3DataTemplate,
+// read from its StatusStore if the status has a StatusStoreBackend, or from
+// the external status Secret if ExternalStatusSecretRef is set
+func statusIndexes(ctx context.Context, cl client.Client,
+	dataTemplate *capm3.Metal3DataTemplate,
+) (map[string]capm3.IndexEntry, error) {
+	if dataTemplate.Status.StatusStoreBackend != "" {
+		store, err := NewStatusStore(ctx, cl, dataTemplate,
+			dataTemplate.Status.StatusStoreBackend,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return store.Get(ctx)
+	}
+	if dataTemplate.Status.ExternalStatusSecretRef == nil {
+		return dataTemplate.Status.Indexes, nil
+	}
+	secret, err := checkSecretExists(cl, ctx,
+		dataTemplate.Status.ExternalStatusSecretRef.Name, dataTemplate.Namespace,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get the external status Secret")
+	}
+	indexes := make(map[string]capm3.IndexEntry)
+	if err := json.Unmarshal(secret.Data[ExternalStatusSecretKey], &indexes); err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshal the indexes")
+	}
+	return indexes, nil
+}
+
+// updateIPIndex rebuilds the IPIndex of the status from the addresses
+// allocated from the IPPoolRef pool to the Metal3Data objects. The addresses
+// not allocated yet are added on a later reconciliation.
+func (m *DataTemplateManager) updateIPIndex(ctx context.Context) error {
+	if m.DataTemplate.Spec.IPPoolRef == nil {
+		m.DataTemplate.Status.IPIndex = nil
+		return nil
+	}
+
+	ipIndex := make(map[string]string)
+	err := m.ForEachIndex(func(index int, machineName, dataName string) error {
+		// The Metal3Data manager names the IPClaim after the Metal3Data and the pool
+		ipClaim := &ipamv1.IPClaim{}
+		key := client.ObjectKey{
+			Name:      dataName + "-" + m.DataTemplate.Spec.IPPoolRef.Name,
+			Namespace: m.DataTemplate.Namespace,
+		}
+		if err := m.client.Get(ctx, key, ipClaim); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return errors.Wrap(err, "Failed to get IPClaim")
+		}
+		if ipClaim.Status.Address == nil {
+			return nil
+		}
+
+		ipAddress := &ipamv1.IPAddress{}
+		key = client.ObjectKey{
+			Name:      ipClaim.Status.Address.Name,
+			Namespace: m.DataTemplate.Namespace,
+		}
+		if err := m.client.Get(ctx, key, ipAddress); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return errors.Wrap(err, "Failed to get IPAddress")
+		}
+		ipIndex[string(ipAddress.Spec.Address)] = machineName
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.DataTemplate.Status.IPIndex = ipIndex
+	return nil
+}
+
+// getDataClient returns the client used to create the Metal3Data objects. It
+// is the controller client, unless a ServiceAccountRef is set on the
+// Metal3DataTemplate.
+func (m *DataTemplateManager) getDataClient(ctx context.Context,
+	clientFactory ServiceAccountClientGetter,
+) (client.Client, error) {
+	if m.DataTemplate.Spec.ServiceAccountRef == nil {
+		return m.client, nil
+	}
+	if clientFactory == nil {
+		return nil, errors.New("No client getter for ServiceAccounts available")
+	}
+	dataClient, err := clientFactory(ctx, m.DataTemplate.Namespace,
+		m.DataTemplate.Spec.ServiceAccountRef.Name,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create client for ServiceAccount %s",
+			m.DataTemplate.Spec.ServiceAccountRef.Name,
+		)
+	}
+	return dataClient, nil
+}
+
+func (m *DataTemplateManager) updateData(ctx context.Context,
+	dataClaim *capm3.Metal3DataClaim, indexes map[int]string,
+	dataClient client.Client,
+) (map[int]string, error) {
+
+	helper, err := patch.NewHelper(dataClaim, m.client)
+	if err != nil {
+		return indexes, errors.Wrap(err, "failed to init patch helper")
+	}
+	// Always patch dataClaim exiting this function so we can persist any changes.
+	defer func() {
+		err := helper.Patch(ctx, dataClaim)
+		if err != nil {
+			m.Log.Info("failed to Patch capm3DataClaim", "cluster", clusterNameFromContext(ctx))
+		}
+	}()
+
+	dataClaim.Status.ErrorMessage = nil
+
+	if dataClaim.DeletionTimestamp.IsZero() {
+		indexes, err = m.createData(ctx, dataClaim, indexes, dataClient)
+		if err != nil {
+			return indexes, err
+		}
+	} else {
+		indexes, err = m.deleteData(ctx, dataClaim, indexes)
+		if err != nil {
+			return indexes, err
+		}
+	}
+	return indexes, nil
+}
+
+func (m *DataTemplateManager) createData(ctx context.Context,
+	dataClaim *capm3.Metal3DataClaim, indexes map[int]string,
+	dataClient client.Client,
+) (map[int]string, error) {
+	if !Contains(dataClaim.Finalizers, capm3.DataClaimFinalizer) {
+		dataClaim.Finalizers = append(dataClaim.Finalizers,
+			capm3.DataClaimFinalizer,
+		)
+	}
+
+	if dataClaimEntry, ok := m.DataTemplate.Status.Indexes[dataClaim.Name]; ok {
+		dataName := m.dataName(dataClaimEntry)
+		machineName := dataClaimEntry.MachineName
+		if machineName == "" {
+			machineName = dataClaim.Name
+		}
+		// The access of the tenant is granted again if it failed when the
+		// Metal3Data was created
+		if err := m.grantTenantAccess(ctx, dataName, machineName,
+			m.machineKind(dataClaim, machineName),
+			types.UID(dataClaimEntry.MachineUID),
+		); err != nil {
+			return indexes, err
+		}
+		dataClaim.Status.RenderedData = &corev1.ObjectReference{
+			Name:      dataName,
+			Namespace: m.DataTemplate.Namespace,
+		}
+		if _, ok := dataClaim.Annotations[AllocationNotificationPendingAnnotation]; ok {
+			return indexes, m.notifyAllocation(ctx, dataClaim, AllocationNotification{
+				Template:    m.DataTemplate.Name,
+				MachineName: machineName,
+				Index:       dataClaimEntry.Index,
+				DataName:    dataName,
+			})
+		}
+		return indexes, nil
+	}
+
+	m3mUID := types.UID("")
+	m3mName := ""
+	m3mKind := ""
+	for _, ownerRef := range dataClaim.OwnerReferences {
+		aGV, err := schema.ParseGroupVersion(ownerRef.APIVersion)
+		if err != nil {
+			return indexes, err
+		}
+		if Contains(m.OwnerKindFilter, ownerRef.Kind) &&
+			aGV.Group == capm3.GroupVersion.Group {
+			m3mUID = ownerRef.UID
+			m3mName = ownerRef.Name
+			m3mKind = ownerRef.Kind
+			break
+		}
+	}
+	if m3mName == "" {
 		return indexes, errors.New("Metal3Machine not found in owner references")
 	}
 
-	// Get a new index for this machine
-	m.Log.Info("Getting index", "Claim", dataClaim.Name)
-	claimIndex := len(indexes)
-	// The length of the map might be smaller than the highest index stored,
-	// this means we have a gap to find
-	for index := 0; index < len(indexes); index++ {
-		if _, ok := indexes[index]; !ok {
-			if claimIndex == len(indexes) {
-				claimIndex = index
-				break
+	m3m, err := m.getMetal3Machine(ctx, m3mName)
+	if err != nil {
+		return indexes, err
+	}
+	if m.machineSkipsAllocation(m3m) {
+		m.Log.Info("Metal3Machine opted out of the allocation",
+			"cluster", clusterNameFromContext(ctx),
+			"Claim", dataClaim.Name, "Metal3Machine", m3mName,
+		)
+		if m.skippedClaims == nil {
+			m.skippedClaims = make(map[string]bool)
+		}
+		m.skippedClaims[dataClaim.Name] = true
+		message := "Metal3Machine " + m3mName + " opted out of the allocation with the " + SkipAllocationAnnotation + " annotation"
+		if _, ok := dataClaim.Annotations[AllocationSkippedAnnotation]; !ok {
+			m.recordAllocationEvent(AllocationSkippedEventReason, message)
+			if dataClaim.Annotations == nil {
+				dataClaim.Annotations = make(map[string]string)
+			}
+			dataClaim.Annotations[AllocationSkippedAnnotation] = ""
+		}
+		dataClaim.Status.ErrorMessage = pointer.StringPtr(message)
+		return indexes, nil
+	}
+	delete(dataClaim.Annotations, AllocationSkippedAnnotation)
+	if m3m == nil && m.requiresMetal3Machine() {
+		return indexes, metal3MachineNotFound(m3mName)
+	}
+
+	if m.DataTemplate.Spec.OwnerReferenceFilter != nil {
+		matches, err := m.machineMatchesFilter(m3m)
+		if err != nil {
+			return indexes, err
+		}
+		if !matches {
+			m.Log.Info("Metal3Machine does not match the owner reference filter",
+				"cluster", clusterNameFromContext(ctx),
+				"Claim", dataClaim.Name, "Metal3Machine", m3mName,
+			)
+			message := "Metal3Machine " + m3mName + " does not match the ownerReferenceFilter of Metal3DataTemplate " + m.DataTemplate.Name
+			m.recordEvent(corev1.EventTypeWarning,
+				OwnerReferenceFilterRejectedEventReason, message,
+			)
+			dataClaim.Status.ErrorMessage = pointer.StringPtr(message)
+			return indexes, nil
+		}
+	}
+
+	if m.DataTemplate.Spec.AllocationCondition != "" {
+		matches, err := m.machineMatchesCondition(m3m)
+		if err != nil {
+			return indexes, err
+		}
+		if !matches {
+			m.Log.Info("Metal3Machine does not match the allocation condition",
+				"cluster", clusterNameFromContext(ctx),
+				"Claim", dataClaim.Name, "Metal3Machine", m3mName,
+				"AllocationCondition", m.DataTemplate.Spec.AllocationCondition,
+			)
+			dataClaim.Status.ErrorMessage = pointer.StringPtr(
+				"Metal3Machine " + m3mName + " does not match the allocationCondition of Metal3DataTemplate " + m.DataTemplate.Name,
+			)
+			return indexes, nil
+		}
+	}
+
+	if m.DataTemplate.Spec.HostSelector != nil {
+		hostName, matches, err := m.hostMatchesSelector(ctx, m3m)
+		if err != nil {
+			return indexes, err
+		}
+		if !matches {
+			m.Log.Info("BareMetalHost does not match the host selector",
+				"cluster", clusterNameFromContext(ctx),
+				"Claim", dataClaim.Name, "Metal3Machine", m3mName,
+				"BareMetalHost", hostName,
+			)
+			if hostName == "" {
+				dataClaim.Status.ErrorMessage = pointer.StringPtr(
+					"Metal3Machine " + m3mName + " has no BareMetalHost to match against the hostSelector of Metal3DataTemplate " + m.DataTemplate.Name,
+				)
+			} else {
+				dataClaim.Status.ErrorMessage = pointer.StringPtr(
+					"BareMetalHost " + hostName + " does not match the hostSelector of Metal3DataTemplate " + m.DataTemplate.Name,
+				)
+			}
+			return indexes, nil
+		}
+	}
+
+	var transferredData *capm3.Metal3Data
+	claimIndex, shared, err := m.getSharedIndex(dataClaim)
+	if err != nil {
+		m.Log.Info("Invalid shared index",
+			"cluster", clusterNameFromContext(ctx),
+			"Claim", dataClaim.Name)
+		dataClaim.Status.ErrorMessage = pointer.StringPtr(err.Error())
+		return indexes, nil
+	}
+	if shared {
+		if _, ok := indexes[claimIndex]; ok {
+			return m.joinSharedData(ctx, dataClaim, indexes, claimIndex,
+				m3mName, m3mKind, m3mUID, dataClient,
+			)
+		}
+	} else {
+		// The Metal3Data transferred from another template is recreated for
+		// this one with its index, since its template and claim can not be
+		// changed
+		if m.DataTemplate.Spec.DataOwnershipTransfer {
+			transferredData, err = m.findTransferredData(ctx, dataClaim,
+				indexes, m3mName,
+			)
+			if err != nil {
+				return indexes, err
+			}
+		}
+
+		// Get a new index for this machine
+		m.Log.Info("Getting index",
+			"cluster", clusterNameFromContext(ctx),
+			"Claim", dataClaim.Name)
+		restoredIndex, restored := m.restoredIndexes[dataClaim.Name]
+		if transferredData != nil {
+			claimIndex = transferredData.Spec.Index
+		} else if staticIndex, ok := m.DataTemplate.Spec.StaticAssignments[m3mName]; ok {
+			if _, taken := indexes[staticIndex]; taken {
+				m.Log.Info("Static index already allocated",
+					"cluster", clusterNameFromContext(ctx),
+					"Claim", dataClaim.Name, "index", staticIndex,
+				)
+				dataClaim.Status.ErrorMessage = pointer.StringPtr(
+					"Static index " + strconv.Itoa(staticIndex) + " of Metal3Machine " + m3mName + " is already allocated",
+				)
+				return indexes, nil
+			}
+			claimIndex = staticIndex
+		} else if _, taken := indexes[restoredIndex]; restored && !taken {
+			claimIndex = restoredIndex
+		} else {
+			claimIndex, err = m.getFreeIndex(indexes)
+		}
+		if err != nil {
+			conditions.MarkTrue(m.DataTemplate, capm3.IndexSpaceExhaustedCondition)
+			dataClaim.Status.ErrorMessage = pointer.StringPtr(err.Error())
+			return indexes, err
+		}
+		if conditions.IsTrue(m.DataTemplate, capm3.IndexSpaceExhaustedCondition) {
+			conditions.MarkFalse(m.DataTemplate, capm3.IndexSpaceExhaustedCondition,
+				capm3.IndexAllocatedReason, capi.ConditionSeverityNone, "",
+			)
+		}
+		if m.isEmergencyIndex(claimIndex) {
+			m.Log.Error(&IndexExhaustedError{DataTemplate: m.DataTemplate.Name},
+				"Allocating an index of the emergency range",
+				"cluster", clusterNameFromContext(ctx),
+				"Claim", dataClaim.Name, "index", claimIndex,
+			)
+			m.recordEvent(corev1.EventTypeWarning,
+				EmergencyIndexAllocatedEventReason,
+				fmt.Sprintf("Allocated index %d of the emergency range to Metal3DataClaim %s",
+					claimIndex, dataClaim.Name,
+				),
+			)
+		}
+	}
+
+	// Set the index and Metal3Data names
+	dataName := m.DataTemplate.Name + "-" + strconv.Itoa(claimIndex)
+
+	m.Log.Info("Index",
+		"cluster", clusterNameFromContext(ctx),
+		"Claim", dataClaim.Name, "index", claimIndex)
+
+	// Create the Metal3Data object, with an Owner ref to the Metal3Machine
+	// (curOwnerRef) and to the Metal3DataTemplate
+	dataObject := &capm3.Metal3Data{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Metal3Data",
+			APIVersion: capm3.GroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dataName,
+			Namespace: m.DataTemplate.Namespace,
+			Labels:    dataClaim.Labels,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					Controller: pointer.BoolPtr(true),
+					APIVersion: m.DataTemplate.APIVersion,
+					Kind:       m.DataTemplate.Kind,
+					Name:       m.DataTemplate.Name,
+					UID:        m.DataTemplate.UID,
+				},
+				{
+					APIVersion: dataClaim.APIVersion,
+					Kind:       dataClaim.Kind,
+					Name:       dataClaim.Name,
+					UID:        dataClaim.UID,
+				},
+				{
+					APIVersion: dataClaim.APIVersion,
+					Kind:       m3mKind,
+					Name:       m3mName,
+					UID:        m3mUID,
+				},
+			},
+		},
+		Spec: capm3.Metal3DataSpec{
+			Index: claimIndex,
+			Template: corev1.ObjectReference{
+				Name:      m.DataTemplate.Name,
+				Namespace: m.DataTemplate.Namespace,
+			},
+			Claim: corev1.ObjectReference{
+				Name:      dataClaim.Name,
+				Namespace: m.DataTemplate.Namespace,
+			},
+		},
+	}
+
+	if m.DataTemplate.Spec.WaitForBMOOnDelete {
+		dataObject.Finalizers = []string{capm3.WaitForBMOFinalizer}
+	}
+
+	if len(m.DataTemplate.Spec.DataAnnotations) != 0 {
+		dataObject.Annotations = make(map[string]string)
+		for key, value := range m.DataTemplate.Spec.DataAnnotations {
+			dataObject.Annotations[key] = value
+		}
+		if _, ok := dataObject.Annotations[capi.ClusterLabelName]; ok {
+			dataObject.Annotations[capi.ClusterLabelName] = m.DataTemplate.Spec.ClusterName
+		}
+	}
+
+	if m.DataTemplate.Spec.HelmTemplateConfigMapRef != nil {
+		renderedSpec, err := m.renderHelmTemplate(ctx, claimIndex, m3mName)
+		if err != nil {
+			dataClaim.Status.ErrorMessage = pointer.StringPtr(err.Error())
+			return indexes, err
+		}
+		// Only the secrets can be chosen, in the namespace of the template
+		if renderedSpec.MetaData != nil {
+			dataObject.Spec.MetaData = &corev1.SecretReference{
+				Name:      renderedSpec.MetaData.Name,
+				Namespace: m.DataTemplate.Namespace,
+			}
+		}
+		if renderedSpec.NetworkData != nil {
+			dataObject.Spec.NetworkData = &corev1.SecretReference{
+				Name:      renderedSpec.NetworkData.Name,
+				Namespace: m.DataTemplate.Namespace,
+			}
+		}
+	}
+
+	if len(m.DataTemplate.Spec.AnnotationFilters) != 0 {
+		m.applyAnnotationFilters(ctx, dataObject, m3m)
+	}
+
+	if err := m.checkDataQuota(ctx); err != nil {
+		m.Log.Info("Warning: Metal3Data quota exceeded",
+			"cluster", clusterNameFromContext(ctx),
+			"Claim", dataClaim.Name, "error", err.Error(),
+		)
+		if _, ok := err.(*QuotaExceededError); ok {
+			m.recordEvent(corev1.EventTypeWarning, QuotaExceededEventReason,
+				err.Error(),
+			)
+		}
+		dataClaim.Status.ErrorMessage = pointer.StringPtr(err.Error())
+		return indexes, err
+	}
+
+	if m.DataTemplate.Spec.PreAllocationHook != nil {
+		err := m.checkPreAllocationHook(ctx, PreAllocationRequest{
+			MachineName: m3mName,
+			Index:       claimIndex,
+			DataName:    dataName,
+			ClusterName: m.DataTemplate.Spec.ClusterName,
+		})
+		if err != nil {
+			dataClaim.Status.ErrorMessage = pointer.StringPtr(err.Error())
+			if _, ok := err.(*HookRejectedError); ok {
+				m.Log.Info("Allocation rejected by the pre-allocation hook",
+					"cluster", clusterNameFromContext(ctx),
+					"Claim", dataClaim.Name, "error", err.Error(),
+				)
+				return indexes, nil
+			}
+			return indexes, err
+		}
+	}
+
+	// Claim the address in the external IPAM before the index is recorded,
+	// so that a failure leaves the status unchanged
+	if err := m.syncExternalIPAM(ctx, http.MethodPost, claimIndex, m3mName); err != nil {
+		dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to claim the address in the external IPAM")
+		return indexes, err
+	}
+
+	// Create the Metal3Data object. If we get a conflict (that will set
+	// HasRequeueAfterError), then requeue to retrigger the reconciliation with
+	// the new state
+	if m.rateLimiter != nil {
+		if err := m.rateLimiter.Wait(ctx); err != nil {
+			m.rollbackExternalIPAMClaim(ctx, claimIndex, m3mName)
+			return indexes, err
+		}
+	}
+	if dataObject.Annotations == nil {
+		dataObject.Annotations = make(map[string]string)
+	}
+	dataObject.Annotations[AllocationTimestampAnnotation] = strconv.FormatInt(
+		time.Now().UnixNano(), 10,
+	)
+	createOpts := []client.CreateOption{}
+	if m.fieldManager != "" {
+		createOpts = append(createOpts, client.FieldOwner(m.fieldManager))
+	}
+	if err := createObject(dataClient, ctx, dataObject, createOpts...); err != nil {
+		// On a conflict, the Metal3Data of the index exists and keeps the
+		// address, that the claim is sent again for
+		if _, ok := err.(*RequeueAfterError); !ok {
+			m.rollbackExternalIPAMClaim(ctx, claimIndex, m3mName)
+			dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to create associated Metal3Data object")
+			return indexes, err
+		}
+		return indexes, m.backoffError(dataClaim)
+	}
+	delete(dataClaim.Annotations, DataClaimRetriesAnnotation)
+	if m.metricsRecorder != nil {
+		m.metricsRecorder.RecordAllocation(m.DataTemplate.Name, claimIndex)
+	}
+	m.DataTemplate.Status.LastCreatedDataName = dataName
+	m.DataTemplate.Status.LastCreatedMachineName = m3mName
+	m.recordProvisionedMachine()
+
+	allocatedAt := metav1.Now()
+	m.DataTemplate.Status.Indexes[dataClaim.Name] = capm3.IndexEntry{
+		Index:       claimIndex,
+		MachineName: m3mName,
+		MachineUID:  string(m3mUID),
+		AllocatedAt: &allocatedAt,
+	}
+	indexes[claimIndex] = dataClaim.Name
+	m.forgetFreedIndex(claimIndex)
+
+	if transferredData != nil {
+		m.Log.Info("Deleting the Metal3Data transferred with the index",
+			"cluster", clusterNameFromContext(ctx),
+			"Claim", dataClaim.Name, "Metal3Data", transferredData.Name,
+		)
+		err := m.deleteDataObject(ctx, transferredData)
+		if err != nil && !apierrors.IsNotFound(err) {
+			dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to delete the transferred Metal3Data object")
+			return indexes, err
+		}
+	}
+
+	if err := m.grantTenantAccess(ctx, dataName, m3mName, m3mKind, m3mUID); err != nil {
+		return indexes, err
+	}
+
+	dataClaim.Status.RenderedData = &corev1.ObjectReference{
+		Name:      dataName,
+		Namespace: m.DataTemplate.Namespace,
+	}
+
+	err = m.notifyAllocation(ctx, dataClaim, AllocationNotification{
+		Template:    m.DataTemplate.Name,
+		MachineName: m3mName,
+		Index:       claimIndex,
+		DataName:    dataName,
+	})
+	return indexes, err
+}
+
+// machineKind returns the kind of the owner reference of the claim to the
+// machine, Metal3Machine if there is none
+func (m *DataTemplateManager) machineKind(dataClaim *capm3.Metal3DataClaim,
+	machineName string,
+) string {
+	for _, ownerRef := range dataClaim.OwnerReferences {
+		if Contains(m.OwnerKindFilter, ownerRef.Kind) && ownerRef.Name == machineName {
+			return ownerRef.Kind
+		}
+	}
+	return "Metal3Machine"
+}
+
+// checkDataQuota returns a QuotaExceededError if a ResourceQuota of the
+// namespace limits the number of Metal3Data objects, and the limit is
+// already reached
+func (m *DataTemplateManager) checkDataQuota(ctx context.Context) error {
+	quotas := corev1.ResourceQuotaList{}
+	opts := &client.ListOptions{
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := m.client.List(ctx, &quotas, opts); err != nil {
+		return errors.Wrap(err, "Failed to list ResourceQuotas")
+	}
+	for _, quota := range quotas.Items {
+		hard, ok := quota.Status.Hard[metal3DataQuotaResource]
+		if !ok {
+			continue
+		}
+		used := quota.Status.Used[metal3DataQuotaResource]
+		if used.Cmp(hard) >= 0 {
+			return &QuotaExceededError{
+				Quota:   quota.Name,
+				Current: int(used.Value()),
+				Max:     int(hard.Value()),
+			}
+		}
+	}
+	return nil
+}
+
+// getSharedIndex returns the index requested by the Metal3DataClaim with the
+// SharedIndexLabel, if the Metal3DataTemplate is in Shared ownership mode
+func (m *DataTemplateManager) getSharedIndex(dataClaim *capm3.Metal3DataClaim,
+) (int, bool, error) {
+	if m.DataTemplate.Spec.OwnershipMode != capm3.OwnershipModeShared {
+		return 0, false, nil
+	}
+	value, ok := dataClaim.Labels[SharedIndexLabel]
+	if !ok {
+		return 0, false, nil
+	}
+	index, err := strconv.Atoi(value)
+	if err != nil || index < m.DataTemplate.Spec.MinIndex ||
+		(m.DataTemplate.Spec.MaxIndex != 0 && index > m.DataTemplate.Spec.MaxIndex) {
+		return 0, false, errors.Errorf(
+			"Invalid %s label %q for Metal3DataTemplate %s", SharedIndexLabel,
+			value, m.DataTemplate.Name,
+		)
+	}
+	return index, true, nil
+}
+
+// joinSharedData adds the Metal3DataClaim and its Metal3Machine to the owners
+// of the existing Metal3Data of a shared index
+func (m *DataTemplateManager) joinSharedData(ctx context.Context,
+	dataClaim *capm3.Metal3DataClaim, indexes map[int]string, claimIndex int,
+	m3mName string, m3mKind string, m3mUID types.UID, dataClient client.Client,
+) (map[int]string, error) {
+	dataName := m.DataTemplate.Name + "-" + strconv.Itoa(claimIndex)
+	m.Log.Info("Sharing index",
+		"cluster", clusterNameFromContext(ctx),
+		"Claim", dataClaim.Name, "index", claimIndex)
+
+	m3Data := &capm3.Metal3Data{}
+	key := client.ObjectKey{
+		Name:      dataName,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := m.client.Get(ctx, key, m3Data); err != nil {
+		dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to get associated Metal3Data object")
+		return indexes, err
+	}
+	// A Metal3Data being handed over is created again once it is gone
+	if !m3Data.DeletionTimestamp.IsZero() {
+		return indexes, &RequeueAfterError{RequeueAfter: requeueAfter}
+	}
+
+	m3Data.OwnerReferences = addOwnerRef(m3Data.OwnerReferences,
+		metav1.OwnerReference{
+			APIVersion: dataClaim.APIVersion,
+			Kind:       dataClaim.Kind,
+			Name:       dataClaim.Name,
+			UID:        dataClaim.UID,
+		},
+	)
+	m3Data.OwnerReferences = addOwnerRef(m3Data.OwnerReferences,
+		metav1.OwnerReference{
+			APIVersion: dataClaim.APIVersion,
+			Kind:       m3mKind,
+			Name:       m3mName,
+			UID:        m3mUID,
+		},
+	)
+	if err := dataClient.Update(ctx, m3Data); err != nil {
+		if apierrors.IsConflict(err) {
+			return indexes, m.backoffError(dataClaim)
+		}
+		dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to update associated Metal3Data object")
+		return indexes, err
+	}
+	delete(dataClaim.Annotations, DataClaimRetriesAnnotation)
+	m.recordProvisionedMachine()
+
+	allocatedAt := metav1.Now()
+	m.DataTemplate.Status.Indexes[dataClaim.Name] = capm3.IndexEntry{
+		Index:       claimIndex,
+		MachineName: m3mName,
+		MachineUID:  string(m3mUID),
+		AllocatedAt: &allocatedAt,
+	}
+	dataClaim.Status.RenderedData = &corev1.ObjectReference{
+		Name:      dataName,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	return indexes, nil
+}
+
+// addOwnerRef appends the owner reference if no reference of the same kind and
+// name is there
+func addOwnerRef(refList []metav1.OwnerReference, ownerRef metav1.OwnerReference,
+) []metav1.OwnerReference {
+	for _, ref := range refList {
+		if ref.Kind == ownerRef.Kind && ref.Name == ownerRef.Name {
+			return refList
+		}
+	}
+	return append(refList, ownerRef)
+}
+
+// maxBackoffDelay caps the delay computed by backoffError when the
+// BackoffPolicy has no MaxInterval, or a bigger one
+const maxBackoffDelay = 24 * time.Hour
+
+// backoffError returns the error to requeue the dataClaim after a conflict,
+// with a delay following the BackoffPolicy of the template. The number of
+// previous attempts is recorded in an annotation on the dataClaim. Once
+// MaxRetries is reached, the dataClaim is marked as failed and nil is
+// returned so that it is not requeued.
+func (m *DataTemplateManager) backoffError(dataClaim *capm3.Metal3DataClaim) error {
+	policy := m.DataTemplate.Spec.BackoffPolicy
+	if policy == nil {
+		return &RequeueAfterError{}
+	}
+
+	retries := 0
+	if dataClaim.Annotations != nil {
+		retries, _ = strconv.Atoi(dataClaim.Annotations[DataClaimRetriesAnnotation])
+	} else {
+		dataClaim.Annotations = make(map[string]string)
+	}
+
+	if retries < 0 {
+		retries = 0
+	}
+
+	if policy.MaxRetries > 0 && retries >= policy.MaxRetries {
+		dataClaim.Status.ErrorMessage = pointer.StringPtr("Maximum number of retries reached to create associated Metal3Data object")
+		return nil
+	}
+
+	maxDelay := maxBackoffDelay
+	if policy.MaxInterval != nil && policy.MaxInterval.Duration < maxDelay {
+		maxDelay = policy.MaxInterval.Duration
+	}
+	delay := time.Duration(0)
+	if policy.InitialInterval != nil {
+		delay = policy.InitialInterval.Duration
+	}
+	multiplier := time.Duration(policy.Multiplier)
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	// The exponent is clamped by stopping once the delay reaches maxDelay,
+	// and the multiplication checked so that it cannot overflow
+	for i := 0; i < retries && delay > 0 && delay < maxDelay; i++ {
+		if delay > maxDelay/multiplier {
+			delay = maxDelay
+			break
+		}
+		delay = delay * multiplier
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	dataClaim.Annotations[DataClaimRetriesAnnotation] = strconv.Itoa(retries + 1)
+	return &RequeueAfterError{RequeueAfter: delay}
+}
+
+// getFreeIndex returns the lowest index, starting from MinIndex and
+// incremented by IndexStep, that is not in use nor reserved by the
+// StaticAssignments. With the FIFO and LIFO
+// allocation orders, a free index of the FreedIndexes is returned first,
+// respectively the oldest or the newest. If all indexes up to MaxIndex are in
+// use, the lowest free index of the EmergencyRange is returned, or an
+// IndexExhaustedError if there is none.
+func (m *DataTemplateManager) getFreeIndex(indexes map[int]string) (int, error) {
+	freedIndexes := m.DataTemplate.Status.FreedIndexes
+	switch m.DataTemplate.Spec.AllocationOrder {
+	case capm3.AllocationOrderFIFO:
+		for _, index := range freedIndexes {
+			if m.isFreeIndex(indexes, index) {
+				return index, nil
+			}
+		}
+	case capm3.AllocationOrderLIFO:
+		for i := len(freedIndexes) - 1; i >= 0; i-- {
+			if m.isFreeIndex(indexes, freedIndexes[i]) {
+				return freedIndexes[i], nil
 			}
 		}
 	}
 
-	// Set the index and Metal3Data names
-	dataName := m.DataTemplate.Name + "-" + strconv.Itoa(claimIndex)
+	claimIndex := m.DataTemplate.Spec.MinIndex
+	for {
+		if _, ok := indexes[claimIndex]; !ok && !m.isStaticIndex(claimIndex) &&
+			!m.isReservedIndex(claimIndex) {
+			break
+		}
+		claimIndex += m.indexStep()
+	}
+	if m.DataTemplate.Spec.MaxIndex != 0 && claimIndex > m.DataTemplate.Spec.MaxIndex {
+		if emergencyRange := m.DataTemplate.Spec.EmergencyRange; emergencyRange != nil {
+			for index := emergencyRange.Min; index <= emergencyRange.Max; index++ {
+				if _, ok := indexes[index]; !ok && !m.isStaticIndex(index) &&
+					!m.isReservedIndex(index) {
+					return index, nil
+				}
+			}
+		}
+		return 0, &IndexExhaustedError{DataTemplate: m.DataTemplate.Name}
+	}
+	return claimIndex, nil
+}
 
-	m.Log.Info("Index", "Claim", dataClaim.Name, "index", claimIndex)
+// isFreeIndex returns true if the index is neither allocated nor reserved and
+// within the bounds and the IndexStep of the Metal3DataTemplate
+func (m *DataTemplateManager) isFreeIndex(indexes map[int]string, index int) bool {
+	if _, ok := indexes[index]; ok || m.isStaticIndex(index) || m.isReservedIndex(index) {
+		return false
+	}
+	return index >= m.DataTemplate.Spec.MinIndex &&
+		(m.DataTemplate.Spec.MaxIndex == 0 || index <= m.DataTemplate.Spec.MaxIndex) &&
+		(index-m.DataTemplate.Spec.MinIndex)%m.indexStep() == 0
+}
 
-	// Create the Metal3Data object, with an Owner ref to the Metal3Machine
-	// (curOwnerRef) and to the Metal3DataTemplate
-	dataObject := &capm3.Metal3Data{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Metal3Data",
-			APIVersion: capm3.GroupVersion.String(),
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      dataName,
-			Namespace: m.DataTemplate.Namespace,
-			Labels:    dataClaim.Labels,
-			OwnerReferences: []metav1.OwnerReference{
-				{
-					Controller: pointer.BoolPtr(true),
-					APIVersion: m.DataTemplate.APIVersion,
-					Kind:       m.DataTemplate.Kind,
-					Name:       m.DataTemplate.Name,
-					UID:        m.DataTemplate.UID,
-				},
-				{
-					APIVersion: dataClaim.APIVersion,
-					Kind:       dataClaim.Kind,
-					Name:       dataClaim.Name,
-					UID:        dataClaim.UID,
-				},
-				{
-					APIVersion: dataClaim.APIVersion,
-					Kind:       "Metal3Machine",
-					Name:       m3mName,
-					UID:        m3mUID,
-				},
-			},
-		},
-		Spec: capm3.Metal3DataSpec{
-			Index: claimIndex,
-			Template: corev1.ObjectReference{
-				Name:      m.DataTemplate.Name,
-				Namespace: m.DataTemplate.Namespace,
-			},
-			Claim: corev1.ObjectReference{
-				Name:      dataClaim.Name,
-				Namespace: m.DataTemplate.Namespace,
-			},
-		},
+// indexStep returns the IndexStep of the Metal3DataTemplate, 1 if unset
+func (m *DataTemplateManager) indexStep() int {
+	if m.DataTemplate.Spec.IndexStep < 1 {
+		return 1
 	}
+	return m.DataTemplate.Spec.IndexStep
+}
 
-	// Create the Metal3Data object. If we get a conflict (that will set
-	// HasRequeueAfterError), then requeue to retrigger the reconciliation with
-	// the new state
-	if err := createObject(m.client, ctx, dataObject); err != nil {
-		if _, ok := err.(*RequeueAfterError); !ok {
-			dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to create associated Metal3Data object")
+// isEmergencyIndex returns true if the index is in the EmergencyRange
+func (m *DataTemplateManager) isEmergencyIndex(index int) bool {
+	emergencyRange := m.DataTemplate.Spec.EmergencyRange
+	return emergencyRange != nil && index >= emergencyRange.Min &&
+		index <= emergencyRange.Max
+}
+
+// updateEmergencyAllocations sets the EmergencyAllocations of the status from
+// its indexes, and the EmergencyRangeInUse condition while there are any
+func (m *DataTemplateManager) updateEmergencyAllocations() {
+	emergencyAllocations := make(map[string]int)
+	for claimName, entry := range m.DataTemplate.Status.Indexes {
+		if m.isEmergencyIndex(entry.Index) {
+			emergencyAllocations[claimName] = entry.Index
 		}
-		return indexes, err
 	}
+	if len(emergencyAllocations) == 0 {
+		m.DataTemplate.Status.EmergencyAllocations = nil
+		conditions.Delete(m.DataTemplate, capm3.EmergencyRangeInUseCondition)
+		return
+	}
+	m.DataTemplate.Status.EmergencyAllocations = emergencyAllocations
+	conditions.MarkTrue(m.DataTemplate, capm3.EmergencyRangeInUseCondition)
+}
 
-	m.DataTemplate.Status.Indexes[dataClaim.Name] = claimIndex
-	indexes[claimIndex] = dataClaim.Name
+// isStaticIndex returns true if the index is reserved by the
+// StaticAssignments
+func (m *DataTemplateManager) isStaticIndex(index int) bool {
+	for _, staticIndex := range m.DataTemplate.Spec.StaticAssignments {
+		if staticIndex == index {
+			return true
+		}
+	}
+	return false
+}
 
-	dataClaim.Status.RenderedData = &corev1.ObjectReference{
-		Name:      dataName,
+// isReservedIndex returns true if the index is in the ReservedIndexes of the
+// status and its reservation did not expire
+func (m *DataTemplateManager) isReservedIndex(index int) bool {
+	now := time.Now()
+	for _, reservation := range m.DataTemplate.Status.ReservedIndexes {
+		if reservation.Index == index && now.Before(reservation.ReservedUntil.Time) {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveIndex adds the released index to the ReservedIndexes of the status
+// for the GracePeriodAfterDelete, if set
+func (m *DataTemplateManager) reserveIndex(index int) {
+	if m.DataTemplate.Spec.GracePeriodAfterDelete == nil {
+		return
+	}
+	reservations := []capm3.IndexReservation{}
+	for _, reservation := range m.DataTemplate.Status.ReservedIndexes {
+		if reservation.Index != index {
+			reservations = append(reservations, reservation)
+		}
+	}
+	reservations = append(reservations, capm3.IndexReservation{
+		Index: index,
+		ReservedUntil: metav1.NewTime(
+			time.Now().Add(m.DataTemplate.Spec.GracePeriodAfterDelete.Duration),
+		),
+	})
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].Index < reservations[j].Index
+	})
+	m.DataTemplate.Status.ReservedIndexes = reservations
+}
+
+// pruneReservedIndexes removes the expired reservations from the
+// ReservedIndexes of the status
+func (m *DataTemplateManager) pruneReservedIndexes() {
+	now := time.Now()
+	reservations := []capm3.IndexReservation{}
+	for _, reservation := range m.DataTemplate.Status.ReservedIndexes {
+		if now.Before(reservation.ReservedUntil.Time) {
+			reservations = append(reservations, reservation)
+		}
+	}
+	if len(reservations) == 0 {
+		reservations = nil
+	}
+	m.DataTemplate.Status.ReservedIndexes = reservations
+}
+
+// reservationsRequeueAfter returns the delay until the earliest reservation of
+// the ReservedIndexes expires, so that the index is freed in time, or 0 if
+// there is no reservation
+func (m *DataTemplateManager) reservationsRequeueAfter() time.Duration {
+	var requeueAfter time.Duration
+	for _, reservation := range m.DataTemplate.Status.ReservedIndexes {
+		delay := time.Until(reservation.ReservedUntil.Time)
+		if delay <= 0 {
+			// Expired reservations are pruned in the next reconciliation
+			delay = time.Second
+		}
+		if requeueAfter == 0 || delay < requeueAfter {
+			requeueAfter = delay
+		}
+	}
+	return requeueAfter
+}
+
+// recordProvisionedMachine increments the ProvisionedMachineCount of the
+// status and the provisionedMachinesCounter when a Metal3Machine gets an index
+func (m *DataTemplateManager) recordProvisionedMachine() {
+	m.DataTemplate.Status.ProvisionedMachineCount++
+	provisionedMachinesCounter.WithLabelValues(m.DataTemplate.Namespace,
+		m.DataTemplate.Name,
+	).Inc()
+}
+
+// recordDeprovisionedMachine increments the DeprovisionedMachineCount of the
+// status and the deprovisionedMachinesCounter when the Metal3DataClaim of a
+// Metal3Machine releases its index
+func (m *DataTemplateManager) recordDeprovisionedMachine() {
+	m.DataTemplate.Status.DeprovisionedMachineCount++
+	deprovisionedMachinesCounter.WithLabelValues(m.DataTemplate.Namespace,
+		m.DataTemplate.Name,
+	).Inc()
+}
+
+// recordFreedIndex appends a released index to the FreedIndexes of the status,
+// for the FIFO and LIFO allocation orders, reserves it for the
+// GracePeriodAfterDelete and notifies the metrics recorder
+func (m *DataTemplateManager) recordFreedIndex(index int) {
+	if m.metricsRecorder != nil {
+		m.metricsRecorder.RecordRelease(m.DataTemplate.Name, index)
+	}
+	m.reserveIndex(index)
+	if m.DataTemplate.Spec.AllocationOrder != capm3.AllocationOrderFIFO &&
+		m.DataTemplate.Spec.AllocationOrder != capm3.AllocationOrderLIFO {
+		m.DataTemplate.Status.FreedIndexes = nil
+		return
+	}
+	m.forgetFreedIndex(index)
+	m.DataTemplate.Status.FreedIndexes = append(
+		m.DataTemplate.Status.FreedIndexes, index,
+	)
+}
+
+// forgetFreedIndex removes an index from the FreedIndexes of the status
+func (m *DataTemplateManager) forgetFreedIndex(index int) {
+	freedIndexes := []int{}
+	for _, freedIndex := range m.DataTemplate.Status.FreedIndexes {
+		if freedIndex != index {
+			freedIndexes = append(freedIndexes, freedIndex)
+		}
+	}
+	if len(freedIndexes) == 0 {
+		freedIndexes = nil
+	}
+	m.DataTemplate.Status.FreedIndexes = freedIndexes
+}
+
+// getMetal3Machine fetches the Metal3Machine of a Metal3DataClaim, once for
+// all the checks of the allocation. It returns nil if it does not exist.
+func (m *DataTemplateManager) getMetal3Machine(ctx context.Context,
+	m3mName string,
+) (*capm3.Metal3Machine, error) {
+	m3m := &capm3.Metal3Machine{}
+	key := client.ObjectKey{
+		Name:      m3mName,
 		Namespace: m.DataTemplate.Namespace,
 	}
+	if err := m.client.Get(ctx, key, m3m); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return m3m, nil
+}
 
-	return indexes, nil
+// requiresMetal3Machine returns true if the Metal3Machine must exist to
+// check its allocation against the Metal3DataTemplate
+func (m *DataTemplateManager) requiresMetal3Machine() bool {
+	return m.DataTemplate.Spec.OwnerReferenceFilter != nil ||
+		m.DataTemplate.Spec.AllocationCondition != "" ||
+		m.DataTemplate.Spec.HostSelector != nil ||
+		len(m.DataTemplate.Spec.AnnotationFilters) != 0
+}
+
+// metal3MachineNotFound returns the error of a missing Metal3Machine that
+// requiresMetal3Machine
+func metal3MachineNotFound(m3mName string) error {
+	return apierrors.NewNotFound(
+		capm3.GroupVersion.WithResource("metal3machines").GroupResource(),
+		m3mName,
+	)
+}
+
+// machineMatchesFilter checks the labels of the Metal3Machine against the
+// OwnerReferenceFilter of the Metal3DataTemplate
+func (m *DataTemplateManager) machineMatchesFilter(m3m *capm3.Metal3Machine,
+) (bool, error) {
+	selector, err := metav1.LabelSelectorAsSelector(m.DataTemplate.Spec.OwnerReferenceFilter)
+	if err != nil {
+		return false, errors.Wrap(err, "invalid ownerReferenceFilter")
+	}
+	return selector.Matches(labels.Set(m3m.Labels)), nil
+}
+
+// machineSkipsAllocation returns true if the Metal3Machine has the
+// SkipAllocationAnnotation set to "true". A missing Metal3Machine does not
+// skip the allocation.
+func (m *DataTemplateManager) machineSkipsAllocation(m3m *capm3.Metal3Machine) bool {
+	return m3m != nil && m3m.Annotations[SkipAllocationAnnotation] == "true"
+}
+
+// applyAnnotationFilters merges the DataSpecPatch of the AnnotationFilters
+// matching the annotations of the Metal3Machine into the Metal3Data. Only
+// the secrets can be chosen, in the namespace of the template.
+func (m *DataTemplateManager) applyAnnotationFilters(ctx context.Context,
+	dataObject *capm3.Metal3Data, m3m *capm3.Metal3Machine,
+) {
+	for _, filter := range m.DataTemplate.Spec.AnnotationFilters {
+		value, ok := m3m.Annotations[filter.AnnotationKey]
+		if !ok || (filter.AnnotationValue != "" && value != filter.AnnotationValue) {
+			continue
+		}
+		m.Log.Info("Applying annotation filter",
+			"cluster", clusterNameFromContext(ctx),
+			"Metal3Machine", m3m.Name, "annotation", filter.AnnotationKey,
+		)
+		if filter.DataSpecPatch.MetaData != nil {
+			dataObject.Spec.MetaData = &corev1.SecretReference{
+				Name:      filter.DataSpecPatch.MetaData.Name,
+				Namespace: m.DataTemplate.Namespace,
+			}
+		}
+		if filter.DataSpecPatch.NetworkData != nil {
+			dataObject.Spec.NetworkData = &corev1.SecretReference{
+				Name:      filter.DataSpecPatch.NetworkData.Name,
+				Namespace: m.DataTemplate.Namespace,
+			}
+		}
+	}
+}
+
+// hostMatchesSelector fetches the BareMetalHost associated with the
+// Metal3Machine and checks its labels against the HostSelector of the
+// Metal3DataTemplate. It returns the name of the BareMetalHost, empty if the
+// Metal3Machine has none.
+func (m *DataTemplateManager) hostMatchesSelector(ctx context.Context,
+	m3m *capm3.Metal3Machine,
+) (string, bool, error) {
+	selector, err := metav1.LabelSelectorAsSelector(m.DataTemplate.Spec.HostSelector)
+	if err != nil {
+		return "", false, errors.Wrap(err, "invalid hostSelector")
+	}
+
+	host, err := getHost(ctx, m3m, m.client, m.Log)
+	if err != nil || host == nil {
+		return "", false, err
+	}
+	return host.Name, selector.Matches(labels.Set(host.Labels)), nil
 }
 
 // DeleteDatas deletes old secrets
@@ -352,24 +3366,81 @@ func (m *DataTemplateManager) deleteData(ctx context.Context,
 	dataClaim *capm3.Metal3DataClaim, indexes map[int]string,
 ) (map[int]string, error) {
 
-	m.Log.Info("Deleting Claim", "Metal3DataClaim", dataClaim.Name)
+	m.Log.Info("Deleting Claim",
+		"cluster", clusterNameFromContext(ctx),
+		"Metal3DataClaim", dataClaim.Name)
 
-	dataClaimIndex, ok := m.DataTemplate.Status.Indexes[dataClaim.Name]
+	dataClaimEntry, ok := m.DataTemplate.Status.Indexes[dataClaim.Name]
+	dataClaimIndex := dataClaimEntry.Index
+	sharedWith := ""
+	handedOver := false
 	if ok {
 		// Try to get the Metal3Data. if it succeeds, delete it
 		tmpM3Data := &capm3.Metal3Data{}
 		key := client.ObjectKey{
-			Name:      m.DataTemplate.Name + "-" + strconv.Itoa(dataClaimIndex),
+			Name:      m.dataName(dataClaimEntry),
 			Namespace: m.DataTemplate.Namespace,
 		}
 		err := m.client.Get(ctx, key, tmpM3Data)
 		if err != nil && !apierrors.IsNotFound(err) {
 			dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to get associated Metal3Data object")
 			return indexes, err
+		} else if err == nil {
+			sharedWith = otherClaim(tmpM3Data, dataClaim.Name)
+		}
+		if apierrors.IsNotFound(err) {
+			machineName := dataClaimEntry.MachineName
+			if machineName == "" {
+				machineName = dataClaim.Name
+			}
+			// The Metal3Data is gone but its address may still be claimed.
+			// It is released before the index, so that a failure keeps the
+			// allocation until the next reconciliation
+			if err := m.syncExternalIPAM(ctx, http.MethodDelete, dataClaimIndex,
+				machineName,
+			); err != nil {
+				dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to release the address in the external IPAM")
+				return indexes, err
+			}
+		}
+		if err == nil && sharedWith != "" && tmpM3Data.Spec.Claim.Name == dataClaim.Name {
+			err = m.handOverSharedData(ctx, dataClaim, dataClaimEntry, tmpM3Data)
+			if err != nil {
+				dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to hand over associated Metal3Data object")
+				return indexes, err
+			}
+			handedOver = true
+		} else if err == nil && sharedWith != "" {
+			// Other claims use this Metal3Data, only remove this claim and its
+			// Metal3Machine from the owners
+			machineName := dataClaimEntry.MachineName
+			if machineName == "" {
+				machineName = dataClaim.Name
+			}
+			ownerRefs := []metav1.OwnerReference{}
+			for _, ownerRef := range tmpM3Data.OwnerReferences {
+				if (ownerRef.Kind == "Metal3DataClaim" && ownerRef.Name == dataClaim.Name) ||
+					(Contains(m.OwnerKindFilter, ownerRef.Kind) && ownerRef.Name == machineName) {
+					continue
+				}
+				ownerRefs = append(ownerRefs, ownerRef)
+			}
+			tmpM3Data.OwnerReferences = ownerRefs
+			err = m.client.Update(ctx, tmpM3Data)
+			if err != nil {
+				dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to update associated Metal3Data object")
+				return indexes, err
+			}
+		} else if err == nil && m.DataTemplate.Spec.DataOwnershipTransfer {
+			err = m.transferData(ctx, dataClaim, dataClaimEntry, tmpM3Data)
+			if err != nil {
+				dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to transfer associated Metal3Data object")
+				return indexes, err
+			}
 		} else if err == nil {
 			// Delete the secret with metadata
 			fmt.Println(tmpM3Data.Name)
-			err = m.client.Delete(ctx, tmpM3Data)
+			err = m.deleteDataObject(ctx, tmpM3Data)
 			if err != nil && !apierrors.IsNotFound(err) {
 				dataClaim.Status.ErrorMessage = pointer.StringPtr("Failed to delete associated Metal3Data object")
 				return indexes, err
@@ -382,12 +3453,304 @@ func (m *DataTemplateManager) deleteData(ctx context.Context,
 		capm3.DataClaimFinalizer,
 	)
 
-	m.Log.Info("Deleted Claim", "Metal3DataClaim", dataClaim.Name)
+	m.Log.Info("Deleted Claim",
+		"cluster", clusterNameFromContext(ctx),
+		"Metal3DataClaim", dataClaim.Name)
 
 	if ok {
+		m.recordDeprovisionedMachine()
+	}
+	if ok && handedOver {
+		// The index is allocated again to the claims sharing it
+		delete(m.DataTemplate.Status.Indexes, dataClaim.Name)
+		delete(indexes, dataClaimIndex)
+	} else if ok && sharedWith != "" {
+		delete(m.DataTemplate.Status.Indexes, dataClaim.Name)
+		indexes[dataClaimIndex] = sharedWith
+	} else if ok {
 		delete(m.DataTemplate.Status.Indexes, dataClaim.Name)
 		delete(indexes, dataClaimIndex)
+		m.recordFreedIndex(dataClaimIndex)
+		if conditions.IsTrue(m.DataTemplate, capm3.IndexSpaceExhaustedCondition) {
+			conditions.MarkFalse(m.DataTemplate, capm3.IndexSpaceExhaustedCondition,
+				capm3.IndexFreedReason, capi.ConditionSeverityNone, "",
+			)
+		}
 	}
 	m.updateStatusTimestamp()
 	return indexes, nil
 }
+
+// handOverSharedData hands the shared index of the deleted Metal3DataClaim
+// over to the other claims of its Metal3Data. The claim of a Metal3Data can
+// not be changed, so the other claims are removed from its owners and from
+// the status, their rendered data is cleared, and the Metal3Data is deleted.
+// The first of them to be reconciled creates it again once it is gone, the
+// others then join it.
+func (m *DataTemplateManager) handOverSharedData(ctx context.Context,
+	dataClaim *capm3.Metal3DataClaim, entry capm3.IndexEntry,
+	m3Data *capm3.Metal3Data,
+) error {
+	machineName := entry.MachineName
+	if machineName == "" {
+		machineName = dataClaim.Name
+	}
+	sharingClaims := []string{}
+	ownerRefs := []metav1.OwnerReference{}
+	for _, ownerRef := range m3Data.OwnerReferences {
+		if ownerRef.Kind == "Metal3DataClaim" && ownerRef.Name != dataClaim.Name {
+			sharingClaims = append(sharingClaims, ownerRef.Name)
+			continue
+		}
+		if Contains(m.OwnerKindFilter, ownerRef.Kind) && ownerRef.Name != machineName {
+			continue
+		}
+		ownerRefs = append(ownerRefs, ownerRef)
+	}
+	m.Log.Info("Handing over the shared Metal3Data",
+		"cluster", clusterNameFromContext(ctx),
+		"Metal3Data", m3Data.Name, "Claims", sharingClaims,
+	)
+	m3Data.OwnerReferences = ownerRefs
+	if err := m.client.Update(ctx, m3Data); err != nil {
+		return errors.Wrap(err, "Failed to update the shared Metal3Data")
+	}
+	for _, claimName := range sharingClaims {
+		delete(m.DataTemplate.Status.Indexes, claimName)
+		if err := m.clearRenderedData(ctx, claimName); err != nil {
+			return err
+		}
+	}
+	err := m.deleteDataObject(ctx, m3Data)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// transferData hands the Metal3Data of a deleted Metal3DataClaim over to the
+// Metal3DataTemplate now referenced by its Metal3Machine, by setting the
+// TransferToAnnotation and removing the Metal3DataClaim from the owners. If
+// the Metal3Machine is gone or still references this template, the
+// Metal3Data is deleted.
+func (m *DataTemplateManager) transferData(ctx context.Context,
+	dataClaim *capm3.Metal3DataClaim, entry capm3.IndexEntry,
+	m3Data *capm3.Metal3Data,
+) error {
+	machineName := entry.MachineName
+	if machineName == "" {
+		machineName = dataClaim.Name
+	}
+	m3m := &capm3.Metal3Machine{}
+	key := client.ObjectKey{
+		Name:      machineName,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := m.client.Get(ctx, key, m3m); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	dataTemplateRef := m3m.Spec.DataTemplate
+	if dataTemplateRef == nil || dataTemplateRef.Name == m.DataTemplate.Name ||
+		(dataTemplateRef.Namespace != "" && dataTemplateRef.Namespace != m.DataTemplate.Namespace) {
+		err := m.deleteDataObject(ctx, m3Data)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	m.Log.Info("Transferring Metal3Data",
+		"cluster", clusterNameFromContext(ctx),
+		"Metal3Data", m3Data.Name, "Metal3DataTemplate", dataTemplateRef.Name,
+	)
+	if err := m.syncExternalIPAM(ctx, http.MethodDelete, entry.Index,
+		machineName,
+	); err != nil {
+		return err
+	}
+	ownerRefs := []metav1.OwnerReference{}
+	for _, ownerRef := range m3Data.OwnerReferences {
+		if ownerRef.Kind == "Metal3DataClaim" && ownerRef.Name == dataClaim.Name {
+			continue
+		}
+		ownerRefs = append(ownerRefs, ownerRef)
+	}
+	m3Data.OwnerReferences = ownerRefs
+	if m3Data.Annotations == nil {
+		m3Data.Annotations = make(map[string]string)
+	}
+	m3Data.Annotations[TransferToAnnotation] = dataTemplateRef.Name
+	return m.client.Update(ctx, m3Data)
+}
+
+// findTransferredData looks for a Metal3Data of the Metal3Machine with the
+// TransferToAnnotation set to this template. It returns it if its index is
+// free here, so that the index is allocated again to the Metal3DataClaim.
+// Otherwise, the Metal3Data is deleted so that a new index is allocated.
+func (m *DataTemplateManager) findTransferredData(ctx context.Context,
+	dataClaim *capm3.Metal3DataClaim, indexes map[int]string, m3mName string,
+) (*capm3.Metal3Data, error) {
+	dataObjects := capm3.Metal3DataList{}
+	if err := m.list(ctx, &dataObjects); err != nil {
+		return nil, err
+	}
+
+	var m3Data *capm3.Metal3Data
+	for i, dataObject := range dataObjects.Items {
+		if dataObject.Annotations[TransferToAnnotation] != m.DataTemplate.Name {
+			continue
+		}
+		for _, ownerRef := range dataObject.OwnerReferences {
+			if Contains(m.OwnerKindFilter, ownerRef.Kind) && ownerRef.Name == m3mName {
+				m3Data = &dataObjects.Items[i]
+				break
+			}
+		}
+		if m3Data != nil {
+			break
+		}
+	}
+	if m3Data == nil {
+		return nil, nil
+	}
+
+	if !m.isFreeIndex(indexes, m3Data.Spec.Index) {
+		m.Log.Info("Index of the transferred Metal3Data not free, deleting it",
+			"cluster", clusterNameFromContext(ctx),
+			"Claim", dataClaim.Name, "Metal3Data", m3Data.Name,
+			"index", m3Data.Spec.Index,
+		)
+		err := m.deleteDataObject(ctx, m3Data)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return m3Data, nil
+}
+
+// otherClaim returns the name of a Metal3DataClaim owning the Metal3Data,
+// other than the given one
+func otherClaim(m3Data *capm3.Metal3Data, claimName string) string {
+	for _, ownerRef := range m3Data.OwnerReferences {
+		if ownerRef.Kind == "Metal3DataClaim" && ownerRef.Name != claimName {
+			return ownerRef.Name
+		}
+	}
+	return ""
+}
+
+// deleteDataObject releases the address of the Metal3Data in the external
+// IPAM, if it was generated from this template, and deletes it. It is listed
+// in the PendingDeletions of the status until the deletion succeeds.
+func (m *DataTemplateManager) deleteDataObject(ctx context.Context,
+	m3Data *capm3.Metal3Data,
+) error {
+	m.addPendingDeletion(m3Data.Name)
+	if m3Data.Spec.Template.Name == m.DataTemplate.Name {
+		entry := m.newIndexEntry(m3Data, m3Data.Spec.Claim.Name)
+		machineName := entry.MachineName
+		if machineName == "" {
+			machineName = m3Data.Spec.Claim.Name
+		}
+		if err := m.syncExternalIPAM(ctx, http.MethodDelete, m3Data.Spec.Index,
+			machineName,
+		); err != nil {
+			return err
+		}
+		if err := m.revokeTenantAccess(ctx, m3Data.Name, machineName,
+			types.UID(entry.MachineUID),
+		); err != nil {
+			return err
+		}
+	}
+	err := m.deleteDataObjectWithRetries(ctx, m3Data)
+	if err == nil || apierrors.IsNotFound(err) {
+		m.removePendingDeletion(m3Data.Name)
+	}
+	return err
+}
+
+// deleteDataObjectWithRetries deletes the Metal3Data. If RetryFailedDeletes
+// is set, the deletion is retried on errors, unless the context is done.
+func (m *DataTemplateManager) deleteDataObjectWithRetries(ctx context.Context,
+	m3Data *capm3.Metal3Data,
+) error {
+	retries := 0
+	if m.DataTemplate.Spec.RetryFailedDeletes {
+		retries = deleteRetries
+	}
+	err := m.client.Delete(ctx, m3Data)
+	for attempt := 0; attempt < retries; attempt++ {
+		if err == nil || apierrors.IsNotFound(err) ||
+			errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return err
+		}
+		m.Log.Info("Failed to delete Metal3Data, retrying",
+			"cluster", clusterNameFromContext(ctx),
+			"Metal3Data", m3Data.Name, "error", err.Error(),
+		)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(deleteRetryInterval):
+		}
+		err = m.client.Delete(ctx, m3Data)
+	}
+	return err
+}
+
+// addPendingDeletion records the Metal3Data in the PendingDeletions of the
+// status, once
+func (m *DataTemplateManager) addPendingDeletion(dataName string) {
+	if Contains(m.DataTemplate.Status.PendingDeletions, dataName) {
+		return
+	}
+	m.DataTemplate.Status.PendingDeletions = append(
+		m.DataTemplate.Status.PendingDeletions, dataName,
+	)
+}
+
+// removePendingDeletion removes the Metal3Data from the PendingDeletions of
+// the status
+func (m *DataTemplateManager) removePendingDeletion(dataName string) {
+	m.DataTemplate.Status.PendingDeletions = Filter(
+		m.DataTemplate.Status.PendingDeletions, dataName,
+	)
+}
+
+// processPendingDeletions deletes again the Metal3Data of the
+// PendingDeletions of the status. The entries of the Metal3Data that are
+// gone, or now belong to another template without being transferred to this
+// one, are removed. It stops at the
+// first failure, the remaining deletions being tried again on the next
+// reconciliation.
+func (m *DataTemplateManager) processPendingDeletions(ctx context.Context) error {
+	pendingDeletions := append([]string{}, m.DataTemplate.Status.PendingDeletions...)
+	for _, dataName := range pendingDeletions {
+		m3Data := &capm3.Metal3Data{}
+		key := client.ObjectKey{
+			Name:      dataName,
+			Namespace: m.DataTemplate.Namespace,
+		}
+		if err := m.client.Get(ctx, key, m3Data); err != nil {
+			if apierrors.IsNotFound(err) {
+				m.removePendingDeletion(dataName)
+				continue
+			}
+			return errors.Wrap(err, "Failed to get the Metal3Data pending deletion")
+		}
+		if !m.isDataFromTemplate(m3Data) &&
+			m3Data.Annotations[TransferToAnnotation] != m.DataTemplate.Name {
+			m.removePendingDeletion(dataName)
+			continue
+		}
+		m.Log.Info("Deleting the Metal3Data pending deletion",
+			"cluster", clusterNameFromContext(ctx), "Metal3Data", dataName,
+		)
+		if err := m.deleteDataObject(ctx, m3Data); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "Failed to delete the Metal3Data pending deletion")
+		}
+	}
+	return nil
+}
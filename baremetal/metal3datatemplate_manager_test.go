@@ -18,25 +18,234 @@ package baremetal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 
+	bmh "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
 	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/metal3-io/cluster-api-provider-metal3/baremetal/testutil"
+	"github.com/metal3-io/cluster-api-provider-metal3/version"
+	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/klog/klogr"
-	// "k8s.io/utils/pointer"
+	"k8s.io/utils/pointer"
 	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 var timeNow = metav1.Now()
 
+// indexesOf returns the allocated index of each claim
+func indexesOf(entries map[string]infrav1.IndexEntry) map[string]int {
+	if entries == nil {
+		return nil
+	}
+	indexes := make(map[string]int, len(entries))
+	for claimName, entry := range entries {
+		indexes[claimName] = entry.Index
+	}
+	return indexes
+}
+
+// newDataQuota returns a ResourceQuota with the given usage of a resource
+func newDataQuota(name, namespace string, resourceName corev1.ResourceName,
+	used, hard int64,
+) *corev1.ResourceQuota {
+	return &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{
+				resourceName: *resource.NewQuantity(hard, resource.DecimalSI),
+			},
+			Used: corev1.ResourceList{
+				resourceName: *resource.NewQuantity(used, resource.DecimalSI),
+			},
+		},
+	}
+}
+
+// dataPointers returns pointers to the given Metal3Data objects
+func dataPointers(datas []infrav1.Metal3Data) []*infrav1.Metal3Data {
+	pointers := make([]*infrav1.Metal3Data, 0, len(datas))
+	for i := range datas {
+		pointers = append(pointers, &datas[i])
+	}
+	return pointers
+}
+
+// failingDeleteClient fails the first deletions
+type failingDeleteClient struct {
+	client.Client
+	failures int
+	attempts int
+}
+
+func (c *failingDeleteClient) Delete(ctx context.Context, obj runtime.Object,
+	opts ...client.DeleteOption,
+) error {
+	c.attempts++
+	if c.attempts <= c.failures {
+		return errors.New("Transient error")
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+// fakeDataInformer records the event handlers and calls them on add and update
+type fakeDataInformer struct {
+	cache.Informer
+	mu       sync.Mutex
+	handlers []toolscache.ResourceEventHandler
+}
+
+func (f *fakeDataInformer) AddEventHandler(handler toolscache.ResourceEventHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers = append(f.handlers, handler)
+}
+
+func (f *fakeDataInformer) add(obj runtime.Object) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, handler := range f.handlers {
+		handler.OnAdd(obj)
+	}
+}
+
+func (f *fakeDataInformer) update(oldObj, newObj runtime.Object) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, handler := range f.handlers {
+		handler.OnUpdate(oldObj, newObj)
+	}
+}
+
+func (f *fakeDataInformer) handlerCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.handlers)
+}
+
+// pagingClient splits the Metal3Data listings in pages of Limit objects and
+// records the number of List calls
+type pagingClient struct {
+	client.Client
+	listCalls int
+}
+
+func (c *pagingClient) List(ctx context.Context, list runtime.Object,
+	opts ...client.ListOption,
+) error {
+	c.listCalls++
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	if err := c.Client.List(ctx, list, opts...); err != nil {
+		return err
+	}
+	dataList, ok := list.(*infrav1.Metal3DataList)
+	if !ok || listOpts.Limit == 0 {
+		return nil
+	}
+	start := 0
+	if listOpts.Continue != "" {
+		start, _ = strconv.Atoi(listOpts.Continue)
+	}
+	end := start + int(listOpts.Limit)
+	dataList.Continue = strconv.Itoa(end)
+	if end >= len(dataList.Items) {
+		end = len(dataList.Items)
+		dataList.Continue = ""
+	}
+	dataList.Items = dataList.Items[start:end]
+	return nil
+}
+
+// createOptionsClient records the options of the Create calls
+type createOptionsClient struct {
+	client.Client
+	createOptions []*client.CreateOptions
+}
+
+func (c *createOptionsClient) Create(ctx context.Context, obj runtime.Object,
+	opts ...client.CreateOption,
+) error {
+	createOpts := &client.CreateOptions{}
+	createOpts.ApplyOptions(opts)
+	c.createOptions = append(c.createOptions, createOpts)
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// machineGetClient counts the Get calls of Metal3Machines
+type machineGetClient struct {
+	client.Client
+	machineGets int
+}
+
+func (c *machineGetClient) Get(ctx context.Context, key client.ObjectKey,
+	obj runtime.Object,
+) error {
+	if _, ok := obj.(*infrav1.Metal3Machine); ok {
+		c.machineGets++
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+// countingRateLimiter counts the calls to Wait
+type countingRateLimiter struct {
+	flowcontrol.RateLimiter
+	waits int
+}
+
+func (r *countingRateLimiter) Wait(ctx context.Context) error {
+	r.waits++
+	return r.RateLimiter.Wait(ctx)
+}
+
+// fakeMetricsRecorder records the allocated and released indexes
+type fakeMetricsRecorder struct {
+	allocations []int
+	releases    []int
+}
+
+func (r *fakeMetricsRecorder) RecordAllocation(template string, index int) {
+	r.allocations = append(r.allocations, index)
+}
+
+func (r *fakeMetricsRecorder) RecordRelease(template string, index int) {
+	r.releases = append(r.releases, index)
+}
+
+// fakeDataInformers returns the same informer for every object
+type fakeDataInformers struct {
+	cache.Informers
+	informer *fakeDataInformer
+}
+
+func (f *fakeDataInformers) GetInformer(ctx context.Context, obj runtime.Object) (cache.Informer, error) {
+	return f.informer, nil
+}
+
 var _ = Describe("Metal3DataTemplate manager", func() {
 	DescribeTable("Test Finalizers",
 		func(template *infrav1.Metal3DataTemplate) {
@@ -168,8 +377,9 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 				Expect(err).NotTo(HaveOccurred())
 			}
 			Expect(addressMap).To(Equal(tc.expectedMap))
-			Expect(tc.template.Status.Indexes).To(Equal(tc.expectedIndexes))
+			Expect(indexesOf(tc.template.Status.Indexes)).To(Equal(tc.expectedIndexes))
 			Expect(tc.template.Status.LastUpdated.IsZero()).To(BeFalse())
+			Expect(tc.template.Status.ControllerVersion).To(Equal(version.Version))
 		},
 		Entry("No indexes", testGetIndexes{
 			template:        &infrav1.Metal3DataTemplate{},
@@ -242,6 +452,32 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 				"abc": 0,
 			},
 		}),
+		Entry("generated indexes", testGetIndexes{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: testObjectMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					MinIndex: 2,
+				},
+			},
+			indexes: dataPointers(testutil.ManifestGenerator{}.GenerateForTemplate(
+				&infrav1.Metal3DataTemplate{
+					ObjectMeta: testObjectMeta,
+					Spec: infrav1.Metal3DataTemplateSpec{
+						MinIndex: 2,
+					},
+				}, 3,
+			)),
+			expectedMap: map[int]string{
+				2: "machine-2",
+				3: "machine-3",
+				4: "machine-4",
+			},
+			expectedIndexes: map[string]int{
+				"machine-2": 2,
+				"machine-3": 3,
+				"machine-4": 4,
+			},
+		}),
 	)
 
 	var templateMeta = metav1.ObjectMeta{
@@ -274,7 +510,7 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 			)
 			Expect(err).NotTo(HaveOccurred())
 
-			nbIndexes, err := templateMgr.UpdateDatas(context.TODO())
+			nbIndexes, _, err := templateMgr.UpdateDatas(context.TODO(), nil)
 			if tc.expectRequeue || tc.expectError {
 				Expect(err).To(HaveOccurred())
 				if tc.expectRequeue {
@@ -287,7 +523,8 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 			}
 			Expect(nbIndexes).To(Equal(tc.expectedNbIndexes))
 			Expect(tc.template.Status.LastUpdated.IsZero()).To(BeFalse())
-			Expect(tc.template.Status.Indexes).To(Equal(tc.expectedIndexes))
+			Expect(tc.template.Status.ControllerVersion).To(Equal(version.Version))
+			Expect(indexesOf(tc.template.Status.Indexes)).To(Equal(tc.expectedIndexes))
 
 			// get list of Metal3Data objects
 			dataObjects := infrav1.Metal3DataClaimList{}
@@ -444,16 +681,269 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 		}),
 	)
 
+	It("Lists the unprovisioned machines", func() {
+		templateMgr, err := NewDataTemplateManager(nil, &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: infrav1.MigrateIndexes(map[string]int{"claim-0": 0}),
+			},
+		}, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		deletionTimestamp := metav1.Now()
+		newClaim := func(name, template, machineName string) infrav1.Metal3DataClaim {
+			dataClaim := infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: "myns",
+				},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: template},
+				},
+			}
+			if machineName != "" {
+				dataClaim.OwnerReferences = []metav1.OwnerReference{
+					{Kind: "Metal3Machine", Name: machineName},
+				}
+			}
+			return dataClaim
+		}
+		deletedClaim := newClaim("claim-3", "abc", "machine-3")
+		deletedClaim.DeletionTimestamp = &deletionTimestamp
+
+		templateMgr.updateUnprovisionedMachines([]infrav1.Metal3DataClaim{
+			newClaim("claim-0", "abc", "machine-0"),
+			newClaim("claim-2", "abc", "machine-2"),
+			newClaim("claim-1", "abc", ""),
+			deletedClaim,
+			newClaim("claim-4", "bcd", "machine-4"),
+		})
+		Expect(templateMgr.DataTemplate.Status.UnprovisionedMachines).To(Equal(
+			[]string{"claim-1", "machine-2"},
+		))
+
+		// The claims opted out of the allocation are not waiting for an index
+		templateMgr.skippedClaims = map[string]bool{"claim-2": true}
+		templateMgr.updateUnprovisionedMachines([]infrav1.Metal3DataClaim{
+			newClaim("claim-1", "abc", ""),
+			newClaim("claim-2", "abc", "machine-2"),
+		})
+		Expect(templateMgr.DataTemplate.Status.UnprovisionedMachines).To(Equal(
+			[]string{"claim-1"},
+		))
+
+		templateMgr.updateUnprovisionedMachines(nil)
+		Expect(templateMgr.DataTemplate.Status.UnprovisionedMachines).To(BeNil())
+	})
+
+	It("Sums the size of the Metal3Data objects", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				ClusterName: "cluster1",
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 2)
+		otherData := infrav1.Metal3Data{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "bcd-0",
+				Namespace: "myns",
+			},
+			Spec: infrav1.Metal3DataSpec{
+				Template: corev1.ObjectReference{Name: "bcd"},
+			},
+		}
+		c := &pagingClient{
+			Client: fakeclient.NewFakeClientWithScheme(setupSchemeMm(),
+				&datas[0], &datas[1], &otherData,
+			),
+		}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		// The Metal3Data listed by getIndexes are reused
+		_, err = templateMgr.getIndexes(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(templateMgr.updateDataSize(context.TODO())).To(Succeed())
+		Expect(c.listCalls).To(Equal(1))
+		var expectedSize int64
+		dataObjects := infrav1.Metal3DataList{}
+		Expect(c.List(context.TODO(), &dataObjects)).To(Succeed())
+		for _, m3Data := range dataObjects.Items {
+			if m3Data.Spec.Template.Name != "abc" {
+				continue
+			}
+			m3DataJSON, err := json.Marshal(m3Data)
+			Expect(err).NotTo(HaveOccurred())
+			expectedSize += int64(len(m3DataJSON))
+		}
+		Expect(expectedSize).NotTo(BeZero())
+		Expect(templateMgr.DataTemplate.Status.DataSizeBytes).To(Equal(expectedSize))
+		Expect(promtestutil.ToFloat64(
+			dataSizeBytesGauge.WithLabelValues("myns", "abc"),
+		)).To(Equal(float64(expectedSize)))
+
+		// The size is not recomputed while the indexes are unchanged
+		templateMgr.listedDatas = nil
+		Expect(templateMgr.updateDataSize(context.TODO())).To(Succeed())
+		Expect(templateMgr.DataTemplate.Status.DataSizeBytes).To(Equal(expectedSize))
+
+		delete(templateMgr.DataTemplate.Status.Indexes, datas[0].Spec.Claim.Name)
+		Expect(templateMgr.updateDataSize(context.TODO())).To(Succeed())
+		Expect(templateMgr.DataTemplate.Status.DataSizeBytes).To(BeZero())
+	})
+
+	DescribeTable("Test recordIndexChanges",
+		func(previousIndexes map[string]int, indexes map[string]int,
+			expectedAnnotation string,
+		) {
+			templateMgr, err := NewDataTemplateManager(nil, &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(indexes),
+				},
+			}, klogr.New())
+			Expect(err).NotTo(HaveOccurred())
+
+			err = templateMgr.recordIndexChanges(context.TODO(),
+				infrav1.MigrateIndexes(previousIndexes),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			annotation, ok := templateMgr.DataTemplate.Annotations[IndexChangesAnnotation]
+			if expectedAnnotation == "" {
+				Expect(ok).To(BeFalse())
+			} else {
+				Expect(annotation).To(Equal(expectedAnnotation))
+			}
+		},
+		Entry("No change", map[string]int{"abc": 0}, map[string]int{"abc": 0}, ""),
+		Entry("Allocated", map[string]int{"abc": 0},
+			map[string]int{"abc": 0, "bcd": 1},
+			`{"allocated":{"bcd":1}}`,
+		),
+		Entry("Allocated and freed", map[string]int{"abc": 0, "bcd": 1},
+			map[string]int{"bcd": 1, "cde": 0},
+			`{"allocated":{"cde":0},"freed":{"abc":0}}`,
+		),
+	)
+
+	type testCaseUpdateIPIndex struct {
+		ipPoolRef       *corev1.LocalObjectReference
+		ipClaims        []*ipamv1.IPClaim
+		ipAddresses     []*ipamv1.IPAddress
+		expectedIPIndex map[string]string
+	}
+
+	DescribeTable("Test updateIPIndex",
+		func(tc testCaseUpdateIPIndex) {
+			objects := []runtime.Object{}
+			for _, ipClaim := range tc.ipClaims {
+				objects = append(objects, ipClaim)
+			}
+			for _, ipAddress := range tc.ipAddresses {
+				objects = append(objects, ipAddress)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupScheme(), objects...)
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					IPPoolRef: tc.ipPoolRef,
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: map[string]infrav1.IndexEntry{
+						"claim0":   {Index: 0, MachineName: "machine0"},
+						"machine1": {Index: 1},
+						"machine2": {Index: 2},
+					},
+					IPIndex: map[string]string{
+						"192.168.0.100": "machine3",
+					},
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(c, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(templateMgr.updateIPIndex(context.TODO())).To(Succeed())
+			Expect(template.Status.IPIndex).To(Equal(tc.expectedIPIndex))
+		},
+		Entry("No pool", testCaseUpdateIPIndex{}),
+		Entry("Pool", testCaseUpdateIPIndex{
+			ipPoolRef: &corev1.LocalObjectReference{Name: "pool1"},
+			ipClaims: []*ipamv1.IPClaim{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc-0-pool1",
+						Namespace: "myns",
+					},
+					Status: ipamv1.IPClaimStatus{
+						Address: &corev1.ObjectReference{Name: "pool1-192-168-0-10"},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc-1-pool1",
+						Namespace: "myns",
+					},
+					Status: ipamv1.IPClaimStatus{
+						Address: &corev1.ObjectReference{Name: "pool1-192-168-0-11"},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc-2-pool1",
+						Namespace: "myns",
+					},
+				},
+			},
+			ipAddresses: []*ipamv1.IPAddress{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "pool1-192-168-0-10",
+						Namespace: "myns",
+					},
+					Spec: ipamv1.IPAddressSpec{
+						Address: "192.168.0.10",
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "pool1-192-168-0-11",
+						Namespace: "myns",
+					},
+					Spec: ipamv1.IPAddressSpec{
+						Address: "192.168.0.11",
+					},
+				},
+			},
+			expectedIPIndex: map[string]string{
+				"192.168.0.10": "machine0",
+				"192.168.0.11": "machine1",
+			},
+		}),
+		Entry("Pool, no allocation", testCaseUpdateIPIndex{
+			ipPoolRef:       &corev1.LocalObjectReference{Name: "pool1"},
+			expectedIPIndex: map[string]string{},
+		}),
+	)
+
 	type testCaseCreateAddresses struct {
 		template        *infrav1.Metal3DataTemplate
 		dataClaim       *infrav1.Metal3DataClaim
 		datas           []*infrav1.Metal3Data
+		machines        []*infrav1.Metal3Machine
+		hosts           []*bmh.BareMetalHost
+		quotas          []*corev1.ResourceQuota
 		indexes         map[int]string
 		expectRequeue   bool
 		expectError     bool
 		expectedDatas   []string
 		expectedMap     map[int]string
 		expectedIndexes map[string]int
+		expectRejection bool
+		expectExhausted bool
+		expectedEvents  []string
 	}
 
 	DescribeTable("Test CreateAddresses",
@@ -462,14 +952,24 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 			for _, address := range tc.datas {
 				objects = append(objects, address)
 			}
+			for _, machine := range tc.machines {
+				objects = append(objects, machine)
+			}
+			for _, host := range tc.hosts {
+				objects = append(objects, host)
+			}
+			for _, quota := range tc.quotas {
+				objects = append(objects, quota)
+			}
 			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
-			templateMgr, err := NewDataTemplateManager(c, tc.template,
-				klogr.New(),
+			recorder := record.NewFakeRecorder(10)
+			templateMgr, err := NewDataTemplateManagerWithOptions(c, tc.template,
+				klogr.New(), WithEventRecorder(recorder),
 			)
 			Expect(err).NotTo(HaveOccurred())
 
 			allocatedMap, err := templateMgr.createData(context.TODO(), tc.dataClaim,
-				tc.indexes,
+				tc.indexes, c,
 			)
 			if tc.expectRequeue || tc.expectError {
 				Expect(err).To(HaveOccurred())
@@ -481,6 +981,16 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 			} else {
 				Expect(err).NotTo(HaveOccurred())
 			}
+			if tc.expectExhausted {
+				Expect(err).To(BeAssignableToTypeOf(&IndexExhaustedError{}))
+				Expect(conditions.IsTrue(tc.template,
+					infrav1.IndexSpaceExhaustedCondition,
+				)).To(BeTrue())
+			} else if len(tc.expectedDatas) > 0 && !tc.expectRequeue {
+				Expect(conditions.IsTrue(tc.template,
+					infrav1.IndexSpaceExhaustedCondition,
+				)).To(BeFalse())
+			}
 			// get list of Metal3Data objects
 			dataObjects := infrav1.Metal3DataList{}
 			opts := &client.ListOptions{}
@@ -495,17 +1005,29 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 				// TODO add further testing later
 			}
 			Expect(len(tc.dataClaim.Finalizers)).To(Equal(1))
+			if tc.expectRejection {
+				Expect(tc.dataClaim.Status.ErrorMessage).NotTo(BeNil())
+			}
+			for _, event := range tc.expectedEvents {
+				Expect(recorder.Events).To(Receive(Equal(event)))
+			}
 
 			Expect(allocatedMap).To(Equal(tc.expectedMap))
-			Expect(tc.template.Status.Indexes).To(Equal(tc.expectedIndexes))
+			Expect(indexesOf(tc.template.Status.Indexes)).To(Equal(tc.expectedIndexes))
+			if len(tc.expectedDatas) > 0 && !tc.expectRequeue {
+				entry := tc.template.Status.Indexes[tc.dataClaim.Name]
+				Expect(entry.MachineName).To(Equal("abc"))
+				Expect(entry.MachineUID).To(Equal("a7241a39-4730-44c4-9d81-e70f27a4ce89"))
+				Expect(entry.AllocatedAt).NotTo(BeNil())
+			}
 		},
 		Entry("Already exists", testCaseCreateAddresses{
 			template: &infrav1.Metal3DataTemplate{
 				ObjectMeta: templateMeta,
 				Status: infrav1.Metal3DataTemplateStatus{
-					Indexes: map[string]int{
+					Indexes: infrav1.MigrateIndexes(map[string]int{
 						"abc": 0,
-					},
+					}),
 				},
 			},
 			dataClaim: &infrav1.Metal3DataClaim{
@@ -520,7 +1042,7 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 				ObjectMeta: templateMeta,
 				Spec:       infrav1.Metal3DataTemplateSpec{},
 				Status: infrav1.Metal3DataTemplateStatus{
-					Indexes: map[string]int{},
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
 				},
 			},
 			indexes: map[int]string{},
@@ -540,9 +1062,9 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 				ObjectMeta: templateMeta,
 				Spec:       infrav1.Metal3DataTemplateSpec{},
 				Status: infrav1.Metal3DataTemplateStatus{
-					Indexes: map[string]int{
+					Indexes: infrav1.MigrateIndexes(map[string]int{
 						"bcd": 0,
-					},
+					}),
 				},
 			},
 			indexes: map[int]string{0: "bcd"},
@@ -564,7 +1086,7 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 				ObjectMeta: templateMeta,
 				Spec:       infrav1.Metal3DataTemplateSpec{},
 				Status: infrav1.Metal3DataTemplateStatus{
-					Indexes: map[string]int{},
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
 				},
 			},
 			indexes: map[int]string{},
@@ -593,98 +1115,3609 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 			expectedDatas:   []string{"abc-0"},
 			expectRequeue:   true,
 		}),
-	)
-
-	type testCaseDeleteDatas struct {
-		template        *infrav1.Metal3DataTemplate
-		dataClaim       *infrav1.Metal3DataClaim
-		datas           []*infrav1.Metal3Data
-		indexes         map[int]string
-		expectedMap     map[int]string
-		expectedIndexes map[string]int
-		expectError     bool
-	}
-
-	DescribeTable("Test DeleteAddresses",
-		func(tc testCaseDeleteDatas) {
-			objects := []runtime.Object{}
-			for _, address := range tc.datas {
-				objects = append(objects, address)
-			}
-			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
-			templateMgr, err := NewDataTemplateManager(c, tc.template,
-				klogr.New(),
-			)
-			Expect(err).NotTo(HaveOccurred())
-
-			allocatedMap, err := templateMgr.deleteData(context.TODO(), tc.dataClaim, tc.indexes)
-			if tc.expectError {
-				Expect(err).To(HaveOccurred())
-			} else {
-				Expect(err).NotTo(HaveOccurred())
-			}
-
-			// get list of Metal3Data objects
-			dataObjects := infrav1.Metal3DataList{}
-			opts := &client.ListOptions{}
-			err = c.List(context.TODO(), &dataObjects, opts)
-			Expect(err).NotTo(HaveOccurred())
-			Expect(len(dataObjects.Items)).To(Equal(0))
-
-			Expect(tc.template.Status.LastUpdated.IsZero()).To(BeFalse())
-			Expect(allocatedMap).To(Equal(tc.expectedMap))
-			Expect(tc.template.Status.Indexes).To(Equal(tc.expectedIndexes))
-			Expect(len(tc.dataClaim.Finalizers)).To(Equal(0))
-		},
-		Entry("Empty Template", testCaseDeleteDatas{
-			template: &infrav1.Metal3DataTemplate{},
-			dataClaim: &infrav1.Metal3DataClaim{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "TestRef",
+		Entry("Not allocated yet, with MinIndex", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					MinIndex: 5,
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{
+						"bcd": 5,
+					}),
 				},
 			},
-		}),
-		Entry("No Deletion needed", testCaseDeleteDatas{
-			template: &infrav1.Metal3DataTemplate{},
+			indexes: map[int]string{5: "bcd"},
 			dataClaim: &infrav1.Metal3DataClaim{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "TestRef",
-				},
+				ObjectMeta: testObjectMetaWithOR,
 			},
-			expectedMap: map[int]string{0: "abcd"},
-			indexes: map[int]string{
-				0: "abcd",
+			expectedIndexes: map[string]int{
+				"abc": 6,
+				"bcd": 5,
+			},
+			expectedMap: map[int]string{
+				5: "bcd",
+				6: "abc",
 			},
+			expectedDatas: []string{"abc-6"},
 		}),
-		Entry("Deletion needed, not found", testCaseDeleteDatas{
+		Entry("Not allocated yet, index space exhausted", testCaseCreateAddresses{
 			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					MinIndex: 1,
+					MaxIndex: 2,
+				},
 				Status: infrav1.Metal3DataTemplateStatus{
-					Indexes: map[string]int{
-						"TestRef": 0,
-					},
+					Indexes: infrav1.MigrateIndexes(map[string]int{
+						"bcd": 1,
+						"cde": 2,
+					}),
 				},
 			},
+			indexes: map[int]string{1: "bcd", 2: "cde"},
 			dataClaim: &infrav1.Metal3DataClaim{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "TestRef",
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			expectedIndexes: map[string]int{
+				"bcd": 1,
+				"cde": 2,
+			},
+			expectedMap: map[int]string{
+				1: "bcd",
+				2: "cde",
+			},
+			expectError:     true,
+			expectExhausted: true,
+		}),
+		Entry("Not allocated yet, quota exceeded", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec:       infrav1.Metal3DataTemplateSpec{},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
 				},
 			},
-			indexes: map[int]string{
-				0: "TestRef",
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			quotas: []*corev1.ResourceQuota{
+				newDataQuota("quota1", "myns", metal3DataQuotaResource, 2, 2),
 			},
 			expectedIndexes: map[string]int{},
 			expectedMap:     map[int]string{},
+			expectError:     true,
+			expectRejection: true,
+			expectedEvents: []string{
+				"Warning QuotaExceeded ResourceQuota quota1 exceeded for Metal3Data: 2 used, 2 allowed",
+			},
 		}),
-		Entry("Deletion needed", testCaseDeleteDatas{
+		Entry("Not allocated yet, emergency range", testCaseCreateAddresses{
 			template: &infrav1.Metal3DataTemplate{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "abc",
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					MinIndex:       1,
+					MaxIndex:       2,
+					EmergencyRange: &infrav1.EmergencyRangeSpec{Min: 10, Max: 12},
 				},
-				Spec: infrav1.Metal3DataTemplateSpec{},
 				Status: infrav1.Metal3DataTemplateStatus{
-					Indexes: map[string]int{
-						"TestRef": 0,
-					},
+					Indexes: infrav1.MigrateIndexes(map[string]int{
+						"bcd": 1,
+						"cde": 2,
+					}),
+				},
+			},
+			indexes: map[int]string{1: "bcd", 2: "cde"},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			expectedIndexes: map[string]int{
+				"abc": 10,
+				"bcd": 1,
+				"cde": 2,
+			},
+			expectedMap: map[int]string{
+				1:  "bcd",
+				2:  "cde",
+				10: "abc",
+			},
+			expectedDatas: []string{"abc-10"},
+			expectedEvents: []string{
+				"Warning EmergencyIndexAllocated Allocated index 10 of the emergency range to Metal3DataClaim abc",
+			},
+		}),
+		Entry("Not allocated yet, index space no longer exhausted", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					MinIndex: 1,
+					MaxIndex: 3,
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{
+						"bcd": 1,
+						"cde": 2,
+					}),
+					Conditions: capi.Conditions{
+						{
+							Type:   infrav1.IndexSpaceExhaustedCondition,
+							Status: corev1.ConditionTrue,
+						},
+					},
+				},
+			},
+			indexes: map[int]string{1: "bcd", 2: "cde"},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			expectedIndexes: map[string]int{
+				"abc": 3,
+				"bcd": 1,
+				"cde": 2,
+			},
+			expectedMap: map[int]string{
+				1: "bcd",
+				2: "cde",
+				3: "abc",
+			},
+			expectedDatas: []string{"abc-3"},
+		}),
+		Entry("Not allocated yet, matching owner reference filter", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					OwnerReferenceFilter: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"pool": "workers"},
+					},
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			machines: []*infrav1.Metal3Machine{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc",
+						Namespace: "myns",
+						Labels:    map[string]string{"pool": "workers"},
+					},
+				},
+			},
+			expectedIndexes: map[string]int{
+				"abc": 0,
+			},
+			expectedMap: map[int]string{
+				0: "abc",
+			},
+			expectedDatas: []string{"abc-0"},
+		}),
+		Entry("Not allocated yet, not matching owner reference filter", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					OwnerReferenceFilter: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"pool": "workers"},
+					},
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			machines: []*infrav1.Metal3Machine{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc",
+						Namespace: "myns",
+						Labels:    map[string]string{"pool": "control-plane"},
+					},
+				},
+			},
+			expectedIndexes: map[string]int{},
+			expectedMap:     map[int]string{},
+			expectRejection: true,
+			expectedEvents: []string{
+				"Warning OwnerReferenceFilterRejected Metal3Machine abc does not match the ownerReferenceFilter of Metal3DataTemplate abc",
+			},
+		}),
+		Entry("Not allocated yet, owner reference filter, machine not found", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					OwnerReferenceFilter: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"pool": "workers"},
+					},
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			expectedIndexes: map[string]int{},
+			expectedMap:     map[int]string{},
+			expectError:     true,
+		}),
+		Entry("Not allocated yet, skip allocation annotation", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec:       infrav1.Metal3DataTemplateSpec{},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			machines: []*infrav1.Metal3Machine{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc",
+						Namespace: "myns",
+						Annotations: map[string]string{
+							SkipAllocationAnnotation: "true",
+						},
+					},
+				},
+			},
+			expectedIndexes: map[string]int{},
+			expectedMap:     map[int]string{},
+			expectRejection: true,
+		}),
+		Entry("Not allocated yet, skip allocation annotation not true", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec:       infrav1.Metal3DataTemplateSpec{},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			machines: []*infrav1.Metal3Machine{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc",
+						Namespace: "myns",
+						Annotations: map[string]string{
+							SkipAllocationAnnotation: "false",
+						},
+					},
+				},
+			},
+			expectedIndexes: map[string]int{
+				"abc": 0,
+			},
+			expectedMap: map[int]string{
+				0: "abc",
+			},
+			expectedDatas: []string{"abc-0"},
+		}),
+		Entry("Not allocated yet, matching allocation condition", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					AllocationCondition: "machine.metadata.labels['role'] == 'worker' && machine.spec.providerID != ''",
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			machines: []*infrav1.Metal3Machine{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc",
+						Namespace: "myns",
+						Labels:    map[string]string{"role": "worker"},
+					},
+					Spec: infrav1.Metal3MachineSpec{
+						ProviderID: pointer.StringPtr("metal3://abc"),
+					},
+				},
+			},
+			expectedIndexes: map[string]int{
+				"abc": 0,
+			},
+			expectedMap: map[int]string{
+				0: "abc",
+			},
+			expectedDatas: []string{"abc-0"},
+		}),
+		Entry("Not allocated yet, not matching allocation condition", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					AllocationCondition: "machine.metadata.labels['role'] == 'worker'",
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			machines: []*infrav1.Metal3Machine{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc",
+						Namespace: "myns",
+						Labels:    map[string]string{"role": "control-plane"},
+					},
+				},
+			},
+			expectedIndexes: map[string]int{},
+			expectedMap:     map[int]string{},
+			expectRejection: true,
+		}),
+		Entry("Not allocated yet, allocation condition not returning a boolean", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					AllocationCondition: "machine.metadata.name",
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			machines: []*infrav1.Metal3Machine{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc",
+						Namespace: "myns",
+					},
+				},
+			},
+			expectedIndexes: map[string]int{},
+			expectedMap:     map[int]string{},
+			expectError:     true,
+		}),
+		Entry("Not allocated yet, matching host selector", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					HostSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"hardware": "gen10"},
+					},
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			machines: []*infrav1.Metal3Machine{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "abc",
+						Namespace:   "myns",
+						Annotations: map[string]string{HostAnnotation: "myns/host-0"},
+					},
+				},
+			},
+			hosts: []*bmh.BareMetalHost{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "host-0",
+						Namespace: "myns",
+						Labels:    map[string]string{"hardware": "gen10"},
+					},
+				},
+			},
+			expectedIndexes: map[string]int{
+				"abc": 0,
+			},
+			expectedMap: map[int]string{
+				0: "abc",
+			},
+			expectedDatas: []string{"abc-0"},
+		}),
+		Entry("Not allocated yet, not matching host selector", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					HostSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"hardware": "gen10"},
+					},
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			machines: []*infrav1.Metal3Machine{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "abc",
+						Namespace:   "myns",
+						Annotations: map[string]string{HostAnnotation: "myns/host-0"},
+					},
+				},
+			},
+			hosts: []*bmh.BareMetalHost{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "host-0",
+						Namespace: "myns",
+						Labels:    map[string]string{"hardware": "gen9"},
+					},
+				},
+			},
+			expectedIndexes: map[string]int{},
+			expectedMap:     map[int]string{},
+			expectRejection: true,
+		}),
+		Entry("Not allocated yet, host selector, no host", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					HostSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"hardware": "gen10"},
+					},
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{}),
+				},
+			},
+			indexes: map[int]string{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			machines: []*infrav1.Metal3Machine{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "abc",
+						Namespace:   "myns",
+						Annotations: nil,
+					},
+				},
+			},
+			hosts: []*bmh.BareMetalHost{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "host-0",
+						Namespace: "myns",
+						Labels:    map[string]string{"hardware": "gen10"},
+					},
+				},
+			},
+			expectedIndexes: map[string]int{},
+			expectedMap:     map[int]string{},
+			expectRejection: true,
+		}),
+		Entry("Not allocated yet, static assignment", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					StaticAssignments: map[string]int{"abc": 3},
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{
+						"bcd": 0,
+					}),
+				},
+			},
+			indexes: map[int]string{0: "bcd"},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			expectedIndexes: map[string]int{
+				"abc": 3,
+				"bcd": 0,
+			},
+			expectedMap: map[int]string{
+				0: "bcd",
+				3: "abc",
+			},
+			expectedDatas: []string{"abc-3"},
+		}),
+		Entry("Not allocated yet, static index already allocated", testCaseCreateAddresses{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					StaticAssignments: map[string]int{"abc": 0},
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{
+						"bcd": 0,
+					}),
+				},
+			},
+			indexes: map[int]string{0: "bcd"},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: testObjectMetaWithOR,
+			},
+			expectedIndexes: map[string]int{
+				"bcd": 0,
+			},
+			expectedMap: map[int]string{
+				0: "bcd",
+			},
+			expectRejection: true,
+		}),
+	)
+
+	It("Records the last created Metal3Data", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes:                map[string]infrav1.IndexEntry{},
+				LastCreatedDataName:    "abc-5",
+				LastCreatedMachineName: "machine-5",
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = templateMgr.createData(context.TODO(), &infrav1.Metal3DataClaim{
+			ObjectMeta: testObjectMetaWithOR,
+		}, map[int]string{}, c)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(template.Status.LastCreatedDataName).To(Equal("abc-0"))
+		Expect(template.Status.LastCreatedMachineName).To(Equal("abc"))
+	})
+
+	It("Transfers the Metal3Data to the new template of the machine", func() {
+		oldTemplate := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				DataOwnershipTransfer: true,
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0, MachineName: "machine-0"},
+				},
+			},
+		}
+		newTemplate := &infrav1.Metal3DataTemplate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "bcd",
+				Namespace: "myns",
+			},
+			Spec: infrav1.Metal3DataTemplateSpec{
+				DataOwnershipTransfer: true,
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{},
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(oldTemplate, 1)
+		m3m := &infrav1.Metal3Machine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+			},
+			Spec: infrav1.Metal3MachineSpec{
+				DataTemplate: &corev1.ObjectReference{Name: "bcd"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), &datas[0], m3m)
+		oldTemplateMgr, err := NewDataTemplateManager(c, oldTemplate, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		newTemplateMgr, err := NewDataTemplateManager(c, newTemplate, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		indexes, err := oldTemplateMgr.deleteData(context.TODO(), &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+			},
+		}, map[int]string{0: "machine-0"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexes).To(BeEmpty())
+		m3Data := &infrav1.Metal3Data{}
+		key := client.ObjectKey{Name: "abc-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, m3Data)).To(Succeed())
+		Expect(m3Data.Annotations[TransferToAnnotation]).To(Equal("bcd"))
+		for _, ownerRef := range m3Data.OwnerReferences {
+			Expect(ownerRef.Kind).NotTo(Equal("Metal3DataClaim"))
+		}
+
+		// The index stays reserved while the Metal3Data keeps its name
+		indexes, err = oldTemplateMgr.getIndexes(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexes).To(Equal(map[int]string{0: ""}))
+		Expect(oldTemplate.Status.Indexes).To(BeEmpty())
+
+		dataClaim := &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: infrav1.GroupVersion.String(),
+						Kind:       "Metal3Machine",
+						Name:       "machine-0",
+					},
+				},
+			},
+		}
+		indexes, err = newTemplateMgr.createData(context.TODO(), dataClaim,
+			map[int]string{}, c,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexes).To(Equal(map[int]string{0: "machine-0"}))
+		Expect(newTemplate.Status.Indexes["machine-0"].DataName).To(BeEmpty())
+		Expect(dataClaim.Status.RenderedData.Name).To(Equal("bcd-0"))
+		Expect(newTemplate.Status.PendingDeletions).To(BeEmpty())
+
+		// The transferred Metal3Data is replaced by a new one of the template
+		Expect(c.Get(context.TODO(), key, &infrav1.Metal3Data{})).NotTo(Succeed())
+		m3Data = &infrav1.Metal3Data{}
+		newKey := client.ObjectKey{Name: "bcd-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), newKey, m3Data)).To(Succeed())
+		Expect(m3Data.Annotations).NotTo(HaveKey(TransferToAnnotation))
+		Expect(m3Data.Spec.Template.Name).To(Equal("bcd"))
+		Expect(m3Data.Spec.Claim.Name).To(Equal("machine-0"))
+		Expect(m3Data.OwnerReferences[0].Name).To(Equal("bcd"))
+
+		_, err = newTemplateMgr.getIndexes(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexesOf(newTemplate.Status.Indexes)).To(Equal(map[string]int{"machine-0": 0}))
+		indexes, err = oldTemplateMgr.getIndexes(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexes).To(BeEmpty())
+	})
+
+	It("Deletes the Metal3Data when the machine keeps the template", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				DataOwnershipTransfer: true,
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0, MachineName: "machine-0"},
+				},
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 1)
+		m3m := &infrav1.Metal3Machine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+			},
+			Spec: infrav1.Metal3MachineSpec{
+				DataTemplate: &corev1.ObjectReference{Name: "abc"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), &datas[0], m3m)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = templateMgr.deleteData(context.TODO(), &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+			},
+		}, map[int]string{0: "machine-0"})
+		Expect(err).NotTo(HaveOccurred())
+		m3Data := &infrav1.Metal3Data{}
+		key := client.ObjectKey{Name: "abc-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, m3Data)).NotTo(Succeed())
+	})
+
+	It("Sets the data annotations on the created Metal3Data", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				ClusterName: "cluster1",
+				DataAnnotations: map[string]string{
+					"backup.velero.io/backup-volumes": "true",
+					capi.ClusterLabelName:             "cluster2",
+				},
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = templateMgr.createData(context.TODO(), &infrav1.Metal3DataClaim{
+			ObjectMeta: testObjectMetaWithOR,
+		}, map[int]string{}, c)
+		Expect(err).NotTo(HaveOccurred())
+
+		m3Data := &infrav1.Metal3Data{}
+		key := client.ObjectKey{Name: "abc-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, m3Data)).To(Succeed())
+		allocationTimestamp, ok := GetAllocationTimestamp(m3Data)
+		Expect(ok).To(BeTrue())
+		Expect(allocationTimestamp).To(BeTemporally("~", time.Now(), time.Second))
+		delete(m3Data.Annotations, AllocationTimestampAnnotation)
+		Expect(m3Data.Annotations).To(Equal(map[string]string{
+			"backup.velero.io/backup-volumes": "true",
+			capi.ClusterLabelName:             "cluster1",
+		}))
+	})
+
+	It("Applies the manager options", func() {
+		rateLimiter := flowcontrol.NewFakeAlwaysRateLimiter()
+		recorder := &fakeMetricsRecorder{}
+		templateMgr, err := NewDataTemplateManagerWithOptions(nil,
+			&infrav1.Metal3DataTemplate{}, klogr.New(),
+			WithPageSize(50),
+			WithRateLimiter(rateLimiter),
+			WithMetricsRecorder(recorder),
+			WithFieldManager("capm3"),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(templateMgr.pageSize).To(Equal(int64(50)))
+		Expect(templateMgr.rateLimiter).To(Equal(rateLimiter))
+		Expect(templateMgr.metricsRecorder).To(Equal(recorder))
+		Expect(templateMgr.fieldManager).To(Equal("capm3"))
+
+		_, err = NewDataTemplateManagerWithOptions(nil,
+			&infrav1.Metal3DataTemplate{}, klogr.New(), WithPageSize(-1),
+		)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Lists the Metal3Data objects by pages", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				ClusterName: "cluster1",
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 5)
+		objects := []runtime.Object{}
+		for i := range datas {
+			objects = append(objects, &datas[i])
+		}
+		c := &pagingClient{
+			Client: fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...),
+		}
+		templateMgr, err := NewDataTemplateManagerWithOptions(c, template,
+			klogr.New(), WithPageSize(2),
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		indexes, err := templateMgr.getIndexes(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexes).To(HaveLen(5))
+		Expect(c.listCalls).To(Equal(3))
+
+		c.listCalls = 0
+		orphans, err := templateMgr.getOrphanDatas(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(orphans).To(HaveLen(5))
+		Expect(c.listCalls).To(Equal(3))
+
+		c.listCalls = 0
+		_, err = templateMgr.ValidateStatusConsistency(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.listCalls).To(Equal(3))
+	})
+
+	It("Throttles and records the Metal3Data creations", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				ClusterName:     "cluster1",
+				AllocationOrder: infrav1.AllocationOrderFIFO,
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{},
+			},
+		}
+		c := &createOptionsClient{
+			Client: fakeclient.NewFakeClientWithScheme(setupSchemeMm()),
+		}
+		rateLimiter := &countingRateLimiter{
+			RateLimiter: flowcontrol.NewFakeAlwaysRateLimiter(),
+		}
+		recorder := &fakeMetricsRecorder{}
+		templateMgr, err := NewDataTemplateManagerWithOptions(c, template,
+			klogr.New(),
+			WithRateLimiter(rateLimiter),
+			WithMetricsRecorder(recorder),
+			WithFieldManager("capm3"),
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = templateMgr.createData(context.TODO(), &infrav1.Metal3DataClaim{
+			ObjectMeta: testObjectMetaWithOR,
+		}, map[int]string{}, c)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rateLimiter.waits).To(Equal(1))
+		Expect(recorder.allocations).To(Equal([]int{0}))
+		Expect(c.createOptions).To(HaveLen(1))
+		Expect(c.createOptions[0].FieldManager).To(Equal("capm3"))
+
+		templateMgr.recordFreedIndex(0)
+		Expect(recorder.releases).To(Equal([]int{0}))
+
+		templateMgr.rateLimiter = flowcontrol.NewFakeNeverRateLimiter()
+		_, err = templateMgr.createData(context.TODO(), &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "def",
+				Namespace:       "myns",
+				OwnerReferences: testObjectMetaWithOR.OwnerReferences,
+			},
+		}, map[int]string{0: "abc"}, c)
+		Expect(err).To(HaveOccurred())
+		Expect(c.createOptions).To(HaveLen(1))
+	})
+
+	It("Fetches the Metal3Machine once per allocation", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				OwnerReferenceFilter: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"pool": "workers"},
+				},
+				AllocationCondition: `machine.metadata.labels.pool == "workers"`,
+				AnnotationFilters: []infrav1.AnnotationFilter{
+					{
+						AnnotationKey: "metal3.io/rack",
+						DataSpecPatch: infrav1.Metal3DataSpec{
+							MetaData: &corev1.SecretReference{Name: "rack-metadata"},
+						},
+					},
+				},
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: infrav1.MigrateIndexes(map[string]int{}),
+			},
+		}
+		c := &machineGetClient{
+			Client: fakeclient.NewFakeClientWithScheme(setupSchemeMm(),
+				&infrav1.Metal3Machine{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "abc",
+						Namespace:   "myns",
+						Labels:      map[string]string{"pool": "workers"},
+						Annotations: map[string]string{"metal3.io/rack": "rack-1"},
+					},
+				},
+			),
+		}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = templateMgr.createData(context.TODO(), &infrav1.Metal3DataClaim{
+			ObjectMeta: testObjectMetaWithOR,
+		}, map[int]string{}, c)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.machineGets).To(Equal(1))
+
+		m3Data := &infrav1.Metal3Data{}
+		Expect(c.Get(context.TODO(), client.ObjectKey{
+			Name: "abc-0", Namespace: "myns",
+		}, m3Data)).To(Succeed())
+		Expect(m3Data.Spec.MetaData.Name).To(Equal("rack-metadata"))
+	})
+
+	type testCaseBackoffError struct {
+		policy                    *infrav1.BackoffPolicySpec
+		annotations               map[string]string
+		expectFailed              bool
+		expectedRequeueAfter      time.Duration
+		expectedRetriesAnnotation string
+	}
+
+	DescribeTable("Test backoffError",
+		func(tc testCaseBackoffError) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					BackoffPolicy: tc.policy,
+				},
+			}
+			dataClaim := &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "abc",
+					Namespace:   "myns",
+					Annotations: tc.annotations,
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(nil, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = templateMgr.backoffError(dataClaim)
+			if tc.expectFailed {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dataClaim.Status.ErrorMessage).NotTo(BeNil())
+				return
+			}
+			Expect(err).To(BeAssignableToTypeOf(&RequeueAfterError{}))
+			Expect(err.(*RequeueAfterError).GetRequeueAfter()).To(Equal(tc.expectedRequeueAfter))
+			Expect(dataClaim.Annotations[DataClaimRetriesAnnotation]).To(Equal(tc.expectedRetriesAnnotation))
+		},
+		Entry("No policy", testCaseBackoffError{}),
+		Entry("First retry", testCaseBackoffError{
+			policy: &infrav1.BackoffPolicySpec{
+				InitialInterval: &metav1.Duration{Duration: time.Second},
+				Multiplier:      2,
+			},
+			expectedRequeueAfter:      time.Second,
+			expectedRetriesAnnotation: "1",
+		}),
+		Entry("Third retry", testCaseBackoffError{
+			policy: &infrav1.BackoffPolicySpec{
+				InitialInterval: &metav1.Duration{Duration: time.Second},
+				Multiplier:      2,
+			},
+			annotations: map[string]string{
+				DataClaimRetriesAnnotation: "2",
+			},
+			expectedRequeueAfter:      4 * time.Second,
+			expectedRetriesAnnotation: "3",
+		}),
+		Entry("Capped by maxInterval", testCaseBackoffError{
+			policy: &infrav1.BackoffPolicySpec{
+				InitialInterval: &metav1.Duration{Duration: time.Second},
+				MaxInterval:     &metav1.Duration{Duration: 3 * time.Second},
+				Multiplier:      2,
+			},
+			annotations: map[string]string{
+				DataClaimRetriesAnnotation: "10",
+			},
+			expectedRequeueAfter:      3 * time.Second,
+			expectedRetriesAnnotation: "11",
+		}),
+		Entry("Capped without maxInterval at high retry counts", testCaseBackoffError{
+			policy: &infrav1.BackoffPolicySpec{
+				InitialInterval: &metav1.Duration{Duration: time.Second},
+				Multiplier:      10,
+			},
+			annotations: map[string]string{
+				DataClaimRetriesAnnotation: "1000000",
+			},
+			expectedRequeueAfter:      maxBackoffDelay,
+			expectedRetriesAnnotation: "1000001",
+		}),
+		Entry("Capped by maxInterval at high retry counts", testCaseBackoffError{
+			policy: &infrav1.BackoffPolicySpec{
+				InitialInterval: &metav1.Duration{Duration: time.Second},
+				MaxInterval:     &metav1.Duration{Duration: time.Minute},
+				Multiplier:      3,
+			},
+			annotations: map[string]string{
+				DataClaimRetriesAnnotation: "200",
+			},
+			expectedRequeueAfter:      time.Minute,
+			expectedRetriesAnnotation: "201",
+		}),
+		Entry("Max retries reached", testCaseBackoffError{
+			policy: &infrav1.BackoffPolicySpec{
+				InitialInterval: &metav1.Duration{Duration: time.Second},
+				MaxRetries:      3,
+			},
+			annotations: map[string]string{
+				DataClaimRetriesAnnotation: "3",
+			},
+			expectFailed: true,
+		}),
+	)
+
+	It("Does not requeue a claim once MaxRetries is reached", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				BackoffPolicy: &infrav1.BackoffPolicySpec{
+					InitialInterval: &metav1.Duration{Duration: time.Second},
+					MaxRetries:      1,
+				},
+			},
+		}
+		dataClaim := &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: infrav1.GroupVersion.String(),
+						Kind:       "Metal3Machine",
+						Name:       "machine-0",
+					},
+				},
+			},
+			Spec: infrav1.Metal3DataClaimSpec{
+				Template: corev1.ObjectReference{Name: "abc"},
+			},
+		}
+		// A Metal3Data of no template holds the name of the first index
+		conflictingData := &infrav1.Metal3Data{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "abc-0",
+				Namespace: "myns",
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			dataClaim, conflictingData,
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).To(BeAssignableToTypeOf(&RequeueAfterError{}))
+		Expect(err.(*RequeueAfterError).GetRequeueAfter()).To(Equal(time.Second))
+
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		savedClaim := &infrav1.Metal3DataClaim{}
+		Expect(c.Get(context.TODO(), client.ObjectKey{
+			Name: "machine-0", Namespace: "myns",
+		}, savedClaim)).To(Succeed())
+		Expect(savedClaim.Status.ErrorMessage).NotTo(BeNil())
+	})
+
+	type testCaseGetDataClient struct {
+		serviceAccountRef *corev1.LocalObjectReference
+		clientGetterFails bool
+		noClientGetter    bool
+		expectError       bool
+		expectSAClient    bool
+	}
+
+	DescribeTable("Test getDataClient",
+		func(tc testCaseGetDataClient) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					ServiceAccountRef: tc.serviceAccountRef,
+				},
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+			saClient := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+			templateMgr, err := NewDataTemplateManager(c, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			var clientGetter ServiceAccountClientGetter
+			if !tc.noClientGetter {
+				clientGetter = func(ctx context.Context, namespace, name string) (client.Client, error) {
+					Expect(namespace).To(Equal("myns"))
+					Expect(name).To(Equal(tc.serviceAccountRef.Name))
+					if tc.clientGetterFails {
+						return nil, errors.New("Failed")
+					}
+					return saClient, nil
+				}
+			}
+
+			dataClient, err := templateMgr.getDataClient(context.TODO(), clientGetter)
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			if tc.expectSAClient {
+				Expect(dataClient).To(BeIdenticalTo(saClient))
+			} else {
+				Expect(dataClient).To(BeIdenticalTo(c))
+			}
+		},
+		Entry("No ServiceAccountRef", testCaseGetDataClient{
+			noClientGetter: true,
+		}),
+		Entry("ServiceAccountRef", testCaseGetDataClient{
+			serviceAccountRef: &corev1.LocalObjectReference{Name: "tenant"},
+			expectSAClient:    true,
+		}),
+		Entry("ServiceAccountRef, no client getter", testCaseGetDataClient{
+			serviceAccountRef: &corev1.LocalObjectReference{Name: "tenant"},
+			noClientGetter:    true,
+			expectError:       true,
+		}),
+		Entry("ServiceAccountRef, client getter fails", testCaseGetDataClient{
+			serviceAccountRef: &corev1.LocalObjectReference{Name: "tenant"},
+			clientGetterFails: true,
+			expectError:       true,
+		}),
+	)
+
+	It("Releases the indexes without the ServiceAccount client", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				ServiceAccountRef: &corev1.LocalObjectReference{Name: "tenant"},
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0},
+				},
+			},
+		}
+		deletionTime := metav1.Now()
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(),
+			template.DeepCopy(),
+			&infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "machine-0",
+					Namespace:         "myns",
+					DeletionTimestamp: &deletionTime,
+					Finalizers:        []string{infrav1.DataClaimFinalizer},
+				},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: "abc"},
+				},
+				Status: infrav1.Metal3DataClaimStatus{
+					RenderedData: &corev1.ObjectReference{Name: "abc-0"},
+				},
+			},
+			&infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "abc-0",
+					Namespace: "myns",
+				},
+				Spec: infrav1.Metal3DataSpec{
+					Index:    0,
+					Template: corev1.ObjectReference{Name: "abc"},
+					Claim:    corev1.ObjectReference{Name: "machine-0"},
+				},
+			},
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		// No client getter is available, the deletion still goes through
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(template.Status.Indexes).To(BeEmpty())
+		key := client.ObjectKey{Name: "abc-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, &infrav1.Metal3Data{})).NotTo(Succeed())
+	})
+
+	type testCaseGetDataForMachine struct {
+		indexes      map[string]int
+		datas        []*infrav1.Metal3Data
+		expectedData string
+		expectError  bool
+	}
+
+	DescribeTable("Test GetDataForMachine",
+		func(tc testCaseGetDataForMachine) {
+			objects := []runtime.Object{}
+			for _, data := range tc.datas {
+				objects = append(objects, data)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(tc.indexes),
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(c, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := templateMgr.GetDataForMachine(context.TODO(), "machine1")
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				Expect(err).To(BeAssignableToTypeOf(&DataNotFoundError{}))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data.Name).To(Equal(tc.expectedData))
+		},
+		Entry("Not allocated", testCaseGetDataForMachine{
+			indexes:     map[string]int{"machine2": 0},
+			expectError: true,
+		}),
+		Entry("Allocated, data missing", testCaseGetDataForMachine{
+			indexes:     map[string]int{"machine1": 1},
+			expectError: true,
+		}),
+		Entry("Allocated", testCaseGetDataForMachine{
+			indexes: map[string]int{"machine1": 1},
+			datas: []*infrav1.Metal3Data{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc-1",
+						Namespace: "myns",
+					},
+				},
+			},
+			expectedData: "abc-1",
+		}),
+	)
+
+	type testCaseCancelProvisioning struct {
+		machineName     string
+		indexes         map[string]infrav1.IndexEntry
+		datas           []*infrav1.Metal3Data
+		dataClaims      []*infrav1.Metal3DataClaim
+		expectError     bool
+		expectedIndexes map[string]int
+	}
+
+	DescribeTable("Test CancelProvisioning",
+		func(tc testCaseCancelProvisioning) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: tc.indexes,
+				},
+			}
+			objects := []runtime.Object{template.DeepCopy()}
+			for _, data := range tc.datas {
+				objects = append(objects, data)
+			}
+			for _, dataClaim := range tc.dataClaims {
+				objects = append(objects, dataClaim)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+			templateMgr, err := NewDataTemplateManager(c, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = templateMgr.CancelProvisioning(context.TODO(), tc.machineName)
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				Expect(err).To(BeAssignableToTypeOf(&DataNotFoundError{}))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+
+			dataObjects := infrav1.Metal3DataList{}
+			Expect(c.List(context.TODO(), &dataObjects)).To(Succeed())
+			Expect(dataObjects.Items).To(BeEmpty())
+
+			savedTemplate := &infrav1.Metal3DataTemplate{}
+			err = c.Get(context.TODO(), client.ObjectKey{Name: "abc", Namespace: "myns"},
+				savedTemplate,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(indexesOf(savedTemplate.Status.Indexes)).To(Equal(tc.expectedIndexes))
+
+			for _, dataClaim := range tc.dataClaims {
+				savedClaim := &infrav1.Metal3DataClaim{}
+				err = c.Get(context.TODO(), client.ObjectKey{
+					Name: dataClaim.Name, Namespace: "myns",
+				}, savedClaim)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(savedClaim.Status.RenderedData).To(BeNil())
+			}
+		},
+		Entry("Not allocated", testCaseCancelProvisioning{
+			machineName: "machine1",
+			indexes: map[string]infrav1.IndexEntry{
+				"machine2": {Index: 0},
+			},
+			expectError: true,
+		}),
+		Entry("Allocated to the claim of the machine", testCaseCancelProvisioning{
+			machineName: "machine1",
+			indexes: map[string]infrav1.IndexEntry{
+				"machine1": {Index: 1},
+				"machine2": {Index: 0},
+			},
+			datas: []*infrav1.Metal3Data{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc-1",
+						Namespace: "myns",
+					},
+				},
+			},
+			dataClaims: []*infrav1.Metal3DataClaim{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "machine1",
+						Namespace: "myns",
+					},
+					Status: infrav1.Metal3DataClaimStatus{
+						RenderedData: &corev1.ObjectReference{Name: "abc-1"},
+					},
+				},
+			},
+			expectedIndexes: map[string]int{"machine2": 0},
+		}),
+		Entry("Allocated, found by machine name", testCaseCancelProvisioning{
+			machineName: "machine1",
+			indexes: map[string]infrav1.IndexEntry{
+				"claim1": {Index: 1, MachineName: "machine1"},
+			},
+			datas: []*infrav1.Metal3Data{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc-1",
+						Namespace: "myns",
+					},
+				},
+			},
+		}),
+		Entry("Allocated, data missing", testCaseCancelProvisioning{
+			machineName: "machine1",
+			indexes: map[string]infrav1.IndexEntry{
+				"machine1": {Index: 1},
+			},
+		}),
+	)
+
+	It("Compacts the status", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				EmergencyRange: &infrav1.EmergencyRangeSpec{Min: 10, Max: 12},
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"":          {Index: 10},
+					"machine-0": {Index: 0},
+				},
+				EmergencyAllocations: map[string]int{"": 10},
+				IPIndex: map[string]string{
+					"192.168.0.10": "machine-0",
+					"192.168.0.11": "",
+				},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy())
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(templateMgr.CompactStatus(context.TODO())).To(Succeed())
+		savedTemplate := &infrav1.Metal3DataTemplate{}
+		key := client.ObjectKey{Name: "abc", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, savedTemplate)).To(Succeed())
+		Expect(indexesOf(savedTemplate.Status.Indexes)).To(Equal(
+			map[string]int{"machine-0": 0},
+		))
+		Expect(savedTemplate.Status.EmergencyAllocations).To(BeEmpty())
+		Expect(savedTemplate.Status.IPIndex).To(Equal(map[string]string{
+			"192.168.0.10": "machine-0",
+		}))
+	})
+
+	It("Migrates the status", func() {
+		allocatedAt := metav1.Now()
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0},
+					"machine-1": {
+						Index:       1,
+						MachineName: "machine-1",
+						AllocatedAt: &allocatedAt,
+					},
+				},
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 2)
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			&datas[0], &datas[1],
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		// The entries are rebuilt from the Metal3Data, so they are kept by the
+		// next reconciliation
+		Expect(templateMgr.MigrateStatus(context.TODO())).To(Succeed())
+		savedTemplate := &infrav1.Metal3DataTemplate{}
+		key := client.ObjectKey{Name: "abc", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, savedTemplate)).To(Succeed())
+		Expect(savedTemplate.Status.Indexes["machine-0"].MachineName).To(Equal("machine-0"))
+		Expect(savedTemplate.Status.Indexes["machine-0"].MachineUID).To(
+			Equal("machine-0-machine-uid"),
+		)
+		Expect(savedTemplate.Status.MigratedFromVersion).To(Equal(StatusVersionIndexMap))
+		Expect(savedTemplate.Status.LastMigratedAt).NotTo(BeNil())
+		Expect(promtestutil.ToFloat64(
+			migrationTimestampGauge.WithLabelValues("myns", "abc"),
+		)).To(Equal(float64(savedTemplate.Status.LastMigratedAt.Unix())))
+
+		Expect(templateMgr.MigrateStatus(context.TODO())).To(Succeed())
+		savedTemplate = &infrav1.Metal3DataTemplate{}
+		Expect(c.Get(context.TODO(), key, savedTemplate)).To(Succeed())
+		Expect(savedTemplate.Status.MigratedFromVersion).To(Equal(StatusVersionIndexEntries))
+	})
+
+	It("Resets the index of a machine", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0},
+					"machine-1": {Index: 1},
+				},
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 2)
+		dataClaim := &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-1",
+				Namespace: "myns",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: infrav1.GroupVersion.String(),
+						Kind:       "Metal3Machine",
+						Name:       "machine-1",
+					},
+				},
+			},
+			Spec: infrav1.Metal3DataClaimSpec{
+				Template: corev1.ObjectReference{Name: "abc"},
+			},
+			Status: infrav1.Metal3DataClaimStatus{
+				RenderedData: &corev1.ObjectReference{Name: "abc-1"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			&datas[0], &datas[1], dataClaim,
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		err = templateMgr.ResetIndex(context.TODO(), "machine-2")
+		Expect(err).To(BeAssignableToTypeOf(&DataNotFoundError{}))
+
+		Expect(templateMgr.ResetIndex(context.TODO(), "machine-1")).To(Succeed())
+		m3Data := &infrav1.Metal3Data{}
+		key := client.ObjectKey{Name: "abc-1", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, m3Data)).NotTo(Succeed())
+		Expect(indexesOf(templateMgr.DataTemplate.Status.Indexes)).To(Equal(
+			map[string]int{"machine-0": 0},
+		))
+		savedClaim := &infrav1.Metal3DataClaim{}
+		key = client.ObjectKey{Name: "machine-1", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, savedClaim)).To(Succeed())
+		Expect(savedClaim.Status.RenderedData).To(BeNil())
+
+		_, delta, err := templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexesOf(templateMgr.DataTemplate.Status.Indexes)).To(Equal(
+			map[string]int{"machine-0": 0, "machine-1": 1},
+		))
+		Expect(delta).To(Equal(DeltaStatus{
+			Created: []DataAllocation{
+				{MachineName: "machine-1", DataName: "abc-1", Index: 1},
+			},
+		}))
+	})
+
+	It("Allocates the other claims when the index space is exhausted", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				MinIndex: 1,
+				MaxIndex: 1,
+			},
+		}
+		objects := []runtime.Object{template.DeepCopy()}
+		for _, name := range []string{"machine-0", "machine-1"} {
+			objects = append(objects, &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: "myns",
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: infrav1.GroupVersion.String(),
+							Kind:       "Metal3Machine",
+							Name:       name,
+						},
+					},
+				},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: "abc"},
+				},
+			})
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		// Whichever claim is processed first, the other one is still
+		// processed and only one gets the index
+		nbIndexes, _, err := templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).To(BeAssignableToTypeOf(&IndexExhaustedError{}))
+		Expect(nbIndexes).To(Equal(1))
+		Expect(templateMgr.DataTemplate.Status.Indexes).To(HaveLen(1))
+		Expect(conditions.IsTrue(templateMgr.DataTemplate,
+			infrav1.IndexSpaceExhaustedCondition,
+		)).To(BeTrue())
+		dataObjects := infrav1.Metal3DataList{}
+		Expect(c.List(context.TODO(), &dataObjects)).To(Succeed())
+		Expect(dataObjects.Items).To(HaveLen(1))
+		Expect(dataObjects.Items[0].Name).To(Equal("abc-1"))
+	})
+
+	It("Simulates the deletion of the allocation of a machine", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				AllocationOrder: infrav1.AllocationOrderFIFO,
+				IPPoolRef:       &corev1.LocalObjectReference{Name: "pool1"},
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0},
+					"claim-1":   {Index: 1, MachineName: "machine-1"},
+					"claim-2":   {Index: 1, MachineName: "machine-2"},
+				},
+				IPIndex: map[string]string{
+					"192.168.0.10": "machine-0",
+					"192.168.0.11": "machine-1",
+				},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = templateMgr.SimulateDelete(context.TODO(), "machine-3")
+		Expect(err).To(BeAssignableToTypeOf(&DataNotFoundError{}))
+
+		actions, err := templateMgr.SimulateDelete(context.TODO(), "machine-0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(actions).To(Equal([]string{
+			"Delete Metal3Data abc-0",
+			"Release IPClaim abc-0-pool1 from IPPool pool1",
+			"Remove Metal3DataClaim machine-0 from the indexes",
+			"Free index 0",
+			"Append index 0 to the freed indexes",
+			"Remove IP address 192.168.0.10 from the IP index",
+		}))
+
+		actions, err = templateMgr.SimulateDelete(context.TODO(), "machine-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(actions).To(Equal([]string{
+			"Remove Metal3DataClaim claim-1 and Metal3Machine machine-1 from the owners of Metal3Data abc-1, shared with Metal3DataClaim claim-2",
+			"Remove Metal3DataClaim claim-1 from the indexes",
+		}))
+		Expect(templateMgr.DataTemplate.Status.Indexes).To(HaveLen(3))
+	})
+
+	It("Patches a Metal3Machine", func() {
+		m3m := &infrav1.Metal3Machine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		Expect(c.Create(context.TODO(), m3m)).To(Succeed())
+		template := &infrav1.Metal3DataTemplate{ObjectMeta: templateMeta}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		key := client.ObjectKey{Name: "machine-0", Namespace: "myns"}
+
+		// A conflict is retried from a fresh copy
+		calls := 0
+		err = templateMgr.PatchMachine(context.TODO(), "machine-0",
+			func(m3m *infrav1.Metal3Machine) {
+				calls++
+				if calls == 1 {
+					concurrent := &infrav1.Metal3Machine{}
+					Expect(c.Get(context.TODO(), key, concurrent)).To(Succeed())
+					concurrent.Labels = map[string]string{"concurrent": "true"}
+					Expect(c.Update(context.TODO(), concurrent)).To(Succeed())
+				}
+				if m3m.Annotations == nil {
+					m3m.Annotations = map[string]string{}
+				}
+				m3m.Annotations["patched"] = "true"
+			},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(calls).To(Equal(2))
+		savedM3m := &infrav1.Metal3Machine{}
+		Expect(c.Get(context.TODO(), key, savedM3m)).To(Succeed())
+		Expect(savedM3m.Annotations).To(HaveKeyWithValue("patched", "true"))
+		Expect(savedM3m.Labels).To(HaveKeyWithValue("concurrent", "true"))
+
+		// A missing Metal3Machine is an error
+		err = templateMgr.PatchMachine(context.TODO(), "machine-1",
+			func(*infrav1.Metal3Machine) {},
+		)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Fetches the remote status", func() {
+		remoteTemplate := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine1": {Index: 1},
+				},
+			},
+		}
+		remoteClient := fakeclient.NewFakeClientWithScheme(setupSchemeMm(),
+			remoteTemplate,
+		)
+		templateMgr, err := NewDataTemplateManager(nil,
+			&infrav1.Metal3DataTemplate{ObjectMeta: templateMeta}, klogr.New(),
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		status, err := templateMgr.FetchRemoteStatus(context.TODO(), remoteClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexesOf(status.Indexes)).To(Equal(map[string]int{"machine1": 1}))
+
+		emptyClient := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		_, err = templateMgr.FetchRemoteStatus(context.TODO(), emptyClient)
+		Expect(err).To(HaveOccurred())
+	})
+
+	DescribeTable("Test clusterNameFromContext",
+		func(ctx context.Context, expectedClusterName string) {
+			Expect(clusterNameFromContext(ctx)).To(Equal(expectedClusterName))
+		},
+		Entry("Not set", context.TODO(), ""),
+		Entry("Set", WithClusterName(context.TODO(), "abc"), "abc"),
+		Entry("Overridden", WithClusterName(
+			WithClusterName(context.TODO(), "abc"), "def",
+		), "def"),
+	)
+
+	type testCaseDiffStatuses struct {
+		a             *infrav1.Metal3DataTemplateStatus
+		b             *infrav1.Metal3DataTemplateStatus
+		expectedDiffs []string
+	}
+
+	DescribeTable("Test DiffStatuses",
+		func(tc testCaseDiffStatuses) {
+			Expect(DiffStatuses(tc.a, tc.b)).To(Equal(tc.expectedDiffs))
+		},
+		Entry("Both nil", testCaseDiffStatuses{
+			expectedDiffs: []string{},
+		}),
+		Entry("Identical", testCaseDiffStatuses{
+			a: &infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine1": {Index: 1, MachineName: "machine1"},
+				},
+				IPIndex: map[string]string{"192.168.0.10": "machine1"},
+			},
+			b: &infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine1": {Index: 1, MachineName: "machine1"},
+				},
+				IPIndex: map[string]string{"192.168.0.10": "machine1"},
+			},
+			expectedDiffs: []string{},
+		}),
+		Entry("Different", testCaseDiffStatuses{
+			a: &infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine1": {Index: 1, MachineName: "machine1"},
+					"machine2": {Index: 2},
+					"machine3": {Index: 3},
+				},
+				IPIndex: map[string]string{
+					"192.168.0.10": "machine1",
+					"192.168.0.11": "machine2",
+				},
+				ControllerVersion: "v0.4.0",
+			},
+			b: &infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine1": {Index: 4, MachineName: "machine4"},
+					"machine2": {Index: 2},
+					"machine5": {Index: 5},
+				},
+				IPIndex: map[string]string{
+					"192.168.0.10": "machine4",
+					"192.168.0.12": "machine5",
+				},
+				ControllerVersion: "v0.4.1",
+			},
+			expectedDiffs: []string{
+				"claim machine1: index 1 != 4",
+				"claim machine1: machine \"machine1\" != \"machine4\"",
+				"claim machine3: index 3 only in the first status",
+				"claim machine5: index 5 only in the second status",
+				"controller version \"v0.4.0\" != \"v0.4.1\"",
+				"ip 192.168.0.10: machine machine1 != machine4",
+				"ip 192.168.0.11: machine machine2 only in the first status",
+				"ip 192.168.0.12: machine machine5 only in the second status",
+			},
+		}),
+	)
+
+	It("Hashes the owner references independently of their order", func() {
+		refA := metav1.OwnerReference{Kind: "Cluster", Name: "abc", UID: "abc-uid"}
+		refB := metav1.OwnerReference{Kind: "Cluster", Name: "bcd", UID: "bcd-uid"}
+
+		hash := ownerReferencesHash([]metav1.OwnerReference{refA, refB})
+		Expect(hash).NotTo(BeEmpty())
+		Expect(ownerReferencesHash([]metav1.OwnerReference{refB, refA})).To(Equal(hash))
+		Expect(ownerReferencesHash([]metav1.OwnerReference{refA})).NotTo(Equal(hash))
+
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: metav1.ObjectMeta{
+				OwnerReferences: []metav1.OwnerReference{refA, refB},
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(nil, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		templateMgr.updateStatusTimestamp()
+		Expect(template.Status.OwnerReferencesHash).To(Equal(hash))
+	})
+
+	type testCaseExplainIndex struct {
+		template            *infrav1.Metal3DataTemplate
+		datas               []*infrav1.Metal3Data
+		index               int
+		expectError         bool
+		expectedExplanation string
+	}
+
+	DescribeTable("Test ExplainIndex",
+		func(tc testCaseExplainIndex) {
+			objects := []runtime.Object{}
+			if tc.template != nil {
+				objects = append(objects, tc.template)
+			}
+			for _, data := range tc.datas {
+				objects = append(objects, data)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+			templateMgr, err := NewDataTemplateManager(c,
+				&infrav1.Metal3DataTemplate{ObjectMeta: templateMeta},
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			explanation, err := templateMgr.ExplainIndex(context.TODO(), tc.index)
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(explanation).To(Equal(tc.expectedExplanation))
+		},
+		Entry("Template not found", testCaseExplainIndex{
+			expectError: true,
+		}),
+		Entry("Index not allocated", testCaseExplainIndex{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{"abc": 0}),
+				},
+			},
+			index:       1,
+			expectError: true,
+		}),
+		Entry("Metal3Data not found", testCaseExplainIndex{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{"abc": 0, "bcd": 1}),
+				},
+			},
+			index:               1,
+			expectedExplanation: "Index 1 allocated to claim bcd, Metal3Data abc-1 not found",
+		}),
+		Entry("Allocated", testCaseExplainIndex{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{"abc": 0, "bcd": 1}),
+				},
+			},
+			datas: []*infrav1.Metal3Data{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc-1",
+						Namespace: "myns",
+						CreationTimestamp: metav1.NewTime(
+							time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+						),
+						OwnerReferences: []metav1.OwnerReference{
+							{
+								Name:       "machine-bcd",
+								Kind:       "Metal3Machine",
+								APIVersion: infrav1.GroupVersion.String(),
+							},
+						},
+					},
+				},
+			},
+			index:               1,
+			expectedExplanation: "Index 1 allocated to machine machine-bcd (Metal3Data abc-1), created at 2020-01-01T00:00:00Z",
+		}),
+	)
+
+	type testCasePurgeStatus struct {
+		annotations     map[string]string
+		datas           []*infrav1.Metal3Data
+		expectError     bool
+		expectedIndexes map[string]int
+	}
+
+	DescribeTable("Test PurgeStatus",
+		func(tc testCasePurgeStatus) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "abc",
+					Namespace:   "myns",
+					Annotations: tc.annotations,
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					LastUpdated: &timeNow,
+					Indexes: infrav1.MigrateIndexes(map[string]int{
+						"stale": 3,
+					}),
+				},
+			}
+			objects := []runtime.Object{template.DeepCopy()}
+			for _, data := range tc.datas {
+				objects = append(objects, data)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+			templateMgr, err := NewDataTemplateManager(c, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = templateMgr.PurgeStatus(context.TODO())
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				Expect(template.Status.Indexes).To(HaveKey("stale"))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+
+			savedTemplate := &infrav1.Metal3DataTemplate{}
+			err = c.Get(context.TODO(), client.ObjectKey{Name: "abc", Namespace: "myns"},
+				savedTemplate,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(savedTemplate.Annotations).NotTo(HaveKey(ConfirmPurgeAnnotation))
+			Expect(indexesOf(savedTemplate.Status.Indexes)).To(Equal(tc.expectedIndexes))
+			Expect(savedTemplate.Status.LastUpdated.IsZero()).To(BeFalse())
+		},
+		Entry("Not confirmed", testCasePurgeStatus{
+			expectError: true,
+		}),
+		Entry("Not confirmed with true", testCasePurgeStatus{
+			annotations: map[string]string{
+				ConfirmPurgeAnnotation: "yes",
+			},
+			expectError: true,
+		}),
+		Entry("Confirmed", testCasePurgeStatus{
+			annotations: map[string]string{
+				ConfirmPurgeAnnotation: "true",
+			},
+			datas: []*infrav1.Metal3Data{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc-0",
+						Namespace: "myns",
+					},
+					Spec: infrav1.Metal3DataSpec{
+						Index: 0,
+						Template: corev1.ObjectReference{
+							Name: "abc",
+						},
+						Claim: corev1.ObjectReference{
+							Name: "machine1",
+						},
+					},
+				},
+			},
+			expectedIndexes: map[string]int{
+				"machine1": 0,
+			},
+		}),
+	)
+
+	It("Iterates over the indexes sorted by index", func() {
+		templateMgr, err := NewDataTemplateManager(nil, &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"claim-2": {Index: 2, MachineName: "machine-2"},
+					"claim-0": {Index: 0},
+					"claim-1": {Index: 1, MachineName: "machine-1"},
+				},
+			},
+		}, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		visited := []string{}
+		err = templateMgr.ForEachIndex(func(index int, machineName, dataName string) error {
+			visited = append(visited, fmt.Sprintf("%d %s %s", index, machineName, dataName))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(visited).To(Equal([]string{
+			"0 claim-0 abc-0",
+			"1 machine-1 abc-1",
+			"2 machine-2 abc-2",
+		}))
+
+		visited = []string{}
+		err = templateMgr.ForEachIndex(func(index int, machineName, dataName string) error {
+			visited = append(visited, machineName)
+			if index == 1 {
+				return errors.New("Failed")
+			}
+			return nil
+		})
+		Expect(err).To(MatchError("Failed"))
+		Expect(visited).To(Equal([]string{"claim-0", "machine-1"}))
+	})
+
+	type testCaseGetFreeIndex struct {
+		allocationOrder   string
+		freedIndexes      []int
+		maxIndex          int
+		indexStep         int
+		staticAssignments map[string]int
+		emergencyRange    *infrav1.EmergencyRangeSpec
+		reservedIndexes   []infrav1.IndexReservation
+		indexes           map[int]string
+		expectError       bool
+		expectedIndex     int
+	}
+
+	DescribeTable("Test getFreeIndex",
+		func(tc testCaseGetFreeIndex) {
+			templateMgr, err := NewDataTemplateManager(nil, &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					MinIndex:          1,
+					MaxIndex:          tc.maxIndex,
+					IndexStep:         tc.indexStep,
+					AllocationOrder:   tc.allocationOrder,
+					StaticAssignments: tc.staticAssignments,
+					EmergencyRange:    tc.emergencyRange,
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					FreedIndexes:    tc.freedIndexes,
+					ReservedIndexes: tc.reservedIndexes,
+				},
+			}, klogr.New())
+			Expect(err).NotTo(HaveOccurred())
+
+			index, err := templateMgr.getFreeIndex(tc.indexes)
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(index).To(Equal(tc.expectedIndex))
+		},
+		Entry("Default order", testCaseGetFreeIndex{
+			freedIndexes:  []int{4, 2},
+			indexes:       map[int]string{1: "abc", 3: "bcd"},
+			expectedIndex: 2,
+		}),
+		Entry("SmallestFirst", testCaseGetFreeIndex{
+			allocationOrder: infrav1.AllocationOrderSmallestFirst,
+			freedIndexes:    []int{4, 2},
+			indexes:         map[int]string{1: "abc", 3: "bcd"},
+			expectedIndex:   2,
+		}),
+		Entry("FIFO", testCaseGetFreeIndex{
+			allocationOrder: infrav1.AllocationOrderFIFO,
+			freedIndexes:    []int{4, 2, 5},
+			indexes:         map[int]string{1: "abc", 3: "bcd"},
+			expectedIndex:   4,
+		}),
+		Entry("LIFO", testCaseGetFreeIndex{
+			allocationOrder: infrav1.AllocationOrderLIFO,
+			freedIndexes:    []int{4, 5, 2},
+			indexes:         map[int]string{1: "abc", 3: "bcd"},
+			expectedIndex:   2,
+		}),
+		Entry("LIFO, freed index allocated or out of bounds", testCaseGetFreeIndex{
+			allocationOrder: infrav1.AllocationOrderLIFO,
+			freedIndexes:    []int{4, 0, 10, 3},
+			maxIndex:        5,
+			indexes:         map[int]string{1: "abc", 3: "bcd"},
+			expectedIndex:   4,
+		}),
+		Entry("FIFO, no freed index", testCaseGetFreeIndex{
+			allocationOrder: infrav1.AllocationOrderFIFO,
+			indexes:         map[int]string{1: "abc", 3: "bcd"},
+			expectedIndex:   2,
+		}),
+		Entry("Static indexes reserved", testCaseGetFreeIndex{
+			staticAssignments: map[string]int{"cp-0": 2, "cp-1": 4},
+			indexes:           map[int]string{1: "abc", 3: "bcd"},
+			expectedIndex:     5,
+		}),
+		Entry("FIFO, static index freed", testCaseGetFreeIndex{
+			allocationOrder:   infrav1.AllocationOrderFIFO,
+			freedIndexes:      []int{2, 4},
+			staticAssignments: map[string]int{"cp-0": 2},
+			indexes:           map[int]string{1: "abc", 3: "bcd"},
+			expectedIndex:     4,
+		}),
+		Entry("Emergency range", testCaseGetFreeIndex{
+			maxIndex:          2,
+			emergencyRange:    &infrav1.EmergencyRangeSpec{Min: 10, Max: 12},
+			staticAssignments: map[string]int{"cp-0": 10},
+			indexes:           map[int]string{1: "abc", 2: "bcd", 11: "cde"},
+			expectedIndex:     12,
+		}),
+		Entry("Emergency range exhausted", testCaseGetFreeIndex{
+			maxIndex:       2,
+			emergencyRange: &infrav1.EmergencyRangeSpec{Min: 10, Max: 10},
+			indexes:        map[int]string{1: "abc", 2: "bcd", 10: "cde"},
+			expectError:    true,
+		}),
+		Entry("FIFO, exhausted", testCaseGetFreeIndex{
+			allocationOrder: infrav1.AllocationOrderFIFO,
+			freedIndexes:    []int{1},
+			maxIndex:        2,
+			indexes:         map[int]string{1: "abc", 2: "bcd"},
+			expectError:     true,
+		}),
+		Entry("Reserved indexes", testCaseGetFreeIndex{
+			reservedIndexes: []infrav1.IndexReservation{
+				{Index: 2, ReservedUntil: metav1.NewTime(time.Now().Add(time.Hour))},
+				{Index: 4, ReservedUntil: metav1.NewTime(time.Now().Add(-time.Hour))},
+			},
+			indexes:       map[int]string{1: "abc", 3: "bcd"},
+			expectedIndex: 4,
+		}),
+		Entry("FIFO, reserved freed index", testCaseGetFreeIndex{
+			allocationOrder: infrav1.AllocationOrderFIFO,
+			freedIndexes:    []int{2, 4},
+			reservedIndexes: []infrav1.IndexReservation{
+				{Index: 2, ReservedUntil: metav1.NewTime(time.Now().Add(time.Hour))},
+			},
+			indexes:       map[int]string{1: "abc", 3: "bcd"},
+			expectedIndex: 4,
+		}),
+		Entry("Index step", testCaseGetFreeIndex{
+			indexStep:     10,
+			indexes:       map[int]string{1: "abc", 11: "bcd", 15: "cde"},
+			expectedIndex: 21,
+		}),
+		Entry("Index step, misaligned freed index", testCaseGetFreeIndex{
+			allocationOrder: infrav1.AllocationOrderFIFO,
+			indexStep:       10,
+			freedIndexes:    []int{5, 11},
+			indexes:         map[int]string{1: "abc"},
+			expectedIndex:   11,
+		}),
+		Entry("Index step, exhausted", testCaseGetFreeIndex{
+			indexStep:   10,
+			maxIndex:    21,
+			indexes:     map[int]string{1: "abc", 11: "bcd", 21: "cde"},
+			expectError: true,
+		}),
+	)
+
+	It("Reserves the released indexes for the grace period", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				GracePeriodAfterDelete: &metav1.Duration{Duration: time.Hour},
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				ReservedIndexes: []infrav1.IndexReservation{
+					{Index: 5, ReservedUntil: metav1.NewTime(time.Now().Add(-time.Minute))},
+				},
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(nil, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		templateMgr.recordFreedIndex(3)
+		templateMgr.recordFreedIndex(1)
+		Expect(templateMgr.isReservedIndex(1)).To(BeTrue())
+		Expect(templateMgr.isReservedIndex(3)).To(BeTrue())
+		Expect(templateMgr.isReservedIndex(5)).To(BeFalse())
+		reservedIndexes := []int{}
+		for _, reservation := range template.Status.ReservedIndexes {
+			reservedIndexes = append(reservedIndexes, reservation.Index)
+		}
+		Expect(reservedIndexes).To(Equal([]int{1, 3, 5}))
+		Expect(template.Status.ReservedIndexes[0].ReservedUntil.Time).To(
+			BeTemporally("~", time.Now().Add(time.Hour), time.Minute),
+		)
+
+		Expect(templateMgr.reservationsRequeueAfter()).To(Equal(time.Second))
+		templateMgr.pruneReservedIndexes()
+		Expect(template.Status.ReservedIndexes).To(HaveLen(2))
+		Expect(templateMgr.reservationsRequeueAfter()).To(
+			BeNumerically("~", time.Hour, time.Minute),
+		)
+		template.Status.ReservedIndexes[1].ReservedUntil = metav1.NewTime(
+			time.Now().Add(10 * time.Minute),
+		)
+		Expect(templateMgr.reservationsRequeueAfter()).To(
+			BeNumerically("~", 10*time.Minute, time.Minute),
+		)
+
+		template.Spec.GracePeriodAfterDelete = nil
+		templateMgr.recordFreedIndex(2)
+		Expect(templateMgr.isReservedIndex(2)).To(BeFalse())
+	})
+
+	It("Tracks the emergency allocations", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				MaxIndex: 2,
+				EmergencyRange: &infrav1.EmergencyRangeSpec{
+					Min:         10,
+					Max:         12,
+					MaxDuration: &metav1.Duration{Duration: time.Hour},
+				},
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"abc": {Index: 1},
+					"bcd": {Index: 10, AllocatedAt: &metav1.Time{
+						Time: time.Now().Add(-2 * time.Hour),
+					}},
+					"cde": {Index: 11, AllocatedAt: &metav1.Time{Time: time.Now()}},
+				},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		templateMgr.updateEmergencyAllocations()
+		Expect(template.Status.EmergencyAllocations).To(Equal(map[string]int{
+			"bcd": 10,
+			"cde": 11,
+		}))
+		Expect(conditions.IsTrue(template, infrav1.EmergencyRangeInUseCondition)).To(BeTrue())
+
+		// The Metal3Data objects do not exist, only the emergency range items
+		// are checked
+		report, err := templateMgr.RunValidations(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Errors).To(ContainElement(ValidationItem{
+			Check:    "EmergencyRange",
+			Message:  "Emergency index 10 of bcd is allocated for more than 1h0m0s",
+			Severity: ValidationSeverityError,
+		}))
+		Expect(report.Warnings).To(ContainElement(ValidationItem{
+			Check:    "EmergencyRange",
+			Message:  "Emergency index 11 is allocated to cde",
+			Severity: ValidationSeverityWarning,
+		}))
+
+		template.Status.Indexes = map[string]infrav1.IndexEntry{"abc": {Index: 1}}
+		templateMgr.updateEmergencyAllocations()
+		Expect(template.Status.EmergencyAllocations).To(BeNil())
+		Expect(conditions.Has(template, infrav1.EmergencyRangeInUseCondition)).To(BeFalse())
+	})
+
+	DescribeTable("Test recordFreedIndex",
+		func(allocationOrder string, freed []int, expectedFreedIndexes []int) {
+			templateMgr, err := NewDataTemplateManager(nil, &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					AllocationOrder: allocationOrder,
+				},
+			}, klogr.New())
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, index := range freed {
+				templateMgr.recordFreedIndex(index)
+			}
+			Expect(templateMgr.DataTemplate.Status.FreedIndexes).To(Equal(expectedFreedIndexes))
+
+			for _, index := range freed {
+				templateMgr.forgetFreedIndex(index)
+			}
+			Expect(templateMgr.DataTemplate.Status.FreedIndexes).To(BeNil())
+		},
+		Entry("SmallestFirst", infrav1.AllocationOrderSmallestFirst, []int{3, 1}, nil),
+		Entry("FIFO", infrav1.AllocationOrderFIFO, []int{3, 1}, []int{3, 1}),
+		Entry("LIFO, freed again", infrav1.AllocationOrderLIFO, []int{3, 1, 3},
+			[]int{1, 3},
+		),
+	)
+
+	type testCaseApplyAnnotationFilters struct {
+		m3mAnnotations map[string]string
+		expectedSpec   infrav1.Metal3DataSpec
+	}
+
+	DescribeTable("Test applyAnnotationFilters",
+		func(tc testCaseApplyAnnotationFilters) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					AnnotationFilters: []infrav1.AnnotationFilter{
+						{
+							AnnotationKey:   "metal3.io/rack",
+							AnnotationValue: "rack-2",
+							DataSpecPatch: infrav1.Metal3DataSpec{
+								MetaData: &corev1.SecretReference{
+									Name:      "rack-2-metadata",
+									Namespace: "otherns",
+								},
+								NetworkData: &corev1.SecretReference{
+									Name: "rack-2-networkdata",
+								},
+							},
+						},
+						{
+							AnnotationKey: "metal3.io/storage",
+							DataSpecPatch: infrav1.Metal3DataSpec{
+								NetworkData: &corev1.SecretReference{
+									Name: "storage-networkdata",
+								},
+							},
+						},
+					},
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(nil, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			dataObject := &infrav1.Metal3Data{}
+			templateMgr.applyAnnotationFilters(context.TODO(), dataObject,
+				&infrav1.Metal3Machine{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "machine1",
+						Namespace:   "myns",
+						Annotations: tc.m3mAnnotations,
+					},
+				},
+			)
+			Expect(dataObject.Spec).To(Equal(tc.expectedSpec))
+		},
+		Entry("No matching filter", testCaseApplyAnnotationFilters{
+			m3mAnnotations: map[string]string{"metal3.io/rack": "rack-1"},
+		}),
+		Entry("Matching filter", testCaseApplyAnnotationFilters{
+			m3mAnnotations: map[string]string{"metal3.io/rack": "rack-2"},
+			expectedSpec: infrav1.Metal3DataSpec{
+				MetaData: &corev1.SecretReference{
+					Name:      "rack-2-metadata",
+					Namespace: "myns",
+				},
+				NetworkData: &corev1.SecretReference{
+					Name:      "rack-2-networkdata",
+					Namespace: "myns",
+				},
+			},
+		}),
+		Entry("Last matching filter takes precedence", testCaseApplyAnnotationFilters{
+			m3mAnnotations: map[string]string{
+				"metal3.io/rack":    "rack-2",
+				"metal3.io/storage": "",
+			},
+			expectedSpec: infrav1.Metal3DataSpec{
+				MetaData: &corev1.SecretReference{
+					Name:      "rack-2-metadata",
+					Namespace: "myns",
+				},
+				NetworkData: &corev1.SecretReference{
+					Name:      "storage-networkdata",
+					Namespace: "myns",
+				},
+			},
+		}),
+	)
+
+	type testCaseGetSharedIndex struct {
+		ownershipMode string
+		labels        map[string]string
+		expectShared  bool
+		expectedIndex int
+		expectError   bool
+	}
+
+	DescribeTable("Test getSharedIndex",
+		func(tc testCaseGetSharedIndex) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					MinIndex:      1,
+					MaxIndex:      5,
+					OwnershipMode: tc.ownershipMode,
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(nil, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			index, shared, err := templateMgr.getSharedIndex(&infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "claim1",
+					Labels: tc.labels,
+				},
+			})
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shared).To(Equal(tc.expectShared))
+			Expect(index).To(Equal(tc.expectedIndex))
+		},
+		Entry("Exclusive mode", testCaseGetSharedIndex{
+			ownershipMode: infrav1.OwnershipModeExclusive,
+			labels:        map[string]string{SharedIndexLabel: "3"},
+		}),
+		Entry("Shared mode, no label", testCaseGetSharedIndex{
+			ownershipMode: infrav1.OwnershipModeShared,
+		}),
+		Entry("Shared mode", testCaseGetSharedIndex{
+			ownershipMode: infrav1.OwnershipModeShared,
+			labels:        map[string]string{SharedIndexLabel: "3"},
+			expectShared:  true,
+			expectedIndex: 3,
+		}),
+		Entry("Shared mode, invalid label", testCaseGetSharedIndex{
+			ownershipMode: infrav1.OwnershipModeShared,
+			labels:        map[string]string{SharedIndexLabel: "three"},
+			expectError:   true,
+		}),
+		Entry("Shared mode, out of bounds", testCaseGetSharedIndex{
+			ownershipMode: infrav1.OwnershipModeShared,
+			labels:        map[string]string{SharedIndexLabel: "6"},
+			expectError:   true,
+		}),
+	)
+
+	It("Shares a Metal3Data between claims in Shared mode", func() {
+		newClaim := func(name string) *infrav1.Metal3DataClaim {
+			return &infrav1.Metal3DataClaim{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: infrav1.GroupVersion.String(),
+					Kind:       "Metal3DataClaim",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: "myns",
+					Labels:    map[string]string{SharedIndexLabel: "3"},
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: infrav1.GroupVersion.String(),
+							Kind:       "Metal3Machine",
+							Name:       name,
+							UID:        types.UID(name + "-uid"),
+						},
+					},
+				},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: "abc"},
+				},
+			}
+		}
+		claim1 := newClaim("machine1")
+		claim2 := newClaim("machine2")
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				OwnershipMode: infrav1.OwnershipModeShared,
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		templateMgr, err := NewDataTemplateManager(c, template,
+			klogr.New(),
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		indexes, err := templateMgr.createData(context.TODO(), claim1,
+			map[int]string{}, c,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		indexes, err = templateMgr.createData(context.TODO(), claim2, indexes, c)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexes).To(Equal(map[int]string{3: "machine1"}))
+		Expect(claim2.Status.RenderedData.Name).To(Equal("abc-3"))
+
+		m3Data := &infrav1.Metal3Data{}
+		key := client.ObjectKey{Name: "abc-3", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, m3Data)).To(Succeed())
+		Expect(m3Data.Spec.Claim.Name).To(Equal("machine1"))
+		Expect(m3Data.OwnerReferences).To(HaveLen(5))
+
+		// The status is rebuilt with both claims
+		_, err = templateMgr.getIndexes(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexesOf(template.Status.Indexes)).To(Equal(map[string]int{
+			"machine1": 3,
+			"machine2": 3,
+		}))
+		Expect(template.Status.Indexes["machine2"].MachineName).To(Equal("machine2"))
+
+		// Deleting a claim other than the one of the Metal3Data keeps it
+		indexes, err = templateMgr.deleteData(context.TODO(), claim2, indexes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexes).To(Equal(map[int]string{3: "machine1"}))
+		m3Data = &infrav1.Metal3Data{}
+		Expect(c.Get(context.TODO(), key, m3Data)).To(Succeed())
+		for _, ownerRef := range m3Data.OwnerReferences {
+			Expect(ownerRef.Name).NotTo(Equal("machine2"))
+		}
+		claim2 = newClaim("machine2")
+		indexes, err = templateMgr.createData(context.TODO(), claim2, indexes, c)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Deleting the claim of the Metal3Data hands it over to the second,
+		// by deleting it so that the second claim creates it again
+		indexes, err = templateMgr.deleteData(context.TODO(), claim1, indexes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexes).To(BeEmpty())
+		Expect(template.Status.Indexes).To(BeEmpty())
+		Expect(c.Get(context.TODO(), key, &infrav1.Metal3Data{})).NotTo(Succeed())
+		claim2 = newClaim("machine2")
+		indexes, err = templateMgr.createData(context.TODO(), claim2, indexes, c)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexes).To(Equal(map[int]string{3: "machine2"}))
+		m3Data = &infrav1.Metal3Data{}
+		Expect(c.Get(context.TODO(), key, m3Data)).To(Succeed())
+		Expect(m3Data.Spec.Claim.Name).To(Equal("machine2"))
+
+		// Deleting the last claim deletes the Metal3Data
+		indexes, err = templateMgr.deleteData(context.TODO(), claim2, indexes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexes).To(BeEmpty())
+		Expect(c.Get(context.TODO(), key, m3Data)).NotTo(Succeed())
+	})
+
+	It("Counts the live Metal3Data objects", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				ClusterName: "cluster1",
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0},
+				},
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 2)
+		otherClusterData := datas[1].DeepCopy()
+		otherClusterData.Name = "abc-2"
+		otherClusterData.Labels[capi.ClusterLabelName] = "cluster2"
+		otherTemplateData := datas[1].DeepCopy()
+		otherTemplateData.Name = "bcd-0"
+		otherTemplateData.Spec.Template.Name = "bcd"
+		c := &pagingClient{
+			Client: fakeclient.NewFakeClientWithScheme(setupSchemeMm(),
+				&datas[0], &datas[1], otherClusterData, otherTemplateData,
+			),
+		}
+		templateMgr, err := NewDataTemplateManagerWithOptions(c, template,
+			klogr.New(), WithPageSize(1),
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		count, err := templateMgr.LiveIndexCount(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(2))
+		Expect(c.listCalls).To(Equal(3))
+		Expect(promtestutil.ToFloat64(
+			liveIndexCountGauge.WithLabelValues("myns", "abc"),
+		)).To(Equal(float64(2)))
+
+		report, err := templateMgr.RunValidations(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Warnings).To(ContainElement(ValidationItem{
+			Check:    "LiveIndexCount",
+			Message:  "2 Metal3Data objects exist for 1 allocated indexes",
+			Severity: ValidationSeverityWarning,
+		}))
+	})
+
+	DescribeTable("Test checkDataQuota",
+		func(tc testCaseCheckDataQuota) {
+			objects := []runtime.Object{}
+			for _, quota := range tc.quotas {
+				objects = append(objects, quota)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+			templateMgr, err := NewDataTemplateManager(c, &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+			}, klogr.New())
+			Expect(err).NotTo(HaveOccurred())
+
+			err = templateMgr.checkDataQuota(context.TODO())
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				Expect(err).To(Equal(&QuotaExceededError{
+					Quota: "quota1", Current: 2, Max: 2,
+				}))
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+		},
+		Entry("No quota", testCaseCheckDataQuota{}),
+		Entry("Quota on other resources", testCaseCheckDataQuota{
+			quotas: []*corev1.ResourceQuota{
+				newDataQuota("quota1", "myns", corev1.ResourcePods, 2, 2),
+			},
+		}),
+		Entry("Quota not reached", testCaseCheckDataQuota{
+			quotas: []*corev1.ResourceQuota{
+				newDataQuota("quota1", "myns", metal3DataQuotaResource, 1, 2),
+			},
+		}),
+		Entry("Quota in another namespace", testCaseCheckDataQuota{
+			quotas: []*corev1.ResourceQuota{
+				newDataQuota("quota1", "otherns", metal3DataQuotaResource, 2, 2),
+			},
+		}),
+		Entry("Quota reached", testCaseCheckDataQuota{
+			quotas: []*corev1.ResourceQuota{
+				newDataQuota("quota1", "myns", metal3DataQuotaResource, 2, 2),
+			},
+			expectError: true,
+		}),
+	)
+
+	type testCaseStoreExternalStatus struct {
+		useExternalStatusStore bool
+		secretRef              *corev1.LocalObjectReference
+		secrets                []*corev1.Secret
+		expectedSecretRef      *corev1.LocalObjectReference
+		expectSecret           bool
+	}
+
+	DescribeTable("Test storeExternalStatus",
+		func(tc testCaseStoreExternalStatus) {
+			objects := []runtime.Object{}
+			for _, secret := range tc.secrets {
+				objects = append(objects, secret)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+			indexes := map[string]infrav1.IndexEntry{
+				"machine1": {Index: 1, MachineName: "machine1"},
+			}
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					UseExternalStatusStore: tc.useExternalStatusStore,
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes:                 indexes,
+					ExternalStatusSecretRef: tc.secretRef,
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(templateMgr.storeExternalStatus(context.TODO())).To(Succeed())
+			Expect(template.Status.ExternalStatusSecretRef).To(Equal(tc.expectedSecretRef))
+
+			secret := &corev1.Secret{}
+			key := client.ObjectKey{Name: "abc-status", Namespace: "myns"}
+			err = c.Get(context.TODO(), key, secret)
+			if !tc.expectSecret {
+				Expect(err).To(HaveOccurred())
+				Expect(template.Status.Indexes).To(Equal(indexes))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(template.Status.Indexes).To(BeNil())
+			Expect(secret.OwnerReferences).To(HaveLen(1))
+
+			storedIndexes, err := statusIndexes(context.TODO(), c, template)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(storedIndexes).To(Equal(indexes))
+		},
+		Entry("Inline status", testCaseStoreExternalStatus{}),
+		Entry("External status", testCaseStoreExternalStatus{
+			useExternalStatusStore: true,
+			expectedSecretRef:      &corev1.LocalObjectReference{Name: "abc-status"},
+			expectSecret:           true,
+		}),
+		Entry("External status, existing Secret", testCaseStoreExternalStatus{
+			useExternalStatusStore: true,
+			secretRef:              &corev1.LocalObjectReference{Name: "abc-status"},
+			secrets: []*corev1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc-status",
+						Namespace: "myns",
+					},
+					Data: map[string][]byte{
+						ExternalStatusSecretKey: []byte("{}"),
+					},
+				},
+			},
+			expectedSecretRef: &corev1.LocalObjectReference{Name: "abc-status"},
+			expectSecret:      true,
+		}),
+		Entry("Back to the inline status", testCaseStoreExternalStatus{
+			secretRef: &corev1.LocalObjectReference{Name: "abc-status"},
+			secrets: []*corev1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc-status",
+						Namespace: "myns",
+					},
+				},
+			},
+		}),
+	)
+
+	It("Only writes the external status Secret when it changes", func() {
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		indexes := map[string]infrav1.IndexEntry{
+			"machine1": {Index: 1, MachineName: "machine1"},
+		}
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				UseExternalStatusStore: true,
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		resourceVersion := func() string {
+			secret := &corev1.Secret{}
+			key := client.ObjectKey{Name: "abc-status", Namespace: "myns"}
+			Expect(c.Get(context.TODO(), key, secret)).To(Succeed())
+			return secret.ResourceVersion
+		}
+
+		template.Status.Indexes = indexes
+		Expect(templateMgr.storeExternalStatus(context.TODO())).To(Succeed())
+		written := resourceVersion()
+		template.Status.Indexes = indexes
+		Expect(templateMgr.storeExternalStatus(context.TODO())).To(Succeed())
+		Expect(resourceVersion()).To(Equal(written))
+
+		template.Status.Indexes = map[string]infrav1.IndexEntry{
+			"machine2": {Index: 2, MachineName: "machine2"},
+		}
+		Expect(templateMgr.storeExternalStatus(context.TODO())).To(Succeed())
+		Expect(resourceVersion()).NotTo(Equal(written))
+
+		// The indexes must fit in the Secret
+		template.Status.Indexes = make(map[string]infrav1.IndexEntry)
+		for i := 0; i < 20000; i++ {
+			name := fmt.Sprintf("machine-%d", i)
+			template.Status.Indexes[name] = infrav1.IndexEntry{
+				Index: i, MachineName: name,
+			}
+		}
+		Expect(templateMgr.storeExternalStatus(context.TODO())).NotTo(Succeed())
+	})
+
+	It("Test GetDataForMachine with an external status", func() {
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(),
+			&infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "abc-1",
+					Namespace: "myns",
+				},
+			},
+		)
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				UseExternalStatusStore: true,
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine1": {Index: 1},
+				},
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(templateMgr.storeExternalStatus(context.TODO())).To(Succeed())
+
+		m3Data, err := templateMgr.GetDataForMachine(context.TODO(), "machine1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m3Data.Name).To(Equal("abc-1"))
+		_, err = templateMgr.GetDataForMachine(context.TODO(), "machine2")
+		Expect(err).To(HaveOccurred())
+
+		// A missing Secret is an error
+		template.Status.ExternalStatusSecretRef.Name = "missing"
+		_, err = templateMgr.GetDataForMachine(context.TODO(), "machine1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Test recordAllocationEvents", func() {
+		// Nothing is recorded without a recorder
+		templateMgr, err := NewDataTemplateManager(nil, &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+		}, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		delta := DeltaStatus{
+			Created: []DataAllocation{
+				{MachineName: "machine3", DataName: "abc-3", Index: 3},
+			},
+			Deleted: []DataAllocation{
+				{MachineName: "machine1", DataName: "abc-1", Index: 1},
+			},
+		}
+		templateMgr.recordAllocationEvents(delta)
+
+		recorder := record.NewFakeRecorder(10)
+		templateMgr, err = NewDataTemplateManagerWithOptions(nil,
+			&infrav1.Metal3DataTemplate{ObjectMeta: templateMeta}, klogr.New(),
+			WithEventRecorder(recorder),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		templateMgr.recordAllocationEvents(delta)
+		Expect(recorder.Events).To(Receive(Equal(
+			"Normal Metal3DataCreated Allocated index 3 to Metal3Machine machine3 in Metal3Data abc-3",
+		)))
+		Expect(recorder.Events).To(Receive(Equal(
+			"Normal Metal3DataDeleted Released index 1 of Metal3Machine machine1 from Metal3Data abc-1",
+		)))
+		Expect(recorder.Events).NotTo(Receive())
+	})
+
+	It("Test DeleteMetrics", func() {
+		templateMgr, err := NewDataTemplateManager(nil, &infrav1.Metal3DataTemplate{
+			ObjectMeta: metav1.ObjectMeta{Name: "deleted", Namespace: "myns"},
+		}, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		dataSizeBytesGauge.WithLabelValues("myns", "deleted").Set(10)
+		allocatedCountGauge.WithLabelValues("myns", "deleted").Set(1)
+		provisionedMachinesCounter.WithLabelValues("myns", "deleted").Inc()
+		allocatedCountGauge.WithLabelValues("myns", "kept").Set(1)
+
+		templateMgr.DeleteMetrics()
+		Expect(dataSizeBytesGauge.DeleteLabelValues("myns", "deleted")).To(BeFalse())
+		Expect(allocatedCountGauge.DeleteLabelValues("myns", "deleted")).To(BeFalse())
+		Expect(provisionedMachinesCounter.DeleteLabelValues("myns", "deleted")).To(BeFalse())
+		Expect(allocatedCountGauge.DeleteLabelValues("myns", "kept")).To(BeTrue())
+	})
+
+	It("Test checkOwnerReferences", func() {
+		recorder := record.NewFakeRecorder(10)
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				MaxOwnerReferences: 5,
+			},
+		}
+		template.OwnerReferences = []metav1.OwnerReference{
+			{Name: "m3m1"}, {Name: "m3m2"}, {Name: "m3m3"},
+		}
+		templateMgr, err := NewDataTemplateManagerWithOptions(nil, template,
+			klogr.New(), WithEventRecorder(recorder),
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		templateMgr.checkOwnerReferences()
+		Expect(recorder.Events).NotTo(Receive())
+
+		template.OwnerReferences = append(template.OwnerReferences,
+			metav1.OwnerReference{Name: "m3m4"},
+		)
+		templateMgr.checkOwnerReferences()
+		Expect(recorder.Events).To(Receive(Equal(
+			"Warning OwnerReferencesLimit 4 owner references out of the maximum of 5",
+		)))
+	})
+
+	It("Test StartDataTemplateReconcile and updateStatusTimestamp", func() {
+		templateMgr, err := NewDataTemplateManager(nil, &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+		}, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		key := types.NamespacedName{Namespace: "myns", Name: "abc"}
+		otherKey := types.NamespacedName{Namespace: "myns", Name: "bcd"}
+
+		StartDataTemplateReconcile(key)
+		StartDataTemplateReconcile(key)
+		StartDataTemplateReconcile(otherKey)
+		Expect(promtestutil.ToFloat64(activeReconcilesGauge)).To(Equal(float64(3)))
+		templateMgr.updateStatusTimestamp()
+		Expect(templateMgr.DataTemplate.Status.ConcurrentReconcileCount).To(Equal(2))
+
+		EndDataTemplateReconcile(key)
+		EndDataTemplateReconcile(key)
+		EndDataTemplateReconcile(otherKey)
+		Expect(promtestutil.ToFloat64(activeReconcilesGauge)).To(Equal(float64(0)))
+		templateMgr.updateStatusTimestamp()
+		Expect(templateMgr.DataTemplate.Status.ConcurrentReconcileCount).To(Equal(0))
+		_, ok := activeDataTemplateReconciles.Load(key)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Test InspectGaps", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				MinIndex:  10,
+				MaxIndex:  100,
+				IndexStep: 10,
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"claim-10": {Index: 10},
+					"claim-40": {Index: 40},
+					"claim-50": {Index: 50},
+				},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		gaps, err := templateMgr.InspectGaps(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gaps).To(Equal([]IndexGap{
+			{Start: 20, End: 30, Size: 2},
+			{Start: 60, End: 100, Size: 5},
+		}))
+
+		templateMgr.updateStatusTimestamp()
+		Expect(template.Status.LargestGap).To(Equal(5))
+		Expect(template.Status.FragmentationRatio).To(Equal("1.40"))
+
+		// Without free index, there is no ratio
+		Expect(fragmentationRatio([]IndexGap{})).To(BeEmpty())
+		Expect(fragmentationRatio([]IndexGap{{Start: 1, End: 3, Size: 3}})).To(Equal("1.00"))
+	})
+
+	It("Test the index checksum", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine1": {Index: 1, MachineName: "machine1", MachineUID: "uid1"},
+					"machine0": {Index: 0, MachineName: "machine0", MachineUID: "uid0"},
+				},
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(nil, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		templateMgr.updateStatusTimestamp()
+		checksum := template.Status.IndexChecksum
+		Expect(checksum).To(HaveLen(64))
+		Expect(template.Annotations).To(HaveKeyWithValue(IndexChecksumAnnotation, checksum))
+
+		// The UIDs and allocation times are ignored
+		now := metav1.Now()
+		Expect(indexChecksum(map[string]infrav1.IndexEntry{
+			"machine0": {Index: 0, MachineName: "machine0", AllocatedAt: &now},
+			"machine1": {Index: 1, MachineName: "machine1", MachineUID: "uid2"},
+		})).To(Equal(checksum))
+
+		// A different allocation has a different checksum
+		Expect(indexChecksum(map[string]infrav1.IndexEntry{
+			"machine0": {Index: 1, MachineName: "machine0"},
+			"machine1": {Index: 0, MachineName: "machine1"},
+		})).NotTo(Equal(checksum))
+	})
+
+	It("Counts the provisioned and deprovisioned machines", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				ProvisionedMachineCount:   3,
+				DeprovisionedMachineCount: 2,
+			},
+		}
+		dataClaim := &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: infrav1.GroupVersion.String(),
+						Kind:       "Metal3Machine",
+						Name:       "machine-0",
+					},
+				},
+			},
+			Spec: infrav1.Metal3DataClaimSpec{
+				Template: corev1.ObjectReference{Name: "abc"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			dataClaim,
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		provisioned := provisionedMachinesCounter.WithLabelValues("myns", "abc")
+		deprovisioned := deprovisionedMachinesCounter.WithLabelValues("myns", "abc")
+		provisionedTotal := promtestutil.ToFloat64(provisioned)
+		deprovisionedTotal := promtestutil.ToFloat64(deprovisioned)
+
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(template.Status.ProvisionedMachineCount).To(Equal(4))
+		Expect(template.Status.DeprovisionedMachineCount).To(Equal(2))
+		Expect(promtestutil.ToFloat64(provisioned)).To(Equal(provisionedTotal + 1))
+
+		// Releasing the index counts a deprovisioned machine
+		_, err = templateMgr.deleteData(context.TODO(), dataClaim,
+			map[int]string{0: "machine-0"},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(template.Status.ProvisionedMachineCount).To(Equal(4))
+		Expect(template.Status.DeprovisionedMachineCount).To(Equal(3))
+		Expect(promtestutil.ToFloat64(deprovisioned)).To(Equal(deprovisionedTotal + 1))
+
+		// A claim without index does not
+		_, err = templateMgr.deleteData(context.TODO(), dataClaim, map[int]string{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(template.Status.DeprovisionedMachineCount).To(Equal(3))
+	})
+
+	It("Sets the wait-for-bmo finalizer on the Metal3Data", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				WaitForBMOOnDelete: true,
+			},
+		}
+		dataClaim := &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: infrav1.GroupVersion.String(),
+						Kind:       "Metal3Machine",
+						Name:       "machine-0",
+					},
+				},
+			},
+			Spec: infrav1.Metal3DataClaimSpec{
+				Template: corev1.ObjectReference{Name: "abc"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			dataClaim,
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		m3Data := &infrav1.Metal3Data{}
+		key := client.ObjectKey{Name: "abc-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, m3Data)).To(Succeed())
+		Expect(m3Data.Finalizers).To(Equal([]string{infrav1.WaitForBMOFinalizer}))
+	})
+
+	It("Recognizes the machine owner kinds of the filter", func() {
+		template := &infrav1.Metal3DataTemplate{ObjectMeta: templateMeta}
+		dataClaim := &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: infrav1.GroupVersion.String(),
+						Kind:       "VirtualMetal3Machine",
+						Name:       "vm-0",
+						UID:        "vm-0-uid",
+					},
+				},
+			},
+			Spec: infrav1.Metal3DataClaimSpec{
+				Template: corev1.ObjectReference{Name: "abc"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			dataClaim,
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(templateMgr.OwnerKindFilter).To(Equal([]string{"Metal3Machine"}))
+
+		// Only Metal3Machine owners are recognized by default
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).To(MatchError(ContainSubstring("Metal3Machine not found in owner references")))
+		Expect(template.Status.Indexes).To(BeEmpty())
+
+		templateMgr.OwnerKindFilter = []string{"Metal3Machine", "VirtualMetal3Machine"}
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(template.Status.Indexes["machine-0"].MachineName).To(Equal("vm-0"))
+		m3Data := &infrav1.Metal3Data{}
+		key := client.ObjectKey{Name: "abc-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, m3Data)).To(Succeed())
+		machineRef := m3Data.OwnerReferences[len(m3Data.OwnerReferences)-1]
+		Expect(machineRef.Kind).To(Equal("VirtualMetal3Machine"))
+		Expect(machineRef.Name).To(Equal("vm-0"))
+		Expect(machineRef.UID).To(BeEquivalentTo("vm-0-uid"))
+
+		// The index is found again from the owners of the Metal3Data
+		template.Status = infrav1.Metal3DataTemplateStatus{}
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(template.Status.Indexes["machine-0"].MachineName).To(Equal("vm-0"))
+	})
+
+	It("Records the AllocationSkipped Event once", func() {
+		template := &infrav1.Metal3DataTemplate{ObjectMeta: templateMeta}
+		m3m := &infrav1.Metal3Machine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "machine-0",
+				Namespace:   "myns",
+				Annotations: map[string]string{SkipAllocationAnnotation: "true"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			m3m, &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "machine-0",
+					Namespace: "myns",
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: infrav1.GroupVersion.String(),
+							Kind:       "Metal3Machine",
+							Name:       "machine-0",
+						},
+					},
+				},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: "abc"},
+				},
+			},
+		)
+		recorder := record.NewFakeRecorder(10)
+		templateMgr, err := NewDataTemplateManagerWithOptions(c, template,
+			klogr.New(), WithEventRecorder(recorder),
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 2; i++ {
+			_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(recorder.Events).To(Receive(HavePrefix(
+			corev1.EventTypeNormal + " " + AllocationSkippedEventReason,
+		)))
+		Expect(recorder.Events).NotTo(Receive())
+		dataClaim := &infrav1.Metal3DataClaim{}
+		key := client.ObjectKey{Name: "machine-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, dataClaim)).To(Succeed())
+		Expect(dataClaim.Annotations).To(HaveKey(AllocationSkippedAnnotation))
+
+		// The annotation is removed once the Metal3Machine gets an index
+		Expect(c.Get(context.TODO(), key, m3m)).To(Succeed())
+		m3m.Annotations = nil
+		Expect(c.Update(context.TODO(), m3m)).To(Succeed())
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		dataClaim = &infrav1.Metal3DataClaim{}
+		Expect(c.Get(context.TODO(), key, dataClaim)).To(Succeed())
+		Expect(dataClaim.Annotations).NotTo(HaveKey(AllocationSkippedAnnotation))
+		Expect(dataClaim.Status.RenderedData).NotTo(BeNil())
+	})
+
+	It("Does not recreate the status automatically if disabled", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				DisableAutoRecreateStatus: true,
+			},
+		}
+		dataClaim := &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-0",
+				Namespace: "myns",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: infrav1.GroupVersion.String(),
+						Kind:       "Metal3Machine",
+						Name:       "machine-0",
+					},
+				},
+			},
+			Spec: infrav1.Metal3DataClaimSpec{
+				Template: corev1.ObjectReference{Name: "abc"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			dataClaim,
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, delta, err := templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).To(BeAssignableToTypeOf(&RequeueAfterError{}))
+		Expect(delta).To(Equal(DeltaStatus{}))
+		Expect(template.Status.Indexes).To(BeEmpty())
+		Expect(template.Status.LastUpdated.IsZero()).To(BeTrue())
+		condition := conditions.Get(template, infrav1.StatusRecreationRequiredCondition)
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).To(Equal(corev1.ConditionTrue))
+		Expect(condition.Severity).To(Equal(capi.ConditionSeverityWarning))
+
+		// Once the status was updated, the indexes are allocated
+		now := metav1.Now()
+		template.Status.LastUpdated = &now
+		_, delta, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(delta.Created).To(HaveLen(1))
+		Expect(indexesOf(template.Status.Indexes)).To(Equal(
+			map[string]int{"machine-0": 0},
+		))
+		Expect(conditions.Has(template, infrav1.StatusRecreationRequiredCondition)).To(BeFalse())
+	})
+
+	type testCaseLargestGap struct {
+		spec            infrav1.Metal3DataTemplateSpec
+		indexes         []int
+		reservedIndexes []int
+		expectedGap     int
+	}
+
+	DescribeTable("Test the largest gap",
+		func(tc testCaseLargestGap) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec:       tc.spec,
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: map[string]infrav1.IndexEntry{},
+				},
+			}
+			for i, index := range tc.indexes {
+				template.Status.Indexes[fmt.Sprintf("claim%d", i)] = infrav1.IndexEntry{
+					Index: index,
+				}
+			}
+			reservedUntil := metav1.NewTime(time.Now().Add(time.Hour))
+			for _, index := range tc.reservedIndexes {
+				template.Status.ReservedIndexes = append(
+					template.Status.ReservedIndexes, infrav1.IndexReservation{
+						Index:         index,
+						ReservedUntil: reservedUntil,
+					},
+				)
+			}
+			templateMgr, err := NewDataTemplateManager(nil, template, klogr.New())
+			Expect(err).NotTo(HaveOccurred())
+
+			templateMgr.updateStatusTimestamp()
+			Expect(template.Status.LargestGap).To(Equal(tc.expectedGap))
+		},
+		Entry("Empty bounded range", testCaseLargestGap{
+			spec:        infrav1.Metal3DataTemplateSpec{MinIndex: 1, MaxIndex: 10},
+			expectedGap: 10,
+		}),
+		Entry("Empty unbounded range", testCaseLargestGap{
+			expectedGap: 0,
+		}),
+		Entry("Gap between the indexes", testCaseLargestGap{
+			spec:        infrav1.Metal3DataTemplateSpec{MaxIndex: 10},
+			indexes:     []int{0, 1, 5, 9},
+			expectedGap: 3,
+		}),
+		Entry("Gap at the end", testCaseLargestGap{
+			spec:        infrav1.Metal3DataTemplateSpec{MaxIndex: 10},
+			indexes:     []int{0, 2, 3},
+			expectedGap: 7,
+		}),
+		Entry("Unbounded range", testCaseLargestGap{
+			indexes:     []int{1, 6},
+			expectedGap: 4,
+		}),
+		Entry("Static and reserved indexes", testCaseLargestGap{
+			spec: infrav1.Metal3DataTemplateSpec{
+				MaxIndex:          9,
+				StaticAssignments: map[string]int{"machine1": 4},
+			},
+			indexes:         []int{0},
+			reservedIndexes: []int{7},
+			expectedGap:     3,
+		}),
+		Entry("Index step", testCaseLargestGap{
+			spec: infrav1.Metal3DataTemplateSpec{
+				MinIndex:  10,
+				MaxIndex:  100,
+				IndexStep: 10,
+			},
+			indexes:     []int{10, 15, 50, 200},
+			expectedGap: 5,
+		}),
+	)
+
+	DescribeTable("Test checkControllerVersion",
+		func(controllerVersion string, minVersion string, expectCompatible bool) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					MinControllerVersion: minVersion,
+				},
+			}
+			conditions.MarkTrue(template, infrav1.IncompatibleControllerVersionCondition)
+
+			Expect(checkControllerVersion(template, controllerVersion)).To(
+				Equal(expectCompatible),
+			)
+			if expectCompatible {
+				Expect(conditions.Has(template,
+					infrav1.IncompatibleControllerVersionCondition,
+				)).To(BeFalse())
+			} else {
+				Expect(conditions.IsTrue(template,
+					infrav1.IncompatibleControllerVersionCondition,
+				)).To(BeTrue())
+				Expect(conditions.GetReason(template,
+					infrav1.IncompatibleControllerVersionCondition,
+				)).To(Equal(infrav1.ControllerVersionTooOldReason))
+			}
+		},
+		Entry("No minimum version", "v1.2.0", "", true),
+		Entry("Newer controller", "v1.4.1", "v1.4.0", true),
+		Entry("Same version", "v1.4.0", "v1.4.0", true),
+		Entry("Older controller", "v1.2.0", "v1.4.0", false),
+		Entry("Development build", "dev", "v1.4.0", true),
+	)
+
+	It("Records the spec revisions", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				ClusterName: "cluster1",
+				MaxIndex:    5,
+			},
+		}
+
+		// The first revision has no changed fields
+		Expect(RecordSpecRevision(template)).To(BeTrue())
+		Expect(template.Status.RevisionHistory).To(HaveLen(1))
+		Expect(template.Status.RevisionHistory[0].Revision).To(Equal(1))
+		Expect(template.Status.RevisionHistory[0].SpecChecksum).NotTo(BeEmpty())
+		Expect(template.Status.RevisionHistory[0].ChangedFields).To(BeEmpty())
+
+		// An unchanged spec is not recorded
+		Expect(RecordSpecRevision(template)).To(BeFalse())
+		Expect(template.Status.RevisionHistory).To(HaveLen(1))
+
+		// Changed, added and removed fields are listed
+		template.Spec.ClusterName = "cluster2"
+		template.Spec.MaxIndex = 0
+		template.Spec.MinIndex = 2
+		Expect(RecordSpecRevision(template)).To(BeTrue())
+		Expect(template.Status.RevisionHistory).To(HaveLen(2))
+		Expect(template.Status.RevisionHistory[1].Revision).To(Equal(2))
+		Expect(template.Status.RevisionHistory[1].ChangedFields).To(Equal(
+			[]string{"clusterName", "maxIndex", "minIndex"},
+		))
+
+		// Only the last entries are kept
+		for i := 3; i < 10+3; i++ {
+			template.Spec.MinIndex = i
+			Expect(RecordSpecRevision(template)).To(BeTrue())
+		}
+		Expect(template.Status.RevisionHistory).To(HaveLen(10))
+		Expect(template.Status.RevisionHistory[0].Revision).To(Equal(3))
+		Expect(template.Status.RevisionHistory[9].Revision).To(Equal(12))
+		Expect(template.Status.RevisionHistory[9].ChangedFields).To(Equal(
+			[]string{"minIndex"},
+		))
+	})
+
+	DescribeTable("Test Startup",
+		func(spec infrav1.Metal3DataTemplateSpec, expectError bool) {
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec:       spec,
+			}
+			templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+			Expect(err).NotTo(HaveOccurred())
+
+			err = templateMgr.Startup(context.TODO())
+			if expectError {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+		},
+		Entry("Valid spec", infrav1.Metal3DataTemplateSpec{}, false),
+		Entry("Invalid spec, only logged", infrav1.Metal3DataTemplateSpec{IndexStep: -1}, false),
+	)
+
+	It("Test RecoverFromPanic", func() {
+		template := &infrav1.Metal3DataTemplate{ObjectMeta: templateMeta}
+		recorder := record.NewFakeRecorder(10)
+		templateMgr, err := NewDataTemplateManagerWithOptions(nil, template,
+			klogr.New(), WithEventRecorder(recorder),
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		// The error of the function is returned
+		recovered, err := templateMgr.RecoverFromPanic(context.TODO(), func() error {
+			return errors.New("failed")
+		})
+		Expect(recovered).To(BeFalse())
+		Expect(err).To(MatchError("failed"))
+
+		// A panic is returned as a PanicError and recorded in a Warning Event
+		recovered, err = templateMgr.RecoverFromPanic(context.TODO(), func() error {
+			var indexes map[string]int
+			indexes["abc"] = 0
+			return nil
+		})
+		Expect(recovered).To(BeTrue())
+		Expect(err).To(BeAssignableToTypeOf(&PanicError{}))
+		Expect(err.(*PanicError).Stack).NotTo(BeEmpty())
+		var event string
+		Expect(recorder.Events).To(Receive(&event))
+		Expect(event).To(HavePrefix(corev1.EventTypeWarning + " " + ReconcilePanicEventReason))
+		Expect(event).To(ContainSubstring("assignment to entry in nil map"))
+	})
+
+	It("Deletes the pending deletions first", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				PendingDeletions: []string{"abc-0", "abc-1", "bcd-0"},
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 1)
+		otherTemplateData := datas[0].DeepCopy()
+		otherTemplateData.Name = "bcd-0"
+		otherTemplateData.Spec.Template.Name = "bcd"
+		c := &failingDeleteClient{
+			Client: fakeclient.NewFakeClientWithScheme(setupSchemeMm(),
+				template.DeepCopy(), &datas[0], otherTemplateData,
+			),
+			failures: 1,
+		}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		// A failure keeps the pending deletion, and no index is rebuilt
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).To(MatchError(ContainSubstring("Transient error")))
+		Expect(template.Status.PendingDeletions).To(ConsistOf("abc-0", "abc-1", "bcd-0"))
+
+		// The missing Metal3Data and the ones of other templates are dropped
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(template.Status.PendingDeletions).To(BeEmpty())
+		Expect(template.Status.Indexes).To(BeEmpty())
+		key := client.ObjectKey{Name: "abc-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, &infrav1.Metal3Data{})).NotTo(Succeed())
+		key = client.ObjectKey{Name: "bcd-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, &infrav1.Metal3Data{})).To(Succeed())
+	})
+
+	type testCaseDeleteDataObject struct {
+		retryFailedDeletes bool
+		failures           int
+		cancelled          bool
+		expectError        bool
+		expectedAttempts   int
+	}
+
+	DescribeTable("Test deleteDataObject",
+		func(tc testCaseDeleteDataObject) {
+			defer func(interval time.Duration) {
+				deleteRetryInterval = interval
+			}(deleteRetryInterval)
+			deleteRetryInterval = time.Millisecond
+
+			m3Data := &infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "abc-0",
+					Namespace: "myns",
+				},
+			}
+			c := &failingDeleteClient{
+				Client:   fakeclient.NewFakeClientWithScheme(setupSchemeMm(), m3Data.DeepCopy()),
+				failures: tc.failures,
+			}
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					RetryFailedDeletes: tc.retryFailedDeletes,
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(c, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.TODO())
+			if tc.cancelled {
+				cancel()
+			} else {
+				defer cancel()
+			}
+			err = templateMgr.deleteDataObject(ctx, m3Data)
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(c.attempts).To(Equal(tc.expectedAttempts))
+			if tc.expectError {
+				Expect(template.Status.PendingDeletions).To(Equal([]string{"abc-0"}))
+			} else {
+				Expect(template.Status.PendingDeletions).To(BeEmpty())
+			}
+		},
+		Entry("No retry, success", testCaseDeleteDataObject{
+			expectedAttempts: 1,
+		}),
+		Entry("No retry, failure", testCaseDeleteDataObject{
+			failures:         1,
+			expectError:      true,
+			expectedAttempts: 1,
+		}),
+		Entry("Retry, success", testCaseDeleteDataObject{
+			retryFailedDeletes: true,
+			failures:           2,
+			expectedAttempts:   3,
+		}),
+		Entry("Retry, failure", testCaseDeleteDataObject{
+			retryFailedDeletes: true,
+			failures:           10,
+			expectError:        true,
+			expectedAttempts:   4,
+		}),
+		Entry("Retry, context cancelled", testCaseDeleteDataObject{
+			retryFailedDeletes: true,
+			failures:           10,
+			cancelled:          true,
+			expectError:        true,
+			expectedAttempts:   1,
+		}),
+	)
+
+	type testCaseDeleteDatas struct {
+		template        *infrav1.Metal3DataTemplate
+		dataClaim       *infrav1.Metal3DataClaim
+		datas           []*infrav1.Metal3Data
+		indexes         map[int]string
+		expectedMap     map[int]string
+		expectedIndexes map[string]int
+		expectError     bool
+		expectFreed     bool
+	}
+
+	DescribeTable("Test DeleteAddresses",
+		func(tc testCaseDeleteDatas) {
+			objects := []runtime.Object{}
+			for _, address := range tc.datas {
+				objects = append(objects, address)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+			templateMgr, err := NewDataTemplateManager(c, tc.template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			allocatedMap, err := templateMgr.deleteData(context.TODO(), tc.dataClaim, tc.indexes)
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			// get list of Metal3Data objects
+			dataObjects := infrav1.Metal3DataList{}
+			opts := &client.ListOptions{}
+			err = c.List(context.TODO(), &dataObjects, opts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(dataObjects.Items)).To(Equal(0))
+
+			Expect(tc.template.Status.LastUpdated.IsZero()).To(BeFalse())
+			Expect(tc.template.Status.ControllerVersion).To(Equal(version.Version))
+			Expect(allocatedMap).To(Equal(tc.expectedMap))
+			Expect(indexesOf(tc.template.Status.Indexes)).To(Equal(tc.expectedIndexes))
+			Expect(len(tc.dataClaim.Finalizers)).To(Equal(0))
+			if tc.expectFreed {
+				Expect(conditions.IsFalse(tc.template,
+					infrav1.IndexSpaceExhaustedCondition,
+				)).To(BeTrue())
+			}
+		},
+		Entry("Empty Template", testCaseDeleteDatas{
+			template: &infrav1.Metal3DataTemplate{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "TestRef",
+				},
+			},
+		}),
+		Entry("No Deletion needed", testCaseDeleteDatas{
+			template: &infrav1.Metal3DataTemplate{},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "TestRef",
+				},
+			},
+			expectedMap: map[int]string{0: "abcd"},
+			indexes: map[int]string{
+				0: "abcd",
+			},
+		}),
+		Entry("Deletion needed, index space exhausted", testCaseDeleteDatas{
+			template: &infrav1.Metal3DataTemplate{
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{
+						"TestRef": 0,
+					}),
+					Conditions: capi.Conditions{
+						{
+							Type:   infrav1.IndexSpaceExhaustedCondition,
+							Status: corev1.ConditionTrue,
+						},
+					},
+				},
+			},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "TestRef",
+				},
+			},
+			indexes: map[int]string{
+				0: "TestRef",
+			},
+			expectedIndexes: map[string]int{},
+			expectedMap:     map[int]string{},
+			expectFreed:     true,
+		}),
+		Entry("Deletion needed, not found", testCaseDeleteDatas{
+			template: &infrav1.Metal3DataTemplate{
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{
+						"TestRef": 0,
+					}),
+				},
+			},
+			dataClaim: &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "TestRef",
+				},
+			},
+			indexes: map[int]string{
+				0: "TestRef",
+			},
+			expectedIndexes: map[string]int{},
+			expectedMap:     map[int]string{},
+		}),
+		Entry("Deletion needed", testCaseDeleteDatas{
+			template: &infrav1.Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "abc",
+				},
+				Spec: infrav1.Metal3DataTemplateSpec{},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: infrav1.MigrateIndexes(map[string]int{
+						"TestRef": 0,
+					}),
 				},
 			},
 			dataClaim: &infrav1.Metal3DataClaim{
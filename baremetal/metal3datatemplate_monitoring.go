@@ -0,0 +1,153 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// StartMonitoring starts a goroutine checking the Metal3DataTemplate every
+// Spec.MonitoringInterval, until the context is cancelled or the template is
+// deleted. Each check reads the template again and compares its status with
+// ValidateStatusConsistency and LiveIndexCount, exports the results as
+// gauges and records a Warning Event per discrepancy, once while the
+// discrepancy lasts. It does nothing if MonitoringInterval is not set.
+// The controller starts it once per template and cancels the context when
+// the template is deleted or the interval changes.
+func (m *DataTemplateManager) StartMonitoring(ctx context.Context) error {
+	if m.DataTemplate.Spec.MonitoringInterval == nil {
+		return nil
+	}
+	interval := m.DataTemplate.Spec.MonitoringInterval.Duration
+	if interval <= 0 {
+		return errors.Errorf("Invalid monitoring interval %v", interval)
+	}
+	key := client.ObjectKey{
+		Name:      m.DataTemplate.Name,
+		Namespace: m.DataTemplate.Namespace,
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		// The discrepancies reported at the previous check
+		reported := map[string]bool{}
+		for {
+			select {
+			case <-ctx.Done():
+				m.Log.Info("Stopped the monitoring", "cluster", clusterNameFromContext(ctx))
+				return
+			case <-ticker.C:
+			}
+			dataTemplate := &capm3.Metal3DataTemplate{}
+			if err := m.client.Get(ctx, key, dataTemplate); err != nil {
+				if apierrors.IsNotFound(err) {
+					m.Log.Info("Stopped the monitoring of the deleted template",
+						"cluster", clusterNameFromContext(ctx),
+					)
+					return
+				}
+				m.Log.Info("Failed to get the Metal3DataTemplate to monitor",
+					"cluster", clusterNameFromContext(ctx), "error", err.Error(),
+				)
+				continue
+			}
+			found, err := m.monitorStatus(ctx, dataTemplate, reported)
+			if err != nil {
+				m.Log.Info("Failed to monitor the status",
+					"cluster", clusterNameFromContext(ctx), "error", err.Error(),
+				)
+				continue
+			}
+			reported = found
+		}
+	}()
+	return nil
+}
+
+// monitorStatus runs one check of StartMonitoring on the current version of
+// the Metal3DataTemplate, with a new manager so that the manager started by
+// the reconciliation is not modified concurrently. It returns the
+// discrepancies found, and only records an Event for those not in reported.
+func (m *DataTemplateManager) monitorStatus(ctx context.Context,
+	dataTemplate *capm3.Metal3DataTemplate, reported map[string]bool,
+) (map[string]bool, error) {
+	monitor, err := NewDataTemplateManagerWithOptions(m.client, dataTemplate,
+		m.Log, WithPageSize(m.pageSize), WithEventRecorder(m.recorder),
+	)
+	if err != nil {
+		return nil, err
+	}
+	monitor.OwnerKindFilter = m.OwnerKindFilter
+
+	found := map[string]bool{}
+	report := func(reason, message string) {
+		key := reason + ": " + message
+		found[key] = true
+		if !reported[key] {
+			monitor.recordEvent(corev1.EventTypeWarning, reason, message)
+		}
+	}
+
+	inconsistencies, err := monitor.ValidateStatusConsistency(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statusInconsistenciesGauge.WithLabelValues(dataTemplate.Namespace,
+		dataTemplate.Name,
+	).Set(float64(len(inconsistencies)))
+	for _, inconsistency := range inconsistencies {
+		report(StatusInconsistentEventReason,
+			fmt.Sprintf("%s: index %d of %s", inconsistency.Reason,
+				inconsistency.Index, inconsistency.ClaimName,
+			),
+		)
+	}
+
+	indexes, err := statusIndexes(ctx, m.client, dataTemplate)
+	if err != nil {
+		return nil, err
+	}
+	allocatedIndexes := make(map[int]bool, len(indexes))
+	for _, entry := range indexes {
+		allocatedIndexes[entry.Index] = true
+	}
+	liveCount, err := monitor.LiveIndexCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	drift := liveCount - len(allocatedIndexes)
+	liveIndexCountDriftGauge.WithLabelValues(dataTemplate.Namespace,
+		dataTemplate.Name,
+	).Set(float64(drift))
+	if drift != 0 {
+		report(LiveIndexCountMismatchEventReason,
+			fmt.Sprintf("%d Metal3Data objects exist for %d allocated indexes",
+				liveCount, len(allocatedIndexes),
+			),
+		)
+	}
+	return found, nil
+}
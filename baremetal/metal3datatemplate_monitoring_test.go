@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/metal3-io/cluster-api-provider-metal3/baremetal/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Metal3DataTemplate monitoring", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	It("Monitors the status in the background", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0},
+					"machine-1": {Index: 1},
+				},
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 1)
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			&datas[0],
+		)
+
+		// Nothing is started without a MonitoringInterval
+		recorder := record.NewFakeRecorder(10)
+		templateMgr, err := NewDataTemplateManagerWithOptions(c, template,
+			klogr.New(), WithEventRecorder(recorder),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(templateMgr.StartMonitoring(context.TODO())).To(Succeed())
+
+		template.Spec.MonitoringInterval = &metav1.Duration{Duration: 10 * time.Millisecond}
+		ctx, cancel := context.WithCancel(context.TODO())
+		defer cancel()
+		Expect(templateMgr.StartMonitoring(ctx)).To(Succeed())
+
+		// machine-1 has no Metal3Data nor Metal3DataClaim
+		Eventually(func() float64 {
+			return promtestutil.ToFloat64(
+				statusInconsistenciesGauge.WithLabelValues("myns", "abc"),
+			)
+		}).Should(Equal(float64(1)))
+		Eventually(func() float64 {
+			return promtestutil.ToFloat64(
+				liveIndexCountDriftGauge.WithLabelValues("myns", "abc"),
+			)
+		}).Should(Equal(float64(-1)))
+		Eventually(recorder.Events).Should(Receive(HavePrefix(
+			corev1.EventTypeWarning + " " + StatusInconsistentEventReason,
+		)))
+		Eventually(recorder.Events).Should(Receive(HavePrefix(
+			corev1.EventTypeWarning + " " + LiveIndexCountMismatchEventReason,
+		)))
+
+		// The discrepancies are only recorded once while they last
+		Consistently(recorder.Events, 100*time.Millisecond).ShouldNot(Receive())
+
+		// The monitoring reads the fixed status at the next check
+		liveTemplate := &infrav1.Metal3DataTemplate{}
+		key := client.ObjectKey{Name: "abc", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, liveTemplate)).To(Succeed())
+		delete(liveTemplate.Status.Indexes, "machine-1")
+		Expect(c.Update(context.TODO(), liveTemplate)).To(Succeed())
+		Eventually(func() float64 {
+			return promtestutil.ToFloat64(
+				statusInconsistenciesGauge.WithLabelValues("myns", "abc"),
+			)
+		}).Should(Equal(float64(0)))
+		Eventually(func() float64 {
+			return promtestutil.ToFloat64(
+				liveIndexCountDriftGauge.WithLabelValues("myns", "abc"),
+			)
+		}).Should(Equal(float64(0)))
+	})
+	type testCaseCheckDataQuota struct {
+		quotas      []*corev1.ResourceQuota
+		expectError bool
+	}
+})
@@ -0,0 +1,104 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PreAllocationRequest is the payload sent to the PreAllocationHook of a
+// Metal3DataTemplate before a Metal3Data is created
+type PreAllocationRequest struct {
+	MachineName string `json:"machineName"`
+	Index       int    `json:"index"`
+	DataName    string `json:"dataName"`
+	ClusterName string `json:"clusterName"`
+}
+
+// preAllocationHookClient is the HTTP client used to send the allocations to
+// the PreAllocationHooks. The timeout is set per request from the hook spec,
+// through the context of the request.
+var preAllocationHookClient = newWebhookClient(0)
+
+// defaultPreAllocationHookTimeout is the timeout of the requests to a
+// PreAllocationHook without TimeoutSeconds
+const defaultPreAllocationHookTimeout = 10 * time.Second
+
+// HookRejectedError represents that the PreAllocationHook did not approve
+// the allocation of an index to a machine
+type HookRejectedError struct {
+	Machine string
+	Reason  string
+}
+
+// Error implements the error interface
+func (e *HookRejectedError) Error() string {
+	return "Pre-allocation hook rejected the allocation of Metal3Machine " +
+		e.Machine + ": " + e.Reason
+}
+
+// checkPreAllocationHook sends the allocation to the PreAllocationHook. It
+// returns a HookRejectedError, with the response body as reason, if the hook
+// does not answer with the HTTP 200 status.
+func (m *DataTemplateManager) checkPreAllocationHook(ctx context.Context,
+	allocation PreAllocationRequest,
+) error {
+	preAllocationHook := m.DataTemplate.Spec.PreAllocationHook
+
+	body, err := json.Marshal(allocation)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the pre-allocation request")
+	}
+	timeout := defaultPreAllocationHookTimeout
+	if preAllocationHook.TimeoutSeconds > 0 {
+		timeout = time.Duration(preAllocationHook.TimeoutSeconds) * time.Second
+	}
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, preAllocationHook.URL,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create the pre-allocation request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := preAllocationHookClient.Do(req.WithContext(hookCtx))
+	if err != nil {
+		return errors.Wrap(err, "Failed to send the pre-allocation request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if len(bytes.TrimSpace(reason)) == 0 {
+			reason = []byte(resp.Status)
+		}
+		return &HookRejectedError{
+			Machine: allocation.MachineName,
+			Reason:  string(bytes.TrimSpace(reason)),
+		}
+	}
+	return nil
+}
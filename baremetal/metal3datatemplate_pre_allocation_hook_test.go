@@ -0,0 +1,119 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/klogr"
+)
+
+var _ = Describe("Metal3DataTemplate pre-allocation hook", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	DescribeTable("Test checkPreAllocationHook",
+		func(serverStatus int, responseBody string, expectedReason string) {
+			requests := make(chan PreAllocationRequest, 1)
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					request := PreAllocationRequest{}
+					Expect(json.NewDecoder(r.Body).Decode(&request)).To(Succeed())
+					requests <- request
+					w.WriteHeader(serverStatus)
+					_, _ = w.Write([]byte(responseBody))
+				},
+			))
+			defer server.Close()
+
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					PreAllocationHook: &infrav1.PreAllocationHookSpec{
+						URL:            server.URL,
+						TimeoutSeconds: 5,
+					},
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(nil, template, klogr.New())
+			Expect(err).NotTo(HaveOccurred())
+
+			allocation := PreAllocationRequest{
+				MachineName: "machine1",
+				Index:       3,
+				DataName:    "abc-3",
+				ClusterName: "cluster1",
+			}
+			err = templateMgr.checkPreAllocationHook(context.TODO(), allocation)
+			Expect(requests).To(Receive(Equal(allocation)))
+			if expectedReason == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(Equal(&HookRejectedError{
+					Machine: "machine1",
+					Reason:  expectedReason,
+				}))
+			}
+		},
+		Entry("Approved", http.StatusOK, "", ""),
+		Entry("Rejected", http.StatusForbidden, "outside of the maintenance window\n",
+			"outside of the maintenance window",
+		),
+		Entry("Rejected without reason", http.StatusAccepted, "", "202 Accepted"),
+	)
+
+	It("Refuses a loopback pre-allocation hook", func() {
+		requests := make(chan struct{}, 1)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				requests <- struct{}{}
+			},
+		))
+		defer server.Close()
+		allowLoopbackWebhooks = false
+		defer func() { allowLoopbackWebhooks = true }()
+
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				PreAllocationHook: &infrav1.PreAllocationHookSpec{
+					URL: server.URL,
+				},
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(nil, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		err = templateMgr.checkPreAllocationHook(context.TODO(),
+			PreAllocationRequest{MachineName: "machine1", Index: 3},
+		)
+		Expect(err).To(HaveOccurred())
+		Expect(err).NotTo(BeAssignableToTypeOf(&HookRejectedError{}))
+		Expect(requests).NotTo(Receive())
+	})
+})
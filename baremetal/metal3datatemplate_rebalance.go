@@ -0,0 +1,229 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Rebalance moves the given Metal3Machines from this template to the target
+// template, in the same namespace, and returns the moves made as
+// human-readable strings. For each Metal3Machine, it points its DataTemplate
+// to the target and clears its rendered data, deletes its Metal3DataClaim,
+// releases its index like CancelProvisioning, then creates a new
+// Metal3DataClaim and allocates an index from the target. A Metal3DataClaim
+// has the name of its Metal3Machine, so the index of this template is
+// released before the new one is allocated. It stops at the first error, the
+// moves made until then are returned.
+// It is meant to be run offline, while the Metal3Machine controller is
+// paused, since that controller recreates the cleared Metal3DataClaim
+// concurrently. A Metal3DataClaim recreated for the target template is then
+// used as is. The hosts already provisioned keep the data they were
+// provisioned with, they are not rendered again.
+func (m *DataTemplateManager) Rebalance(ctx context.Context,
+	targetTemplate *capm3.Metal3DataTemplate, machineNames []string,
+) ([]string, error) {
+	if targetTemplate.Namespace != m.DataTemplate.Namespace {
+		return nil, errors.New("Cannot rebalance to a Metal3DataTemplate in another namespace")
+	}
+	if targetTemplate.Name == m.DataTemplate.Name {
+		return nil, errors.New("Cannot rebalance to the same Metal3DataTemplate")
+	}
+	targetMgr, err := NewDataTemplateManager(m.client, targetTemplate, m.Log)
+	if err != nil {
+		return nil, err
+	}
+	targetMgr.OwnerKindFilter = m.OwnerKindFilter
+
+	moves := []string{}
+	for _, machineName := range machineNames {
+		indexes, err := statusIndexes(ctx, m.client, m.DataTemplate)
+		if err != nil {
+			return moves, err
+		}
+		claimName := claimNameForMachine(indexes, machineName)
+		if claimName == "" {
+			return moves, &DataNotFoundError{Machine: machineName}
+		}
+		index := indexes[claimName].Index
+
+		m3m := &capm3.Metal3Machine{}
+		key := client.ObjectKey{
+			Name:      machineName,
+			Namespace: m.DataTemplate.Namespace,
+		}
+		if err := m.client.Get(ctx, key, m3m); err != nil {
+			return moves, errors.Wrap(err, "Failed to get Metal3Machine")
+		}
+		helper, err := patch.NewHelper(m3m, m.client)
+		if err != nil {
+			return moves, errors.Wrap(err, "failed to init patch helper")
+		}
+		m3m.Spec.DataTemplate = &corev1.ObjectReference{
+			Name:      targetTemplate.Name,
+			Namespace: targetTemplate.Namespace,
+		}
+		m3m.Status.RenderedData = nil
+		m3m.Status.MetaData = nil
+		m3m.Status.NetworkData = nil
+		if err := helper.Patch(ctx, m3m); err != nil {
+			return moves, errors.Wrap(err, "Failed to patch Metal3Machine")
+		}
+		moves = append(moves, fmt.Sprintf(
+			"Update Metal3Machine %s to reference Metal3DataTemplate %s",
+			machineName, targetTemplate.Name,
+		))
+
+		machineKind, err := m.claimMachineKind(ctx, claimName, machineName)
+		if err != nil {
+			return moves, err
+		}
+		if err := m.removeDataClaim(ctx, claimName); err != nil {
+			return moves, err
+		}
+		moves = append(moves, fmt.Sprintf("Delete Metal3DataClaim %s", claimName))
+
+		if err := m.CancelProvisioning(ctx, machineName); err != nil {
+			return moves, err
+		}
+		moves = append(moves, fmt.Sprintf(
+			"Free index %d of Metal3DataTemplate %s", index, m.DataTemplate.Name,
+		))
+
+		dataClaim := &capm3.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m3m.Name,
+				Namespace: m3m.Namespace,
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: capm3.GroupVersion.String(),
+						Kind:       machineKind,
+						Name:       m3m.Name,
+						UID:        m3m.UID,
+						Controller: pointer.BoolPtr(true),
+					},
+				},
+				Labels: m3m.Labels,
+			},
+			Spec: capm3.Metal3DataClaimSpec{
+				Template: *m3m.Spec.DataTemplate,
+			},
+		}
+		if err := m.createRebalancedClaim(ctx, dataClaim); err != nil {
+			return moves, err
+		}
+		if _, _, err := targetMgr.UpdateDatas(ctx, nil); err != nil {
+			return moves, err
+		}
+		m3Data, err := targetMgr.GetDataForMachine(ctx, machineName)
+		if err != nil {
+			return moves, err
+		}
+		moves = append(moves, fmt.Sprintf(
+			"Allocate index %d of Metal3DataTemplate %s to Metal3Machine %s in Metal3Data %s",
+			m3Data.Spec.Index, targetTemplate.Name, machineName, m3Data.Name,
+		))
+	}
+	return moves, nil
+}
+
+// createRebalancedClaim creates the Metal3DataClaim of a rebalanced machine.
+// If the Metal3Machine controller already recreated it for the target
+// template, it is kept.
+func (m *DataTemplateManager) createRebalancedClaim(ctx context.Context,
+	dataClaim *capm3.Metal3DataClaim,
+) error {
+	err := m.client.Create(ctx, dataClaim)
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return errors.Wrap(err, "Failed to create Metal3DataClaim")
+	}
+	existingClaim := &capm3.Metal3DataClaim{}
+	key := client.ObjectKey{
+		Name:      dataClaim.Name,
+		Namespace: dataClaim.Namespace,
+	}
+	if err := m.client.Get(ctx, key, existingClaim); err != nil {
+		return errors.Wrap(err, "Failed to get Metal3DataClaim")
+	}
+	if existingClaim.Spec.Template.Name != dataClaim.Spec.Template.Name ||
+		!existingClaim.DeletionTimestamp.IsZero() {
+		return errors.Errorf("Metal3DataClaim %s already exists for Metal3DataTemplate %s",
+			existingClaim.Name, existingClaim.Spec.Template.Name,
+		)
+	}
+	return nil
+}
+
+// claimMachineKind returns the kind of the machine owning the
+// Metal3DataClaim, Metal3Machine if the claim is gone
+func (m *DataTemplateManager) claimMachineKind(ctx context.Context,
+	claimName string, machineName string,
+) (string, error) {
+	dataClaim := &capm3.Metal3DataClaim{}
+	key := client.ObjectKey{
+		Name:      claimName,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := m.client.Get(ctx, key, dataClaim); err != nil && !apierrors.IsNotFound(err) {
+		return "", errors.Wrap(err, "Failed to get Metal3DataClaim")
+	}
+	return m.machineKind(dataClaim, machineName), nil
+}
+
+// removeDataClaim removes the finalizer of the Metal3DataClaim and deletes
+// it, so that a Metal3DataClaim with the same name can be created again
+func (m *DataTemplateManager) removeDataClaim(ctx context.Context,
+	claimName string,
+) error {
+	dataClaim := &capm3.Metal3DataClaim{}
+	key := client.ObjectKey{
+		Name:      claimName,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := m.client.Get(ctx, key, dataClaim); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrap(err, "Failed to get Metal3DataClaim")
+	}
+	helper, err := patch.NewHelper(dataClaim, m.client)
+	if err != nil {
+		return errors.Wrap(err, "failed to init patch helper")
+	}
+	dataClaim.Finalizers = Filter(dataClaim.Finalizers, capm3.DataClaimFinalizer)
+	if err := helper.Patch(ctx, dataClaim); err != nil {
+		return errors.Wrap(err, "Failed to patch Metal3DataClaim")
+	}
+	if err := m.client.Delete(ctx, dataClaim); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "Failed to delete Metal3DataClaim")
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/metal3-io/cluster-api-provider-metal3/baremetal/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// racingClaimClient creates each Metal3DataClaim before it is created, like
+// the Metal3Machine controller recreating it concurrently
+type racingClaimClient struct {
+	client.Client
+}
+
+func (c *racingClaimClient) Create(ctx context.Context, obj runtime.Object,
+	opts ...client.CreateOption,
+) error {
+	if dataClaim, ok := obj.(*infrav1.Metal3DataClaim); ok {
+		if err := c.Client.Create(ctx, dataClaim.DeepCopy()); err != nil {
+			return err
+		}
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+var _ = Describe("Metal3DataTemplate rebalance", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	It("Rebalances machines to another template", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0},
+				},
+			},
+		}
+		targetTemplate := &infrav1.Metal3DataTemplate{
+			ObjectMeta: metav1.ObjectMeta{Name: "bcd", Namespace: "myns"},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 1)
+		m3m := &infrav1.Metal3Machine{
+			ObjectMeta: metav1.ObjectMeta{Name: "machine-0", Namespace: "myns"},
+			Spec: infrav1.Metal3MachineSpec{
+				DataTemplate: &corev1.ObjectReference{Name: "abc", Namespace: "myns"},
+			},
+			Status: infrav1.Metal3MachineStatus{
+				RenderedData: &corev1.ObjectReference{Name: "abc-0", Namespace: "myns"},
+			},
+		}
+		dataClaim := &infrav1.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       "machine-0",
+				Namespace:  "myns",
+				Finalizers: []string{infrav1.DataClaimFinalizer},
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: infrav1.GroupVersion.String(),
+						Kind:       "Metal3Machine",
+						Name:       "machine-0",
+					},
+				},
+			},
+			Spec: infrav1.Metal3DataClaimSpec{
+				Template: corev1.ObjectReference{Name: "abc"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), template.DeepCopy(),
+			targetTemplate.DeepCopy(), &datas[0], m3m, dataClaim,
+		)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = templateMgr.Rebalance(context.TODO(), template, []string{"machine-0"})
+		Expect(err).To(HaveOccurred())
+		moves, err := templateMgr.Rebalance(context.TODO(), targetTemplate,
+			[]string{"machine-1"},
+		)
+		Expect(err).To(BeAssignableToTypeOf(&DataNotFoundError{}))
+		Expect(moves).To(BeEmpty())
+
+		moves, err = templateMgr.Rebalance(context.TODO(), targetTemplate,
+			[]string{"machine-0"},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(moves).To(Equal([]string{
+			"Update Metal3Machine machine-0 to reference Metal3DataTemplate bcd",
+			"Delete Metal3DataClaim machine-0",
+			"Free index 0 of Metal3DataTemplate abc",
+			"Allocate index 0 of Metal3DataTemplate bcd to Metal3Machine machine-0 in Metal3Data bcd-0",
+		}))
+		Expect(templateMgr.DataTemplate.Status.Indexes).To(BeEmpty())
+
+		savedM3m := &infrav1.Metal3Machine{}
+		key := client.ObjectKey{Name: "machine-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, savedM3m)).To(Succeed())
+		Expect(savedM3m.Spec.DataTemplate.Name).To(Equal("bcd"))
+		Expect(savedM3m.Status.RenderedData).To(BeNil())
+		savedClaim := &infrav1.Metal3DataClaim{}
+		Expect(c.Get(context.TODO(), key, savedClaim)).To(Succeed())
+		Expect(savedClaim.Spec.Template.Name).To(Equal("bcd"))
+		m3Data := &infrav1.Metal3Data{}
+		key = client.ObjectKey{Name: "abc-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, m3Data)).NotTo(Succeed())
+		key = client.ObjectKey{Name: "bcd-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, m3Data)).To(Succeed())
+	})
+
+	It("Rebalances a machine whose claim was recreated concurrently", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0},
+				},
+			},
+		}
+		targetTemplate := &infrav1.Metal3DataTemplate{
+			ObjectMeta: metav1.ObjectMeta{Name: "bcd", Namespace: "myns"},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 1)
+		m3m := &infrav1.Metal3Machine{
+			ObjectMeta: metav1.ObjectMeta{Name: "machine-0", Namespace: "myns"},
+			Spec: infrav1.Metal3MachineSpec{
+				DataTemplate: &corev1.ObjectReference{Name: "abc", Namespace: "myns"},
+			},
+		}
+		c := &racingClaimClient{
+			Client: fakeclient.NewFakeClientWithScheme(setupSchemeMm(),
+				template.DeepCopy(), targetTemplate.DeepCopy(), &datas[0], m3m,
+			),
+		}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		moves, err := templateMgr.Rebalance(context.TODO(), targetTemplate,
+			[]string{"machine-0"},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(moves).To(ContainElement(
+			"Allocate index 0 of Metal3DataTemplate bcd to Metal3Machine machine-0 in Metal3Data bcd-0",
+		))
+		savedClaim := &infrav1.Metal3DataClaim{}
+		key := client.ObjectKey{Name: "machine-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, savedClaim)).To(Succeed())
+		Expect(savedClaim.Spec.Template.Name).To(Equal("bcd"))
+
+		// A claim recreated for another template is not taken over
+		Expect(templateMgr.createRebalancedClaim(context.TODO(),
+			&infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "machine-1", Namespace: "myns"},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: "bcd"},
+				},
+			},
+		)).To(Succeed())
+		Expect(templateMgr.createRebalancedClaim(context.TODO(),
+			&infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "machine-1", Namespace: "myns"},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: "cde"},
+				},
+			},
+		)).NotTo(Succeed())
+	})
+})
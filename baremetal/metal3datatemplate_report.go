@@ -0,0 +1,591 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/go-logr/logr"
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// PrintStatus writes the status of the Metal3DataTemplate to w. The format
+// is either "json", "yaml" or "table". The table lists the allocated indexes
+// and whether the Metal3Data objects exist.
+func PrintStatus(ctx context.Context, cl client.Client,
+	dataTemplate *capm3.Metal3DataTemplate, format string, w io.Writer,
+) error {
+	indexes, err := statusIndexes(ctx, cl, dataTemplate)
+	if err != nil {
+		return err
+	}
+	status := dataTemplate.Status.DeepCopy()
+	status.Indexes = indexes
+
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the status")
+		}
+		_, err = fmt.Fprintln(w, string(out))
+		return err
+	case "yaml":
+		out, err := yaml.Marshal(status)
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the status")
+		}
+		_, err = w.Write(out)
+		return err
+	case "table":
+		return printStatusTable(ctx, cl, dataTemplate, indexes, w)
+	default:
+		return errors.Errorf("Unknown output format %q", format)
+	}
+}
+
+// printStatusTable writes one line per allocated index, sorted by index
+func printStatusTable(ctx context.Context, cl client.Client,
+	dataTemplate *capm3.Metal3DataTemplate, indexes map[string]capm3.IndexEntry,
+	w io.Writer,
+) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tMACHINE\tDATANAME\tDATAEXISTS")
+	err := forEachIndex(dataTemplate, indexes, func(index int, machineName, dataName string) error {
+		dataExists := true
+		key := client.ObjectKey{
+			Name:      dataName,
+			Namespace: dataTemplate.Namespace,
+		}
+		if err := cl.Get(ctx, key, &capm3.Metal3Data{}); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return errors.Wrap(err, "Failed to get Metal3Data")
+			}
+			dataExists = false
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\n", index, machineName, dataName,
+			dataExists,
+		)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// DataTemplateSummary contains the key fields of a Metal3DataTemplate, as
+// listed by ListDataTemplates
+type DataTemplateSummary struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Allocated int    `json:"allocated"`
+	// Capacity is the number of indexes between MinIndex and MaxIndex with
+	// the IndexStep of the template, 0 if MaxIndex is not set
+	Capacity        int    `json:"capacity"`
+	HealthScore     int    `json:"healthScore"`
+	OwnerReferences int    `json:"ownerReferences"`
+	ErrorMessage    string `json:"errorMessage,omitempty"`
+}
+
+// ListDataTemplates returns the summaries of the Metal3DataTemplates of the
+// cluster, in all namespaces, sorted by namespace and name. The HealthScore
+// and the ErrorMessage, the errors found, come from RunValidations.
+func ListDataTemplates(ctx context.Context, cl client.Client,
+	clusterName string, log logr.Logger,
+) ([]DataTemplateSummary, error) {
+	dataTemplates := capm3.Metal3DataTemplateList{}
+	if err := cl.List(ctx, &dataTemplates); err != nil {
+		return nil, errors.Wrap(err, "Failed to list Metal3DataTemplates")
+	}
+	sort.Slice(dataTemplates.Items, func(i, j int) bool {
+		if dataTemplates.Items[i].Namespace != dataTemplates.Items[j].Namespace {
+			return dataTemplates.Items[i].Namespace < dataTemplates.Items[j].Namespace
+		}
+		return dataTemplates.Items[i].Name < dataTemplates.Items[j].Name
+	})
+
+	summaries := []DataTemplateSummary{}
+	for i := range dataTemplates.Items {
+		dataTemplate := &dataTemplates.Items[i]
+		if dataTemplate.Spec.ClusterName != clusterName {
+			continue
+		}
+		templateMgr, err := NewDataTemplateManager(cl, dataTemplate, log)
+		if err != nil {
+			return nil, err
+		}
+		indexes, err := statusIndexes(ctx, cl, dataTemplate)
+		if err != nil {
+			return nil, err
+		}
+		report, err := templateMgr.RunValidations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		errorMessages := []string{}
+		for _, item := range report.Errors {
+			errorMessages = append(errorMessages, item.Message)
+		}
+
+		summary := DataTemplateSummary{
+			Name:            dataTemplate.Name,
+			Namespace:       dataTemplate.Namespace,
+			Allocated:       len(indexes),
+			HealthScore:     report.HealthScore,
+			OwnerReferences: len(dataTemplate.OwnerReferences),
+			ErrorMessage:    strings.Join(errorMessages, "; "),
+		}
+		if dataTemplate.Spec.MaxIndex != 0 {
+			summary.Capacity = (dataTemplate.Spec.MaxIndex-dataTemplate.Spec.MinIndex)/
+				templateMgr.indexStep() + 1
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// PrintDataTemplates writes the summaries of the Metal3DataTemplates of the
+// cluster to w. The format is either "json", "yaml" or "table". If wide is
+// set, the table also contains the number of owner references and the error
+// message.
+func PrintDataTemplates(ctx context.Context, cl client.Client,
+	clusterName string, log logr.Logger, format string, wide bool, w io.Writer,
+) error {
+	summaries, err := ListDataTemplates(ctx, cl, clusterName, log)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the Metal3DataTemplates")
+		}
+		_, err = fmt.Fprintln(w, string(out))
+		return err
+	case "yaml":
+		out, err := yaml.Marshal(summaries)
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the Metal3DataTemplates")
+		}
+		_, err = w.Write(out)
+		return err
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		header := "NAMESPACE\tNAME\tALLOCATED\tCAPACITY\tHEALTH"
+		if wide {
+			header += "\tOWNERREFERENCES\tERROR"
+		}
+		fmt.Fprintln(tw, header)
+		for _, summary := range summaries {
+			capacity := "-"
+			if summary.Capacity != 0 {
+				capacity = strconv.Itoa(summary.Capacity)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d", summary.Namespace,
+				summary.Name, summary.Allocated, capacity, summary.HealthScore,
+			)
+			if wide {
+				fmt.Fprintf(tw, "\t%d\t%s", summary.OwnerReferences,
+					summary.ErrorMessage,
+				)
+			}
+			fmt.Fprintln(tw)
+		}
+		return tw.Flush()
+	default:
+		return errors.Errorf("Unknown output format %q", format)
+	}
+}
+
+// csvExportEntry is the data the ipTemplate of ExportCSV is rendered with
+type csvExportEntry struct {
+	Index       int
+	MachineName string
+}
+
+// ExportCSV writes the allocations of the Metal3DataTemplate to w as CSV,
+// sorted by index, with a machineName,index,ip,dataName header. The ip column
+// is rendered from ipTemplate, a Go template receiving the .Index and
+// .MachineName of the allocation, for example "192.168.0.{{.Index}}".
+func ExportCSV(ctx context.Context, cl client.Client,
+	dataTemplate *capm3.Metal3DataTemplate, w io.Writer, ipTemplate string,
+) error {
+	tmpl, err := template.New("ip").Option("missingkey=error").Parse(ipTemplate)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse the IP template")
+	}
+	indexes, err := statusIndexes(ctx, cl, dataTemplate)
+	if err != nil {
+		return err
+	}
+
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write([]string{"machineName", "index", "ip", "dataName"}); err != nil {
+		return errors.Wrap(err, "Failed to write the CSV header")
+	}
+	err = forEachIndex(dataTemplate, indexes, func(index int, machineName, dataName string) error {
+		ip := bytes.Buffer{}
+		if err := tmpl.Execute(&ip, csvExportEntry{
+			Index:       index,
+			MachineName: machineName,
+		}); err != nil {
+			return errors.Wrapf(err, "Failed to render the IP of index %d", index)
+		}
+		if err := csvWriter.Write([]string{
+			machineName,
+			strconv.Itoa(index),
+			ip.String(),
+			dataName,
+		}); err != nil {
+			return errors.Wrap(err, "Failed to write the CSV")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+const (
+	// TerraformResourceType is the type of the resources written by
+	// ExportTerraformState
+	TerraformResourceType = "metal3_data_allocation"
+
+	// terraformStateVersion is the version of the Terraform state format, and
+	// terraformVersion the oldest Terraform version reading it
+	terraformStateVersion = 4
+	terraformVersion      = "0.14.0"
+
+	// terraformProvider is the provider of the TerraformResourceType resources
+	terraformProvider = "provider[\"registry.terraform.io/metal3-io/metal3\"]"
+)
+
+// terraformState is the subset of the Terraform state format written by
+// ExportTerraformState
+type terraformState struct {
+	Version          int                 `json:"version"`
+	TerraformVersion string              `json:"terraform_version"`
+	Serial           int                 `json:"serial"`
+	Lineage          string              `json:"lineage"`
+	Outputs          map[string]string   `json:"outputs"`
+	Resources        []terraformResource `json:"resources"`
+}
+
+type terraformResource struct {
+	Mode      string              `json:"mode"`
+	Type      string              `json:"type"`
+	Name      string              `json:"name"`
+	Provider  string              `json:"provider"`
+	Instances []terraformInstance `json:"instances"`
+}
+
+type terraformInstance struct {
+	SchemaVersion int                      `json:"schema_version"`
+	Attributes    terraformAllocationAttrs `json:"attributes"`
+}
+
+// terraformAllocationAttrs are the attributes of a TerraformResourceType
+// resource. The id is <namespace>/<Metal3Data name>.
+type terraformAllocationAttrs struct {
+	ID          string `json:"id"`
+	Index       int    `json:"index"`
+	MachineName string `json:"machine_name"`
+	DataName    string `json:"data_name"`
+	ClusterName string `json:"cluster_name"`
+}
+
+// ExportTerraformState writes the allocations of the Metal3DataTemplate to w
+// as a Terraform state, with one TerraformResourceType resource per
+// Metal3Machine, sorted by index, named after the Metal3Machine. The lineage
+// is the UID of the Metal3DataTemplate.
+func ExportTerraformState(ctx context.Context, cl client.Client,
+	dataTemplate *capm3.Metal3DataTemplate, w io.Writer,
+) error {
+	indexes, err := statusIndexes(ctx, cl, dataTemplate)
+	if err != nil {
+		return err
+	}
+
+	state := terraformState{
+		Version:          terraformStateVersion,
+		TerraformVersion: terraformVersion,
+		Serial:           1,
+		Lineage:          string(dataTemplate.UID),
+		Outputs:          map[string]string{},
+		Resources:        []terraformResource{},
+	}
+	err = forEachIndex(dataTemplate, indexes, func(index int, machineName, dataName string) error {
+		state.Resources = append(state.Resources, terraformResource{
+			Mode:     "managed",
+			Type:     TerraformResourceType,
+			Name:     terraformResourceName(machineName),
+			Provider: terraformProvider,
+			Instances: []terraformInstance{
+				{
+					Attributes: terraformAllocationAttrs{
+						ID:          dataTemplate.Namespace + "/" + dataName,
+						Index:       index,
+						MachineName: machineName,
+						DataName:    dataName,
+						ClusterName: dataTemplate.Spec.ClusterName,
+					},
+				},
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return errors.Wrap(encoder.Encode(state), "Failed to write the Terraform state")
+}
+
+// terraformResourceName returns a valid Terraform resource name for a
+// Kubernetes object name. The dots are replaced by underscores, which are
+// not allowed in object names, and a name starting with a digit is prefixed
+// with an underscore.
+func terraformResourceName(name string) string {
+	name = strings.ReplaceAll(name, ".", "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// AllocationPreview is the allocation DryRun proposes for a Metal3Machine
+type AllocationPreview struct {
+	MachineName string `json:"machineName"`
+	Index       int    `json:"index"`
+	DataName    string `json:"dataName"`
+	// Existing is true if the index is already allocated to the machine
+	Existing bool `json:"existing"`
+	// Error is the reason why no index would be allocated, if any
+	Error string `json:"error,omitempty"`
+}
+
+// DryRun returns the allocations the next UpdateDatas would make for the
+// given Metal3Machines of the Metal3DataTemplate, in order, for example to
+// review them before creating their Metal3DataClaims. A machine that already
+// has an index keeps it. The skip-allocation annotation, the
+// ownerReferenceFilter, the allocationCondition, the hostSelector and the
+// static assignments are checked, but not the quotas nor the
+// PreAllocationHook. It only reads the objects and does not create, update or
+// delete any. The options configure the DataTemplateManager checking the
+// Metal3Machines, like the one of the controller.
+func DryRun(ctx context.Context, cl client.Client,
+	dataTemplate *capm3.Metal3DataTemplate, log logr.Logger,
+	machineNames []string, options ...DataTemplateManagerOption,
+) ([]AllocationPreview, error) {
+	m, err := NewDataTemplateManagerWithOptions(cl, dataTemplate, log, options...)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := statusIndexes(ctx, cl, dataTemplate)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make(map[int]string)
+	for claimName, entry := range entries {
+		indexes[entry.Index] = claimName
+	}
+
+	previews := make([]AllocationPreview, 0, len(machineNames))
+	for _, machineName := range machineNames {
+		preview := AllocationPreview{MachineName: machineName}
+		if claimName := claimNameForMachine(entries, machineName); claimName != "" {
+			preview.Index = entries[claimName].Index
+			preview.DataName = m.dataName(entries[claimName])
+			preview.Existing = true
+			previews = append(previews, preview)
+			continue
+		}
+
+		reason, err := m.previewRejection(ctx, machineName)
+		if err != nil {
+			return nil, err
+		}
+		index := 0
+		if reason == "" {
+			if staticIndex, ok := dataTemplate.Spec.StaticAssignments[machineName]; ok {
+				if _, taken := indexes[staticIndex]; taken {
+					reason = "Static index " + strconv.Itoa(staticIndex) + " is already allocated"
+				}
+				index = staticIndex
+			} else if index, err = m.getFreeIndex(indexes); err != nil {
+				reason = err.Error()
+			}
+		}
+		if reason != "" {
+			preview.Error = reason
+			previews = append(previews, preview)
+			continue
+		}
+		indexes[index] = machineName
+		preview.Index = index
+		preview.DataName = dataTemplate.Name + "-" + strconv.Itoa(index)
+		previews = append(previews, preview)
+	}
+	return previews, nil
+}
+
+// WriteAllocationPreviews writes the allocations proposed by DryRun to w as a
+// table
+func WriteAllocationPreviews(w io.Writer, previews []AllocationPreview) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MACHINE\tINDEX\tDATANAME\tRESULT")
+	for _, preview := range previews {
+		switch {
+		case preview.Error != "":
+			fmt.Fprintf(tw, "%s\t\t\t%s\n", preview.MachineName, preview.Error)
+		case preview.Existing:
+			fmt.Fprintf(tw, "%s\t%d\t%s\tExisting\n", preview.MachineName,
+				preview.Index, preview.DataName,
+			)
+		default:
+			fmt.Fprintf(tw, "%s\t%d\t%s\tAllocated\n", preview.MachineName,
+				preview.Index, preview.DataName,
+			)
+		}
+	}
+	return tw.Flush()
+}
+
+// ProvisioningReportResult aggregates the provisioning of the Metal3Machines
+// of the Metal3Data of a Metal3DataTemplate
+type ProvisioningReportResult struct {
+	Namespace string `json:"namespace"`
+	Template  string `json:"template"`
+	// Machines is the number of Metal3Data with an existing Metal3Machine
+	Machines    int `json:"machines"`
+	Provisioned int `json:"provisioned"`
+	Failed      int `json:"failed"`
+	// SuccessRate is the ratio of provisioned Metal3Machines, from 0 to 1
+	SuccessRate float64 `json:"successRate"`
+	// AverageTimeToReady is the average time from the creation of the
+	// Metal3Data to the last update of the status of the ready Metal3Machines
+	AverageTimeToReady metav1.Duration `json:"averageTimeToReady"`
+}
+
+// WriteCSV writes the report to w as CSV, with a header line
+func (r *ProvisioningReportResult) WriteCSV(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.WriteAll([][]string{
+		{"namespace", "template", "machines", "provisioned", "failed",
+			"successRate", "averageTimeToReady",
+		},
+		{r.Namespace, r.Template, strconv.Itoa(r.Machines),
+			strconv.Itoa(r.Provisioned), strconv.Itoa(r.Failed),
+			strconv.FormatFloat(r.SuccessRate, 'f', 2, 64),
+			r.AverageTimeToReady.Duration.String(),
+		},
+	}); err != nil {
+		return errors.Wrap(err, "Failed to write the CSV")
+	}
+	return nil
+}
+
+// ProvisioningReport computes the provisioning success rate, the failure count
+// and the average time to ready of the Metal3Machines of the Metal3Data of
+// the Metal3DataTemplate. The Metal3Machines have no ready timestamp, so the
+// last update of their status is used instead. The options configure the
+// DataTemplateManager listing the Metal3Data, like the one of the controller.
+func ProvisioningReport(ctx context.Context, cl client.Client,
+	dataTemplate *capm3.Metal3DataTemplate, log logr.Logger,
+	options ...DataTemplateManagerOption,
+) (*ProvisioningReportResult, error) {
+	m, err := NewDataTemplateManagerWithOptions(cl, dataTemplate, log, options...)
+	if err != nil {
+		return nil, err
+	}
+	listOpts := []client.ListOption{}
+	if dataTemplate.Spec.ClusterName != "" {
+		listOpts = append(listOpts, client.MatchingLabels{
+			capi.ClusterLabelName: dataTemplate.Spec.ClusterName,
+		})
+	}
+	dataObjects := capm3.Metal3DataList{}
+	if err := m.list(ctx, &dataObjects, listOpts...); err != nil {
+		return nil, err
+	}
+
+	report := &ProvisioningReportResult{
+		Namespace: dataTemplate.Namespace,
+		Template:  dataTemplate.Name,
+	}
+	var timeToReady time.Duration
+	for i := range dataObjects.Items {
+		m3Data := &dataObjects.Items[i]
+		if !m.isDataFromTemplate(m3Data) {
+			continue
+		}
+		m3m := &capm3.Metal3Machine{}
+		key := client.ObjectKey{
+			Name:      m3Data.Spec.Claim.Name,
+			Namespace: dataTemplate.Namespace,
+		}
+		if err := cl.Get(ctx, key, m3m); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, errors.Wrap(err, "Failed to get Metal3Machine")
+		}
+		report.Machines++
+		switch {
+		case m3m.Status.Ready:
+			report.Provisioned++
+			if m3m.Status.LastUpdated != nil &&
+				m3m.Status.LastUpdated.After(m3Data.CreationTimestamp.Time) {
+				timeToReady += m3m.Status.LastUpdated.Sub(m3Data.CreationTimestamp.Time)
+			}
+		case m3m.Status.FailureReason != nil || m3m.Status.FailureMessage != nil ||
+			m3Data.Status.ErrorMessage != nil:
+			report.Failed++
+		}
+	}
+	if report.Machines != 0 {
+		report.SuccessRate = float64(report.Provisioned) / float64(report.Machines)
+	}
+	if report.Provisioned != 0 {
+		report.AverageTimeToReady.Duration = timeToReady / time.Duration(report.Provisioned)
+	}
+	return report, nil
+}
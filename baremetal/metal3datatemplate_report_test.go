@@ -0,0 +1,417 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/metal3-io/cluster-api-provider-metal3/baremetal/testutil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/klogr"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Metal3DataTemplate report", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	type testCasePrintStatus struct {
+		format         string
+		expectError    bool
+		expectedOutput string
+	}
+
+	DescribeTable("Test PrintStatus",
+		func(tc testCasePrintStatus) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "abc",
+					Namespace: "myns",
+				},
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: map[string]infrav1.IndexEntry{
+						"claim-1": {
+							Index:       1,
+							MachineName: "machine-1",
+						},
+						"claim-0": {
+							Index: 0,
+						},
+					},
+				},
+			}
+			m3Data := &infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "abc-0",
+					Namespace: "myns",
+				},
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), m3Data)
+
+			out := &bytes.Buffer{}
+			err := PrintStatus(context.TODO(), c, template, tc.format, out)
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(out.String()).To(Equal(tc.expectedOutput))
+		},
+		Entry("Unknown format", testCasePrintStatus{
+			format:      "xml",
+			expectError: true,
+		}),
+		Entry("Table", testCasePrintStatus{
+			format: "table",
+			expectedOutput: "INDEX  MACHINE    DATANAME  DATAEXISTS\n" +
+				"0      claim-0    abc-0     true\n" +
+				"1      machine-1  abc-1     false\n",
+		}),
+		Entry("JSON", testCasePrintStatus{
+			format: "json",
+			expectedOutput: `{
+  "indexes": {
+    "claim-0": {
+      "index": 0
+    },
+    "claim-1": {
+      "index": 1,
+      "machineName": "machine-1"
+    }
+  }
+}
+`,
+		}),
+		Entry("YAML", testCasePrintStatus{
+			format: "yaml",
+			expectedOutput: `indexes:
+  claim-0:
+    index: 0
+  claim-1:
+    index: 1
+    machineName: machine-1
+`,
+		}),
+	)
+
+	type testCasePrintDataTemplates struct {
+		format         string
+		wide           bool
+		expectError    bool
+		expectedOutput string
+	}
+
+	DescribeTable("Test PrintDataTemplates",
+		func(tc testCasePrintDataTemplates) {
+			objects := []runtime.Object{
+				&infrav1.Metal3DataTemplate{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc",
+						Namespace: "myns",
+						OwnerReferences: []metav1.OwnerReference{
+							{Name: "machine-0"}, {Name: "machine-1"},
+						},
+					},
+					Spec: infrav1.Metal3DataTemplateSpec{
+						ClusterName: "foo",
+						MaxIndex:    9,
+					},
+					Status: infrav1.Metal3DataTemplateStatus{
+						Indexes: map[string]infrav1.IndexEntry{
+							"machine-0": {Index: 0},
+						},
+					},
+				},
+				&infrav1.Metal3DataTemplate{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "bcd",
+						Namespace: "myns",
+					},
+					Spec: infrav1.Metal3DataTemplateSpec{ClusterName: "bar"},
+				},
+				&infrav1.Metal3DataTemplate{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "abc",
+						Namespace: "anotherns",
+					},
+					Spec: infrav1.Metal3DataTemplateSpec{ClusterName: "foo"},
+				},
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+
+			out := &bytes.Buffer{}
+			err := PrintDataTemplates(context.TODO(), c, "foo", klogr.New(),
+				tc.format, tc.wide, out,
+			)
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(out.String()).To(Equal(tc.expectedOutput))
+		},
+		Entry("Unknown format", testCasePrintDataTemplates{
+			format:      "xml",
+			expectError: true,
+		}),
+		Entry("Table", testCasePrintDataTemplates{
+			format: "table",
+			expectedOutput: "NAMESPACE  NAME  ALLOCATED  CAPACITY  HEALTH\n" +
+				"anotherns  abc   0          -         100\n" +
+				"myns       abc   1          10        75\n",
+		}),
+		Entry("Wide table", testCasePrintDataTemplates{
+			format: "table",
+			wide:   true,
+			expectedOutput: "NAMESPACE  NAME  ALLOCATED  CAPACITY  HEALTH  OWNERREFERENCES  ERROR\n" +
+				"anotherns  abc   0          -         100     0                \n" +
+				"myns       abc   1          10        75      2                GhostEntry: index 0 of machine-0\n",
+		}),
+		Entry("JSON", testCasePrintDataTemplates{
+			format: "json",
+			expectedOutput: `[
+  {
+    "name": "abc",
+    "namespace": "anotherns",
+    "allocated": 0,
+    "capacity": 0,
+    "healthScore": 100,
+    "ownerReferences": 0
+  },
+  {
+    "name": "abc",
+    "namespace": "myns",
+    "allocated": 1,
+    "capacity": 10,
+    "healthScore": 75,
+    "ownerReferences": 2,
+    "errorMessage": "GhostEntry: index 0 of machine-0"
+  }
+]
+`,
+		}),
+	)
+
+	type testCaseExportCSV struct {
+		ipTemplate     string
+		expectError    bool
+		expectedOutput string
+	}
+
+	DescribeTable("Test ExportCSV",
+		func(tc testCaseExportCSV) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: templateMeta,
+				Status: infrav1.Metal3DataTemplateStatus{
+					Indexes: map[string]infrav1.IndexEntry{
+						"claim-10": {
+							Index:       10,
+							MachineName: "machine,10",
+						},
+						"claim-2": {
+							Index: 2,
+						},
+					},
+				},
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+
+			out := &bytes.Buffer{}
+			err := ExportCSV(context.TODO(), c, template, out, tc.ipTemplate)
+			if tc.expectError {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(out.String()).To(Equal(tc.expectedOutput))
+		},
+		Entry("IP from the index", testCaseExportCSV{
+			ipTemplate: "192.168.0.{{.Index}}",
+			expectedOutput: "machineName,index,ip,dataName\n" +
+				"claim-2,2,192.168.0.2,abc-2\n" +
+				"\"machine,10\",10,192.168.0.10,abc-10\n",
+		}),
+		Entry("Invalid template", testCaseExportCSV{
+			ipTemplate:  "192.168.0.{{.Index",
+			expectError: true,
+		}),
+		Entry("Unknown field", testCaseExportCSV{
+			ipTemplate:  "{{.Offset}}",
+			expectError: true,
+		}),
+	)
+
+	It("Test ExportTerraformState", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "abc",
+				Namespace: "myns",
+				UID:       "template-uid",
+			},
+			Spec: infrav1.Metal3DataTemplateSpec{
+				ClusterName: "cluster1",
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"claim-10": {
+						Index:       10,
+						MachineName: "machine.10",
+					},
+					"2-claim": {
+						Index: 2,
+					},
+				},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+
+		out := &bytes.Buffer{}
+		Expect(ExportTerraformState(context.TODO(), c, template, out)).To(Succeed())
+		state := terraformState{}
+		Expect(json.Unmarshal(out.Bytes(), &state)).To(Succeed())
+		Expect(state.Version).To(Equal(4))
+		Expect(state.Lineage).To(Equal("template-uid"))
+		Expect(state.Resources).To(HaveLen(2))
+
+		resource := state.Resources[0]
+		Expect(resource.Type).To(Equal(TerraformResourceType))
+		Expect(resource.Mode).To(Equal("managed"))
+		Expect(resource.Name).To(Equal("_2-claim"))
+		Expect(resource.Instances).To(Equal([]terraformInstance{
+			{
+				Attributes: terraformAllocationAttrs{
+					ID:          "myns/abc-2",
+					Index:       2,
+					MachineName: "2-claim",
+					DataName:    "abc-2",
+					ClusterName: "cluster1",
+				},
+			},
+		}))
+		Expect(state.Resources[1].Name).To(Equal("machine_10"))
+		Expect(state.Resources[1].Instances[0].Attributes.Index).To(Equal(10))
+	})
+
+	It("Previews the allocations", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				MaxIndex:          3,
+				StaticAssignments: map[string]int{"machine-s": 3},
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0},
+				},
+			},
+		}
+		skippedMachine := &infrav1.Metal3Machine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "machine-skip",
+				Namespace:   "myns",
+				Annotations: map[string]string{SkipAllocationAnnotation: "true"},
+			},
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), skippedMachine)
+
+		previews, err := DryRun(context.TODO(), c, template, klogr.New(), []string{
+			"machine-0", "machine-1", "machine-skip", "machine-2", "machine-s",
+			"machine-3",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(previews).To(Equal([]AllocationPreview{
+			{MachineName: "machine-0", Index: 0, DataName: "abc-0", Existing: true},
+			{MachineName: "machine-1", Index: 1, DataName: "abc-1"},
+			{
+				MachineName: "machine-skip",
+				Error:       "Opted out of the allocation with the metal3.io/skip-allocation annotation",
+			},
+			{MachineName: "machine-2", Index: 2, DataName: "abc-2"},
+			{MachineName: "machine-s", Index: 3, DataName: "abc-3"},
+			{
+				MachineName: "machine-3",
+				Error:       "No free index left in Metal3DataTemplate abc",
+			},
+		}))
+		Expect(template.Status.Indexes).To(HaveLen(1))
+
+		out := &bytes.Buffer{}
+		Expect(WriteAllocationPreviews(out, previews[:3])).To(Succeed())
+		Expect(out.String()).To(Equal(
+			"MACHINE       INDEX  DATANAME  RESULT\n" +
+				"machine-0     0      abc-0     Existing\n" +
+				"machine-1     1      abc-1     Allocated\n" +
+				"machine-skip                   Opted out of the allocation with the metal3.io/skip-allocation annotation\n",
+		))
+	})
+
+	It("Reports the provisioning of the Metal3Machines", func() {
+		template := &infrav1.Metal3DataTemplate{ObjectMeta: templateMeta}
+		created := metav1.NewTime(time.Now().Truncate(time.Second))
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 4)
+		objects := []runtime.Object{}
+		for i := range datas {
+			datas[i].CreationTimestamp = created
+			objects = append(objects, &datas[i])
+		}
+		failureMessage := "Failed"
+		for i, status := range []infrav1.Metal3MachineStatus{
+			{Ready: true, LastUpdated: &metav1.Time{Time: created.Add(10 * time.Minute)}},
+			{Ready: true, LastUpdated: &metav1.Time{Time: created.Add(20 * time.Minute)}},
+			{FailureMessage: &failureMessage},
+		} {
+			objects = append(objects, &infrav1.Metal3Machine{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      fmt.Sprintf("machine-%d", i),
+					Namespace: "myns",
+				},
+				Status: status,
+			})
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+
+		report, err := ProvisioningReport(context.TODO(), c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report).To(Equal(&ProvisioningReportResult{
+			Namespace:          "myns",
+			Template:           "abc",
+			Machines:           3,
+			Provisioned:        2,
+			Failed:             1,
+			SuccessRate:        float64(2) / 3,
+			AverageTimeToReady: metav1.Duration{Duration: 15 * time.Minute},
+		}))
+
+		output := bytes.Buffer{}
+		Expect(report.WriteCSV(&output)).To(Succeed())
+		Expect(output.String()).To(Equal(
+			"namespace,template,machines,provisioned,failed,successRate,averageTimeToReady\n" +
+				"myns,abc,3,2,1,0.67,15m0s\n",
+		))
+	})
+})
@@ -0,0 +1,215 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"reflect"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// tenantAccessName returns the name of the Role and RoleBinding granting the
+// machine access to the Metal3Data. It contains the UID of the machine, so
+// that a new machine with the same name is never bound to the access of the
+// previous one, or the name of the machine if the UID is not known.
+func tenantAccessName(dataName string, m3mName string, m3mUID types.UID) string {
+	if m3mUID == "" {
+		return dataName + "-" + m3mName
+	}
+	return dataName + "-" + string(m3mUID)
+}
+
+// grantTenantAccess creates, if the Metal3DataTemplate has TenantIsolation,
+// a Role allowing to get the Metal3Data, and a RoleBinding binding it to the
+// ServiceAccount of the TenantServiceAccountAnnotation of the Metal3Machine,
+// both owned by the Metal3Machine. Existing objects are updated to match.
+// Nothing is created if the Metal3Machine has no such annotation.
+func (m *DataTemplateManager) grantTenantAccess(ctx context.Context,
+	dataName string, m3mName string, m3mKind string, m3mUID types.UID,
+) error {
+	if !m.DataTemplate.Spec.TenantIsolation {
+		return nil
+	}
+	// The machine may be of any kind of the OwnerKindFilter
+	m3m := &unstructured.Unstructured{}
+	m3m.SetGroupVersionKind(capm3.GroupVersion.WithKind(m3mKind))
+	key := client.ObjectKey{
+		Name:      m3mName,
+		Namespace: m.DataTemplate.Namespace,
+	}
+	if err := m.client.Get(ctx, key, m3m); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrap(err, "Failed to get the Metal3Machine")
+	}
+	serviceAccount := m3m.GetAnnotations()[TenantServiceAccountAnnotation]
+	if serviceAccount == "" {
+		m.Log.Info("No tenant ServiceAccount for the Metal3Machine, not granting access to the Metal3Data",
+			"cluster", clusterNameFromContext(ctx), "Metal3Machine", m3mName,
+		)
+		return nil
+	}
+
+	ownerRefs := []metav1.OwnerReference{
+		{
+			APIVersion: capm3.GroupVersion.String(),
+			Kind:       m3mKind,
+			Name:       m3mName,
+			UID:        m3mUID,
+		},
+	}
+	accessName := tenantAccessName(dataName, m3mName, m3mUID)
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            accessName,
+			Namespace:       m.DataTemplate.Namespace,
+			OwnerReferences: ownerRefs,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups:     []string{capm3.GroupVersion.Group},
+				Resources:     []string{"metal3datas"},
+				ResourceNames: []string{dataName},
+				Verbs:         []string{"get"},
+			},
+		},
+	}
+	if err := m.ensureTenantRole(ctx, role); err != nil {
+		return err
+	}
+	roleBinding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            accessName,
+			Namespace:       m.DataTemplate.Namespace,
+			OwnerReferences: ownerRefs,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     accessName,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      serviceAccount,
+				Namespace: m.DataTemplate.Namespace,
+			},
+		},
+	}
+	return m.ensureTenantRoleBinding(ctx, roleBinding)
+}
+
+// ensureTenantRole creates the Role, or updates the rules and owners of the
+// existing one if they differ
+func (m *DataTemplateManager) ensureTenantRole(ctx context.Context,
+	role *rbacv1.Role,
+) error {
+	err := m.client.Create(ctx, role)
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return errors.Wrap(err, "Failed to create the tenant Role")
+	}
+	existing := &rbacv1.Role{}
+	key := client.ObjectKey{Name: role.Name, Namespace: role.Namespace}
+	if err := m.client.Get(ctx, key, existing); err != nil {
+		return errors.Wrap(err, "Failed to get the tenant Role")
+	}
+	if reflect.DeepEqual(existing.Rules, role.Rules) &&
+		reflect.DeepEqual(existing.OwnerReferences, role.OwnerReferences) {
+		return nil
+	}
+	existing.Rules = role.Rules
+	existing.OwnerReferences = role.OwnerReferences
+	if err := m.client.Update(ctx, existing); err != nil {
+		return errors.Wrap(err, "Failed to update the tenant Role")
+	}
+	return nil
+}
+
+// ensureTenantRoleBinding creates the RoleBinding, or updates the subjects
+// and owners of the existing one if they differ. The RoleRef being
+// immutable, an existing RoleBinding referencing another Role is deleted
+// and created again.
+func (m *DataTemplateManager) ensureTenantRoleBinding(ctx context.Context,
+	roleBinding *rbacv1.RoleBinding,
+) error {
+	err := m.client.Create(ctx, roleBinding)
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return errors.Wrap(err, "Failed to create the tenant RoleBinding")
+	}
+	existing := &rbacv1.RoleBinding{}
+	key := client.ObjectKey{Name: roleBinding.Name, Namespace: roleBinding.Namespace}
+	if err := m.client.Get(ctx, key, existing); err != nil {
+		return errors.Wrap(err, "Failed to get the tenant RoleBinding")
+	}
+	if existing.RoleRef != roleBinding.RoleRef {
+		if err := m.client.Delete(ctx, existing); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "Failed to delete the tenant RoleBinding")
+		}
+		if err := m.client.Create(ctx, roleBinding); err != nil {
+			return errors.Wrap(err, "Failed to create the tenant RoleBinding")
+		}
+		return nil
+	}
+	if reflect.DeepEqual(existing.Subjects, roleBinding.Subjects) &&
+		reflect.DeepEqual(existing.OwnerReferences, roleBinding.OwnerReferences) {
+		return nil
+	}
+	existing.Subjects = roleBinding.Subjects
+	existing.OwnerReferences = roleBinding.OwnerReferences
+	if err := m.client.Update(ctx, existing); err != nil {
+		return errors.Wrap(err, "Failed to update the tenant RoleBinding")
+	}
+	return nil
+}
+
+// revokeTenantAccess deletes, if the Metal3DataTemplate has TenantIsolation,
+// the Role and RoleBinding granting the machine access to the Metal3Data
+func (m *DataTemplateManager) revokeTenantAccess(ctx context.Context,
+	dataName string, m3mName string, m3mUID types.UID,
+) error {
+	if !m.DataTemplate.Spec.TenantIsolation {
+		return nil
+	}
+	objectMeta := metav1.ObjectMeta{
+		Name:      tenantAccessName(dataName, m3mName, m3mUID),
+		Namespace: m.DataTemplate.Namespace,
+	}
+	roleBinding := &rbacv1.RoleBinding{ObjectMeta: objectMeta}
+	if err := m.client.Delete(ctx, roleBinding); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "Failed to delete the tenant RoleBinding")
+	}
+	role := &rbacv1.Role{ObjectMeta: objectMeta}
+	if err := m.client.Delete(ctx, role); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "Failed to delete the tenant Role")
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Metal3DataTemplate tenant access", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	It("Grants the tenant access to the Metal3Data", func() {
+		scheme := setupSchemeMm()
+		Expect(rbacv1.AddToScheme(scheme)).To(Succeed())
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				TenantIsolation: true,
+			},
+		}
+		// A stale RoleBinding, referencing another Role, is recreated
+		objects := []runtime.Object{template.DeepCopy(), &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "abc-0-machine-0-uid",
+				Namespace: "myns",
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "Role",
+				Name:     "other",
+			},
+		}}
+		for i, serviceAccount := range []string{"tenant-a", ""} {
+			name := fmt.Sprintf("machine-%d", i)
+			m3m := &infrav1.Metal3Machine{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: "myns",
+					UID:       types.UID(name + "-uid"),
+				},
+			}
+			if serviceAccount != "" {
+				m3m.Annotations = map[string]string{
+					TenantServiceAccountAnnotation: serviceAccount,
+				}
+			}
+			objects = append(objects, m3m, &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: "myns",
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: infrav1.GroupVersion.String(),
+							Kind:       "Metal3Machine",
+							Name:       name,
+							UID:        m3m.UID,
+						},
+					},
+				},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: "abc"},
+				},
+			})
+		}
+		c := fakeclient.NewFakeClientWithScheme(scheme, objects...)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = templateMgr.UpdateDatas(context.TODO(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(indexesOf(template.Status.Indexes)).To(Equal(
+			map[string]int{"machine-0": 0, "machine-1": 1},
+		))
+
+		role := &rbacv1.Role{}
+		key := client.ObjectKey{Name: "abc-0-machine-0-uid", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, role)).To(Succeed())
+		Expect(role.Rules).To(Equal([]rbacv1.PolicyRule{
+			{
+				APIGroups:     []string{infrav1.GroupVersion.Group},
+				Resources:     []string{"metal3datas"},
+				ResourceNames: []string{"abc-0"},
+				Verbs:         []string{"get"},
+			},
+		}))
+		Expect(role.OwnerReferences[0].UID).To(BeEquivalentTo("machine-0-uid"))
+		roleBinding := &rbacv1.RoleBinding{}
+		Expect(c.Get(context.TODO(), key, roleBinding)).To(Succeed())
+		Expect(roleBinding.RoleRef.Name).To(Equal("abc-0-machine-0-uid"))
+		Expect(roleBinding.Subjects).To(Equal([]rbacv1.Subject{
+			{Kind: "ServiceAccount", Name: "tenant-a", Namespace: "myns"},
+		}))
+
+		// Without a tenant ServiceAccount, no access is granted
+		missingKey := client.ObjectKey{Name: "abc-1-machine-1-uid", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), missingKey, &rbacv1.Role{})).NotTo(Succeed())
+		Expect(c.Get(context.TODO(), missingKey, &rbacv1.RoleBinding{})).NotTo(Succeed())
+
+		// The access is revoked when the Metal3Data is deleted
+		m3Data := &infrav1.Metal3Data{}
+		dataKey := client.ObjectKey{Name: "abc-0", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), dataKey, m3Data)).To(Succeed())
+		Expect(templateMgr.deleteDataObject(context.TODO(), m3Data)).To(Succeed())
+		Expect(c.Get(context.TODO(), key, &rbacv1.Role{})).NotTo(Succeed())
+		Expect(c.Get(context.TODO(), key, &rbacv1.RoleBinding{})).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,361 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// StatusInconsistency describes a mismatch between the status of a
+// Metal3DataTemplate and its Metal3Data and Metal3DataClaim objects
+type StatusInconsistency struct {
+	ClaimName string
+	Index     int
+	Reason    string
+}
+
+// ValidateStatusConsistency compares the index entries of the status with
+// the Metal3Data and Metal3DataClaim objects, and returns the mismatches
+// sorted by claim name. It does not modify the status.
+func (m *DataTemplateManager) ValidateStatusConsistency(ctx context.Context,
+) ([]StatusInconsistency, error) {
+	indexes, err := statusIndexes(ctx, m.client, m.DataTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	dataObjects := capm3.Metal3DataList{}
+	if err := m.list(ctx, &dataObjects); err != nil {
+		return nil, errors.Wrap(err, "Failed to list Metal3Data")
+	}
+	dataNames := make(map[string]bool)
+	inconsistencies := []StatusInconsistency{}
+	for _, dataObject := range dataObjects.Items {
+		if dataObject.Spec.Template.Name != m.DataTemplate.Name ||
+			m.isTransferredData(&dataObject) {
+			continue
+		}
+		dataNames[dataObject.Name] = true
+		entry, ok := indexes[dataObject.Spec.Claim.Name]
+		if !ok || entry.Index != dataObject.Spec.Index {
+			inconsistencies = append(inconsistencies, StatusInconsistency{
+				ClaimName: dataObject.Spec.Claim.Name,
+				Index:     dataObject.Spec.Index,
+				Reason:    MissingEntryReason,
+			})
+		}
+	}
+
+	for claimName, entry := range indexes {
+		if dataNames[m.dataName(entry)] {
+			continue
+		}
+		reason := MissingDataReason
+		dataClaim := &capm3.Metal3DataClaim{}
+		key := client.ObjectKey{
+			Name:      claimName,
+			Namespace: m.DataTemplate.Namespace,
+		}
+		if err := m.client.Get(ctx, key, dataClaim); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, errors.Wrap(err, "Failed to get Metal3DataClaim")
+			}
+			reason = GhostEntryReason
+		} else if !dataClaim.DeletionTimestamp.IsZero() {
+			reason = GhostEntryReason
+		}
+		inconsistencies = append(inconsistencies, StatusInconsistency{
+			ClaimName: claimName,
+			Index:     entry.Index,
+			Reason:    reason,
+		})
+	}
+
+	sort.Slice(inconsistencies, func(i, j int) bool {
+		return inconsistencies[i].ClaimName < inconsistencies[j].ClaimName
+	})
+	return inconsistencies, nil
+}
+
+// SelfHeal repairs the inconsistencies found by ValidateStatusConsistency and
+// patches the status. The ghost entries are removed, the missing entries are
+// rebuilt from the Metal3Data objects, and the missing Metal3Data objects of
+// live Metal3DataClaims are created again with their previous index if it is
+// still free. The Metal3Data objects are created with the controller client,
+// so it fails if a ServiceAccountRef is set.
+func (m *DataTemplateManager) SelfHeal(ctx context.Context) error {
+	inconsistencies, err := m.ValidateStatusConsistency(ctx)
+	if err != nil {
+		return err
+	}
+	if len(inconsistencies) == 0 {
+		return nil
+	}
+
+	dataClient, err := m.getDataClient(ctx, nil)
+	if err != nil {
+		return err
+	}
+	helper, err := patch.NewHelper(m.DataTemplate, m.client)
+	if err != nil {
+		return errors.Wrap(err, "failed to init patch helper")
+	}
+
+	// Rebuilding the indexes from the Metal3Data objects drops the ghost
+	// entries and restores the missing ones
+	indexes, err := m.getIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.restoredIndexes = make(map[string]int)
+	defer func() {
+		m.restoredIndexes = nil
+	}()
+	for _, inconsistency := range inconsistencies {
+		m.Log.Info("Repairing the status",
+			"cluster", clusterNameFromContext(ctx),
+			"Claim", inconsistency.ClaimName, "index", inconsistency.Index,
+			"reason", inconsistency.Reason,
+		)
+		if inconsistency.Reason != MissingDataReason {
+			continue
+		}
+
+		dataClaim := &capm3.Metal3DataClaim{}
+		key := client.ObjectKey{
+			Name:      inconsistency.ClaimName,
+			Namespace: m.DataTemplate.Namespace,
+		}
+		if err := m.client.Get(ctx, key, dataClaim); err != nil {
+			return errors.Wrap(err, "Failed to get Metal3DataClaim")
+		}
+		dataClaim.Status.RenderedData = nil
+		m.restoredIndexes[dataClaim.Name] = inconsistency.Index
+		indexes, err = m.updateData(ctx, dataClaim, indexes, dataClient)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.updateStatusTimestamp()
+	if err := m.storeExternalStatus(ctx); err != nil {
+		return err
+	}
+	return helper.Patch(ctx, m.DataTemplate)
+}
+
+const (
+	// ValidationSeverityError is the severity of the ValidationItems that
+	// require an action
+	ValidationSeverityError = "Error"
+
+	// ValidationSeverityWarning is the severity of the ValidationItems that
+	// may prevent future allocations
+	ValidationSeverityWarning = "Warning"
+)
+
+// ValidationItem is a problem found by one of the checks of RunValidations
+type ValidationItem struct {
+	Check    string
+	Message  string
+	Severity string
+}
+
+// ValidationReport aggregates the results of the checks of RunValidations.
+// HealthScore goes from 100, no problem found, down to 0.
+type ValidationReport struct {
+	Errors      []ValidationItem
+	Warnings    []ValidationItem
+	HealthScore int
+	GeneratedAt metav1.Time
+}
+
+// add appends the item to the Errors or the Warnings depending on its
+// severity
+func (r *ValidationReport) add(check, severity, message string) {
+	item := ValidationItem{
+		Check:    check,
+		Message:  message,
+		Severity: severity,
+	}
+	if severity == ValidationSeverityError {
+		r.Errors = append(r.Errors, item)
+	} else {
+		r.Warnings = append(r.Warnings, item)
+	}
+}
+
+// RunValidations runs the status consistency, quota, orphan, index bounds,
+// live index count and emergency range checks and aggregates their results in
+// a ValidationReport.
+// Each error lowers the HealthScore by 20 and each warning by 5. It does not
+// modify any object.
+func (m *DataTemplateManager) RunValidations(ctx context.Context,
+) (*ValidationReport, error) {
+	report := &ValidationReport{
+		Errors:      []ValidationItem{},
+		Warnings:    []ValidationItem{},
+		GeneratedAt: metav1.Now(),
+	}
+
+	inconsistencies, err := m.ValidateStatusConsistency(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, inconsistency := range inconsistencies {
+		report.add("StatusConsistency", ValidationSeverityError,
+			fmt.Sprintf("%s: index %d of %s", inconsistency.Reason,
+				inconsistency.Index, inconsistency.ClaimName,
+			),
+		)
+	}
+
+	if err := m.checkDataQuota(ctx); err != nil {
+		quotaErr, ok := err.(*QuotaExceededError)
+		if !ok {
+			return nil, err
+		}
+		report.add("Quota", ValidationSeverityWarning, quotaErr.Error())
+	}
+
+	orphans, err := m.getOrphanDatas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, orphan := range orphans {
+		report.add("Orphans", ValidationSeverityWarning,
+			fmt.Sprintf("Metal3Data %s has no live Metal3DataClaim %s",
+				orphan.Name, orphan.Spec.Claim.Name,
+			),
+		)
+	}
+
+	indexes, err := statusIndexes(ctx, m.client, m.DataTemplate)
+	if err != nil {
+		return nil, err
+	}
+	err = forEachIndex(m.DataTemplate, indexes, func(index int, machineName, dataName string) error {
+		if m.isEmergencyIndex(index) {
+			return nil
+		}
+		if index < m.DataTemplate.Spec.MinIndex || (m.DataTemplate.Spec.MaxIndex != 0 &&
+			index > m.DataTemplate.Spec.MaxIndex) {
+			report.add("IndexBounds", ValidationSeverityError,
+				fmt.Sprintf("Index %d of %s is out of the bounds of the template",
+					index, machineName,
+				),
+			)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	liveCount, err := m.LiveIndexCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allocatedIndexes := make(map[int]bool, len(indexes))
+	for _, entry := range indexes {
+		allocatedIndexes[entry.Index] = true
+	}
+	if liveCount != len(allocatedIndexes) {
+		report.add("LiveIndexCount", ValidationSeverityWarning,
+			fmt.Sprintf("%d Metal3Data objects exist for %d allocated indexes",
+				liveCount, len(allocatedIndexes),
+			),
+		)
+	}
+
+	emergencyClaims := make([]string, 0, len(m.DataTemplate.Status.EmergencyAllocations))
+	for claimName := range m.DataTemplate.Status.EmergencyAllocations {
+		emergencyClaims = append(emergencyClaims, claimName)
+	}
+	sort.Strings(emergencyClaims)
+	var maxDuration *metav1.Duration
+	if m.DataTemplate.Spec.EmergencyRange != nil {
+		maxDuration = m.DataTemplate.Spec.EmergencyRange.MaxDuration
+	}
+	for _, claimName := range emergencyClaims {
+		index := m.DataTemplate.Status.EmergencyAllocations[claimName]
+		allocatedAt := indexes[claimName].AllocatedAt
+		if maxDuration != nil && allocatedAt != nil &&
+			time.Since(allocatedAt.Time) > maxDuration.Duration {
+			report.add("EmergencyRange", ValidationSeverityError,
+				fmt.Sprintf("Emergency index %d of %s is allocated for more than %s",
+					index, claimName, maxDuration.Duration,
+				),
+			)
+			continue
+		}
+		report.add("EmergencyRange", ValidationSeverityWarning,
+			fmt.Sprintf("Emergency index %d is allocated to %s", index, claimName),
+		)
+	}
+
+	report.HealthScore = 100 - 20*len(report.Errors) - 5*len(report.Warnings)
+	if report.HealthScore < 0 {
+		report.HealthScore = 0
+	}
+	return report, nil
+}
+
+// getOrphanDatas returns the Metal3Data objects of the template whose
+// Metal3DataClaim is missing or being deleted, sorted by name
+func (m *DataTemplateManager) getOrphanDatas(ctx context.Context,
+) ([]capm3.Metal3Data, error) {
+	dataObjects := capm3.Metal3DataList{}
+	if err := m.list(ctx, &dataObjects); err != nil {
+		return nil, errors.Wrap(err, "Failed to list Metal3Data")
+	}
+
+	orphans := []capm3.Metal3Data{}
+	for _, dataObject := range dataObjects.Items {
+		if dataObject.Spec.Template.Name != m.DataTemplate.Name {
+			continue
+		}
+		dataClaim := &capm3.Metal3DataClaim{}
+		key := client.ObjectKey{
+			Name:      dataObject.Spec.Claim.Name,
+			Namespace: m.DataTemplate.Namespace,
+		}
+		if err := m.client.Get(ctx, key, dataClaim); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, errors.Wrap(err, "Failed to get Metal3DataClaim")
+			}
+			orphans = append(orphans, dataObject)
+		} else if !dataClaim.DeletionTimestamp.IsZero() {
+			orphans = append(orphans, dataObject)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Name < orphans[j].Name
+	})
+	return orphans, nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/metal3-io/cluster-api-provider-metal3/baremetal/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Metal3DataTemplate validation", func() {
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	It("Test ValidateStatusConsistency and SelfHeal", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				MinIndex: 1,
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-1": {Index: 1},
+					"machine-2": {Index: 2},
+					"machine-3": {Index: 3},
+				},
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 4)
+		// Index 0 is free, machine-2 must get its index 2 back
+		template.Spec.MinIndex = 0
+		objects := []runtime.Object{template.DeepCopy(), &datas[0], &datas[3]}
+		// machine-2 lost its Metal3Data, machine-3 is gone and machine-4 is
+		// missing from the status
+		for _, claimName := range []string{"machine-1", "machine-2", "machine-4"} {
+			objects = append(objects, &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      claimName,
+					Namespace: "myns",
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: infrav1.GroupVersion.String(),
+							Kind:       "Metal3Machine",
+							Name:       claimName,
+						},
+					},
+				},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: "abc"},
+				},
+				Status: infrav1.Metal3DataClaimStatus{
+					RenderedData: &corev1.ObjectReference{Name: "abc"},
+				},
+			})
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		inconsistencies, err := templateMgr.ValidateStatusConsistency(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(inconsistencies).To(Equal([]StatusInconsistency{
+			{ClaimName: "machine-2", Index: 2, Reason: MissingDataReason},
+			{ClaimName: "machine-3", Index: 3, Reason: GhostEntryReason},
+			{ClaimName: "machine-4", Index: 4, Reason: MissingEntryReason},
+		}))
+
+		Expect(templateMgr.SelfHeal(context.TODO())).To(Succeed())
+		m3Data := &infrav1.Metal3Data{}
+		key := client.ObjectKey{Name: "abc-2", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, m3Data)).To(Succeed())
+		Expect(m3Data.Spec.Claim.Name).To(Equal("machine-2"))
+
+		savedTemplate := &infrav1.Metal3DataTemplate{}
+		Expect(c.Get(context.TODO(), client.ObjectKey{Name: "abc", Namespace: "myns"},
+			savedTemplate,
+		)).To(Succeed())
+		Expect(indexesOf(savedTemplate.Status.Indexes)).To(Equal(map[string]int{
+			"machine-1": 1,
+			"machine-2": 2,
+			"machine-4": 4,
+		}))
+
+		inconsistencies, err = templateMgr.ValidateStatusConsistency(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(inconsistencies).To(BeEmpty())
+		Expect(templateMgr.SelfHeal(context.TODO())).To(Succeed())
+	})
+
+	It("Test RunValidations", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"machine-0": {Index: 0},
+					"machine-1": {Index: 1},
+				},
+			},
+		}
+		datas := testutil.ManifestGenerator{}.GenerateForTemplate(template, 4)
+		objects := []runtime.Object{&datas[0], &datas[1]}
+		for _, claimName := range []string{"machine-0", "machine-1", "machine-3"} {
+			objects = append(objects, &infrav1.Metal3DataClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      claimName,
+					Namespace: "myns",
+				},
+				Spec: infrav1.Metal3DataClaimSpec{
+					Template: corev1.ObjectReference{Name: "abc"},
+				},
+			})
+		}
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		report, err := templateMgr.RunValidations(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Errors).To(BeEmpty())
+		Expect(report.Warnings).To(BeEmpty())
+		Expect(report.HealthScore).To(Equal(100))
+		Expect(report.GeneratedAt.IsZero()).To(BeFalse())
+
+		// machine-1 is gone, index 3 is out of the bounds and the quota is
+		// reached
+		template.Spec.MaxIndex = 2
+		template.Status.Indexes["machine-3"] = infrav1.IndexEntry{Index: 3}
+		objects = []runtime.Object{&datas[0], &datas[1], &datas[3],
+			objects[2], objects[4],
+			newDataQuota("quota1", "myns", metal3DataQuotaResource, 3, 3),
+		}
+		c = fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+		templateMgr, err = NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		report, err = templateMgr.RunValidations(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Errors).To(Equal([]ValidationItem{
+			{
+				Check:    "IndexBounds",
+				Message:  "Index 3 of machine-3 is out of the bounds of the template",
+				Severity: ValidationSeverityError,
+			},
+		}))
+		Expect(report.Warnings).To(Equal([]ValidationItem{
+			{
+				Check:    "Quota",
+				Message:  "ResourceQuota quota1 exceeded for Metal3Data: 3 used, 3 allowed",
+				Severity: ValidationSeverityWarning,
+			},
+			{
+				Check:    "Orphans",
+				Message:  "Metal3Data abc-1 has no live Metal3DataClaim machine-1",
+				Severity: ValidationSeverityWarning,
+			},
+		}))
+		Expect(report.HealthScore).To(Equal(70))
+	})
+})
@@ -0,0 +1,420 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// informerHandlers dispatches the events of a shared informer to handlers
+// that can be removed, since the handlers added to a shared informer stay
+// until the informer stops
+type informerHandlers struct {
+	mu       sync.Mutex
+	nextID   int
+	handlers map[int]toolscache.ResourceEventHandler
+}
+
+// informerDispatchers holds the informerHandlers of each informer used by
+// the Watch methods
+var informerDispatchers = struct {
+	sync.Mutex
+	dispatchers map[cache.Informer]*informerHandlers
+}{dispatchers: make(map[cache.Informer]*informerHandlers)}
+
+// addInformerHandler adds the handler to the events of the informer, and
+// returns the function removing it
+func addInformerHandler(informer cache.Informer,
+	handler toolscache.ResourceEventHandler,
+) func() {
+	informerDispatchers.Lock()
+	defer informerDispatchers.Unlock()
+	dispatcher, ok := informerDispatchers.dispatchers[informer]
+	if !ok {
+		dispatcher = &informerHandlers{
+			handlers: make(map[int]toolscache.ResourceEventHandler),
+		}
+		informerDispatchers.dispatchers[informer] = dispatcher
+	}
+	dispatcher.mu.Lock()
+	id := dispatcher.nextID
+	dispatcher.nextID++
+	dispatcher.handlers[id] = handler
+	dispatcher.mu.Unlock()
+	// The handler is ready to receive the events before the dispatcher is
+	if !ok {
+		informer.AddEventHandler(dispatcher)
+	}
+	return func() {
+		dispatcher.mu.Lock()
+		defer dispatcher.mu.Unlock()
+		delete(dispatcher.handlers, id)
+	}
+}
+
+// current returns the handlers, so that they are called without the lock
+func (h *informerHandlers) current() []toolscache.ResourceEventHandler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	handlers := make([]toolscache.ResourceEventHandler, 0, len(h.handlers))
+	for _, handler := range h.handlers {
+		handlers = append(handlers, handler)
+	}
+	return handlers
+}
+
+// OnAdd implements toolscache.ResourceEventHandler
+func (h *informerHandlers) OnAdd(obj interface{}) {
+	for _, handler := range h.current() {
+		handler.OnAdd(obj)
+	}
+}
+
+// OnUpdate implements toolscache.ResourceEventHandler
+func (h *informerHandlers) OnUpdate(oldObj, newObj interface{}) {
+	for _, handler := range h.current() {
+		handler.OnUpdate(oldObj, newObj)
+	}
+}
+
+// OnDelete implements toolscache.ResourceEventHandler
+func (h *informerHandlers) OnDelete(obj interface{}) {
+	for _, handler := range h.current() {
+		handler.OnDelete(obj)
+	}
+}
+
+// WatchDataCreation calls onCreated for each Metal3Data created from this
+// template, in the template cluster, after the watch started. It blocks until
+// the context is cancelled.
+func (m *DataTemplateManager) WatchDataCreation(ctx context.Context,
+	onCreated func(capm3.Metal3Data),
+) error {
+	if m.Informers == nil {
+		return errors.New("No informers set, cannot watch Metal3Data")
+	}
+
+	informer, err := m.Informers.GetInformer(ctx, &capm3.Metal3Data{})
+	if err != nil {
+		return errors.Wrap(err, "Failed to get Metal3Data informer")
+	}
+
+	// The creation timestamp only has a second precision. Truncating the start
+	// time may deliver an object created just before the watch, but never
+	// skips one created after.
+	start := metav1.NewTime(time.Now().Truncate(time.Second))
+	done := ctx.Done()
+
+	remove := addInformerHandler(informer, toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			// An event may be dispatched while the handler is removed
+			select {
+			case <-done:
+				return
+			default:
+			}
+			m3Data, ok := obj.(*capm3.Metal3Data)
+			if !ok {
+				return
+			}
+			// The informer replays the objects already in its cache when the
+			// handler is added, and again after a relist.
+			if m3Data.CreationTimestamp.Before(&start) {
+				return
+			}
+			if !m.isDataFromTemplate(m3Data) {
+				return
+			}
+			onCreated(*m3Data.DeepCopy())
+		},
+	})
+	defer remove()
+
+	<-done
+	return nil
+}
+
+// OwnerReferenceEventType is the type of an OwnerReferenceEvent
+type OwnerReferenceEventType string
+
+const (
+	// OwnerReferenceAdded is sent when an owner reference is added to the
+	// Metal3DataTemplate
+	OwnerReferenceAdded OwnerReferenceEventType = "Added"
+
+	// OwnerReferenceRemoved is sent when an owner reference is removed from
+	// the Metal3DataTemplate
+	OwnerReferenceRemoved OwnerReferenceEventType = "Removed"
+)
+
+// OwnerReferenceEvent describes a change of the owner references of the
+// Metal3DataTemplate
+type OwnerReferenceEvent struct {
+	Type     OwnerReferenceEventType
+	OwnerRef metav1.OwnerReference
+}
+
+// WatchOwnerReferences sends an OwnerReferenceEvent to ch for each owner
+// reference added to or removed from the Metal3DataTemplate after the watch
+// started. It blocks until the context is cancelled.
+func (m *DataTemplateManager) WatchOwnerReferences(ctx context.Context,
+	ch chan<- OwnerReferenceEvent,
+) error {
+	if m.Informers == nil {
+		return errors.New("No informers set, cannot watch Metal3DataTemplate")
+	}
+
+	informer, err := m.Informers.GetInformer(ctx, &capm3.Metal3DataTemplate{})
+	if err != nil {
+		return errors.Wrap(err, "Failed to get Metal3DataTemplate informer")
+	}
+	done := ctx.Done()
+
+	remove := addInformerHandler(informer, toolscache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldTemplate, ok := oldObj.(*capm3.Metal3DataTemplate)
+			if !ok {
+				return
+			}
+			newTemplate, ok := newObj.(*capm3.Metal3DataTemplate)
+			if !ok {
+				return
+			}
+			if newTemplate.Name != m.DataTemplate.Name ||
+				newTemplate.Namespace != m.DataTemplate.Namespace {
+				return
+			}
+			for _, event := range diffOwnerReferences(oldTemplate.OwnerReferences,
+				newTemplate.OwnerReferences,
+			) {
+				// An event may be dispatched while the handler is removed
+				select {
+				case <-done:
+					return
+				case ch <- event:
+				}
+			}
+		},
+	})
+	defer remove()
+
+	<-done
+	return nil
+}
+
+// diffOwnerReferences returns the events turning the oldRefs owner references
+// into the newRefs ones, the removals first
+func diffOwnerReferences(oldRefs, newRefs []metav1.OwnerReference,
+) []OwnerReferenceEvent {
+	oldRefs = sortedOwnerReferences(oldRefs)
+	newRefs = sortedOwnerReferences(newRefs)
+	if reflect.DeepEqual(oldRefs, newRefs) {
+		return nil
+	}
+
+	events := []OwnerReferenceEvent{}
+	for _, oldRef := range oldRefs {
+		if !containsOwnerReference(newRefs, oldRef) {
+			events = append(events, OwnerReferenceEvent{
+				Type:     OwnerReferenceRemoved,
+				OwnerRef: oldRef,
+			})
+		}
+	}
+	for _, newRef := range newRefs {
+		if !containsOwnerReference(oldRefs, newRef) {
+			events = append(events, OwnerReferenceEvent{
+				Type:     OwnerReferenceAdded,
+				OwnerRef: newRef,
+			})
+		}
+	}
+	return events
+}
+
+// sortedOwnerReferences returns a copy of the owner references sorted by
+// kind and name
+func sortedOwnerReferences(ownerRefs []metav1.OwnerReference) []metav1.OwnerReference {
+	sortedRefs := make([]metav1.OwnerReference, len(ownerRefs))
+	copy(sortedRefs, ownerRefs)
+	sort.Slice(sortedRefs, func(i, j int) bool {
+		if sortedRefs[i].Kind != sortedRefs[j].Kind {
+			return sortedRefs[i].Kind < sortedRefs[j].Kind
+		}
+		return sortedRefs[i].Name < sortedRefs[j].Name
+	})
+	return sortedRefs
+}
+
+// containsOwnerReference returns true if an identical owner reference is in
+// the list
+func containsOwnerReference(ownerRefs []metav1.OwnerReference,
+	ownerRef metav1.OwnerReference,
+) bool {
+	for _, ref := range ownerRefs {
+		if reflect.DeepEqual(ref, ownerRef) {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexChangeEventType is the type of an IndexChangeEvent
+type IndexChangeEventType string
+
+const (
+	// IndexAllocated is sent when an index is allocated to a Metal3Machine
+	IndexAllocated IndexChangeEventType = "Allocated"
+	// IndexFreed is sent when the index of a Metal3Machine is released
+	IndexFreed IndexChangeEventType = "Freed"
+)
+
+// IndexChangeEvent describes an allocation or release of an index of the
+// Metal3DataTemplate
+type IndexChangeEvent struct {
+	Type        IndexChangeEventType
+	Index       int
+	MachineName string
+}
+
+// WatchIndexChanges sends an IndexChangeEvent to ch for each index allocated
+// or freed after the watch started, comparing the indexes of the status,
+// read from the external store if any, each time the resource version of the
+// Metal3DataTemplate changes. The informer relists and watches again after
+// watch errors. It blocks until the context is cancelled.
+func (m *DataTemplateManager) WatchIndexChanges(ctx context.Context,
+	ch chan<- IndexChangeEvent,
+) error {
+	if m.Informers == nil {
+		return errors.New("No informers set, cannot watch Metal3DataTemplate")
+	}
+
+	previous, err := statusIndexes(ctx, m.client, m.DataTemplate)
+	if err != nil {
+		return err
+	}
+	informer, err := m.Informers.GetInformer(ctx, &capm3.Metal3DataTemplate{})
+	if err != nil {
+		return errors.Wrap(err, "Failed to get Metal3DataTemplate informer")
+	}
+	done := ctx.Done()
+
+	remove := addInformerHandler(informer, toolscache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// An event may be dispatched while the handler is removed
+			select {
+			case <-done:
+				return
+			default:
+			}
+			oldTemplate, ok := oldObj.(*capm3.Metal3DataTemplate)
+			if !ok {
+				return
+			}
+			newTemplate, ok := newObj.(*capm3.Metal3DataTemplate)
+			if !ok {
+				return
+			}
+			if newTemplate.Name != m.DataTemplate.Name ||
+				newTemplate.Namespace != m.DataTemplate.Namespace ||
+				newTemplate.ResourceVersion == oldTemplate.ResourceVersion {
+				return
+			}
+			current, err := statusIndexes(ctx, m.client, newTemplate)
+			if err != nil {
+				m.Log.Info("Failed to get the indexes of the watched template",
+					"cluster", clusterNameFromContext(ctx), "error", err.Error(),
+				)
+				return
+			}
+			events := diffIndexes(previous, current)
+			previous = current
+			for _, event := range events {
+				select {
+				case <-done:
+					return
+				case ch <- event:
+				}
+			}
+		},
+	})
+	defer remove()
+
+	<-done
+	return nil
+}
+
+// diffIndexes returns the events turning the oldEntries indexes into the
+// newEntries ones, the releases first, each sorted by index. An index
+// changing for a claim is a release followed by an allocation.
+func diffIndexes(oldEntries, newEntries map[string]capm3.IndexEntry,
+) []IndexChangeEvent {
+	freed := []IndexChangeEvent{}
+	allocated := []IndexChangeEvent{}
+	for claimName, oldEntry := range oldEntries {
+		if newEntry, ok := newEntries[claimName]; !ok || newEntry.Index != oldEntry.Index {
+			freed = append(freed, IndexChangeEvent{
+				Type:        IndexFreed,
+				Index:       oldEntry.Index,
+				MachineName: entryMachineName(claimName, oldEntry),
+			})
+		}
+	}
+	for claimName, newEntry := range newEntries {
+		if oldEntry, ok := oldEntries[claimName]; !ok || newEntry.Index != oldEntry.Index {
+			allocated = append(allocated, IndexChangeEvent{
+				Type:        IndexAllocated,
+				Index:       newEntry.Index,
+				MachineName: entryMachineName(claimName, newEntry),
+			})
+		}
+	}
+	sortIndexChangeEvents(freed)
+	sortIndexChangeEvents(allocated)
+	return append(freed, allocated...)
+}
+
+// sortIndexChangeEvents sorts the events by index, then by Metal3Machine for
+// the indexes shared by several Metal3Machines
+func sortIndexChangeEvents(events []IndexChangeEvent) {
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Index != events[j].Index {
+			return events[i].Index < events[j].Index
+		}
+		return events[i].MachineName < events[j].MachineName
+	})
+}
+
+// entryMachineName returns the Metal3Machine of a status entry. The entries
+// written by previous versions only contain the index, the claim being named
+// after the Metal3Machine.
+func entryMachineName(claimName string, entry capm3.IndexEntry) string {
+	if entry.MachineName != "" {
+		return entry.MachineName
+	}
+	return claimName
+}
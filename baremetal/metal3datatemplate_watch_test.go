@@ -0,0 +1,404 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/klogr"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+)
+
+var _ = Describe("Metal3DataTemplate watches", func() {
+	type testCaseWatchDataCreation struct {
+		noInformers  bool
+		data         *infrav1.Metal3Data
+		expectCalled bool
+	}
+
+	DescribeTable("Test WatchDataCreation",
+		func(tc testCaseWatchDataCreation) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "abc",
+					Namespace: "myns",
+				},
+				Spec: infrav1.Metal3DataTemplateSpec{
+					ClusterName: "cluster1",
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(nil, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			if tc.noInformers {
+				err = templateMgr.WatchDataCreation(context.TODO(),
+					func(infrav1.Metal3Data) {},
+				)
+				Expect(err).To(HaveOccurred())
+				return
+			}
+
+			informer := &fakeDataInformer{}
+			templateMgr.Informers = &fakeDataInformers{informer: informer}
+
+			created := make(chan string, 10)
+			ctx, cancel := context.WithCancel(context.TODO())
+			watchErr := make(chan error)
+			go func() {
+				watchErr <- templateMgr.WatchDataCreation(ctx,
+					func(m3Data infrav1.Metal3Data) {
+						created <- m3Data.Name
+					},
+				)
+			}()
+
+			// Wait for the handler to be registered
+			sentinel := &infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "sentinel",
+					Namespace:         "myns",
+					CreationTimestamp: metav1.NewTime(time.Now().Add(time.Hour)),
+					Labels: map[string]string{
+						capi.ClusterLabelName: "cluster1",
+					},
+				},
+				Spec: infrav1.Metal3DataSpec{
+					Template: corev1.ObjectReference{
+						Name: "abc",
+					},
+				},
+			}
+			Eventually(func() bool {
+				informer.add(sentinel)
+				select {
+				case name := <-created:
+					return name == "sentinel"
+				case <-time.After(10 * time.Millisecond):
+					return false
+				}
+			}).Should(BeTrue())
+
+			informer.add(tc.data)
+			if tc.expectCalled {
+				Expect(created).To(Receive(Equal(tc.data.Name)))
+			} else {
+				Expect(created).NotTo(Receive())
+			}
+
+			cancel()
+			Eventually(watchErr).Should(Receive(BeNil()))
+		},
+		Entry("No informers", testCaseWatchDataCreation{
+			noInformers: true,
+		}),
+		Entry("Created after the start", testCaseWatchDataCreation{
+			data: &infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "abc-0",
+					Namespace:         "myns",
+					CreationTimestamp: metav1.NewTime(time.Now().Add(time.Minute)),
+					Labels: map[string]string{
+						capi.ClusterLabelName: "cluster1",
+					},
+				},
+				Spec: infrav1.Metal3DataSpec{
+					Template: corev1.ObjectReference{
+						Name: "abc",
+					},
+				},
+			},
+			expectCalled: true,
+		}),
+		Entry("Created before the start", testCaseWatchDataCreation{
+			data: &infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "abc-0",
+					Namespace:         "myns",
+					CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+					Labels: map[string]string{
+						capi.ClusterLabelName: "cluster1",
+					},
+				},
+				Spec: infrav1.Metal3DataSpec{
+					Template: corev1.ObjectReference{
+						Name: "abc",
+					},
+				},
+			},
+		}),
+		Entry("Other template", testCaseWatchDataCreation{
+			data: &infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "bbc-0",
+					Namespace:         "myns",
+					CreationTimestamp: metav1.NewTime(time.Now().Add(time.Minute)),
+					Labels: map[string]string{
+						capi.ClusterLabelName: "cluster1",
+					},
+				},
+				Spec: infrav1.Metal3DataSpec{
+					Template: corev1.ObjectReference{
+						Name: "bbc",
+					},
+				},
+			},
+		}),
+		Entry("Other cluster", testCaseWatchDataCreation{
+			data: &infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "abc-0",
+					Namespace:         "myns",
+					CreationTimestamp: metav1.NewTime(time.Now().Add(time.Minute)),
+					Labels: map[string]string{
+						capi.ClusterLabelName: "cluster2",
+					},
+				},
+				Spec: infrav1.Metal3DataSpec{
+					Template: corev1.ObjectReference{
+						Name: "abc",
+					},
+				},
+			},
+		}),
+		Entry("Other namespace", testCaseWatchDataCreation{
+			data: &infrav1.Metal3Data{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "abc-0",
+					Namespace:         "otherns",
+					CreationTimestamp: metav1.NewTime(time.Now().Add(time.Minute)),
+					Labels: map[string]string{
+						capi.ClusterLabelName: "cluster1",
+					},
+				},
+				Spec: infrav1.Metal3DataSpec{
+					Template: corev1.ObjectReference{
+						Name: "abc",
+					},
+				},
+			},
+		}),
+	)
+
+	It("Test addInformerHandler", func() {
+		informer := &fakeDataInformer{}
+		added := make(chan string, 10)
+		handler := func(name string) toolscache.ResourceEventHandler {
+			return toolscache.ResourceEventHandlerFuncs{
+				AddFunc: func(obj interface{}) { added <- name },
+			}
+		}
+
+		// The informer has a single handler dispatching to the others
+		removeFirst := addInformerHandler(informer, handler("first"))
+		removeSecond := addInformerHandler(informer, handler("second"))
+		Expect(informer.handlerCount()).To(Equal(1))
+		informer.add(&infrav1.Metal3Data{})
+		Expect([]string{<-added, <-added}).To(ConsistOf("first", "second"))
+
+		removeFirst()
+		informer.add(&infrav1.Metal3Data{})
+		Expect(added).To(Receive(Equal("second")))
+		Expect(added).NotTo(Receive())
+
+		removeSecond()
+		informer.add(&infrav1.Metal3Data{})
+		Expect(added).NotTo(Receive())
+		Expect(informer.handlerCount()).To(Equal(1))
+	})
+
+	type testCaseWatchOwnerReferences struct {
+		noInformers    bool
+		templateName   string
+		oldOwnerRefs   []metav1.OwnerReference
+		newOwnerRefs   []metav1.OwnerReference
+		expectedEvents []OwnerReferenceEvent
+	}
+
+	DescribeTable("Test WatchOwnerReferences",
+		func(tc testCaseWatchOwnerReferences) {
+			template := &infrav1.Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "abc",
+					Namespace: "myns",
+				},
+			}
+			templateMgr, err := NewDataTemplateManager(nil, template,
+				klogr.New(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			events := make(chan OwnerReferenceEvent, 10)
+			if tc.noInformers {
+				err = templateMgr.WatchOwnerReferences(context.TODO(), events)
+				Expect(err).To(HaveOccurred())
+				return
+			}
+
+			informer := &fakeDataInformer{}
+			templateMgr.Informers = &fakeDataInformers{informer: informer}
+
+			ctx, cancel := context.WithCancel(context.TODO())
+			watchErr := make(chan error)
+			go func() {
+				watchErr <- templateMgr.WatchOwnerReferences(ctx, events)
+			}()
+			Eventually(informer.handlerCount).Should(Equal(1))
+
+			oldTemplate := &infrav1.Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            tc.templateName,
+					Namespace:       "myns",
+					ResourceVersion: "1",
+					OwnerReferences: tc.oldOwnerRefs,
+				},
+			}
+			newTemplate := oldTemplate.DeepCopy()
+			newTemplate.ResourceVersion = "2"
+			newTemplate.OwnerReferences = tc.newOwnerRefs
+			informer.update(oldTemplate, newTemplate)
+
+			for _, expectedEvent := range tc.expectedEvents {
+				Expect(events).To(Receive(Equal(expectedEvent)))
+			}
+			Expect(events).NotTo(Receive())
+
+			cancel()
+			Eventually(watchErr).Should(Receive(BeNil()))
+		},
+		Entry("No informers", testCaseWatchOwnerReferences{
+			noInformers: true,
+		}),
+		Entry("Unchanged", testCaseWatchOwnerReferences{
+			templateName: "abc",
+			oldOwnerRefs: []metav1.OwnerReference{
+				{Kind: "Metal3DataClaim", Name: "claim1"},
+				{Kind: "Metal3DataClaim", Name: "claim2"},
+			},
+			newOwnerRefs: []metav1.OwnerReference{
+				{Kind: "Metal3DataClaim", Name: "claim2"},
+				{Kind: "Metal3DataClaim", Name: "claim1"},
+			},
+		}),
+		Entry("Added and removed", testCaseWatchOwnerReferences{
+			templateName: "abc",
+			oldOwnerRefs: []metav1.OwnerReference{
+				{Kind: "Metal3DataClaim", Name: "claim1"},
+				{Kind: "Metal3DataClaim", Name: "claim2"},
+			},
+			newOwnerRefs: []metav1.OwnerReference{
+				{Kind: "Metal3DataClaim", Name: "claim2"},
+				{Kind: "Metal3DataClaim", Name: "claim3"},
+			},
+			expectedEvents: []OwnerReferenceEvent{
+				{
+					Type:     OwnerReferenceRemoved,
+					OwnerRef: metav1.OwnerReference{Kind: "Metal3DataClaim", Name: "claim1"},
+				},
+				{
+					Type:     OwnerReferenceAdded,
+					OwnerRef: metav1.OwnerReference{Kind: "Metal3DataClaim", Name: "claim3"},
+				},
+			},
+		}),
+		Entry("Other template", testCaseWatchOwnerReferences{
+			templateName: "bbc",
+			newOwnerRefs: []metav1.OwnerReference{
+				{Kind: "Metal3DataClaim", Name: "claim1"},
+			},
+		}),
+	)
+
+	var templateMeta = metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+
+	It("Test WatchIndexChanges", func() {
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: map[string]infrav1.IndexEntry{
+					"claim0": {Index: 0, MachineName: "machine0"},
+					"claim1": {Index: 1, MachineName: "machine1"},
+					"claim2": {Index: 2},
+				},
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(nil, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		events := make(chan IndexChangeEvent, 10)
+		Expect(templateMgr.WatchIndexChanges(context.TODO(), events)).NotTo(Succeed())
+
+		informer := &fakeDataInformer{}
+		templateMgr.Informers = &fakeDataInformers{informer: informer}
+		ctx, cancel := context.WithCancel(context.TODO())
+		watchErr := make(chan error)
+		go func() {
+			watchErr <- templateMgr.WatchIndexChanges(ctx, events)
+		}()
+		Eventually(informer.handlerCount).Should(Equal(1))
+
+		oldTemplate := template.DeepCopy()
+		oldTemplate.ResourceVersion = "1"
+		newTemplate := oldTemplate.DeepCopy()
+		newTemplate.ResourceVersion = "2"
+		newTemplate.Status.Indexes = map[string]infrav1.IndexEntry{
+			"claim0": {Index: 0, MachineName: "machine0"},
+			"claim1": {Index: 3, MachineName: "machine1"},
+			"claim4": {Index: 4, MachineName: "machine4"},
+		}
+		informer.update(oldTemplate, newTemplate)
+		for _, expectedEvent := range []IndexChangeEvent{
+			{Type: IndexFreed, Index: 1, MachineName: "machine1"},
+			{Type: IndexFreed, Index: 2, MachineName: "claim2"},
+			{Type: IndexAllocated, Index: 3, MachineName: "machine1"},
+			{Type: IndexAllocated, Index: 4, MachineName: "machine4"},
+		} {
+			Expect(events).To(Receive(Equal(expectedEvent)))
+		}
+		Expect(events).NotTo(Receive())
+
+		// A resync with the same resource version and other templates are
+		// ignored
+		informer.update(newTemplate, newTemplate)
+		otherTemplate := oldTemplate.DeepCopy()
+		otherTemplate.Name = "bbc"
+		otherTemplate.ResourceVersion = "3"
+		otherTemplate.Status.Indexes = nil
+		informer.update(oldTemplate, otherTemplate)
+		Expect(events).NotTo(Receive())
+
+		cancel()
+		Eventually(watchErr).Should(Receive(BeNil()))
+
+		// The handler is removed with the watch
+		informer.update(oldTemplate, newTemplate)
+		Expect(events).NotTo(Receive())
+		Expect(informerDispatchers.dispatchers[informer].current()).To(BeEmpty())
+	})
+})
@@ -1284,6 +1284,10 @@ func (m *MachineManager) WaitForM3Metadata(ctx context.Context) error {
 		if m.Metal3Machine.Spec.DataTemplate == nil {
 			return nil
 		}
+		// The Metal3Machine opted out of the allocation, no data is rendered
+		if m.Metal3Machine.Annotations[SkipAllocationAnnotation] == "true" {
+			return nil
+		}
 		if m.Metal3Machine.Spec.DataTemplate.Namespace == "" {
 			m.Metal3Machine.Spec.DataTemplate.Namespace = m.Metal3Machine.Namespace
 		}
@@ -2991,6 +2991,18 @@ var _ = Describe("Metal3Machine manager", func() {
 			Machine:       newMachine("myName", "myName", nil),
 			ExpectRequeue: true,
 		}),
+		Entry("Skip allocation annotation", testCaseM3MetaData{
+			M3Machine: newMetal3Machine("myName", nil, &capm3.Metal3MachineSpec{
+				DataTemplate: &corev1.ObjectReference{Name: "abcd"},
+			}, nil, &metav1.ObjectMeta{
+				Name:      "myName",
+				Namespace: "myns",
+				Annotations: map[string]string{
+					SkipAllocationAnnotation: "true",
+				},
+			}),
+			Machine: newMachine("myName", "myName", nil),
+		}),
 		Entry("Data claim without status", testCaseM3MetaData{
 			M3Machine: newMetal3Machine("myName", nil, &capm3.Metal3MachineSpec{
 				DataTemplate: &corev1.ObjectReference{Name: "abcd"},
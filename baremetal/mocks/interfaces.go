@@ -0,0 +1,24 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal_mocks
+
+import (
+	baremetal "github.com/metal3-io/cluster-api-provider-metal3/baremetal"
+)
+
+// The mocks are generated, the interface drift is caught here at compile time
+var _ baremetal.DataTemplateManagerInterface = &MockDataTemplateManagerInterface{}
@@ -102,3 +102,17 @@ func (mr *MockDataManagerInterfaceMockRecorder) ReleaseLeases(ctx interface{}) *
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseLeases", reflect.TypeOf((*MockDataManagerInterface)(nil).ReleaseLeases), ctx)
 }
+
+// WaitForHost mocks base method
+func (m *MockDataManagerInterface) WaitForHost(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WaitForHost", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WaitForHost indicates an expected call of WaitForHost
+func (mr *MockDataManagerInterfaceMockRecorder) WaitForHost(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WaitForHost", reflect.TypeOf((*MockDataManagerInterface)(nil).WaitForHost), ctx)
+}
@@ -25,8 +25,11 @@ package baremetal_mocks
 import (
 	context "context"
 	gomock "github.com/golang/mock/gomock"
+	v1alpha4 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	baremetal "github.com/metal3-io/cluster-api-provider-metal3/baremetal"
 	reflect "reflect"
 	v1alpha3 "sigs.k8s.io/cluster-api/api/v1alpha3"
+	client "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // MockDataTemplateManagerInterface is a mock of DataTemplateManagerInterface interface
@@ -76,6 +79,18 @@ func (mr *MockDataTemplateManagerInterfaceMockRecorder) UnsetFinalizer() *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnsetFinalizer", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).UnsetFinalizer))
 }
 
+// DeleteMetrics mocks base method
+func (m *MockDataTemplateManagerInterface) DeleteMetrics() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "DeleteMetrics")
+}
+
+// DeleteMetrics indicates an expected call of DeleteMetrics
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) DeleteMetrics() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMetrics", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).DeleteMetrics))
+}
+
 // SetClusterOwnerRef mocks base method
 func (m *MockDataTemplateManagerInterface) SetClusterOwnerRef(arg0 *v1alpha3.Cluster) error {
 	m.ctrl.T.Helper()
@@ -90,17 +105,425 @@ func (mr *MockDataTemplateManagerInterfaceMockRecorder) SetClusterOwnerRef(arg0
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetClusterOwnerRef", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).SetClusterOwnerRef), arg0)
 }
 
+// AcquireLeaseLock mocks base method
+func (m *MockDataTemplateManagerInterface) AcquireLeaseLock(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AcquireLeaseLock", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AcquireLeaseLock indicates an expected call of AcquireLeaseLock
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) AcquireLeaseLock(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcquireLeaseLock", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).AcquireLeaseLock), arg0)
+}
+
+// ReleaseLeaseLock mocks base method
+func (m *MockDataTemplateManagerInterface) ReleaseLeaseLock(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseLeaseLock", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseLeaseLock indicates an expected call of ReleaseLeaseLock
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) ReleaseLeaseLock(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseLeaseLock", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).ReleaseLeaseLock), arg0)
+}
+
+// RecoverFromPanic mocks base method
+func (m *MockDataTemplateManagerInterface) RecoverFromPanic(arg0 context.Context, arg1 func() error) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecoverFromPanic", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecoverFromPanic indicates an expected call of RecoverFromPanic
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) RecoverFromPanic(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecoverFromPanic", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).RecoverFromPanic), arg0, arg1)
+}
+
+// Startup mocks base method
+func (m *MockDataTemplateManagerInterface) Startup(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Startup", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Startup indicates an expected call of Startup
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) Startup(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Startup", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).Startup), arg0)
+}
+
 // UpdateDatas mocks base method
-func (m *MockDataTemplateManagerInterface) UpdateDatas(arg0 context.Context) (int, error) {
+func (m *MockDataTemplateManagerInterface) UpdateDatas(arg0 context.Context, arg1 baremetal.ServiceAccountClientGetter) (int, baremetal.DeltaStatus, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateDatas", arg0)
+	ret := m.ctrl.Call(m, "UpdateDatas", arg0, arg1)
 	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(baremetal.DeltaStatus)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// UpdateDatas indicates an expected call of UpdateDatas
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) UpdateDatas(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDatas", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).UpdateDatas), arg0, arg1)
+}
+
+// GetDataForMachine mocks base method
+func (m *MockDataTemplateManagerInterface) GetDataForMachine(arg0 context.Context, arg1 string) (*v1alpha4.Metal3Data, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDataForMachine", arg0, arg1)
+	ret0, _ := ret[0].(*v1alpha4.Metal3Data)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// UpdateDatas indicates an expected call of UpdateDatas
-func (mr *MockDataTemplateManagerInterfaceMockRecorder) UpdateDatas(arg0 interface{}) *gomock.Call {
+// GetDataForMachine indicates an expected call of GetDataForMachine
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) GetDataForMachine(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDataForMachine", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).GetDataForMachine), arg0, arg1)
+}
+
+// ExplainIndex mocks base method
+func (m *MockDataTemplateManagerInterface) ExplainIndex(arg0 context.Context, arg1 int) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExplainIndex", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExplainIndex indicates an expected call of ExplainIndex
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) ExplainIndex(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExplainIndex", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).ExplainIndex), arg0, arg1)
+}
+
+// PurgeStatus mocks base method
+func (m *MockDataTemplateManagerInterface) PurgeStatus(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeStatus", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PurgeStatus indicates an expected call of PurgeStatus
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) PurgeStatus(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeStatus", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).PurgeStatus), arg0)
+}
+
+// CompactStatus mocks base method
+func (m *MockDataTemplateManagerInterface) CompactStatus(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompactStatus", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CompactStatus indicates an expected call of CompactStatus
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) CompactStatus(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompactStatus", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).CompactStatus), arg0)
+}
+
+// MigrateStatus mocks base method
+func (m *MockDataTemplateManagerInterface) MigrateStatus(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MigrateStatus", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MigrateStatus indicates an expected call of MigrateStatus
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) MigrateStatus(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MigrateStatus", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).MigrateStatus), arg0)
+}
+
+// WatchDataCreation mocks base method
+func (m *MockDataTemplateManagerInterface) WatchDataCreation(arg0 context.Context, arg1 func(v1alpha4.Metal3Data)) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WatchDataCreation", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WatchDataCreation indicates an expected call of WatchDataCreation
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) WatchDataCreation(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WatchDataCreation", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).WatchDataCreation), arg0, arg1)
+}
+
+// WatchOwnerReferences mocks base method
+func (m *MockDataTemplateManagerInterface) WatchOwnerReferences(arg0 context.Context, arg1 chan<- baremetal.OwnerReferenceEvent) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WatchOwnerReferences", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WatchOwnerReferences indicates an expected call of WatchOwnerReferences
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) WatchOwnerReferences(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WatchOwnerReferences", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).WatchOwnerReferences), arg0, arg1)
+}
+
+// WatchIndexChanges mocks base method
+func (m *MockDataTemplateManagerInterface) WatchIndexChanges(arg0 context.Context, arg1 chan<- baremetal.IndexChangeEvent) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WatchIndexChanges", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WatchIndexChanges indicates an expected call of WatchIndexChanges
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) WatchIndexChanges(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WatchIndexChanges", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).WatchIndexChanges), arg0, arg1)
+}
+
+// InspectGaps mocks base method
+func (m *MockDataTemplateManagerInterface) InspectGaps(arg0 context.Context) ([]baremetal.IndexGap, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InspectGaps", arg0)
+	ret0, _ := ret[0].([]baremetal.IndexGap)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// InspectGaps indicates an expected call of InspectGaps
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) InspectGaps(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InspectGaps", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).InspectGaps), arg0)
+}
+
+// CancelProvisioning mocks base method
+func (m *MockDataTemplateManagerInterface) CancelProvisioning(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CancelProvisioning", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CancelProvisioning indicates an expected call of CancelProvisioning
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) CancelProvisioning(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CancelProvisioning", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).CancelProvisioning), arg0, arg1)
+}
+
+// ResetIndex mocks base method
+func (m *MockDataTemplateManagerInterface) ResetIndex(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetIndex", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResetIndex indicates an expected call of ResetIndex
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) ResetIndex(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetIndex", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).ResetIndex), arg0, arg1)
+}
+
+// SimulateDelete mocks base method
+func (m *MockDataTemplateManagerInterface) SimulateDelete(arg0 context.Context, arg1 string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SimulateDelete", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SimulateDelete indicates an expected call of SimulateDelete
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) SimulateDelete(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SimulateDelete", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).SimulateDelete), arg0, arg1)
+}
+
+// Rebalance mocks base method
+func (m *MockDataTemplateManagerInterface) Rebalance(arg0 context.Context, arg1 *v1alpha4.Metal3DataTemplate, arg2 []string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Rebalance", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Rebalance indicates an expected call of Rebalance
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) Rebalance(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rebalance", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).Rebalance), arg0, arg1, arg2)
+}
+
+// PatchMachine mocks base method
+func (m *MockDataTemplateManagerInterface) PatchMachine(arg0 context.Context, arg1 string, arg2 func(*v1alpha4.Metal3Machine)) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PatchMachine", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PatchMachine indicates an expected call of PatchMachine
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) PatchMachine(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PatchMachine", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).PatchMachine), arg0, arg1, arg2)
+}
+
+// FetchRemoteStatus mocks base method
+func (m *MockDataTemplateManagerInterface) FetchRemoteStatus(arg0 context.Context, arg1 client.Client) (*v1alpha4.Metal3DataTemplateStatus, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FetchRemoteStatus", arg0, arg1)
+	ret0, _ := ret[0].(*v1alpha4.Metal3DataTemplateStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FetchRemoteStatus indicates an expected call of FetchRemoteStatus
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) FetchRemoteStatus(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchRemoteStatus", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).FetchRemoteStatus), arg0, arg1)
+}
+
+// ValidateStatusConsistency mocks base method
+func (m *MockDataTemplateManagerInterface) ValidateStatusConsistency(arg0 context.Context) ([]baremetal.StatusInconsistency, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ValidateStatusConsistency", arg0)
+	ret0, _ := ret[0].([]baremetal.StatusInconsistency)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ValidateStatusConsistency indicates an expected call of ValidateStatusConsistency
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) ValidateStatusConsistency(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ValidateStatusConsistency", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).ValidateStatusConsistency), arg0)
+}
+
+// SelfHeal mocks base method
+func (m *MockDataTemplateManagerInterface) SelfHeal(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SelfHeal", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SelfHeal indicates an expected call of SelfHeal
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) SelfHeal(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SelfHeal", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).SelfHeal), arg0)
+}
+
+// RunValidations mocks base method
+func (m *MockDataTemplateManagerInterface) RunValidations(arg0 context.Context) (*baremetal.ValidationReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RunValidations", arg0)
+	ret0, _ := ret[0].(*baremetal.ValidationReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RunValidations indicates an expected call of RunValidations
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) RunValidations(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RunValidations", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).RunValidations), arg0)
+}
+
+// LiveIndexCount mocks base method
+func (m *MockDataTemplateManagerInterface) LiveIndexCount(arg0 context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LiveIndexCount", arg0)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LiveIndexCount indicates an expected call of LiveIndexCount
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) LiveIndexCount(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LiveIndexCount", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).LiveIndexCount), arg0)
+}
+
+// StartMonitoring mocks base method
+func (m *MockDataTemplateManagerInterface) StartMonitoring(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StartMonitoring", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StartMonitoring indicates an expected call of StartMonitoring
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) StartMonitoring(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartMonitoring", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).StartMonitoring), arg0)
+}
+
+// ForEachIndex mocks base method
+func (m *MockDataTemplateManagerInterface) ForEachIndex(arg0 func(int, string, string) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ForEachIndex", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ForEachIndex indicates an expected call of ForEachIndex
+func (mr *MockDataTemplateManagerInterfaceMockRecorder) ForEachIndex(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ForEachIndex", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).ForEachIndex), arg0)
+}
+
+// MockDataTemplateMetricsRecorder is a mock of DataTemplateMetricsRecorder interface
+type MockDataTemplateMetricsRecorder struct {
+	ctrl     *gomock.Controller
+	recorder *MockDataTemplateMetricsRecorderMockRecorder
+}
+
+// MockDataTemplateMetricsRecorderMockRecorder is the mock recorder for MockDataTemplateMetricsRecorder
+type MockDataTemplateMetricsRecorderMockRecorder struct {
+	mock *MockDataTemplateMetricsRecorder
+}
+
+// NewMockDataTemplateMetricsRecorder creates a new mock instance
+func NewMockDataTemplateMetricsRecorder(ctrl *gomock.Controller) *MockDataTemplateMetricsRecorder {
+	mock := &MockDataTemplateMetricsRecorder{ctrl: ctrl}
+	mock.recorder = &MockDataTemplateMetricsRecorderMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockDataTemplateMetricsRecorder) EXPECT() *MockDataTemplateMetricsRecorderMockRecorder {
+	return m.recorder
+}
+
+// RecordAllocation mocks base method
+func (m *MockDataTemplateMetricsRecorder) RecordAllocation(template string, index int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "RecordAllocation", template, index)
+}
+
+// RecordAllocation indicates an expected call of RecordAllocation
+func (mr *MockDataTemplateMetricsRecorderMockRecorder) RecordAllocation(template, index interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordAllocation", reflect.TypeOf((*MockDataTemplateMetricsRecorder)(nil).RecordAllocation), template, index)
+}
+
+// RecordRelease mocks base method
+func (m *MockDataTemplateMetricsRecorder) RecordRelease(template string, index int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "RecordRelease", template, index)
+}
+
+// RecordRelease indicates an expected call of RecordRelease
+func (mr *MockDataTemplateMetricsRecorderMockRecorder) RecordRelease(template, index interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDatas", reflect.TypeOf((*MockDataTemplateManagerInterface)(nil).UpdateDatas), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordRelease", reflect.TypeOf((*MockDataTemplateMetricsRecorder)(nil).RecordRelease), template, index)
 }
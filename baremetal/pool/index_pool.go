@@ -0,0 +1,217 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pool combines several Metal3DataTemplates into a larger index space
+package pool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/metal3-io/cluster-api-provider-metal3/baremetal"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// requeueAfter is the delay returned while a previous Metal3DataClaim of the
+// Metal3Machine is being deleted
+const requeueAfter = time.Second * 30
+
+// Member is a Metal3DataTemplate of an IndexPool
+type Member struct {
+	// DataTemplate is the Metal3DataTemplate managed by Manager
+	DataTemplate *capm3.Metal3DataTemplate
+	Manager      baremetal.DataTemplateManagerInterface
+	// Selector restricts the Metal3Machines assigned to this template based on
+	// their labels. If nil, all the Metal3Machines can be assigned.
+	Selector labels.Selector
+}
+
+// IndexPool assigns the Metal3Machines to the Metal3DataTemplates of its
+// members, round-robin among the members whose selector matches
+type IndexPool struct {
+	client        client.Client
+	clientFactory baremetal.ServiceAccountClientGetter
+	members       []Member
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewIndexPool returns a new IndexPool. All the Metal3DataTemplates must be in
+// the same namespace.
+func NewIndexPool(client client.Client,
+	clientFactory baremetal.ServiceAccountClientGetter, members []Member,
+) (*IndexPool, error) {
+	if len(members) == 0 {
+		return nil, errors.New("No Metal3DataTemplate in the pool")
+	}
+	for _, member := range members {
+		if member.DataTemplate == nil || member.Manager == nil {
+			return nil, errors.New("Pool member without Metal3DataTemplate or manager")
+		}
+		if member.DataTemplate.Namespace != members[0].DataTemplate.Namespace {
+			return nil, errors.New("Metal3DataTemplates of a pool must be in the same namespace")
+		}
+	}
+	return &IndexPool{
+		client:        client,
+		clientFactory: clientFactory,
+		members:       members,
+	}, nil
+}
+
+// AllocateForMachine returns the Metal3DataTemplate, the Metal3Data and the
+// index allocated to the Metal3Machine. If there is no allocation yet, it
+// creates the Metal3DataClaim of the Metal3Machine for the next member whose
+// selector matches, and allocates the index. An exhausted member is skipped.
+func (p *IndexPool) AllocateForMachine(ctx context.Context, machineName string,
+) (string, string, int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, member := range p.members {
+		m3Data, err := member.Manager.GetDataForMachine(ctx, machineName)
+		if err == nil {
+			return member.DataTemplate.Name, m3Data.Name, m3Data.Spec.Index, nil
+		}
+		if _, ok := err.(*baremetal.DataNotFoundError); !ok {
+			return "", "", 0, err
+		}
+	}
+
+	m3m := &capm3.Metal3Machine{}
+	key := client.ObjectKey{
+		Name:      machineName,
+		Namespace: p.members[0].DataTemplate.Namespace,
+	}
+	if err := p.client.Get(ctx, key, m3m); err != nil {
+		return "", "", 0, errors.Wrap(err, "Failed to get Metal3Machine")
+	}
+
+	for i := 0; i < len(p.members); i++ {
+		memberIndex := (p.next + i) % len(p.members)
+		member := p.members[memberIndex]
+		if member.Selector != nil && !member.Selector.Matches(labels.Set(m3m.Labels)) {
+			continue
+		}
+
+		m3Data, err := p.allocate(ctx, member, m3m)
+		if err != nil {
+			if _, ok := errors.Cause(err).(*baremetal.IndexExhaustedError); ok {
+				continue
+			}
+			return "", "", 0, err
+		}
+		p.next = (memberIndex + 1) % len(p.members)
+		return member.DataTemplate.Name, m3Data.Name, m3Data.Spec.Index, nil
+	}
+	return "", "", 0, errors.New("No Metal3DataTemplate of the pool can allocate an index for " + machineName)
+}
+
+// allocate creates the Metal3DataClaim of the Metal3Machine for the member
+// and runs the allocation. The claim is deleted if the member is exhausted.
+// It returns a RequeueAfterError while a previous claim of the Metal3Machine
+// is being deleted.
+func (p *IndexPool) allocate(ctx context.Context, member Member,
+	m3m *capm3.Metal3Machine,
+) (*capm3.Metal3Data, error) {
+	dataClaim := &capm3.Metal3DataClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      m3m.Name,
+			Namespace: m3m.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: capm3.GroupVersion.String(),
+					Kind:       "Metal3Machine",
+					Name:       m3m.Name,
+					UID:        m3m.UID,
+					Controller: pointer.BoolPtr(true),
+				},
+			},
+			Labels: m3m.Labels,
+		},
+		Spec: capm3.Metal3DataClaimSpec{
+			Template: corev1.ObjectReference{
+				Name:      member.DataTemplate.Name,
+				Namespace: member.DataTemplate.Namespace,
+			},
+		},
+	}
+	if err := p.client.Create(ctx, dataClaim); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return nil, errors.Wrap(err, "Failed to create Metal3DataClaim")
+		}
+		existingClaim := &capm3.Metal3DataClaim{}
+		key := client.ObjectKey{Name: m3m.Name, Namespace: m3m.Namespace}
+		if err := p.client.Get(ctx, key, existingClaim); err != nil {
+			return nil, errors.Wrap(err, "Failed to get Metal3DataClaim")
+		}
+		if !existingClaim.DeletionTimestamp.IsZero() {
+			return nil, &baremetal.RequeueAfterError{RequeueAfter: requeueAfter}
+		}
+		if existingClaim.Spec.Template.Name != member.DataTemplate.Name {
+			return nil, errors.Errorf("Metal3DataClaim %s already exists for Metal3DataTemplate %s",
+				m3m.Name, existingClaim.Spec.Template.Name,
+			)
+		}
+	}
+
+	if _, _, err := member.Manager.UpdateDatas(ctx, p.clientFactory); err != nil {
+		if _, ok := errors.Cause(err).(*baremetal.IndexExhaustedError); ok {
+			if err := p.deleteDataClaim(ctx, dataClaim); err != nil {
+				return nil, err
+			}
+		}
+		return nil, err
+	}
+	return member.Manager.GetDataForMachine(ctx, m3m.Name)
+}
+
+// deleteDataClaim deletes the Metal3DataClaim of an exhausted member. It got
+// no index, so its finalizer is removed first, for the claim of the next
+// member to be created right away.
+func (p *IndexPool) deleteDataClaim(ctx context.Context,
+	dataClaim *capm3.Metal3DataClaim,
+) error {
+	existingClaim := &capm3.Metal3DataClaim{}
+	key := client.ObjectKey{Name: dataClaim.Name, Namespace: dataClaim.Namespace}
+	if err := p.client.Get(ctx, key, existingClaim); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrap(err, "Failed to get Metal3DataClaim")
+	}
+	if len(existingClaim.Finalizers) > 0 {
+		existingClaim.Finalizers = baremetal.Filter(existingClaim.Finalizers,
+			capm3.DataClaimFinalizer,
+		)
+		if err := p.client.Update(ctx, existingClaim); err != nil {
+			return errors.Wrap(err, "Failed to update Metal3DataClaim")
+		}
+	}
+	if err := p.client.Delete(ctx, existingClaim); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "Failed to delete Metal3DataClaim")
+	}
+	return nil
+}
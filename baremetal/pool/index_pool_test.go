@@ -0,0 +1,195 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pool
+
+import (
+	"context"
+	"testing"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/metal3-io/cluster-api-provider-metal3/baremetal"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newMachine(name string, machineLabels map[string]string) *capm3.Metal3Machine {
+	return &capm3.Metal3Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "myns",
+			UID:       types.UID(name + "-uid"),
+			Labels:    machineLabels,
+		},
+	}
+}
+
+func newMember(t *testing.T, c client.Client, name string, minIndex, maxIndex int,
+	selector labels.Selector,
+) Member {
+	template := &capm3.Metal3DataTemplate{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: capm3.GroupVersion.String(),
+			Kind:       "Metal3DataTemplate",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "myns",
+		},
+		Spec: capm3.Metal3DataTemplateSpec{
+			MinIndex: minIndex,
+			MaxIndex: maxIndex,
+		},
+	}
+	manager, err := baremetal.NewDataTemplateManager(c, template, klogr.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Member{
+		DataTemplate: template,
+		Manager:      manager,
+		Selector:     selector,
+	}
+}
+
+func TestNewIndexPool(t *testing.T) {
+	g := NewWithT(t)
+	c := fakeclient.NewFakeClientWithScheme(setupScheme())
+
+	_, err := NewIndexPool(c, nil, nil)
+	g.Expect(err).To(HaveOccurred())
+
+	otherNamespace := newMember(t, c, "tmpl-b", 0, 0, nil)
+	otherNamespace.DataTemplate.Namespace = "otherns"
+	_, err = NewIndexPool(c, nil, []Member{
+		newMember(t, c, "tmpl-a", 0, 0, nil), otherNamespace,
+	})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestAllocateForMachineRoundRobin(t *testing.T) {
+	g := NewWithT(t)
+	c := fakeclient.NewFakeClientWithScheme(setupScheme(),
+		newMachine("machine1", nil), newMachine("machine2", nil),
+		newMachine("machine3", nil), newMachine("machine4", nil),
+	)
+	indexPool, err := NewIndexPool(c, nil, []Member{
+		newMember(t, c, "tmpl-a", 1, 1, nil),
+		newMember(t, c, "tmpl-b", 10, 11, nil),
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	templateName, dataName, index, err := indexPool.AllocateForMachine(context.TODO(), "machine1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect([]interface{}{templateName, dataName, index}).To(Equal(
+		[]interface{}{"tmpl-a", "tmpl-a-1", 1},
+	))
+
+	templateName, dataName, index, err = indexPool.AllocateForMachine(context.TODO(), "machine2")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect([]interface{}{templateName, dataName, index}).To(Equal(
+		[]interface{}{"tmpl-b", "tmpl-b-10", 10},
+	))
+
+	// tmpl-a is exhausted
+	templateName, dataName, index, err = indexPool.AllocateForMachine(context.TODO(), "machine3")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect([]interface{}{templateName, dataName, index}).To(Equal(
+		[]interface{}{"tmpl-b", "tmpl-b-11", 11},
+	))
+
+	// An existing allocation is returned
+	templateName, dataName, index, err = indexPool.AllocateForMachine(context.TODO(), "machine1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect([]interface{}{templateName, dataName, index}).To(Equal(
+		[]interface{}{"tmpl-a", "tmpl-a-1", 1},
+	))
+
+	// The pool is exhausted and the claim is removed
+	_, _, _, err = indexPool.AllocateForMachine(context.TODO(), "machine4")
+	g.Expect(err).To(HaveOccurred())
+	dataClaims := capm3.Metal3DataClaimList{}
+	g.Expect(c.List(context.TODO(), &dataClaims)).To(Succeed())
+	g.Expect(dataClaims.Items).To(HaveLen(3))
+}
+
+func TestAllocateForMachineDeletedClaim(t *testing.T) {
+	g := NewWithT(t)
+	deletionTime := metav1.Now()
+	c := fakeclient.NewFakeClientWithScheme(setupScheme(),
+		newMachine("machine1", nil),
+		&capm3.Metal3DataClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "machine1",
+				Namespace:         "myns",
+				DeletionTimestamp: &deletionTime,
+				Finalizers:        []string{capm3.DataClaimFinalizer},
+			},
+			Spec: capm3.Metal3DataClaimSpec{
+				Template: corev1.ObjectReference{Name: "tmpl-b"},
+			},
+		},
+	)
+	indexPool, err := NewIndexPool(c, nil, []Member{
+		newMember(t, c, "tmpl-a", 0, 0, nil),
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The allocation waits for the previous claim to be gone
+	_, _, _, err = indexPool.AllocateForMachine(context.TODO(), "machine1")
+	g.Expect(err).To(BeAssignableToTypeOf(&baremetal.RequeueAfterError{}))
+}
+
+func TestAllocateForMachineSelector(t *testing.T) {
+	g := NewWithT(t)
+	c := fakeclient.NewFakeClientWithScheme(setupScheme(),
+		newMachine("machine1", map[string]string{"pool": "gpu"}),
+		newMachine("machine2", map[string]string{"pool": "cpu"}),
+	)
+	indexPool, err := NewIndexPool(c, nil, []Member{
+		newMember(t, c, "tmpl-a", 0, 0, labels.SelectorFromSet(labels.Set{"pool": "gpu"})),
+		newMember(t, c, "tmpl-b", 0, 0, labels.SelectorFromSet(labels.Set{"pool": "gpu"})),
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	templateName, _, _, err := indexPool.AllocateForMachine(context.TODO(), "machine1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(templateName).To(Equal("tmpl-a"))
+
+	_, _, _, err = indexPool.AllocateForMachine(context.TODO(), "machine2")
+	g.Expect(err).To(HaveOccurred())
+
+	_, _, _, err = indexPool.AllocateForMachine(context.TODO(), "machine3")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func setupScheme() *runtime.Scheme {
+	s := runtime.NewScheme()
+	if err := capm3.AddToScheme(s); err != nil {
+		panic(err)
+	}
+	if err := corev1.AddToScheme(s); err != nil {
+		panic(err)
+	}
+	return s
+}
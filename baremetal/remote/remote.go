@@ -15,10 +15,16 @@ package remote
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha3"
 	kcfg "sigs.k8s.io/cluster-api/util/kubeconfig"
@@ -44,3 +50,61 @@ func NewClusterClient(ctx context.Context, c client.Client, cluster *clusterv1.C
 
 	return corev1.NewForConfig(restConfig)
 }
+
+// tokenRenewalRatio is the fraction of the lifetime of a ServiceAccount token
+// after which a new one is requested, as the kubelet does
+const tokenRenewalRatio = 0.8
+
+// serviceAccountClient is a client created by the ServiceAccount client
+// getter, with the time at which its token is renewed
+type serviceAccountClient struct {
+	client  client.Client
+	renewAt time.Time
+}
+
+// NewServiceAccountClientGetter returns a function that creates clients
+// authenticated with a token requested for a ServiceAccount. The client of a
+// ServiceAccount is reused until most of the lifetime of its token has
+// elapsed, then a new token is requested.
+func NewServiceAccountClientGetter(restConfig *rest.Config, scheme *runtime.Scheme,
+) func(ctx context.Context, namespace, name string) (client.Client, error) {
+	var mu sync.Mutex
+	clients := make(map[types.NamespacedName]serviceAccountClient)
+
+	return func(ctx context.Context, namespace, name string) (client.Client, error) {
+		key := types.NamespacedName{Namespace: namespace, Name: name}
+		mu.Lock()
+		defer mu.Unlock()
+		if cached, ok := clients[key]; ok && time.Now().Before(cached.renewAt) {
+			return cached.client, nil
+		}
+
+		coreClient, err := corev1.NewForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		requestTime := time.Now()
+		tokenRequest, err := coreClient.ServiceAccounts(namespace).CreateToken(ctx,
+			name, &authenticationv1.TokenRequest{}, metav1.CreateOptions{},
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create token for ServiceAccount %q in namespace %q",
+				name, namespace)
+		}
+
+		saConfig := rest.AnonymousClientConfig(restConfig)
+		saConfig.BearerToken = tokenRequest.Status.Token
+
+		saClient, err := client.New(saConfig, client.Options{Scheme: scheme})
+		if err != nil {
+			return nil, err
+		}
+		lifetime := tokenRequest.Status.ExpirationTimestamp.Sub(requestTime)
+		clients[key] = serviceAccountClient{
+			client:  saClient,
+			renewAt: requestTime.Add(time.Duration(float64(lifetime) * tokenRenewalRatio)),
+		}
+		return saClient, nil
+	}
+}
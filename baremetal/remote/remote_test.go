@@ -15,12 +15,20 @@ package remote
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha3"
 	"sigs.k8s.io/cluster-api/util/secret"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
@@ -116,3 +124,93 @@ func TestNewClusterClient(t *testing.T) {
 	})
 
 }
+
+// newTokenServer returns an API server issuing ServiceAccount tokens valid
+// for the given lifetime, counting the token requests
+func newTokenServer(lifetime time.Duration, tokenRequests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var body interface{}
+		switch r.URL.Path {
+		case "/api":
+			body = metav1.APIVersions{Versions: []string{"v1"}}
+		case "/apis":
+			body = metav1.APIGroupList{}
+		case "/api/v1":
+			body = metav1.APIResourceList{GroupVersion: "v1"}
+		case "/api/v1/namespaces/test/serviceaccounts/sa/token":
+			atomic.AddInt32(tokenRequests, 1)
+			body = authenticationv1.TokenRequest{
+				Status: authenticationv1.TokenRequestStatus{
+					Token:               "token",
+					ExpirationTimestamp: metav1.NewTime(time.Now().Add(lifetime)),
+				},
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(body)
+	}))
+}
+
+func TestNewServiceAccountClientGetter(t *testing.T) {
+	t.Run("client reused while the token is valid", func(t *testing.T) {
+		var tokenRequests int32
+		server := newTokenServer(time.Hour, &tokenRequests)
+		defer server.Close()
+		getClient := NewServiceAccountClientGetter(&rest.Config{Host: server.URL},
+			runtime.NewScheme(),
+		)
+
+		first, err := getClient(context.TODO(), "test", "sa")
+		if err != nil {
+			t.Fatalf("Expected no errors, got %v", err)
+		}
+		second, err := getClient(context.TODO(), "test", "sa")
+		if err != nil {
+			t.Fatalf("Expected no errors, got %v", err)
+		}
+		if first != second || atomic.LoadInt32(&tokenRequests) != 1 {
+			t.Fatalf("Expected the client to be reused, got %d token requests",
+				atomic.LoadInt32(&tokenRequests),
+			)
+		}
+	})
+
+	t.Run("token renewed before it expires", func(t *testing.T) {
+		var tokenRequests int32
+		server := newTokenServer(time.Second, &tokenRequests)
+		defer server.Close()
+		getClient := NewServiceAccountClientGetter(&rest.Config{Host: server.URL},
+			runtime.NewScheme(),
+		)
+
+		if _, err := getClient(context.TODO(), "test", "sa"); err != nil {
+			t.Fatalf("Expected no errors, got %v", err)
+		}
+		time.Sleep(900 * time.Millisecond)
+		if _, err := getClient(context.TODO(), "test", "sa"); err != nil {
+			t.Fatalf("Expected no errors, got %v", err)
+		}
+		if atomic.LoadInt32(&tokenRequests) != 2 {
+			t.Fatalf("Expected a new token, got %d token requests",
+				atomic.LoadInt32(&tokenRequests),
+			)
+		}
+	})
+
+	t.Run("token request failure", func(t *testing.T) {
+		var tokenRequests int32
+		server := newTokenServer(time.Hour, &tokenRequests)
+		defer server.Close()
+		getClient := NewServiceAccountClientGetter(&rest.Config{Host: server.URL},
+			runtime.NewScheme(),
+		)
+
+		_, err := getClient(context.TODO(), "test", "unknown")
+		if err == nil || !strings.Contains(err.Error(), "failed to create token") {
+			t.Fatalf("Expected a token error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// maxStatusObjectSize is the maximum size of the JSON of the Indexes stored
+// in a ConfigMap or a Secret, whose data is limited to 1 MiB
+const maxStatusObjectSize = 1024*1024 - 1024
+
+// statusStoreWatchInterval is how often Watch reads the Indexes
+var statusStoreWatchInterval = 10 * time.Second
+
+// StatusStore stores the Indexes of the status of a Metal3DataTemplate
+// outside of the Metal3DataTemplate
+type StatusStore interface {
+	// Get returns the stored Indexes, nil if none are stored
+	Get(context.Context) (map[string]capm3.IndexEntry, error)
+	// Set stores the Indexes
+	Set(context.Context, map[string]capm3.IndexEntry) error
+	// Watch calls onChange with the Indexes each time they change, until the
+	// context is cancelled
+	Watch(context.Context, func(map[string]capm3.IndexEntry)) error
+	// Delete removes the stored Indexes
+	Delete(context.Context) error
+}
+
+// NewStatusStore returns the StatusStore of the backend for the
+// Metal3DataTemplate, or nil for the Etcd backend, which stores the Indexes
+// in the Metal3DataTemplate or the external status Secret
+func NewStatusStore(ctx context.Context, cl client.Client,
+	dataTemplate *capm3.Metal3DataTemplate, backend capm3.StatusStoreBackend,
+) (StatusStore, error) {
+	switch backend {
+	case "", capm3.StatusStoreBackendEtcd:
+		return nil, nil
+	case capm3.StatusStoreBackendConfigMap:
+		return &configMapStatusStore{client: cl, dataTemplate: dataTemplate}, nil
+	default:
+		return nil, errors.Errorf("Unknown status store backend %s", backend)
+	}
+}
+
+// watchStatusStore polls the store every statusStoreWatchInterval and calls
+// onChange when the Indexes changed, until the context is cancelled
+func watchStatusStore(ctx context.Context, store StatusStore,
+	onChange func(map[string]capm3.IndexEntry),
+) error {
+	indexes, err := store.Get(ctx)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(statusStoreWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		current, err := store.Get(ctx)
+		if err != nil || reflect.DeepEqual(current, indexes) {
+			continue
+		}
+		indexes = current
+		onChange(current)
+	}
+}
+
+// configMapStatusStore stores the Indexes in a ConfigMap named
+// <template name>-status, owned by the Metal3DataTemplate. The Indexes must
+// fit in the 1 MiB of data of a ConfigMap.
+type configMapStatusStore struct {
+	client       client.Client
+	dataTemplate *capm3.Metal3DataTemplate
+}
+
+func (s *configMapStatusStore) key() client.ObjectKey {
+	return client.ObjectKey{
+		Name:      s.dataTemplate.Name + ExternalStatusSecretSuffix,
+		Namespace: s.dataTemplate.Namespace,
+	}
+}
+
+// Get implements StatusStore
+func (s *configMapStatusStore) Get(ctx context.Context,
+) (map[string]capm3.IndexEntry, error) {
+	configMap := &corev1.ConfigMap{}
+	if err := s.client.Get(ctx, s.key(), configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "Failed to get the status ConfigMap")
+	}
+	indexes := make(map[string]capm3.IndexEntry)
+	if err := json.Unmarshal(
+		[]byte(configMap.Data[ExternalStatusSecretKey]), &indexes,
+	); err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshal the indexes")
+	}
+	return indexes, nil
+}
+
+// Set implements StatusStore
+func (s *configMapStatusStore) Set(ctx context.Context,
+	indexes map[string]capm3.IndexEntry,
+) error {
+	indexesJSON, err := json.Marshal(indexes)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the indexes")
+	}
+	if len(indexesJSON) > maxStatusObjectSize {
+		return errors.Errorf("The indexes, %d bytes, do not fit in the status ConfigMap",
+			len(indexesJSON),
+		)
+	}
+	configMap := &corev1.ConfigMap{}
+	err = s.client.Get(ctx, s.key(), configMap)
+	if err == nil {
+		// The ConfigMap is only written when its content changes
+		if configMap.Data[ExternalStatusSecretKey] == string(indexesJSON) {
+			return nil
+		}
+		configMap.Data = map[string]string{ExternalStatusSecretKey: string(indexesJSON)}
+		return errors.Wrap(s.client.Update(ctx, configMap),
+			"Failed to update the status ConfigMap",
+		)
+	} else if !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "Failed to get the status ConfigMap")
+	}
+	configMap = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.key().Name,
+			Namespace: s.key().Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					Controller: pointer.BoolPtr(true),
+					APIVersion: s.dataTemplate.APIVersion,
+					Kind:       s.dataTemplate.Kind,
+					Name:       s.dataTemplate.Name,
+					UID:        s.dataTemplate.UID,
+				},
+			},
+		},
+		Data: map[string]string{ExternalStatusSecretKey: string(indexesJSON)},
+	}
+	return errors.Wrap(s.client.Create(ctx, configMap),
+		"Failed to create the status ConfigMap",
+	)
+}
+
+// Watch implements StatusStore
+func (s *configMapStatusStore) Watch(ctx context.Context,
+	onChange func(map[string]capm3.IndexEntry),
+) error {
+	return watchStatusStore(ctx, s, onChange)
+}
+
+// Delete implements StatusStore
+func (s *configMapStatusStore) Delete(ctx context.Context) error {
+	configMap := &corev1.ConfigMap{}
+	if err := s.client.Get(ctx, s.key(), configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrap(err, "Failed to get the status ConfigMap")
+	}
+	if err := s.client.Delete(ctx, configMap); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "Failed to delete the status ConfigMap")
+	}
+	return nil
+}
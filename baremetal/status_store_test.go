@@ -0,0 +1,142 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package baremetal
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Status stores", func() {
+	templateMeta := metav1.ObjectMeta{
+		Name:      "abc",
+		Namespace: "myns",
+	}
+	indexes := map[string]infrav1.IndexEntry{
+		"machine1": {Index: 1, MachineName: "machine1"},
+	}
+
+	It("Stores the indexes in a ConfigMap", func() {
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		template := &infrav1.Metal3DataTemplate{ObjectMeta: templateMeta}
+		store, err := NewStatusStore(context.TODO(), c, template,
+			infrav1.StatusStoreBackendConfigMap,
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		storedIndexes, err := store.Get(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(storedIndexes).To(BeNil())
+
+		// Set creates the ConfigMap, then updates it
+		Expect(store.Set(context.TODO(), map[string]infrav1.IndexEntry{})).To(Succeed())
+		Expect(store.Set(context.TODO(), indexes)).To(Succeed())
+		configMap := &corev1.ConfigMap{}
+		key := client.ObjectKey{Name: "abc-status", Namespace: "myns"}
+		Expect(c.Get(context.TODO(), key, configMap)).To(Succeed())
+		Expect(configMap.OwnerReferences).To(HaveLen(1))
+		storedIndexes, err = store.Get(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(storedIndexes).To(Equal(indexes))
+
+		Expect(store.Delete(context.TODO())).To(Succeed())
+		Expect(c.Get(context.TODO(), key, &corev1.ConfigMap{})).NotTo(Succeed())
+		Expect(store.Delete(context.TODO())).To(Succeed())
+
+		// Indexes too large for a ConfigMap are refused
+		tooLarge := map[string]infrav1.IndexEntry{
+			"machine1": {MachineName: strings.Repeat("a", maxStatusObjectSize)},
+		}
+		Expect(store.Set(context.TODO(), tooLarge)).To(MatchError(
+			ContainSubstring("do not fit in the status ConfigMap"),
+		))
+	})
+
+	It("Watches the changes of the indexes", func() {
+		watchInterval := statusStoreWatchInterval
+		statusStoreWatchInterval = 10 * time.Millisecond
+		defer func() { statusStoreWatchInterval = watchInterval }()
+
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		template := &infrav1.Metal3DataTemplate{ObjectMeta: templateMeta}
+		store, err := NewStatusStore(context.TODO(), c, template,
+			infrav1.StatusStoreBackendConfigMap,
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.TODO())
+		changes := make(chan map[string]infrav1.IndexEntry, 10)
+		done := make(chan error)
+		go func() {
+			done <- store.Watch(ctx, func(indexes map[string]infrav1.IndexEntry) {
+				changes <- indexes
+			})
+		}()
+		// Let the watch read the initial, empty, indexes
+		time.Sleep(50 * time.Millisecond)
+		Expect(changes).NotTo(Receive())
+
+		Expect(store.Set(context.TODO(), indexes)).To(Succeed())
+		Eventually(changes).Should(Receive(Equal(indexes)))
+		Consistently(changes, 50*time.Millisecond).ShouldNot(Receive())
+
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("Moves the indexes between the backends", func() {
+		c := fakeclient.NewFakeClientWithScheme(setupSchemeMm())
+		template := &infrav1.Metal3DataTemplate{
+			ObjectMeta: templateMeta,
+			Spec: infrav1.Metal3DataTemplateSpec{
+				StatusStoreBackend: infrav1.StatusStoreBackendConfigMap,
+			},
+			Status: infrav1.Metal3DataTemplateStatus{
+				Indexes: indexes,
+			},
+		}
+		templateMgr, err := NewDataTemplateManager(c, template, klogr.New())
+		Expect(err).NotTo(HaveOccurred())
+		key := client.ObjectKey{Name: "abc-status", Namespace: "myns"}
+
+		Expect(templateMgr.storeExternalStatus(context.TODO())).To(Succeed())
+		Expect(template.Status.Indexes).To(BeNil())
+		Expect(template.Status.StatusStoreBackend).To(Equal(infrav1.StatusStoreBackendConfigMap))
+		Expect(c.Get(context.TODO(), key, &corev1.ConfigMap{})).To(Succeed())
+		storedIndexes, err := statusIndexes(context.TODO(), c, template)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(storedIndexes).To(Equal(indexes))
+
+		// Back to Etcd, the ConfigMap is deleted
+		template.Spec.StatusStoreBackend = infrav1.StatusStoreBackendEtcd
+		template.Status.Indexes = storedIndexes
+		Expect(templateMgr.storeExternalStatus(context.TODO())).To(Succeed())
+		Expect(template.Status.Indexes).To(Equal(indexes))
+		Expect(template.Status.StatusStoreBackend).To(BeEmpty())
+		Expect(c.Get(context.TODO(), key, &corev1.ConfigMap{})).NotTo(Succeed())
+	})
+})
@@ -54,6 +54,8 @@ const (
 )
 
 func TestManagers(t *testing.T) {
+	// The webhooks of the tests are served locally
+	allowLoopbackWebhooks = true
 	RegisterFailHandler(Fail)
 
 	RunSpecs(t, "Manager Suite")
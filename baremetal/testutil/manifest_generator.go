@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testutil contains helpers to build the objects used in the tests
+// of the baremetal package.
+package testutil
+
+import (
+	"strconv"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+)
+
+// ManifestGenerator generates objects consistent with a Metal3DataTemplate,
+// as the Metal3DataTemplate controller would create them.
+type ManifestGenerator struct {
+	// ClaimNamePrefix is the prefix of the names of the Metal3DataClaims and
+	// Metal3Machines owning the generated objects. Defaults to "machine".
+	ClaimNamePrefix string
+
+	// Labels are set on the generated objects, in addition to the cluster
+	// label.
+	Labels map[string]string
+}
+
+// GenerateForTemplate returns count Metal3Data objects with sequential
+// indexes starting at the MinIndex of the template. The Metal3Data with
+// index i is named <template>-<i> and is owned by the template, the
+// Metal3DataClaim and the Metal3Machine named <prefix>-<i>.
+func (g ManifestGenerator) GenerateForTemplate(template *capm3.Metal3DataTemplate,
+	count int,
+) []capm3.Metal3Data {
+	claimNamePrefix := g.ClaimNamePrefix
+	if claimNamePrefix == "" {
+		claimNamePrefix = "machine"
+	}
+
+	datas := make([]capm3.Metal3Data, 0, count)
+	for i := 0; i < count; i++ {
+		index := template.Spec.MinIndex + i
+		claimName := claimNamePrefix + "-" + strconv.Itoa(index)
+
+		labels := make(map[string]string)
+		for key, value := range g.Labels {
+			labels[key] = value
+		}
+		if template.Spec.ClusterName != "" {
+			labels[capi.ClusterLabelName] = template.Spec.ClusterName
+		}
+
+		datas = append(datas, capm3.Metal3Data{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "Metal3Data",
+				APIVersion: capm3.GroupVersion.String(),
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      template.Name + "-" + strconv.Itoa(index),
+				Namespace: template.Namespace,
+				Labels:    labels,
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						Controller: pointer.BoolPtr(true),
+						APIVersion: capm3.GroupVersion.String(),
+						Kind:       "Metal3DataTemplate",
+						Name:       template.Name,
+						UID:        template.UID,
+					},
+					{
+						APIVersion: capm3.GroupVersion.String(),
+						Kind:       "Metal3DataClaim",
+						Name:       claimName,
+						UID:        types.UID(claimName + "-claim-uid"),
+					},
+					{
+						APIVersion: capm3.GroupVersion.String(),
+						Kind:       "Metal3Machine",
+						Name:       claimName,
+						UID:        types.UID(claimName + "-machine-uid"),
+					},
+				},
+			},
+			Spec: capm3.Metal3DataSpec{
+				Index: index,
+				Template: corev1.ObjectReference{
+					Name:      template.Name,
+					Namespace: template.Namespace,
+				},
+				Claim: corev1.ObjectReference{
+					Name:      claimName,
+					Namespace: template.Namespace,
+				},
+			},
+		})
+	}
+	return datas
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"testing"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+)
+
+func TestGenerateForTemplate(t *testing.T) {
+	g := NewWithT(t)
+
+	template := &capm3.Metal3DataTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "abc",
+			Namespace: "myns",
+			UID:       "abc-uid",
+		},
+		Spec: capm3.Metal3DataTemplateSpec{
+			ClusterName: "cluster1",
+			MinIndex:    3,
+		},
+	}
+
+	g.Expect(ManifestGenerator{}.GenerateForTemplate(template, 0)).To(BeEmpty())
+
+	datas := ManifestGenerator{
+		Labels: map[string]string{"foo": "bar"},
+	}.GenerateForTemplate(template, 2)
+	g.Expect(datas).To(HaveLen(2))
+	for i, data := range datas {
+		g.Expect(data.Spec.Index).To(Equal(3 + i))
+		g.Expect(data.Namespace).To(Equal("myns"))
+		g.Expect(data.Spec.Template.Name).To(Equal("abc"))
+		g.Expect(data.Labels).To(Equal(map[string]string{
+			"foo":                 "bar",
+			capi.ClusterLabelName: "cluster1",
+		}))
+		g.Expect(metav1.IsControlledBy(&data, template)).To(BeTrue())
+		g.Expect(data.OwnerReferences[1].Name).To(Equal(data.Spec.Claim.Name))
+		g.Expect(data.OwnerReferences[2].Kind).To(Equal("Metal3Machine"))
+	}
+	g.Expect(datas[0].Name).To(Equal("abc-3"))
+	g.Expect(datas[0].Spec.Claim.Name).To(Equal("machine-3"))
+	g.Expect(datas[1].Name).To(Equal("abc-4"))
+
+	datas = ManifestGenerator{ClaimNamePrefix: "m3m"}.GenerateForTemplate(template, 1)
+	g.Expect(datas[0].Spec.Claim.Name).To(Equal("m3m-3"))
+}
@@ -18,7 +18,12 @@ package baremetal
 
 import (
 	"context"
+	"net"
+	"net/http"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	// comment for go-lint
 	"github.com/go-logr/logr"
@@ -39,6 +44,10 @@ import (
 const (
 	// metal3SecretType defines the type of secret created by metal3
 	metal3SecretType corev1.SecretType = "infrastructure.cluster.x-k8s.io/secret"
+
+	// AllocationTimestampAnnotation is set on a Metal3Data when it is created
+	// to the time of its allocation, in nanoseconds since the Unix epoch
+	AllocationTimestampAnnotation = "metal3.io/allocation-timestamp"
 )
 
 // Filter filters a list for a string.
@@ -222,9 +231,63 @@ func fetchM3DataTemplate(ctx context.Context,
 		return nil, errors.New("Metal3DataTemplate associated with another cluster")
 	}
 
+	if err := MergeBaseTemplates(ctx, cl, metal3DataTemplate); err != nil {
+		return nil, err
+	}
+
 	return metal3DataTemplate, nil
 }
 
+// MergeBaseTemplates merges the data rendering fields of the chain of base
+// templates of the Metal3DataTemplate into its spec: MetaData, NetworkData,
+// HelmTemplateConfigMapRef and DataAnnotations. Each of them that is unset
+// takes the value of the closest base template setting it. The other fields,
+// for the allocation, locking and access of the template, are not inherited.
+// It returns an error if the chain has a cycle, and a RequeueAfterError if a
+// base template does not exist.
+func MergeBaseTemplates(ctx context.Context, cl client.Client,
+	dataTemplate *capm3.Metal3DataTemplate,
+) error {
+	visited := map[string]bool{dataTemplate.Name: true}
+	baseTemplateRef := dataTemplate.Spec.BaseTemplateRef
+	for baseTemplateRef != nil {
+		if visited[baseTemplateRef.Name] {
+			return errors.New("Circular base template reference to " +
+				baseTemplateRef.Name,
+			)
+		}
+		visited[baseTemplateRef.Name] = true
+
+		baseTemplate := &capm3.Metal3DataTemplate{}
+		key := client.ObjectKey{
+			Name:      baseTemplateRef.Name,
+			Namespace: dataTemplate.Namespace,
+		}
+		if err := cl.Get(ctx, key, baseTemplate); err != nil {
+			if apierrors.IsNotFound(err) {
+				return &RequeueAfterError{RequeueAfter: requeueAfter}
+			}
+			return errors.Wrap(err, "Failed to get base Metal3DataTemplate")
+		}
+
+		spec := &dataTemplate.Spec
+		if spec.MetaData == nil {
+			spec.MetaData = baseTemplate.Spec.MetaData
+		}
+		if spec.NetworkData == nil {
+			spec.NetworkData = baseTemplate.Spec.NetworkData
+		}
+		if spec.HelmTemplateConfigMapRef == nil {
+			spec.HelmTemplateConfigMapRef = baseTemplate.Spec.HelmTemplateConfigMapRef
+		}
+		if spec.DataAnnotations == nil {
+			spec.DataAnnotations = baseTemplate.Spec.DataAnnotations
+		}
+		baseTemplateRef = baseTemplate.Spec.BaseTemplateRef
+	}
+	return nil
+}
+
 func fetchM3DataClaim(ctx context.Context, cl client.Client, mLog logr.Logger,
 	name, namespace string,
 ) (*capm3.Metal3DataClaim, error) {
@@ -311,3 +374,55 @@ func getM3Machine(ctx context.Context, cl client.Client, mLog logr.Logger,
 func parseProviderID(providerID string) string {
 	return strings.TrimPrefix(providerID, "metal3://")
 }
+
+// GetAllocationTimestamp returns the time of allocation of a Metal3Data from
+// its AllocationTimestampAnnotation, and false if the annotation is not set
+// or invalid
+func GetAllocationTimestamp(data *capm3.Metal3Data) (time.Time, bool) {
+	value, ok := data.Annotations[AllocationTimestampAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	nanoseconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanoseconds), true
+}
+
+// allowLoopbackWebhooks lets the webhook clients connect to the loopback
+// addresses, for the tests
+var allowLoopbackWebhooks = false
+
+// newWebhookClient returns an HTTP client for the external URLs set in the
+// Metal3DataTemplates. It refuses to connect to the loopback, link-local and
+// unspecified addresses, once the host name is resolved, so that a template
+// can not make the controller reach its own host or the metadata service of
+// the cloud provider.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: controlWebhookAddress,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// controlWebhookAddress fails if the resolved address of a webhook
+// connection is not allowed
+func controlWebhookAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("Invalid address %s", address)
+	}
+	if (ip.IsLoopback() && !allowLoopbackWebhooks) || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return errors.Errorf("Connecting to %s is not allowed", host)
+	}
+	return nil
+}
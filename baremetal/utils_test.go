@@ -24,16 +24,16 @@ import (
 	. "github.com/onsi/gomega"
 
 	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	//"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/utils/pointer"
-	"sigs.k8s.io/controller-runtime/pkg/client"
-	//fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/klog/klogr"
+	"k8s.io/utils/pointer"
 	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
 	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 var _ = Describe("Metal3 manager utils", func() {
@@ -551,6 +551,117 @@ var _ = Describe("Metal3 manager utils", func() {
 		}),
 	)
 
+	type testCaseMergeBaseTemplates struct {
+		baseTemplates []*capm3.Metal3DataTemplate
+		expectError   bool
+		expectRequeue bool
+		expectedSpec  capm3.Metal3DataTemplateSpec
+	}
+
+	DescribeTable("Test MergeBaseTemplates",
+		func(tc testCaseMergeBaseTemplates) {
+			objects := []runtime.Object{}
+			for _, baseTemplate := range tc.baseTemplates {
+				objects = append(objects, baseTemplate)
+			}
+			c := fakeclient.NewFakeClientWithScheme(setupSchemeMm(), objects...)
+			dataTemplate := &capm3.Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "worker",
+					Namespace: "myns",
+				},
+				Spec: capm3.Metal3DataTemplateSpec{
+					ClusterName:     "abc",
+					BaseTemplateRef: &corev1.LocalObjectReference{Name: "base"},
+					MaxIndex:        10,
+				},
+			}
+
+			err := MergeBaseTemplates(context.TODO(), c, dataTemplate)
+			if tc.expectError || tc.expectRequeue {
+				Expect(err).To(HaveOccurred())
+				if tc.expectRequeue {
+					Expect(err).To(BeAssignableToTypeOf(&RequeueAfterError{}))
+				} else {
+					Expect(err).NotTo(BeAssignableToTypeOf(&RequeueAfterError{}))
+				}
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataTemplate.Spec).To(Equal(tc.expectedSpec))
+		},
+		Entry("Base template does not exist", testCaseMergeBaseTemplates{
+			expectRequeue: true,
+		}),
+		Entry("Chain of base templates", testCaseMergeBaseTemplates{
+			baseTemplates: []*capm3.Metal3DataTemplate{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "base",
+						Namespace: "myns",
+					},
+					Spec: capm3.Metal3DataTemplateSpec{
+						ClusterName:     "abc",
+						BaseTemplateRef: &corev1.LocalObjectReference{Name: "root"},
+						MinIndex:        1,
+						MaxIndex:        5,
+						MetaData: &capm3.MetaData{
+							Strings: []capm3.MetaDataString{
+								{Key: "role", Value: "worker"},
+							},
+						},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "root",
+						Namespace: "myns",
+					},
+					Spec: capm3.Metal3DataTemplateSpec{
+						ClusterName:        "abc",
+						MinIndex:           2,
+						MaxOwnerReferences: 3,
+						TenantIsolation:    true,
+						MetaData: &capm3.MetaData{
+							Strings: []capm3.MetaDataString{
+								{Key: "role", Value: "base"},
+							},
+						},
+						NetworkData:     &capm3.NetworkData{},
+						DataAnnotations: map[string]string{"site": "paris"},
+					},
+				},
+			},
+			expectedSpec: capm3.Metal3DataTemplateSpec{
+				ClusterName:     "abc",
+				BaseTemplateRef: &corev1.LocalObjectReference{Name: "base"},
+				MaxIndex:        10,
+				MetaData: &capm3.MetaData{
+					Strings: []capm3.MetaDataString{
+						{Key: "role", Value: "worker"},
+					},
+				},
+				NetworkData:     &capm3.NetworkData{},
+				DataAnnotations: map[string]string{"site": "paris"},
+			},
+		}),
+		Entry("Circular base templates", testCaseMergeBaseTemplates{
+			baseTemplates: []*capm3.Metal3DataTemplate{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "base",
+						Namespace: "myns",
+					},
+					Spec: capm3.Metal3DataTemplateSpec{
+						ClusterName:     "abc",
+						BaseTemplateRef: &corev1.LocalObjectReference{Name: "worker"},
+					},
+				},
+			},
+			expectError: true,
+		}),
+	)
+
 	type testCaseFetchM3Data struct {
 		Data          *capm3.Metal3Data
 		Name          string
@@ -736,4 +847,21 @@ var _ = Describe("Metal3 manager utils", func() {
 		Expect(parseProviderID("metal3://abcd")).To(Equal("abcd"))
 		Expect(parseProviderID("foo://abcd")).To(Equal("foo://abcd"))
 	})
+
+	It("Gets the allocation timestamp of a Metal3Data", func() {
+		data := &capm3.Metal3Data{}
+		_, ok := GetAllocationTimestamp(data)
+		Expect(ok).To(BeFalse())
+
+		data.Annotations = map[string]string{
+			AllocationTimestampAnnotation: "invalid",
+		}
+		_, ok = GetAllocationTimestamp(data)
+		Expect(ok).To(BeFalse())
+
+		data.Annotations[AllocationTimestampAnnotation] = "1600000000123456789"
+		timestamp, ok := GetAllocationTimestamp(data)
+		Expect(ok).To(BeTrue())
+		Expect(timestamp.UnixNano()).To(BeEquivalentTo(1600000000123456789))
+	})
 })
@@ -140,6 +140,11 @@ func (r *Metal3DataReconciler) reconcileDelete(ctx context.Context,
 		return checkRequeueError(err, "Failed to release IP address leases")
 	}
 
+	err = metadataMgr.WaitForHost(ctx)
+	if err != nil {
+		return checkRequeueError(err, "Failed to wait for the BareMetalHost")
+	}
+
 	metadataMgr.UnsetFinalizer()
 
 	return ctrl.Result{}, nil
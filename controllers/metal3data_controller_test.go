@@ -100,6 +100,7 @@ var _ = Describe("Metal3Data manager", func() {
 						m.EXPECT().ReleaseLeases(context.TODO()).Return(errors.New(""))
 					} else {
 						m.EXPECT().ReleaseLeases(context.TODO()).Return(nil)
+						m.EXPECT().WaitForHost(context.TODO()).Return(nil)
 						m.EXPECT().UnsetFinalizer()
 					}
 				}
@@ -305,6 +306,7 @@ var _ = Describe("Metal3Data manager", func() {
 		ExpectRequeue        bool
 		ReleaseLeasesRequeue bool
 		ReleaseLeasesError   bool
+		WaitForHostRequeue   bool
 	}
 
 	DescribeTable("ReconcileDelete tests",
@@ -324,8 +326,12 @@ var _ = Describe("Metal3Data manager", func() {
 				m.EXPECT().ReleaseLeases(context.TODO()).Return(&baremetal.RequeueAfterError{})
 			} else if tc.ReleaseLeasesError {
 				m.EXPECT().ReleaseLeases(context.TODO()).Return(errors.New(""))
+			} else if tc.WaitForHostRequeue {
+				m.EXPECT().ReleaseLeases(context.TODO()).Return(nil)
+				m.EXPECT().WaitForHost(context.TODO()).Return(&baremetal.RequeueAfterError{})
 			} else {
 				m.EXPECT().ReleaseLeases(context.TODO()).Return(nil)
+				m.EXPECT().WaitForHost(context.TODO()).Return(nil)
 				m.EXPECT().UnsetFinalizer()
 			}
 
@@ -357,6 +363,11 @@ var _ = Describe("Metal3Data manager", func() {
 			ExpectRequeue:        true,
 			ReleaseLeasesRequeue: true,
 		}),
+		Entry("Reconcile waits for the BareMetalHost", reconcileDeleteTestCase{
+			ExpectError:        false,
+			ExpectRequeue:      true,
+			WaitForHostRequeue: true,
+		}),
 	)
 
 	type testCaseMetal3IPClaimToMetal3Data struct {
@@ -18,6 +18,9 @@ package controllers
 
 import (
 	"context"
+	"reflect"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
@@ -25,12 +28,17 @@ import (
 	"github.com/pkg/errors"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/flowcontrol"
 	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
 	"sigs.k8s.io/cluster-api/util"
 	"sigs.k8s.io/cluster-api/util/patch"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
@@ -40,9 +48,36 @@ const (
 
 // Metal3DataTemplateReconciler reconciles a Metal3DataTemplate object
 type Metal3DataTemplateReconciler struct {
-	Client         client.Client
-	ManagerFactory baremetal.ManagerFactoryInterface
-	Log            logr.Logger
+	Client                     client.Client
+	ManagerFactory             baremetal.ManagerFactoryInterface
+	Log                        logr.Logger
+	ServiceAccountClientGetter baremetal.ServiceAccountClientGetter
+	// StatusRecreateThrottle, if set, is shared by all reconciliations to
+	// space out the listing of the Metal3Data objects across templates.
+	StatusRecreateThrottle flowcontrol.RateLimiter
+	// MaxConcurrentReconciles is the maximum number of concurrent
+	// reconciliations. If unset, the default of controller-runtime is used.
+	MaxConcurrentReconciles int
+
+	// startups holds a *dataTemplateStartup per Metal3DataTemplate, by
+	// namespaced name
+	startups sync.Map
+	// monitors holds a *dataTemplateMonitor per monitored
+	// Metal3DataTemplate, by namespaced name
+	monitors sync.Map
+}
+
+// dataTemplateMonitor is the background monitoring of a Metal3DataTemplate,
+// started with its MonitoringInterval
+type dataTemplateMonitor struct {
+	interval time.Duration
+	cancel   context.CancelFunc
+}
+
+// dataTemplateStartup runs the Startup of a Metal3DataTemplate once
+type dataTemplateStartup struct {
+	once sync.Once
+	err  error
 }
 
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=metal3datatemplates,verbs=get;list;watch;create;update;patch;delete
@@ -51,41 +86,81 @@ type Metal3DataTemplateReconciler struct {
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=metal3datas/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=metal3dataclaims,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=metal3dataclaims/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=metal3machines,verbs=get;list;watch
+// +kubebuilder:rbac:groups=metal3.io,resources=baremetalhosts,verbs=get;list;watch
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=metal3ipclaims,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=metal3ipclaims/status,verbs=get
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=metal3ipaddresses,verbs=get;list;watch
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=metal3ipaddresses/status,verbs=get
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;list;watch
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters/status,verbs=get
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;delete
+// +kubebuilder:rbac:groups="",resources=resourcequotas,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=events,verbs=get;list;watch;create;update;patch
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=serviceaccounts/token,verbs=create
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;create;update;delete
 
 // Reconcile handles Metal3Machine events
 func (r *Metal3DataTemplateReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, rerr error) {
-	ctx := context.Background()
+	// Cancelling the context at the end of the reconciliation stops the
+	// renewal of the LeaderElectionLease
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	metadataLog := r.Log.WithName(dataTemplateControllerName).WithValues("metal3-datatemplate", req.NamespacedName)
 
+	baremetal.StartDataTemplateReconcile(req.NamespacedName)
+	defer baremetal.EndDataTemplateReconcile(req.NamespacedName)
+
 	// Fetch the Metal3DataTemplate instance.
 	capm3DataTemplate := &capm3.Metal3DataTemplate{}
 
 	if err := r.Client.Get(ctx, req.NamespacedName, capm3DataTemplate); err != nil {
 		if apierrors.IsNotFound(err) {
+			r.startups.Delete(req.NamespacedName)
+			r.stopMonitoring(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
 	}
+	ctx = baremetal.WithClusterName(ctx, capm3DataTemplate.Spec.ClusterName)
+
 	helper, err := patch.NewHelper(capm3DataTemplate, r.Client)
 	if err != nil {
 		return ctrl.Result{}, errors.Wrap(err, "failed to init patch helper")
 	}
+	// The spec merged with the base templates is not persisted
+	ownSpec := capm3DataTemplate.Spec.DeepCopy()
+	// The Lease lock, if any, is released once the status is patched
+	var lockedMgr baremetal.DataTemplateManagerInterface
 	// Always patch capm3Machine exiting this function so we can persist any Metal3Machine changes.
 	defer func() {
+		capm3DataTemplate.Spec = *ownSpec
 		err := helper.Patch(ctx, capm3DataTemplate)
 		if err != nil {
 			metadataLog.Info("failed to Patch capm3DataTemplate")
 		}
+		if lockedMgr != nil {
+			if err := lockedMgr.ReleaseLeaseLock(ctx); err != nil {
+				metadataLog.Error(err, "failed to release the Lease lock")
+			}
+		}
 	}()
 
+	// Leave the template to a newer controller, unless it is being deleted
+	if capm3DataTemplate.ObjectMeta.DeletionTimestamp.IsZero() &&
+		!baremetal.CheckControllerVersion(capm3DataTemplate) {
+		metadataLog.Info("Controller version older than the minControllerVersion, not reconciling",
+			"minControllerVersion", capm3DataTemplate.Spec.MinControllerVersion,
+		)
+		return ctrl.Result{}, nil
+	}
+
+	if baremetal.RecordSpecRevision(capm3DataTemplate) {
+		metadataLog.Info("Spec changed, recorded a new revision")
+	}
+
 	cluster := &capi.Cluster{}
 	key := client.ObjectKey{
 		Name:      capm3DataTemplate.Spec.ClusterName,
@@ -119,13 +194,65 @@ func (r *Metal3DataTemplateReconciler) Reconcile(req ctrl.Request) (_ ctrl.Resul
 		}
 	}
 
+	// The LeaderElectionLease is kept, and renewed, across reconciliations
+	if capm3DataTemplate.Spec.UseLeaseLock || capm3DataTemplate.Spec.LeaderElectionLease != nil {
+		if err := metadataMgr.AcquireLeaseLock(ctx); err != nil {
+			return checkRequeueError(err, "Failed to acquire the Lease lock")
+		}
+		if capm3DataTemplate.Spec.UseLeaseLock {
+			lockedMgr = metadataMgr
+		}
+	}
+
 	// Handle deleted metadata
 	if !capm3DataTemplate.ObjectMeta.DeletionTimestamp.IsZero() {
-		return r.reconcileDelete(ctx, metadataMgr)
+		r.stopMonitoring(req.NamespacedName)
+		return r.recoverReconcile(ctx, metadataMgr, r.reconcileDelete)
+	}
+
+	if err := r.startup(ctx, req.NamespacedName, metadataMgr); err != nil {
+		return checkRequeueError(err, "Failed to start the Metal3DataTemplate")
+	}
+
+	if err := r.monitor(ctx, req.NamespacedName, capm3DataTemplate, metadataMgr); err != nil {
+		return checkRequeueError(err, "Failed to start the monitoring")
+	}
+
+	if err := baremetal.MergeBaseTemplates(ctx, r.Client, capm3DataTemplate); err != nil {
+		return checkRequeueError(err, "Failed to merge the base templates")
+	}
+
+	// Reset the status if the operator confirmed it
+	if capm3DataTemplate.Annotations[baremetal.ConfirmPurgeAnnotation] == "true" {
+		if err := metadataMgr.PurgeStatus(ctx); err != nil {
+			return checkRequeueError(err, "Failed to purge the status")
+		}
 	}
 
 	// Handle non-deleted machines
-	return r.reconcileNormal(ctx, metadataMgr)
+	return r.recoverReconcile(ctx, metadataMgr, r.reconcileNormal)
+}
+
+// recoverReconcile runs reconcile, requeueing the reconciliation instead of
+// crashing the controller if it panics. The manager records the panic as a
+// Warning Event on the Metal3DataTemplate.
+func (r *Metal3DataTemplateReconciler) recoverReconcile(ctx context.Context,
+	metadataMgr baremetal.DataTemplateManagerInterface,
+	reconcile func(context.Context, baremetal.DataTemplateManagerInterface) (ctrl.Result, error),
+) (ctrl.Result, error) {
+	var res ctrl.Result
+	recovered, err := metadataMgr.RecoverFromPanic(ctx, func() error {
+		var err error
+		res, err = reconcile(ctx, metadataMgr)
+		return err
+	})
+	if recovered {
+		r.Log.WithName(dataTemplateControllerName).Info(
+			"Reconciliation panicked, requeuing", "error", err.Error(),
+		)
+		return ctrl.Result{Requeue: true, RequeueAfter: requeueAfter}, nil
+	}
+	return res, err
 }
 
 func (r *Metal3DataTemplateReconciler) reconcileNormal(ctx context.Context,
@@ -134,44 +261,169 @@ func (r *Metal3DataTemplateReconciler) reconcileNormal(ctx context.Context,
 	// If the Metal3DataTemplate doesn't have finalizer, add it.
 	metadataMgr.SetFinalizer()
 
-	_, err := metadataMgr.UpdateDatas(ctx)
+	r.throttleStatusRecreate()
+	_, delta, err := metadataMgr.UpdateDatas(ctx, r.ServiceAccountClientGetter)
 	if err != nil {
 		return checkRequeueError(err, "Failed to recreate the status")
 	}
-	return ctrl.Result{}, nil
+	r.logDeltaStatus(delta)
+	// Requeue to free the reserved indexes when their reservation expires
+	return ctrl.Result{RequeueAfter: delta.RequeueAfter}, nil
 }
 
 func (r *Metal3DataTemplateReconciler) reconcileDelete(ctx context.Context,
 	metadataMgr baremetal.DataTemplateManagerInterface,
 ) (ctrl.Result, error) {
 
-	allocationsNb, err := metadataMgr.UpdateDatas(ctx)
+	r.throttleStatusRecreate()
+	allocationsNb, delta, err := metadataMgr.UpdateDatas(ctx, r.ServiceAccountClientGetter)
 	if err != nil {
 		return checkRequeueError(err, "Failed to recreate the status")
 	}
+	r.logDeltaStatus(delta)
 
 	if allocationsNb == 0 {
 		// metal3datatemplate is marked for deletion and ready to be deleted,
-		// so remove the finalizer.
+		// so remove the finalizer and its metrics.
 		metadataMgr.UnsetFinalizer()
+		metadataMgr.DeleteMetrics()
 	}
 
 	return ctrl.Result{}, nil
 }
 
+// logDeltaStatus logs the allocations created and deleted by UpdateDatas
+func (r *Metal3DataTemplateReconciler) logDeltaStatus(delta baremetal.DeltaStatus) {
+	log := r.Log.WithName(dataTemplateControllerName)
+	for _, allocation := range delta.Created {
+		log.Info("Allocated index", "index", allocation.Index,
+			"machine", allocation.MachineName, "data", allocation.DataName,
+		)
+	}
+	for _, allocation := range delta.Deleted {
+		log.Info("Released index", "index", allocation.Index,
+			"machine", allocation.MachineName, "data", allocation.DataName,
+		)
+	}
+	if delta.RequeueNeeded {
+		log.Info("Metal3DataClaims are waiting for an index")
+	}
+}
+
+// startup calls the Startup of the manager the first time the
+// Metal3DataTemplate is reconciled, once even if concurrent reconciliations
+// race. It is called again in the next reconciliation if it failed.
+func (r *Metal3DataTemplateReconciler) startup(ctx context.Context,
+	key types.NamespacedName, metadataMgr baremetal.DataTemplateManagerInterface,
+) error {
+	value, _ := r.startups.LoadOrStore(key, &dataTemplateStartup{})
+	startup := value.(*dataTemplateStartup)
+	startup.once.Do(func() {
+		startup.err = metadataMgr.Startup(ctx)
+	})
+	if startup.err != nil {
+		r.startups.Delete(key)
+		return startup.err
+	}
+	return nil
+}
+
+// monitor starts the monitoring of the Metal3DataTemplate if it has a
+// MonitoringInterval, once per template. The monitoring is restarted if the
+// interval changed, and stopped if it was unset. It runs with its own
+// context, that the reconciliation does not cancel.
+func (r *Metal3DataTemplateReconciler) monitor(ctx context.Context,
+	key types.NamespacedName, dataTemplate *capm3.Metal3DataTemplate,
+	metadataMgr baremetal.DataTemplateManagerInterface,
+) error {
+	if dataTemplate.Spec.MonitoringInterval == nil {
+		r.stopMonitoring(key)
+		return nil
+	}
+	interval := dataTemplate.Spec.MonitoringInterval.Duration
+	if value, ok := r.monitors.Load(key); ok {
+		if value.(*dataTemplateMonitor).interval == interval {
+			return nil
+		}
+		r.stopMonitoring(key)
+	}
+
+	monitorCtx, cancel := context.WithCancel(
+		baremetal.WithClusterName(context.Background(), dataTemplate.Spec.ClusterName),
+	)
+	if err := metadataMgr.StartMonitoring(monitorCtx); err != nil {
+		cancel()
+		return err
+	}
+	r.monitors.Store(key, &dataTemplateMonitor{interval: interval, cancel: cancel})
+	return nil
+}
+
+// stopMonitoring stops the monitoring of the Metal3DataTemplate, if any
+func (r *Metal3DataTemplateReconciler) stopMonitoring(key types.NamespacedName) {
+	if value, ok := r.monitors.Load(key); ok {
+		value.(*dataTemplateMonitor).cancel()
+		r.monitors.Delete(key)
+	}
+}
+
+// throttleStatusRecreate blocks until the StatusRecreateThrottle allows a new
+// listing of the Metal3Data objects
+func (r *Metal3DataTemplateReconciler) throttleStatusRecreate() {
+	if r.StatusRecreateThrottle != nil {
+		r.StatusRecreateThrottle.Accept()
+	}
+}
+
 // SetupWithManager will add watches for this controller
 func (r *Metal3DataTemplateReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&capm3.Metal3DataTemplate{}).
+		For(&capm3.Metal3DataTemplate{},
+			builder.WithPredicates(predicate.Funcs{UpdateFunc: r.UpdatePredicate}),
+		).
 		Watches(
 			&source.Kind{Type: &capm3.Metal3DataClaim{}},
 			&handler.EnqueueRequestsFromMapFunc{
 				ToRequests: handler.ToRequestsFunc(r.Metal3DataClaimToMetal3DataTemplate),
 			},
 		).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: r.MaxConcurrentReconciles,
+		}).
 		Complete(r)
 }
 
+// UpdatePredicate filters out the update events of a Metal3DataTemplate where
+// only Status.LastUpdated and Status.ConcurrentReconcileCount changed, since
+// the reconciler sets them on every reconciliation and would otherwise
+// trigger itself
+func (r *Metal3DataTemplateReconciler) UpdatePredicate(e event.UpdateEvent) bool {
+	oldTemplate, ok := e.ObjectOld.(*capm3.Metal3DataTemplate)
+	if !ok {
+		return true
+	}
+	newTemplate, ok := e.ObjectNew.(*capm3.Metal3DataTemplate)
+	if !ok {
+		return true
+	}
+	oldTemplate = oldTemplate.DeepCopy()
+	newTemplate = newTemplate.DeepCopy()
+
+	// The resource version and managed fields change on every write
+	oldTemplate.ResourceVersion = ""
+	newTemplate.ResourceVersion = ""
+	oldTemplate.ManagedFields = nil
+	newTemplate.ManagedFields = nil
+	oldTemplate.Status.LastUpdated = nil
+	newTemplate.Status.LastUpdated = nil
+	oldTemplate.Status.ConcurrentReconcileCount = 0
+	newTemplate.Status.ConcurrentReconcileCount = 0
+
+	return !reflect.DeepEqual(oldTemplate.ObjectMeta, newTemplate.ObjectMeta) ||
+		!reflect.DeepEqual(oldTemplate.Spec, newTemplate.Spec) ||
+		!reflect.DeepEqual(oldTemplate.Status, newTemplate.Status)
+}
+
 // Metal3DataClaimToMetal3DataTemplate will return a reconcile request for a
 // Metal3DataTemplate if the event is for a
 // Metal3DataClaim and that Metal3DataClaim references a Metal3DataTemplate
@@ -18,6 +18,8 @@ package controllers
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
@@ -27,19 +29,36 @@ import (
 	infrav1 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
 	"github.com/metal3-io/cluster-api-provider-metal3/baremetal"
 	baremetal_mocks "github.com/metal3-io/cluster-api-provider-metal3/baremetal/mocks"
+	"github.com/metal3-io/cluster-api-provider-metal3/version"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/klog/klogr"
 	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/util/conditions"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+// fakeThrottleClock is a flowcontrol.Clock where sleeping advances the time
+type fakeThrottleClock struct {
+	now time.Time
+}
+
+func (c *fakeThrottleClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeThrottleClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
 var _ = Describe("Metal3DataTemplate manager", func() {
 
 	type testCaseReconcile struct {
@@ -53,6 +72,7 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 		reconcileNormalError bool
 		reconcileDeleteError bool
 		setOwnerRefError     bool
+		startupError         bool
 	}
 
 	DescribeTable("Test Reconcile",
@@ -76,6 +96,11 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 				f.EXPECT().NewDataTemplateManager(gomock.Any(), gomock.Any()).Return(m, nil)
 			}
 			if tc.expectManager {
+				m.EXPECT().RecoverFromPanic(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_ context.Context, fn func() error) (bool, error) {
+						return false, fn()
+					},
+				).AnyTimes()
 				if tc.setOwnerRefError {
 					m.EXPECT().SetClusterOwnerRef(gomock.Any()).Return(errors.New(""))
 				} else {
@@ -85,19 +110,26 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 				}
 			}
 			if tc.m3dt != nil && !tc.m3dt.DeletionTimestamp.IsZero() && tc.reconcileDeleteError {
-				m.EXPECT().UpdateDatas(context.TODO()).Return(0, errors.New(""))
+				m.EXPECT().UpdateDatas(gomock.Any(), nil).Return(0, baremetal.DeltaStatus{}, errors.New(""))
 			} else if tc.m3dt != nil && !tc.m3dt.DeletionTimestamp.IsZero() {
-				m.EXPECT().UpdateDatas(context.TODO()).Return(0, nil)
+				m.EXPECT().UpdateDatas(gomock.Any(), nil).Return(0, baremetal.DeltaStatus{}, nil)
 				m.EXPECT().UnsetFinalizer()
+				m.EXPECT().DeleteMetrics()
+			}
+
+			if tc.m3dt != nil && tc.m3dt.DeletionTimestamp.IsZero() &&
+				tc.startupError {
+				m.EXPECT().Startup(gomock.Any()).Return(errors.New(""))
 			}
 
 			if tc.m3dt != nil && tc.m3dt.DeletionTimestamp.IsZero() &&
 				tc.reconcileNormal {
+				m.EXPECT().Startup(gomock.Any()).Return(nil)
 				m.EXPECT().SetFinalizer()
 				if tc.reconcileNormalError {
-					m.EXPECT().UpdateDatas(context.TODO()).Return(0, errors.New(""))
+					m.EXPECT().UpdateDatas(gomock.Any(), nil).Return(0, baremetal.DeltaStatus{}, errors.New(""))
 				} else {
-					m.EXPECT().UpdateDatas(context.TODO()).Return(1, nil)
+					m.EXPECT().UpdateDatas(gomock.Any(), nil).Return(1, baremetal.DeltaStatus{}, nil)
 				}
 			}
 
@@ -116,7 +148,8 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 
 			result, err := dataTemplateReconcile.Reconcile(req)
 
-			if tc.expectError || tc.managerError || tc.reconcileNormalError {
+			if tc.expectError || tc.managerError || tc.reconcileNormalError ||
+				tc.startupError {
 				Expect(err).To(HaveOccurred())
 			} else {
 				Expect(err).NotTo(HaveOccurred())
@@ -183,6 +216,17 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 			},
 			managerError: true,
 		}),
+		Entry("Startup error", testCaseReconcile{
+			m3dt: &infrav1.Metal3DataTemplate{
+				ObjectMeta: testObjectMeta,
+				Spec:       infrav1.Metal3DataTemplateSpec{ClusterName: "abc"},
+			},
+			cluster: &capi.Cluster{
+				ObjectMeta: testObjectMeta,
+			},
+			startupError:  true,
+			expectManager: true,
+		}),
 		Entry("Reconcile normal error", testCaseReconcile{
 			m3dt: &infrav1.Metal3DataTemplate{
 				ObjectMeta: testObjectMeta,
@@ -212,6 +256,7 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 		ExpectError   bool
 		ExpectRequeue bool
 		UpdateError   bool
+		RequeueAfter  time.Duration
 	}
 
 	DescribeTable("ReconcileNormal tests",
@@ -230,9 +275,11 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 			m.EXPECT().SetFinalizer()
 
 			if !tc.UpdateError {
-				m.EXPECT().UpdateDatas(context.TODO()).Return(1, nil)
+				m.EXPECT().UpdateDatas(context.TODO(), nil).Return(1, baremetal.DeltaStatus{
+					RequeueAfter: tc.RequeueAfter,
+				}, nil)
 			} else {
-				m.EXPECT().UpdateDatas(context.TODO()).Return(0, errors.New(""))
+				m.EXPECT().UpdateDatas(context.TODO(), nil).Return(0, baremetal.DeltaStatus{}, errors.New(""))
 			}
 
 			res, err := dataTemplateReconcile.reconcileNormal(context.TODO(), m)
@@ -248,11 +295,17 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 			} else {
 				Expect(res.Requeue).To(BeFalse())
 			}
+			Expect(res.RequeueAfter).To(Equal(tc.RequeueAfter))
 		},
 		Entry("No error", reconcileNormalTestCase{
 			ExpectError:   false,
 			ExpectRequeue: false,
 		}),
+		Entry("Reserved indexes", reconcileNormalTestCase{
+			ExpectError:   false,
+			ExpectRequeue: false,
+			RequeueAfter:  time.Hour,
+		}),
 		Entry("Update error", reconcileNormalTestCase{
 			UpdateError:   true,
 			ExpectError:   true,
@@ -281,12 +334,13 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 			m := baremetal_mocks.NewMockDataTemplateManagerInterface(gomockCtrl)
 
 			if !tc.DeleteError && tc.DeleteReady {
-				m.EXPECT().UpdateDatas(context.TODO()).Return(0, nil)
+				m.EXPECT().UpdateDatas(context.TODO(), nil).Return(0, baremetal.DeltaStatus{}, nil)
 				m.EXPECT().UnsetFinalizer()
+				m.EXPECT().DeleteMetrics()
 			} else if !tc.DeleteError {
-				m.EXPECT().UpdateDatas(context.TODO()).Return(1, nil)
+				m.EXPECT().UpdateDatas(context.TODO(), nil).Return(1, baremetal.DeltaStatus{}, nil)
 			} else {
-				m.EXPECT().UpdateDatas(context.TODO()).Return(0, errors.New(""))
+				m.EXPECT().UpdateDatas(context.TODO(), nil).Return(0, baremetal.DeltaStatus{}, errors.New(""))
 			}
 
 			res, err := dataTemplateReconcile.reconcileDelete(context.TODO(), m)
@@ -320,6 +374,196 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 		}),
 	)
 
+	It("Spaces out the status recreation across templates", func() {
+		gomockCtrl := gomock.NewController(GinkgoT())
+		clock := &fakeThrottleClock{now: time.Now()}
+
+		dataTemplateReconcile := &Metal3DataTemplateReconciler{
+			Client: fake.NewFakeClientWithScheme(setupScheme()),
+			Log:    klogr.New(),
+			StatusRecreateThrottle: flowcontrol.NewTokenBucketRateLimiterWithClock(
+				10, 1, clock,
+			),
+		}
+
+		listTimes := []time.Time{}
+		for i := 0; i < 10; i++ {
+			m := baremetal_mocks.NewMockDataTemplateManagerInterface(gomockCtrl)
+			m.EXPECT().SetFinalizer()
+			m.EXPECT().UpdateDatas(context.TODO(), nil).DoAndReturn(
+				func(ctx context.Context, clientFactory baremetal.ServiceAccountClientGetter) (int, baremetal.DeltaStatus, error) {
+					listTimes = append(listTimes, clock.Now())
+					return 1, baremetal.DeltaStatus{}, nil
+				},
+			)
+			_, err := dataTemplateReconcile.reconcileNormal(context.TODO(), m)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		gomockCtrl.Finish()
+
+		Expect(len(listTimes)).To(Equal(10))
+		for i := 1; i < len(listTimes); i++ {
+			Expect(listTimes[i].Sub(listTimes[i-1])).To(
+				BeNumerically("~", 100*time.Millisecond, time.Millisecond),
+			)
+		}
+	})
+
+	It("Does not reconcile templates requiring a newer controller", func() {
+		controllerVersion := version.Version
+		version.Version = "v1.2.0"
+		defer func() { version.Version = controllerVersion }()
+
+		gomockCtrl := gomock.NewController(GinkgoT())
+		f := baremetal_mocks.NewMockManagerFactoryInterface(gomockCtrl)
+		c := fake.NewFakeClientWithScheme(setupScheme(),
+			&infrav1.Metal3DataTemplate{
+				ObjectMeta: testObjectMeta,
+				Spec: infrav1.Metal3DataTemplateSpec{
+					ClusterName:          "abc",
+					MinControllerVersion: "v1.4.0",
+				},
+			},
+		)
+		dataTemplateReconcile := &Metal3DataTemplateReconciler{
+			Client:         c,
+			ManagerFactory: f,
+			Log:            klogr.New(),
+		}
+
+		key := types.NamespacedName{Name: "abc", Namespace: "myns"}
+		_, err := dataTemplateReconcile.Reconcile(reconcile.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		gomockCtrl.Finish()
+
+		savedTemplate := &infrav1.Metal3DataTemplate{}
+		Expect(c.Get(context.TODO(), key, savedTemplate)).To(Succeed())
+		Expect(conditions.IsTrue(savedTemplate,
+			infrav1.IncompatibleControllerVersionCondition,
+		)).To(BeTrue())
+
+		// A template being deleted is still deleted
+		gomockCtrl = gomock.NewController(GinkgoT())
+		f = baremetal_mocks.NewMockManagerFactoryInterface(gomockCtrl)
+		dataTemplateReconcile.ManagerFactory = f
+		savedTemplate.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+		Expect(c.Update(context.TODO(), savedTemplate)).To(Succeed())
+		f.EXPECT().NewDataTemplateManager(gomock.Any(), gomock.Any()).Return(nil,
+			errors.New(""),
+		)
+		_, err = dataTemplateReconcile.Reconcile(reconcile.Request{NamespacedName: key})
+		Expect(err).To(HaveOccurred())
+		gomockCtrl.Finish()
+	})
+
+	It("Starts each template once", func() {
+		gomockCtrl := gomock.NewController(GinkgoT())
+		m := baremetal_mocks.NewMockDataTemplateManagerInterface(gomockCtrl)
+		dataTemplateReconcile := &Metal3DataTemplateReconciler{
+			Client: fake.NewFakeClientWithScheme(setupScheme()),
+			Log:    klogr.New(),
+		}
+		key := types.NamespacedName{Name: "abc", Namespace: "myns"}
+
+		// A failed startup is retried
+		m.EXPECT().Startup(gomock.Any()).Return(errors.New(""))
+		Expect(dataTemplateReconcile.startup(context.TODO(), key, m)).NotTo(Succeed())
+
+		m.EXPECT().Startup(gomock.Any()).Return(nil).Times(1)
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				Expect(dataTemplateReconcile.startup(context.TODO(), key, m)).To(Succeed())
+			}()
+		}
+		wg.Wait()
+		gomockCtrl.Finish()
+	})
+
+	It("Monitors each template once", func() {
+		gomockCtrl := gomock.NewController(GinkgoT())
+		m := baremetal_mocks.NewMockDataTemplateManagerInterface(gomockCtrl)
+		dataTemplateReconcile := &Metal3DataTemplateReconciler{
+			Client: fake.NewFakeClientWithScheme(setupScheme()),
+			Log:    klogr.New(),
+		}
+		key := types.NamespacedName{Name: "abc", Namespace: "myns"}
+		template := &infrav1.Metal3DataTemplate{}
+
+		// Nothing is started without a MonitoringInterval
+		Expect(dataTemplateReconcile.monitor(context.TODO(), key, template, m)).To(Succeed())
+
+		// A failed start is retried
+		template.Spec.MonitoringInterval = &metav1.Duration{Duration: time.Minute}
+		m.EXPECT().StartMonitoring(gomock.Any()).Return(errors.New(""))
+		Expect(dataTemplateReconcile.monitor(context.TODO(), key, template, m)).NotTo(Succeed())
+
+		var monitorCtx context.Context
+		m.EXPECT().StartMonitoring(gomock.Any()).DoAndReturn(
+			func(ctx context.Context) error {
+				monitorCtx = ctx
+				return nil
+			},
+		).Times(1)
+		for i := 0; i < 3; i++ {
+			Expect(dataTemplateReconcile.monitor(context.TODO(), key, template, m)).To(Succeed())
+		}
+		Expect(monitorCtx.Err()).NotTo(HaveOccurred())
+
+		// A new interval restarts the monitoring
+		template.Spec.MonitoringInterval = &metav1.Duration{Duration: time.Hour}
+		firstCtx := monitorCtx
+		m.EXPECT().StartMonitoring(gomock.Any()).DoAndReturn(
+			func(ctx context.Context) error {
+				monitorCtx = ctx
+				return nil
+			},
+		)
+		Expect(dataTemplateReconcile.monitor(context.TODO(), key, template, m)).To(Succeed())
+		Expect(firstCtx.Err()).To(HaveOccurred())
+		Expect(monitorCtx.Err()).NotTo(HaveOccurred())
+
+		// The monitoring stops with the template
+		dataTemplateReconcile.stopMonitoring(key)
+		Expect(monitorCtx.Err()).To(HaveOccurred())
+		gomockCtrl.Finish()
+	})
+
+	It("Requeues a panicking reconciliation", func() {
+		gomockCtrl := gomock.NewController(GinkgoT())
+		m := baremetal_mocks.NewMockDataTemplateManagerInterface(gomockCtrl)
+		dataTemplateReconcile := &Metal3DataTemplateReconciler{
+			Client: fake.NewFakeClientWithScheme(setupScheme()),
+			Log:    klogr.New(),
+		}
+
+		m.EXPECT().RecoverFromPanic(context.TODO(), gomock.Any()).Return(
+			true, &baremetal.PanicError{Value: "nil map"},
+		)
+		res, err := dataTemplateReconcile.recoverReconcile(context.TODO(), m,
+			dataTemplateReconcile.reconcileNormal,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.RequeueAfter).To(Equal(requeueAfter))
+
+		// Without a panic, the result of the reconciliation is returned
+		m.EXPECT().RecoverFromPanic(context.TODO(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, fn func() error) (bool, error) {
+				return false, fn()
+			},
+		)
+		m.EXPECT().SetFinalizer()
+		m.EXPECT().UpdateDatas(context.TODO(), nil).Return(0, baremetal.DeltaStatus{}, errors.New(""))
+		_, err = dataTemplateReconcile.recoverReconcile(context.TODO(), m,
+			dataTemplateReconcile.reconcileNormal,
+		)
+		Expect(err).To(HaveOccurred())
+		gomockCtrl.Finish()
+	})
+
 	type TestCaseM3DCToM3DT struct {
 		DataClaim     *infrav1.Metal3DataClaim
 		ExpectRequest bool
@@ -390,6 +634,71 @@ var _ = Describe("Metal3DataTemplate manager", func() {
 		),
 	)
 
+	type TestCaseUpdatePredicate struct {
+		Update        func(*infrav1.Metal3DataTemplate)
+		ExpectRequest bool
+	}
+
+	DescribeTable("Metal3DataTemplate UpdatePredicate",
+		func(tc TestCaseUpdatePredicate) {
+			lastUpdated := metav1.Now()
+			oldTemplate := &infrav1.Metal3DataTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "abc",
+					Namespace:       "myns",
+					ResourceVersion: "1",
+				},
+				Spec: infrav1.Metal3DataTemplateSpec{ClusterName: "abc"},
+				Status: infrav1.Metal3DataTemplateStatus{
+					LastUpdated: &lastUpdated,
+					Indexes: map[string]infrav1.IndexEntry{
+						"machine-0": {Index: 0},
+					},
+				},
+			}
+			newTemplate := oldTemplate.DeepCopy()
+			newUpdated := metav1.NewTime(lastUpdated.Add(time.Minute))
+			newTemplate.ResourceVersion = "2"
+			newTemplate.Status.LastUpdated = &newUpdated
+			tc.Update(newTemplate)
+
+			r := Metal3DataTemplateReconciler{}
+			Expect(r.UpdatePredicate(event.UpdateEvent{
+				MetaOld:   oldTemplate,
+				ObjectOld: oldTemplate,
+				MetaNew:   newTemplate,
+				ObjectNew: newTemplate,
+			})).To(Equal(tc.ExpectRequest))
+		},
+		Entry("Only LastUpdated changed", TestCaseUpdatePredicate{
+			Update: func(m3dt *infrav1.Metal3DataTemplate) {},
+		}),
+		Entry("Only LastUpdated and ConcurrentReconcileCount changed", TestCaseUpdatePredicate{
+			Update: func(m3dt *infrav1.Metal3DataTemplate) {
+				m3dt.Status.ConcurrentReconcileCount = 2
+			},
+		}),
+		Entry("Spec changed", TestCaseUpdatePredicate{
+			Update: func(m3dt *infrav1.Metal3DataTemplate) {
+				m3dt.Spec.ClusterName = "def"
+			},
+			ExpectRequest: true,
+		}),
+		Entry("Status changed", TestCaseUpdatePredicate{
+			Update: func(m3dt *infrav1.Metal3DataTemplate) {
+				m3dt.Status.Indexes = map[string]infrav1.IndexEntry{}
+			},
+			ExpectRequest: true,
+		}),
+		Entry("Deletion requested", TestCaseUpdatePredicate{
+			Update: func(m3dt *infrav1.Metal3DataTemplate) {
+				now := metav1.Now()
+				m3dt.DeletionTimestamp = &now
+			},
+			ExpectRequest: true,
+		}),
+	)
+
 	It("Test checkRequeueError", func() {
 		result, err := checkRequeueError(nil, "")
 		Expect(err).NotTo(HaveOccurred())
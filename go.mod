@@ -9,6 +9,7 @@ require (
 	github.com/go-openapi/swag v0.19.9 // indirect
 	github.com/gobuffalo/envy v1.7.1 // indirect
 	github.com/golang/mock v1.4.4
+	github.com/google/cel-go v0.6.0
 	github.com/google/go-cmp v0.5.2 // indirect
 	github.com/google/gofuzz v1.2.0
 	github.com/google/uuid v1.1.2 // indirect
@@ -21,6 +22,7 @@ require (
 	github.com/onsi/gomega v1.10.2
 	github.com/operator-framework/operator-sdk v0.17.0 // indirect
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
 	github.com/prometheus/common v0.13.0 // indirect
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a // indirect
 	golang.org/x/net v0.0.0-20200904194848-62affa334b73
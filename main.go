@@ -20,6 +20,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	bmoapis "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
@@ -29,6 +30,7 @@ import (
 	"github.com/metal3-io/cluster-api-provider-metal3/baremetal"
 	capm3remote "github.com/metal3-io/cluster-api-provider-metal3/baremetal/remote"
 	"github.com/metal3-io/cluster-api-provider-metal3/controllers"
+	"github.com/metal3-io/cluster-api-provider-metal3/webhooks"
 	ipamv1 "github.com/metal3-io/ip-address-manager/api/v1alpha1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -36,6 +38,7 @@ import (
 	"k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/klog"
 	"k8s.io/klog/klogr"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha3"
@@ -54,6 +57,9 @@ var (
 	webhookPort             int
 	healthAddr              string
 	watchNamespace          string
+	statusRecreateThrottle  time.Duration
+	maxConcurrentReconciles int
+	ownerKinds              string
 )
 
 func init() {
@@ -80,6 +86,12 @@ func main() {
 		"Webhook Server port (set to 0 to disable)")
 	flag.StringVar(&healthAddr, "health-addr", ":9440",
 		"The address the health endpoint binds to.")
+	flag.DurationVar(&statusRecreateThrottle, "status-recreate-throttle", 0,
+		"The minimum interval between two listings of the Metal3Data objects across Metal3DataTemplates (e.g. 100ms). Set to 0 to disable.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The maximum number of concurrent reconciliations of the Metal3DataTemplates.")
+	flag.StringVar(&ownerKinds, "owner-kinds", strings.Join(baremetal.DefaultOwnerKindFilter, ","),
+		"Comma separated kinds of the owner references, in the group of the Metal3Machines, recognized as the machine of a Metal3DataClaim.")
 	flag.Parse()
 
 	ctrl.SetLogger(klogr.New())
@@ -119,6 +131,15 @@ func main() {
 	}
 }
 
+// newStatusRecreateThrottle returns a rate limiter allowing one listing of the
+// Metal3Data objects per interval, or nil if the interval is not positive
+func newStatusRecreateThrottle(interval time.Duration) flowcontrol.RateLimiter {
+	if interval <= 0 {
+		return nil
+	}
+	return flowcontrol.NewTokenBucketRateLimiter(float32(time.Second)/float32(interval), 1)
+}
+
 func waitForAPIs(cfg *rest.Config) error {
 	c, err := discovery.NewDiscoveryClientForConfig(cfg)
 	if err != nil {
@@ -179,10 +200,24 @@ func setupReconcilers(mgr ctrl.Manager) {
 		os.Exit(1)
 	}
 
+	// The data managers recognize the machines of the owner kinds
+	dataManagerFactory := baremetal.NewManagerFactoryWithOwnerKindFilter(
+		mgr.GetClient(), strings.Split(ownerKinds, ","),
+	)
+	// The data template managers record the Events of the templates, and
+	// watch the objects with the cache of the manager
+	dataTemplateManagerFactory := dataManagerFactory.WithEventRecorder(
+		mgr.GetEventRecorderFor("metal3datatemplate-controller"),
+	).WithInformers(mgr.GetCache())
 	if err := (&controllers.Metal3DataTemplateReconciler{
 		Client:         mgr.GetClient(),
-		ManagerFactory: baremetal.NewManagerFactory(mgr.GetClient()),
+		ManagerFactory: dataTemplateManagerFactory,
 		Log:            ctrl.Log.WithName("controllers").WithName("Metal3DataTemplate"),
+		ServiceAccountClientGetter: capm3remote.NewServiceAccountClientGetter(
+			mgr.GetConfig(), mgr.GetScheme(),
+		),
+		StatusRecreateThrottle:  newStatusRecreateThrottle(statusRecreateThrottle),
+		MaxConcurrentReconciles: maxConcurrentReconciles,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Metal3DataTemplateReconciler")
 		os.Exit(1)
@@ -190,7 +225,7 @@ func setupReconcilers(mgr ctrl.Manager) {
 
 	if err := (&controllers.Metal3DataReconciler{
 		Client:         mgr.GetClient(),
-		ManagerFactory: baremetal.NewManagerFactory(mgr.GetClient()),
+		ManagerFactory: dataManagerFactory,
 		Log:            ctrl.Log.WithName("controllers").WithName("Metal3Data"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Metal3DataReconciler")
@@ -287,4 +322,27 @@ func setupWebhooks(mgr ctrl.Manager) {
 		setupLog.Error(err, "unable to create webhook", "webhook", "Metal3DataClaim")
 		os.Exit(1)
 	}
+
+	if err := (&webhooks.NamespaceQuotaGuard{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("webhooks").WithName("NamespaceQuotaGuard"),
+	}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "NamespaceQuotaGuard")
+		os.Exit(1)
+	}
+
+	if err := (&webhooks.AllocationConditionGuard{
+		Log: ctrl.Log.WithName("webhooks").WithName("AllocationConditionGuard"),
+	}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "AllocationConditionGuard")
+		os.Exit(1)
+	}
+
+	if err := (&webhooks.BaseTemplateGuard{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("webhooks").WithName("BaseTemplateGuard"),
+	}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "BaseTemplateGuard")
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,79 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/metal3-io/cluster-api-provider-metal3/baremetal"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// AllocationConditionGuardPath is the path of the AllocationConditionGuard
+// webhook
+const AllocationConditionGuardPath = "/validate-infrastructure-cluster-x-k8s-io-v1alpha4-metal3datatemplate-allocationcondition"
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-infrastructure-cluster-x-k8s-io-v1alpha4-metal3datatemplate-allocationcondition,mutating=false,failurePolicy=fail,groups=infrastructure.cluster.x-k8s.io,resources=metal3datatemplates,versions=v1alpha4,name=allocationcondition.metal3datatemplate.infrastructure.cluster.x-k8s.io,matchPolicy=Equivalent
+
+// AllocationConditionGuard rejects the Metal3DataTemplates whose
+// AllocationCondition does not compile. It is compiled by the controller, so
+// that the API types do not depend on the expression language.
+type AllocationConditionGuard struct {
+	Log     logr.Logger
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the AllocationConditionGuard in the
+// webhook server of the manager
+func (g *AllocationConditionGuard) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(AllocationConditionGuardPath,
+		&webhook.Admission{Handler: g},
+	)
+	return nil
+}
+
+// InjectDecoder implements admission.DecoderInjector
+func (g *AllocationConditionGuard) InjectDecoder(decoder *admission.Decoder) error {
+	g.decoder = decoder
+	return nil
+}
+
+// Handle implements admission.Handler
+func (g *AllocationConditionGuard) Handle(ctx context.Context, req admission.Request) admission.Response {
+	dataTemplate := &capm3.Metal3DataTemplate{}
+	if err := g.decoder.Decode(req, dataTemplate); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if dataTemplate.Spec.AllocationCondition == "" {
+		return admission.Allowed("")
+	}
+
+	if _, err := baremetal.CompileAllocationCondition(
+		dataTemplate.Spec.AllocationCondition,
+	); err != nil {
+		g.Log.Info("Rejecting Metal3DataTemplate", "namespace", req.Namespace,
+			"name", dataTemplate.Name, "reason", err.Error(),
+		)
+		return admission.Denied("spec.allocationCondition: " + err.Error())
+	}
+	return admission.Allowed("")
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestAllocationConditionGuard(t *testing.T) {
+	tests := []struct {
+		name          string
+		operation     admissionv1beta1.Operation
+		condition     string
+		expectAllowed bool
+	}{
+		{
+			name:          "should allow without allocationCondition",
+			operation:     admissionv1beta1.Create,
+			expectAllowed: true,
+		},
+		{
+			name:          "should allow a valid allocationCondition",
+			operation:     admissionv1beta1.Create,
+			condition:     "machine.metadata.labels['role'] == 'worker'",
+			expectAllowed: true,
+		},
+		{
+			name:          "should reject an invalid allocationCondition",
+			operation:     admissionv1beta1.Create,
+			condition:     "machine.metadata.labels['role'] ==",
+			expectAllowed: false,
+		},
+		{
+			name:          "should reject an invalid allocationCondition on update",
+			operation:     admissionv1beta1.Update,
+			condition:     "machine.metadata.labels['role'] ==",
+			expectAllowed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			scheme := runtime.NewScheme()
+			g.Expect(capm3.AddToScheme(scheme)).To(Succeed())
+			decoder, err := admission.NewDecoder(scheme)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			guard := &AllocationConditionGuard{Log: klogr.New()}
+			g.Expect(guard.InjectDecoder(decoder)).To(Succeed())
+
+			raw, err := json.Marshal(&capm3.Metal3DataTemplate{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: capm3.GroupVersion.String(),
+					Kind:       "Metal3DataTemplate",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "abc",
+					Namespace: "foo",
+				},
+				Spec: capm3.Metal3DataTemplateSpec{
+					AllocationCondition: tt.condition,
+				},
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			response := guard.Handle(context.TODO(), admission.Request{
+				AdmissionRequest: admissionv1beta1.AdmissionRequest{
+					Operation: tt.operation,
+					Namespace: "foo",
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			})
+			g.Expect(response.Allowed).To(Equal(tt.expectAllowed))
+		})
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-logr/logr"
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// BaseTemplateGuardPath is the path of the BaseTemplateGuard webhook
+const BaseTemplateGuardPath = "/validate-infrastructure-cluster-x-k8s-io-v1alpha4-metal3datatemplate-basetemplate"
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-infrastructure-cluster-x-k8s-io-v1alpha4-metal3datatemplate-basetemplate,mutating=false,failurePolicy=fail,groups=infrastructure.cluster.x-k8s.io,resources=metal3datatemplates,versions=v1alpha4,name=basetemplate.metal3datatemplate.infrastructure.cluster.x-k8s.io,matchPolicy=Equivalent
+
+// BaseTemplateGuard rejects the Metal3DataTemplates whose chain of base
+// templates leads back to them, for example A extends B extends A. A missing
+// base template ends the chain, the controller waiting for it.
+type BaseTemplateGuard struct {
+	Client  client.Client
+	Log     logr.Logger
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the BaseTemplateGuard in the webhook
+// server of the manager
+func (g *BaseTemplateGuard) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(BaseTemplateGuardPath,
+		&webhook.Admission{Handler: g},
+	)
+	return nil
+}
+
+// InjectDecoder implements admission.DecoderInjector
+func (g *BaseTemplateGuard) InjectDecoder(decoder *admission.Decoder) error {
+	g.decoder = decoder
+	return nil
+}
+
+// Handle implements admission.Handler
+func (g *BaseTemplateGuard) Handle(ctx context.Context, req admission.Request) admission.Response {
+	dataTemplate := &capm3.Metal3DataTemplate{}
+	if err := g.decoder.Decode(req, dataTemplate); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if dataTemplate.Spec.BaseTemplateRef == nil {
+		return admission.Allowed("")
+	}
+	namespace := dataTemplate.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+
+	reason, err := g.checkChain(ctx, namespace, dataTemplate)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if reason != "" {
+		g.Log.Info("Rejecting Metal3DataTemplate", "namespace", namespace,
+			"name", dataTemplate.Name, "reason", reason,
+		)
+		return admission.Denied(reason)
+	}
+	return admission.Allowed("")
+}
+
+// checkChain returns a non-empty reason if the chain of base templates of the
+// Metal3DataTemplate has a cycle
+func (g *BaseTemplateGuard) checkChain(ctx context.Context, namespace string,
+	dataTemplate *capm3.Metal3DataTemplate,
+) (string, error) {
+	chain := []string{dataTemplate.Name}
+	visited := map[string]bool{dataTemplate.Name: true}
+	baseTemplateRef := dataTemplate.Spec.BaseTemplateRef
+	for baseTemplateRef != nil {
+		chain = append(chain, baseTemplateRef.Name)
+		if visited[baseTemplateRef.Name] {
+			return "spec.baseTemplateRef: circular base template chain " +
+				strings.Join(chain, " -> "), nil
+		}
+		visited[baseTemplateRef.Name] = true
+
+		baseTemplate := &capm3.Metal3DataTemplate{}
+		key := client.ObjectKey{
+			Name:      baseTemplateRef.Name,
+			Namespace: namespace,
+		}
+		if err := g.Client.Get(ctx, key, baseTemplate); err != nil {
+			if apierrors.IsNotFound(err) {
+				return "", nil
+			}
+			return "", errors.Wrap(err, "Failed to get base Metal3DataTemplate")
+		}
+		baseTemplateRef = baseTemplate.Spec.BaseTemplateRef
+	}
+	return "", nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestBaseTemplateGuard(t *testing.T) {
+	tests := []struct {
+		name          string
+		baseTemplate  string
+		templates     []runtime.Object
+		expectAllowed bool
+	}{
+		{
+			name:          "should allow without baseTemplateRef",
+			expectAllowed: true,
+		},
+		{
+			name:          "should allow a missing base template",
+			baseTemplate:  "base",
+			expectAllowed: true,
+		},
+		{
+			name:         "should allow a chain of base templates",
+			baseTemplate: "base",
+			templates: []runtime.Object{
+				newBaseTemplate("base", "foo", "root"),
+				newBaseTemplate("root", "foo", ""),
+			},
+			expectAllowed: true,
+		},
+		{
+			name:         "should reject a chain leading back to the template",
+			baseTemplate: "base",
+			templates: []runtime.Object{
+				newBaseTemplate("base", "foo", "root"),
+				newBaseTemplate("root", "foo", "abc"),
+			},
+			expectAllowed: false,
+		},
+		{
+			name:         "should reject a cycle further in the chain",
+			baseTemplate: "base",
+			templates: []runtime.Object{
+				newBaseTemplate("base", "foo", "root"),
+				newBaseTemplate("root", "foo", "base"),
+			},
+			expectAllowed: false,
+		},
+		{
+			name:         "should ignore the templates of other namespaces",
+			baseTemplate: "base",
+			templates: []runtime.Object{
+				newBaseTemplate("base", "bar", "abc"),
+			},
+			expectAllowed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			scheme := runtime.NewScheme()
+			g.Expect(capm3.AddToScheme(scheme)).To(Succeed())
+			decoder, err := admission.NewDecoder(scheme)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			guard := &BaseTemplateGuard{
+				Client: fake.NewFakeClientWithScheme(scheme, tt.templates...),
+				Log:    klogr.New(),
+			}
+			g.Expect(guard.InjectDecoder(decoder)).To(Succeed())
+
+			dataTemplate := newBaseTemplate("abc", "foo", tt.baseTemplate)
+			dataTemplate.TypeMeta = metav1.TypeMeta{
+				APIVersion: capm3.GroupVersion.String(),
+				Kind:       "Metal3DataTemplate",
+			}
+			raw, err := json.Marshal(dataTemplate)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			response := guard.Handle(context.TODO(), admission.Request{
+				AdmissionRequest: admissionv1beta1.AdmissionRequest{
+					Operation: admissionv1beta1.Update,
+					Namespace: "foo",
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			})
+			g.Expect(response.Allowed).To(Equal(tt.expectAllowed))
+		})
+	}
+}
+
+func newBaseTemplate(name, namespace, baseTemplate string) *capm3.Metal3DataTemplate {
+	dataTemplate := &capm3.Metal3DataTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+	if baseTemplate != "" {
+		dataTemplate.Spec.BaseTemplateRef = &corev1.LocalObjectReference{
+			Name: baseTemplate,
+		}
+	}
+	return dataTemplate
+}
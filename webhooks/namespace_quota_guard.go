@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	"github.com/pkg/errors"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// NamespaceQuotaGuardPath is the path of the NamespaceQuotaGuard webhook
+const NamespaceQuotaGuardPath = "/validate-infrastructure-cluster-x-k8s-io-v1alpha4-metal3datatemplate-quota"
+
+// metal3DataQuotaResource is the object count resource of the Metal3Data in
+// a ResourceQuota
+var metal3DataQuotaResource = corev1.ResourceName("count/metal3datas." +
+	capm3.GroupVersion.Group,
+)
+
+// +kubebuilder:webhook:verbs=create,path=/validate-infrastructure-cluster-x-k8s-io-v1alpha4-metal3datatemplate-quota,mutating=false,failurePolicy=fail,groups=infrastructure.cluster.x-k8s.io,resources=metal3datatemplates,versions=v1alpha4,name=quota.metal3datatemplate.infrastructure.cluster.x-k8s.io,matchPolicy=Equivalent
+
+// NamespaceQuotaGuard rejects the creation of a Metal3DataTemplate in a
+// namespace whose ResourceQuotas do not leave room for the Metal3Data the
+// template may create, MaxOwnerReferences or at least one.
+type NamespaceQuotaGuard struct {
+	Client  client.Client
+	Log     logr.Logger
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the NamespaceQuotaGuard in the webhook
+// server of the manager
+func (g *NamespaceQuotaGuard) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(NamespaceQuotaGuardPath,
+		&webhook.Admission{Handler: g},
+	)
+	return nil
+}
+
+// InjectDecoder implements admission.DecoderInjector
+func (g *NamespaceQuotaGuard) InjectDecoder(decoder *admission.Decoder) error {
+	g.decoder = decoder
+	return nil
+}
+
+// Handle implements admission.Handler
+func (g *NamespaceQuotaGuard) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1beta1.Create {
+		return admission.Allowed("")
+	}
+
+	dataTemplate := &capm3.Metal3DataTemplate{}
+	if err := g.decoder.Decode(req, dataTemplate); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	namespace := dataTemplate.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+
+	reason, err := g.checkQuota(ctx, namespace, dataTemplate)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if reason != "" {
+		g.Log.Info("Rejecting Metal3DataTemplate", "namespace", namespace,
+			"name", dataTemplate.Name, "reason", reason,
+		)
+		return admission.Denied(reason)
+	}
+	return admission.Allowed("")
+}
+
+// checkQuota returns a non-empty reason if one of the ResourceQuotas of the
+// namespace does not have enough Metal3Data left for the Metal3DataTemplate
+func (g *NamespaceQuotaGuard) checkQuota(ctx context.Context, namespace string,
+	dataTemplate *capm3.Metal3DataTemplate,
+) (string, error) {
+	requested := int64(dataTemplate.Spec.MaxOwnerReferences)
+	if requested < 1 {
+		requested = 1
+	}
+
+	quotas := corev1.ResourceQuotaList{}
+	opts := &client.ListOptions{
+		Namespace: namespace,
+	}
+	if err := g.Client.List(ctx, &quotas, opts); err != nil {
+		return "", errors.Wrap(err, "Failed to list ResourceQuotas")
+	}
+	for _, quota := range quotas.Items {
+		hard, ok := quota.Status.Hard[metal3DataQuotaResource]
+		if !ok {
+			continue
+		}
+		used := quota.Status.Used[metal3DataQuotaResource]
+		if used.Value()+requested > hard.Value() {
+			return fmt.Sprintf(
+				"ResourceQuota %s of namespace %s has %d of %d %s used, not enough for the %d requested by Metal3DataTemplate %s",
+				quota.Name, namespace, used.Value(), hard.Value(),
+				metal3DataQuotaResource, requested, dataTemplate.Name,
+			), nil
+		}
+	}
+	return "", nil
+}
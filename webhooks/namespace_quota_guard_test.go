@@ -0,0 +1,154 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	capm3 "github.com/metal3-io/cluster-api-provider-metal3/api/v1alpha4"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestNamespaceQuotaGuard(t *testing.T) {
+	tests := []struct {
+		name          string
+		operation     admissionv1beta1.Operation
+		maxOwnerRefs  int
+		quotas        []runtime.Object
+		expectAllowed bool
+	}{
+		{
+			name:          "should allow without ResourceQuota",
+			operation:     admissionv1beta1.Create,
+			maxOwnerRefs:  10,
+			expectAllowed: true,
+		},
+		{
+			name:         "should allow with enough quota left",
+			operation:    admissionv1beta1.Create,
+			maxOwnerRefs: 5,
+			quotas: []runtime.Object{
+				newQuota("abc", "foo", 10, 5),
+			},
+			expectAllowed: true,
+		},
+		{
+			name:         "should reject with not enough quota left",
+			operation:    admissionv1beta1.Create,
+			maxOwnerRefs: 6,
+			quotas: []runtime.Object{
+				newQuota("abc", "foo", 10, 5),
+			},
+			expectAllowed: false,
+		},
+		{
+			name:      "should reject without MaxOwnerReferences when the quota is used",
+			operation: admissionv1beta1.Create,
+			quotas: []runtime.Object{
+				newQuota("abc", "foo", 5, 5),
+			},
+			expectAllowed: false,
+		},
+		{
+			name:         "should ignore the ResourceQuotas of other namespaces",
+			operation:    admissionv1beta1.Create,
+			maxOwnerRefs: 6,
+			quotas: []runtime.Object{
+				newQuota("abc", "bar", 10, 5),
+			},
+			expectAllowed: true,
+		},
+		{
+			name:         "should ignore the updates",
+			operation:    admissionv1beta1.Update,
+			maxOwnerRefs: 6,
+			quotas: []runtime.Object{
+				newQuota("abc", "foo", 10, 5),
+			},
+			expectAllowed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			scheme := runtime.NewScheme()
+			g.Expect(capm3.AddToScheme(scheme)).To(Succeed())
+			g.Expect(corev1.AddToScheme(scheme)).To(Succeed())
+			decoder, err := admission.NewDecoder(scheme)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			guard := &NamespaceQuotaGuard{
+				Client: fake.NewFakeClientWithScheme(scheme, tt.quotas...),
+				Log:    klogr.New(),
+			}
+			g.Expect(guard.InjectDecoder(decoder)).To(Succeed())
+
+			raw, err := json.Marshal(&capm3.Metal3DataTemplate{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: capm3.GroupVersion.String(),
+					Kind:       "Metal3DataTemplate",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "abc",
+					Namespace: "foo",
+				},
+				Spec: capm3.Metal3DataTemplateSpec{
+					MaxOwnerReferences: tt.maxOwnerRefs,
+				},
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			response := guard.Handle(context.TODO(), admission.Request{
+				AdmissionRequest: admissionv1beta1.AdmissionRequest{
+					Operation: tt.operation,
+					Namespace: "foo",
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			})
+			g.Expect(response.Allowed).To(Equal(tt.expectAllowed))
+		})
+	}
+}
+
+func newQuota(name, namespace string, hard, used int64) *corev1.ResourceQuota {
+	return &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{
+				metal3DataQuotaResource: *resource.NewQuantity(hard, resource.DecimalSI),
+			},
+			Used: corev1.ResourceList{
+				metal3DataQuotaResource: *resource.NewQuantity(used, resource.DecimalSI),
+			},
+		},
+	}
+}